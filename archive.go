@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Archives of tracks are expanded into upload/extract and every audio entry
+// is ingested on its own. Only audio files and cover images are written out,
+// the rest of the archive is skipped
+const archiveExtractPath string = "upload/extract"
+
+// finished resumable uploads wait here for their ingest job
+const finishedUploadPath string = "upload/finished"
+
+var archiveExts []string = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// cover images picked up from archives, lower is preferred
+var archiveCoverNames map[string]int = map[string]int{
+	"cover.jpg":   0,
+	"cover.jpeg":  1,
+	"cover.png":   2,
+	"folder.jpg":  3,
+	"folder.jpeg": 4,
+	"folder.png":  5,
+}
+
+var errArchiveTooLarge = errors.New("archive contents exceed the size limit")
+
+func isArchiveFileName(name string) bool {
+	lower := strings.ToLower(name)
+
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AudyFileResult is the outcome of one file of an upload, in the shape of
+// ftpu_file_processed messages
+type AudyFileResult struct {
+	FileName string `json:"fileName"`
+	Key      string `json:"key"`
+	Success  bool   `json:"success"`
+}
+
+// AudyArchiveEntry is an extracted audio file. cover is the image found in
+// its directory or the closest parent one
+type AudyArchiveEntry struct {
+	name  string
+	path  string
+	cover string
+}
+
+type archiveExtractor struct {
+	dest    string
+	entries int
+	written int64
+	tracks  []*AudyArchiveEntry
+	covers  map[string]string
+}
+
+// safeArchivePath rejects entry names escaping the extraction directory
+// (zip slip). Backslashes are taken as separators, archives made on
+// Windows use them
+func safeArchivePath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	// drive letters count as absolute too
+	if path.IsAbs(name) || (len(name) > 1 && name[1] == ':' && strings.ContainsRune("abcdefghijklmnopqrstuvwxyz", rune(name[0]|0x20))) {
+		return "", false
+	}
+
+	clean := path.Clean(name)
+
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+
+	return clean, true
+}
+
+func (x *archiveExtractor) add(name string, mode os.FileMode, r io.Reader) *AudyTrackProcessingErr {
+	x.entries++
+
+	if x.entries > config.Upload.ArchiveMaxEntries {
+		return &AudyTrackProcessingErr{fmt.Errorf("archive has more than %v entries", config.Upload.ArchiveMaxEntries), nil, "archive_too_many_entries"}
+	}
+
+	clean, ok := safeArchivePath(name)
+
+	if !ok {
+		return &AudyTrackProcessingErr{fmt.Errorf("archive entry %v points outside of the archive", name), nil, "archive_unsafe_path"}
+	}
+
+	// directories, links and devices aren't extracted
+	if !mode.IsRegular() {
+		return nil
+	}
+
+	base := path.Base(clean)
+	coverRank, isCover := archiveCoverNames[strings.ToLower(base)]
+
+	if strings.HasPrefix(base, ".") || (!isCover && !isAudioFileName(base)) {
+		return nil
+	}
+
+	target := filepath.Join(x.dest, filepath.FromSlash(clean))
+
+	if !strings.HasPrefix(target, x.dest+string(filepath.Separator)) {
+		return &AudyTrackProcessingErr{fmt.Errorf("archive entry %v points outside of the archive", name), nil, "archive_unsafe_path"}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return &AudyTrackProcessingErr{err, nil, "create_dir"}
+	}
+
+	// an entry repeated in the archive keeps its first copy
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+
+	if os.IsExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return &AudyTrackProcessingErr{err, nil, "write_file"}
+	}
+
+	// sizes in headers can lie, so the limit is checked on what is written
+	limit := int64(config.Upload.ArchiveMaxMB)<<20 - x.written
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	f.Close()
+	x.written += n
+
+	if err == nil && n > limit {
+		err = errArchiveTooLarge
+	}
+
+	if err != nil {
+		os.Remove(target)
+
+		if err == errArchiveTooLarge {
+			return &AudyTrackProcessingErr{err, nil, "archive_too_large"}
+		}
+
+		return &AudyTrackProcessingErr{err, nil, "archive_read"}
+	}
+
+	if isCover {
+		dir := path.Dir(clean)
+
+		if current, ok := x.covers[dir]; !ok || coverRank < archiveCoverNames[strings.ToLower(filepath.Base(current))] {
+			x.covers[dir] = target
+		}
+
+		return nil
+	}
+
+	x.tracks = append(x.tracks, &AudyArchiveEntry{clean, target, ""})
+	return nil
+}
+
+func (x *archiveExtractor) readZip(archivePath string) *AudyTrackProcessingErr {
+	zr, err := zip.OpenReader(archivePath)
+
+	if err != nil {
+		return &AudyTrackProcessingErr{err, nil, "archive_read"}
+	}
+
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		rc, err := f.Open()
+
+		if err != nil {
+			return &AudyTrackProcessingErr{err, nil, "archive_read"}
+		}
+
+		procErr := x.add(f.Name, f.Mode(), rc)
+		rc.Close()
+
+		if procErr != nil {
+			return procErr
+		}
+	}
+
+	return nil
+}
+
+func (x *archiveExtractor) readTar(archivePath string, gzipped bool) *AudyTrackProcessingErr {
+	f, err := os.Open(archivePath)
+
+	if err != nil {
+		return &AudyTrackProcessingErr{err, nil, "open_file"}
+	}
+
+	defer f.Close()
+
+	var r io.Reader = f
+
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+
+		if err != nil {
+			return &AudyTrackProcessingErr{err, nil, "archive_read"}
+		}
+
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return &AudyTrackProcessingErr{err, nil, "archive_read"}
+		}
+
+		if procErr := x.add(hdr.Name, hdr.FileInfo().Mode(), tr); procErr != nil {
+			return procErr
+		}
+	}
+}
+
+// extractArchive writes the audio files and covers of an archive to dest.
+// On error nothing is left behind
+func extractArchive(archivePath, fileName, dest string) ([]*AudyArchiveEntry, *AudyTrackProcessingErr) {
+	dest, err := filepath.Abs(dest)
+
+	if err != nil {
+		return nil, &AudyTrackProcessingErr{err, nil, "create_dir"}
+	}
+
+	if err = os.MkdirAll(dest, os.ModePerm); err != nil {
+		return nil, &AudyTrackProcessingErr{err, nil, "create_dir"}
+	}
+
+	x := &archiveExtractor{
+		dest:   dest,
+		tracks: make([]*AudyArchiveEntry, 0),
+		covers: make(map[string]string, 0),
+	}
+
+	var procErr *AudyTrackProcessingErr
+	lower := strings.ToLower(fileName)
+
+	if strings.HasSuffix(lower, ".zip") {
+		procErr = x.readZip(archivePath)
+	} else {
+		procErr = x.readTar(archivePath, strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz"))
+	}
+
+	if procErr == nil && len(x.tracks) == 0 {
+		procErr = &AudyTrackProcessingErr{nil, nil, "archive_no_tracks"}
+	}
+
+	if procErr != nil {
+		os.RemoveAll(dest)
+		return nil, procErr
+	}
+
+	for _, e := range x.tracks {
+		for dir := path.Dir(e.name); ; dir = path.Dir(dir) {
+			if cover, ok := x.covers[dir]; ok {
+				e.cover = cover
+				break
+			}
+
+			if dir == "." || dir == "/" {
+				break
+			}
+		}
+	}
+
+	return x.tracks, nil
+}
+
+// ingestArchive adds every track of an archive right away and reports how
+// each entry went. The archive is removed afterwards
+func ingestArchive(archivePath, fileName string) ([]*AudyFileResult, *AudyTrackProcessingErr) {
+	defer os.Remove(archivePath)
+
+	id, err := genUploadID()
+
+	if err != nil {
+		return nil, &AudyTrackProcessingErr{err, nil, "create_dir"}
+	}
+
+	dest := filepath.Join(archiveExtractPath, id)
+	entries, procErr := extractArchive(archivePath, fileName, dest)
+
+	if procErr != nil {
+		return nil, procErr
+	}
+
+	defer os.RemoveAll(dest)
+
+	results := make([]*AudyFileResult, len(entries))
+
+	for i, e := range entries {
+		track, procErr := processTrack(e.path, path.Base(e.name), e.cover)
+		results[i] = &AudyFileResult{e.name, "", procErr == nil}
+
+		if procErr != nil {
+			results[i].Key = procErr.key
+			continue
+		}
+
+		setLibTrack(track)
+		invalidateLibCache()
+
+		SendMessageAll(&gin.H{
+			"type": "track_add",
+			"data": &gin.H{
+				"track":    track,
+				"revision": libRevision(),
+			},
+		})
+	}
+
+	return results, nil
+}
+
+// expandArchiveJob extracts an archive of an ingest job and queues its
+// tracks as jobs of the same batch, so they are reported one by one
+func expandArchiveJob(job *DBJob, payload *ingestJobPayload) *AudyJobError {
+	dest := filepath.Join(archiveExtractPath, job.Batch, fmt.Sprint(job.ID))
+	os.RemoveAll(dest)
+
+	entries, procErr := extractArchive(payload.Path, payload.FileName, dest)
+
+	if procErr != nil {
+		return &AudyJobError{procErr.underlying, procErr.key, true}
+	}
+
+	// the archive is removed below, failed tracks of a watched one are
+	// rejected on their own
+	watchedArchive := ""
+
+	if payload.Source == ingestSourceWatch {
+		watchedArchive = payload.Path
+	}
+
+	for _, e := range entries {
+		_, dbErr := jobQueue.Enqueue(jobTypeIngest, job.Batch, e.path, job.userID, &ingestJobPayload{
+			Path:           e.path,
+			FileName:       e.name,
+			Source:         ingestSourceArchive,
+			Cover:          e.cover,
+			WatchedArchive: watchedArchive,
+		})
+
+		// queueing again would duplicate the entries that made it
+		if dbErr != nil {
+			return &AudyJobError{errors.New(dbErr.Error()), "db", true}
+		}
+	}
+
+	os.Remove(payload.Path)
+	return nil
+}
+
+// removeArchiveUploads drops what is left of archives of a finished batch
+func removeArchiveUploads(batch string) {
+	os.RemoveAll(filepath.Join(archiveExtractPath, batch))
+}
+
+// moveFinishedUpload keeps a finished resumable upload until its ingest job
+// runs
+func moveFinishedUpload(dataPath, id, fileName string) (string, error) {
+	if err := os.MkdirAll(finishedUploadPath, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(finishedUploadPath, fmt.Sprint(id, "-", filepath.Base(fileName)))
+
+	return target, os.Rename(dataPath, target)
+}
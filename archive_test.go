@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSafeArchivePath(t *testing.T) {
+	cases := []struct {
+		name  string
+		clean string
+		ok    bool
+	}{
+		{"track.mp3", "track.mp3", true},
+		{"album/track.mp3", "album/track.mp3", true},
+		{"./album/track.mp3", "album/track.mp3", true},
+		{"album/../track.mp3", "track.mp3", true},
+		{"..track.mp3", "..track.mp3", true},
+		{"album\\cd1\\track.mp3", "album/cd1/track.mp3", true},
+		{"..", "", false},
+		{"../track.mp3", "", false},
+		{"album/../../track.mp3", "", false},
+		{"..\\track.mp3", "", false},
+		{"album\\..\\..\\track.mp3", "", false},
+		{"/etc/passwd", "", false},
+		{"\\etc\\passwd", "", false},
+		{"\\\\server\\share\\track.mp3", "", false},
+		{"C:\\Windows\\track.mp3", "", false},
+		{"c:/track.mp3", "", false},
+		{"C:track.mp3", "", false},
+	}
+
+	for _, tc := range cases {
+		clean, ok := safeArchivePath(tc.name)
+
+		if ok != tc.ok || clean != tc.clean {
+			t.Errorf("%q: got %q %v, want %q %v", tc.name, clean, ok, tc.clean, tc.ok)
+		}
+	}
+}
+
+func testArchiveExtractor(t *testing.T, maxMB, maxEntries int) *archiveExtractor {
+	prev := config.Upload
+	t.Cleanup(func() { config.Upload = prev })
+
+	config.Upload.ArchiveMaxMB = maxMB
+	config.Upload.ArchiveMaxEntries = maxEntries
+
+	return &archiveExtractor{
+		dest:   t.TempDir(),
+		tracks: make([]*AudyArchiveEntry, 0),
+		covers: make(map[string]string, 0),
+	}
+}
+
+func TestArchiveExtractorAdd(t *testing.T) {
+	cases := []struct {
+		name string
+		mode os.FileMode
+		key  string
+		// extracted file, relative to the destination
+		file string
+	}{
+		{"album/track.mp3", 0644, "", "album/track.mp3"},
+		{"album\\cd1\\track.mp3", 0644, "", "album/cd1/track.mp3"},
+		{"album/cover.jpg", 0644, "", "album/cover.jpg"},
+		{"album/notes.txt", 0644, "", ""},
+		{"album/.track.mp3", 0644, "", ""},
+		{"album", os.ModeDir | 0755, "", ""},
+		{"album/link.mp3", os.ModeSymlink | 0777, "", ""},
+		{"../track.mp3", 0644, "archive_unsafe_path", ""},
+		{"../link.mp3", os.ModeSymlink | 0777, "archive_unsafe_path", ""},
+		{"/tmp/track.mp3", 0644, "archive_unsafe_path", ""},
+		{"C:\\track.mp3", 0644, "archive_unsafe_path", ""},
+		{"album\\..\\..\\track.mp3", 0644, "archive_unsafe_path", ""},
+	}
+
+	for _, tc := range cases {
+		x := testArchiveExtractor(t, 1, 10)
+		procErr := x.add(tc.name, tc.mode, strings.NewReader("data"))
+
+		key := ""
+
+		if procErr != nil {
+			key = procErr.key
+		}
+
+		if key != tc.key {
+			t.Errorf("%q: got %q, want %q", tc.name, key, tc.key)
+		}
+
+		var files []string
+
+		filepath.Walk(x.dest, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(x.dest, path)
+				files = append(files, filepath.ToSlash(rel))
+			}
+
+			return nil
+		})
+
+		if tc.file == "" && len(files) != 0 {
+			t.Errorf("%q: extracted %v", tc.name, files)
+		} else if tc.file != "" && (len(files) != 1 || files[0] != tc.file) {
+			t.Errorf("%q: extracted %v, want %v", tc.name, files, tc.file)
+		}
+	}
+}
+
+func TestArchiveSymlinkEntriesNotFollowed(t *testing.T) {
+	outside := t.TempDir()
+	archive := filepath.Join(t.TempDir(), "album.tar")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	// the link isn't created, so the track behind it lands in a real folder
+	tw.WriteHeader(&tar.Header{Name: "album", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777})
+	tw.WriteHeader(&tar.Header{Name: "album/track.mp3", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testArchiveExtractor(t, 1, 10)
+	dest := filepath.Join(t.TempDir(), "extract")
+	entries, procErr := extractArchive(archive, "album.tar", dest)
+
+	if procErr != nil {
+		t.Fatal(procErr.Error())
+	}
+
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].path, dest+string(filepath.Separator)) {
+		t.Fatalf("entries %+v", entries)
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dest, "album")); err != nil || !fi.IsDir() {
+		t.Errorf("album isn't a plain folder (%v)", err)
+	}
+
+	if left, _ := ioutil.ReadDir(outside); len(left) != 0 {
+		t.Errorf("link target got %v files", len(left))
+	}
+}
+
+// testLyingZip stores data deflated under a header claiming size bytes
+func testLyingZip(t *testing.T, data []byte, size uint64) string {
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+	fw.Write(data)
+	fw.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "track.mp3",
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: size,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write(compressed.Bytes())
+	zw.Close()
+
+	archive := filepath.Join(t.TempDir(), "album.zip")
+
+	if err = ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func TestArchiveSizeLimitIgnoresHeaders(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 3<<20)
+
+	cases := []struct {
+		name string
+		size uint64
+	}{
+		{"claims more", 1 << 31},
+		{"claims less", 1024},
+	}
+
+	for _, tc := range cases {
+		archive := testLyingZip(t, data, tc.size)
+		testArchiveExtractor(t, 1, 10)
+		dest := filepath.Join(t.TempDir(), "extract")
+
+		entries, procErr := extractArchive(archive, "album.zip", dest)
+
+		if procErr == nil {
+			t.Errorf("%v: extracted %v entries", tc.name, len(entries))
+			continue
+		}
+
+		// a header claiming less fails on its own once it's overrun
+		if procErr.key != "archive_too_large" && !(tc.size < 1<<20 && procErr.key == "archive_read") {
+			t.Errorf("%v: got %v", tc.name, procErr.key)
+		}
+
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("%v: extraction left %v behind", tc.name, dest)
+		}
+	}
+}
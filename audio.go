@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dhowden/tag"
+)
+
+// audio is requested in this layout from the decode command
+const decodeSampleRate int = 48000
+const decodeChannels int = 2
+
+var errNoDecoder error = errors.New("no decoder available for this format")
+
+// audioSink receives decoded audio. Several sinks may share one decoding
+// pass, so a track is decoded once for everything computed from its samples
+type audioSink interface {
+	start(rate, channels int)
+	// addFrame takes one sample per channel in the -1..1 range
+	addFrame(frame []float64)
+}
+
+func startSinks(sinks []audioSink, rate, channels int) {
+	for _, s := range sinks {
+		s.start(rate, channels)
+	}
+}
+
+func addFrame(sinks []audioSink, frame []float64) {
+	for _, s := range sinks {
+		s.addFrame(frame)
+	}
+}
+
+// readFloatStream reads interleaved little endian float32 samples
+func readFloatStream(r io.Reader, rate, channels int, sinks []audioSink) error {
+	startSinks(sinks, rate, channels)
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	raw := make([]byte, 4*channels)
+	frame := make([]float64, channels)
+
+	for {
+		if _, err := io.ReadFull(br, raw); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+
+			return err
+		}
+
+		for ch := range frame {
+			frame[ch] = float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[ch*4:])))
+		}
+
+		addFrame(sinks, frame)
+	}
+}
+
+// readWav reads PCM and float WAV files without any external decoder
+func readWav(r io.ReadSeeker, sinks []audioSink) error {
+	riff := make([]byte, 12)
+	if _, err := io.ReadFull(r, riff); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 8)
+	var audioFormat, channels, bits uint16
+	var rate uint32
+
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+
+		id := string(chunk[:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		if id == "fmt " {
+			if size > wavMaxFmtSize {
+				return errors.New("wav fmt chunk is too large")
+			}
+
+			fmtChunk := make([]byte, size)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return err
+			}
+
+			if len(fmtChunk) < 16 {
+				return errors.New("wav fmt chunk is too short")
+			}
+
+			audioFormat = binary.LittleEndian.Uint16(fmtChunk[0:2])
+			channels = binary.LittleEndian.Uint16(fmtChunk[2:4])
+			rate = binary.LittleEndian.Uint32(fmtChunk[4:8])
+			bits = binary.LittleEndian.Uint16(fmtChunk[14:16])
+
+			// WAVE_FORMAT_EXTENSIBLE keeps the actual format in the sub format guid
+			if audioFormat == 0xfffe && len(fmtChunk) >= 26 {
+				audioFormat = binary.LittleEndian.Uint16(fmtChunk[24:26])
+			}
+		} else if id == "data" {
+			if channels == 0 || rate < 100 {
+				return errors.New("wav fmt chunk not found before data chunk")
+			}
+
+			return readPCM(io.LimitReader(r, size), audioFormat, int(channels), int(rate), int(bits), sinks)
+		} else if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return err
+		}
+
+		if size%2 == 1 {
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readPCM(r io.Reader, audioFormat uint16, channels, rate, bits int, sinks []audioSink) error {
+	if audioFormat == 3 && bits == 32 {
+		return readFloatStream(r, rate, channels, sinks)
+	}
+
+	if audioFormat != 1 || (bits != 16 && bits != 24 && bits != 32) {
+		return errNoDecoder
+	}
+
+	startSinks(sinks, rate, channels)
+
+	width := bits / 8
+	scale := math.Pow(2, float64(bits-1))
+	br := bufio.NewReaderSize(r, 64*1024)
+	raw := make([]byte, width*channels)
+	frame := make([]float64, channels)
+
+	for {
+		if _, err := io.ReadFull(br, raw); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+
+			return err
+		}
+
+		for ch := range frame {
+			s := raw[ch*width : (ch+1)*width]
+			var v int32
+
+			switch width {
+			case 2:
+				v = int32(int16(binary.LittleEndian.Uint16(s)))
+			case 3:
+				v = int32(uint32(s[0])<<8|uint32(s[1])<<16|uint32(s[2])<<24) >> 8
+			case 4:
+				v = int32(binary.LittleEndian.Uint32(s))
+			}
+
+			frame[ch] = float64(v) / scale
+		}
+
+		addFrame(sinks, frame)
+	}
+}
+
+func decoderAvailable() bool {
+	if len(config.DecodeCommand) == 0 {
+		return false
+	}
+
+	_, err := exec.LookPath(config.DecodeCommand[0])
+	return err == nil
+}
+
+// readCommand decodes the file with the configured decode command into
+// float32 samples
+func readCommand(path string, sinks []audioSink) error {
+	if !decoderAvailable() {
+		return errNoDecoder
+	}
+
+	args := make([]string, len(config.DecodeCommand))
+
+	for i, arg := range config.DecodeCommand {
+		args[i] = strings.Replace(arg, "{input}", path, -1)
+	}
+
+	stderr := &strings.Builder{}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	readErr := readFloatStream(stdout, decodeSampleRate, decodeChannels, sinks)
+	io.Copy(io.Discard, stdout)
+
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %v", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	return readErr
+}
+
+// decodeAudio feeds the track samples to the sinks. WAV files are read
+// natively, everything else goes through the decode command
+func decodeAudio(path string, format *AudyFormat, sinks ...audioSink) error {
+	if format.Name == "wav" {
+		f, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		err = readWav(f, sinks)
+		f.Close()
+
+		if err != errNoDecoder {
+			return err
+		}
+	}
+
+	return readCommand(path, sinks)
+}
+
+// analyzeTrack computes the loudness and the waveform of a stored track in a
+// single decoding pass. Loudness is taken from tags when they have it. When
+// no decoder is available the gain source stays empty, so the backfill can
+// retry later
+func analyzeTrack(t *DBTrack, m tag.Metadata, gain, waveform, fingerprint bool) {
+	sinks := []audioSink{}
+	var meter *loudnessMeter
+	var wave *waveformBuilder
+	var fp *fingerprintBuilder
+
+	if gain && !applyGainTags(t, m) {
+		meter = &loudnessMeter{}
+		sinks = append(sinks, meter)
+	}
+
+	if waveform {
+		wave = &waveformBuilder{}
+		sinks = append(sinks, wave)
+	}
+
+	if fingerprint {
+		fp = &fingerprintBuilder{}
+		sinks = append(sinks, fp)
+	}
+
+	if len(sinks) == 0 {
+		return
+	}
+
+	// tracks of remote stores aren't downloaded when they can't be decoded
+	if t.Format != "wav" && !decoderAvailable() {
+		return
+	}
+
+	trackPath, release, err := localTrackFile(t)
+
+	if err != nil {
+		fmt.Printf("Unable to read track %v: %v\n", t.Md5, err.Error())
+		return
+	}
+
+	err = decodeAudio(trackPath, getFormat(t.Format), sinks...)
+	release()
+
+	if err == errNoDecoder {
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("Unable to decode track %v: %v\n", t.Md5, err.Error())
+	}
+
+	if meter != nil {
+		applyMeasuredGain(t, meter, err)
+	}
+
+	if wave != nil && err == nil {
+		if err = wave.save(waveformKey(t.Md5)); err != nil {
+			fmt.Printf("Unable to save waveform of track %v: %v\n", t.Md5, err.Error())
+		}
+	}
+
+	// an empty fingerprint keeps undecodable tracks from being tried again
+	if fp != nil {
+		t.fingerprint = []uint32{}
+
+		if err == nil {
+			t.fingerprint = fp.result()
+		}
+	}
+}
+
+// set while backfillAnalysis runs, scans finishing together start it once
+var analysisRunning int32
+
+// backfillAnalysis analyses tracks stored before loudness, waveforms and
+// fingerprints were computed at ingest or while no decoder was installed
+func backfillAnalysis() {
+	if !atomic.CompareAndSwapInt32(&analysisRunning, 0, 1) {
+		return
+	}
+
+	defer atomic.StoreInt32(&analysisRunning, 0)
+
+	pending, dbErr := db.GetTracksByGainSource(gainSourceNone)
+
+	if dbErr != nil {
+		dbErr.Print()
+		return
+	}
+
+	fingerprints, dbErr := db.GetFingerprints()
+
+	if dbErr != nil {
+		dbErr.Print()
+		return
+	}
+
+	needsGain := make(map[string]bool, len(pending))
+
+	for _, t := range pending {
+		needsGain[t.Md5] = true
+	}
+
+	tracks := make([]*DBTrack, 0)
+
+	for _, t := range libTracks() {
+		_, hasFingerprint := fingerprints[t.Md5]
+
+		if needsGain[t.Md5] || !hasWaveform(t.Md5) || !hasFingerprint {
+			tracks = append(tracks, t)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return
+	}
+
+	fmt.Printf("Analyzing %v tracks in background...\n", len(tracks))
+
+	albums := make(map[int]bool, 0)
+
+	for _, lt := range tracks {
+		// analysis runs on a copy, the library track is only replaced once
+		// the values are stored
+		t := *lt
+		var m tag.Metadata
+
+		if needsGain[t.Md5] {
+			if f, err := openTrack(&t); err == nil {
+				m, _ = tag.ReadFrom(f)
+				f.Close()
+			}
+		}
+
+		_, hasFingerprint := fingerprints[t.Md5]
+		analyzeTrack(&t, m, needsGain[t.Md5], !hasWaveform(t.Md5), !hasFingerprint)
+
+		if t.fingerprint != nil {
+			if _, dbErr = db.SetTrackFingerprint(t.Md5, t.fingerprint); dbErr != nil {
+				dbErr.Print()
+			}
+		}
+
+		if !needsGain[t.Md5] || t.GainSource == gainSourceNone {
+			continue
+		}
+
+		if _, dbErr = db.SetTrackLoudness(&t); dbErr != nil {
+			dbErr.Print()
+			continue
+		}
+
+		updateLibTrack(t.Md5, func(nt *DBTrack) {
+			nt.Loudness = t.Loudness
+			nt.TrackGain = t.TrackGain
+			nt.TrackPeak = t.TrackPeak
+			nt.AlbumGain = t.AlbumGain
+			nt.AlbumPeak = t.AlbumPeak
+			nt.GainSource = t.GainSource
+			nt.albumGainTagged = t.albumGainTagged
+		})
+
+		albums[t.AlbumID] = true
+	}
+
+	for albumID := range albums {
+		refreshAlbumGain(albumID)
+	}
+
+	invalidateLibCache()
+	fmt.Println("Background track analysis finished")
+}
@@ -1,58 +1,318 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// AudyAuth keeps sessions that were used recently along with their users. All
+// cached sessions of one user share the same *DBUser, so changes made through
+// one session are seen by the others
 type AudyAuth struct {
-	SesCache map[string]*DBUser
+	SesCache map[string]*AudySession
+	mutex    sync.Mutex
+}
+
+type AudySession struct {
+	Session *DBSession
+	User    *DBUser
+}
+
+// RemIPAlert is shown to the user on the next login after one of their
+// sessions was used from a foreign address while rem_ip was on
+type RemIPAlert struct {
+	IP   string `json:"ip"`
+	Time int64  `json:"time"`
 }
 
 const UserKey string = "__user_session__"
+const SessionKey string = "__session__"
+const SessionCookie string = "session_hash"
+
+// last_seen is written at most once per this interval to spare the database
+// from a write on every request
+const sessionTouchInterval int64 = 60
+
+// sessionID derives the stored session id from the cookie token, so the
+// sessions table never contains usable credentials
+func sessionID(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
 
 func (aa *AudyAuth) Middleware() gin.HandlerFunc {
-	aa.SesCache = make(map[string]*DBUser, 0)
+	aa.SesCache = make(map[string]*AudySession, 0)
 
 	return func(c *gin.Context) {
-		cookie, err := c.Cookie("session_hash")
+		token, err := c.Cookie(SessionCookie)
 
-		if err == http.ErrNoCookie {
+		if err == http.ErrNoCookie || len(token) == 0 {
 			c.Set(UserKey, nil)
 			return
 		}
 
-		if _, ok := aa.SesCache[cookie]; ok {
-			c.Set(UserKey, aa.SesCache[cookie])
-		} else {
-			u, dberr := db.GetUserByHash(cookie)
+		s := aa.getSession(sessionID(token))
 
-			if u != nil {
-				u.HasAvatar = true
-				u.IsRoot = config.RootUser == u.login
+		if s != nil && s.User.RemIP && !sameNetwork(s.Session.IP, c.ClientIP()) {
+			aa.rejectSession(s, c.ClientIP())
+			s = nil
+		}
 
-				avatarFilePath := fmt.Sprintf("db/avatars/%v.jpg", u.ID)
-				if _, err = os.Stat(avatarFilePath); os.IsNotExist(err) {
-					u.HasAvatar = false
-				}
+		if s == nil {
+			c.SetCookie(SessionCookie, "", -1, "/", "", false, true)
+			c.Set(UserKey, nil)
+			c.Next()
+			return
+		}
+
+		c.Set(SessionKey, s.Session)
+		c.Set(UserKey, s.User)
+		c.Next()
+	}
+}
+
+// getSession returns a valid session by id, loading it into the cache if
+// needed. Expired sessions are removed and reported as missing
+func (aa *AudyAuth) getSession(id string) *AudySession {
+	now := time.Now().Unix()
+
+	aa.mutex.Lock()
+	s, ok := aa.SesCache[id]
+	aa.mutex.Unlock()
+
+	if !ok {
+		session, dbErr := db.GetSession(id)
+
+		if dbErr != nil {
+			if dbErr.underlying != sql.ErrNoRows {
+				dbErr.Print()
 			}
+			return nil
+		}
+
+		u := aa.cachedUser(session.userID)
 
-			if dberr != nil {
-				if dberr.underlying != sql.ErrNoRows {
-					dberr.Print()
+		if u == nil {
+			if u, dbErr = db.GetUser(session.userID); dbErr != nil {
+				if dbErr.underlying != sql.ErrNoRows {
+					dbErr.Print()
 				}
-			} else {
-				aa.SesCache[u.sessionHash] = u
+				return nil
 			}
 
-			c.Set(UserKey, u)
+			u.HasAvatar = blobExists(avatarKey(u.ID))
+			u.IsRoot = config.RootUser == u.login
 		}
 
-		c.Next()
+		s = &AudySession{session, u}
+
+		aa.mutex.Lock()
+		aa.SesCache[id] = s
+		aa.mutex.Unlock()
+	}
+
+	if s.Session.Expires <= now {
+		aa.RevokeSession(id)
+		return nil
+	}
+
+	// cached sessions are shared by concurrent requests, so last_seen is
+	// checked and bumped under the mutex and only one of them touches the db
+	aa.mutex.Lock()
+	touch := now-s.Session.LastSeen >= sessionTouchInterval
+
+	if touch {
+		s.Session.LastSeen = now
+	}
+	aa.mutex.Unlock()
+
+	if touch {
+		if _, dbErr := db.TouchSession(id, now); dbErr != nil {
+			dbErr.Print()
+		}
+	}
+
+	return s
+}
+
+// sameNetwork reports whether both addresses belong to one subnet of the
+// configured rem_ip prefix length. An invalid prefix matches nothing, since
+// net.CIDRMask returns nil for it and nil masks compare equal
+func sameNetwork(a, b string) bool {
+	ipA := net.ParseIP(a)
+	ipB := net.ParseIP(b)
+
+	if ipA == nil || ipB == nil {
+		return false
+	}
+
+	if v4A, v4B := ipA.To4(), ipB.To4(); v4A != nil || v4B != nil {
+		if v4A == nil || v4B == nil {
+			return false
+		}
+
+		mask := net.CIDRMask(config.RemIPPrefixV4, 32)
+		return mask != nil && v4A.Mask(mask).Equal(v4B.Mask(mask))
+	}
+
+	mask := net.CIDRMask(config.RemIPPrefixV6, 128)
+	return mask != nil && ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+// rejectSession revokes a rem_ip session used from a foreign address and
+// remembers the address to tell the user about it on the next login
+func (aa *AudyAuth) rejectSession(s *AudySession, ip string) {
+	fmt.Printf("Session of user %v bound to %v was used from %v. Revoking\n", s.User.login, s.Session.IP, ip)
+
+	if dbErr := aa.RevokeSession(s.Session.ID); dbErr != nil {
+		dbErr.Print()
+	}
+
+	alert, _ := json.Marshal(&RemIPAlert{ip, time.Now().Unix()})
+
+	aa.mutex.Lock()
+	s.User.remIPAlert = string(alert)
+	aa.mutex.Unlock()
+
+	if _, dbErr := db.SetUserRemIPAlert(s.User.ID, string(alert)); dbErr != nil {
+		dbErr.Print()
+	}
+}
+
+// takeRemIPAlert returns the pending rem_ip alert of the user and clears it,
+// so it's shown only once
+func (aa *AudyAuth) takeRemIPAlert(u *DBUser) string {
+	aa.mutex.Lock()
+	alert := u.remIPAlert
+	u.remIPAlert = ""
+	aa.mutex.Unlock()
+
+	if len(alert) > 0 {
+		if _, dbErr := db.SetUserRemIPAlert(u.ID, ""); dbErr != nil {
+			dbErr.Print()
+		}
+	}
+
+	return alert
+}
+
+func (aa *AudyAuth) cachedUser(userID int) *DBUser {
+	aa.mutex.Lock()
+	defer aa.mutex.Unlock()
+
+	for _, s := range aa.SesCache {
+		if s.User.ID == userID {
+			return s.User
+		}
+	}
+
+	return nil
+}
+
+// CreateSession stores a new session of the user and sets its cookie
+func (aa *AudyAuth) CreateSession(c *gin.Context, u *DBUser) *DBWorkerError {
+	token, err := newSessionToken()
+
+	if err != nil {
+		return &DBWorkerError{err, "", "generating session token"}
+	}
+
+	now := time.Now().Unix()
+	maxAge := config.SessionTime * 60 * 60
+
+	s := &DBSession{
+		ID:        sessionID(token),
+		userID:    u.ID,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now + int64(maxAge),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+
+	if _, dbErr := db.AddSession(s); dbErr != nil {
+		return dbErr
+	}
+
+	c.SetCookie(SessionCookie, token, maxAge, "/", "", false, true)
+	return nil
+}
+
+func (aa *AudyAuth) RevokeSession(id string) *DBWorkerError {
+	aa.mutex.Lock()
+	delete(aa.SesCache, id)
+	aa.mutex.Unlock()
+
+	_, dbErr := db.RemoveSession(id)
+	return dbErr
+}
+
+// RevokeUserSessions removes all sessions of the user except the given one,
+// which may be left empty
+func (aa *AudyAuth) RevokeUserSessions(userID int, exceptID string) *DBWorkerError {
+	aa.mutex.Lock()
+	for id, s := range aa.SesCache {
+		if s.User.ID == userID && id != exceptID {
+			delete(aa.SesCache, id)
+		}
+	}
+	aa.mutex.Unlock()
+
+	_, dbErr := db.RemoveUserSessions(userID, exceptID)
+	return dbErr
+}
+
+// EvictUser drops cached sessions of the user so the next request reloads the
+// user from the database
+func (aa *AudyAuth) EvictUser(userID int) {
+	aa.mutex.Lock()
+	defer aa.mutex.Unlock()
+
+	for id, s := range aa.SesCache {
+		if s.User.ID == userID {
+			delete(aa.SesCache, id)
+		}
+	}
+}
+
+// CleanupLoop removes expired sessions from the database and the cache
+func (aa *AudyAuth) CleanupLoop(interval time.Duration) {
+	for {
+		now := time.Now().Unix()
+
+		if _, dbErr := db.RemoveExpiredSessions(now); dbErr != nil {
+			dbErr.Print()
+		}
+
+		aa.mutex.Lock()
+		for id, s := range aa.SesCache {
+			if s.Session.Expires <= now {
+				delete(aa.SesCache, id)
+			}
+		}
+		aa.mutex.Unlock()
+
+		time.Sleep(interval)
 	}
 }
 
@@ -65,3 +325,13 @@ func (aa *AudyAuth) GetUser(c *gin.Context) *DBUser {
 
 	return v.(*DBUser)
 }
+
+func (aa *AudyAuth) GetSession(c *gin.Context) *DBSession {
+	v, ok := c.Get(SessionKey)
+
+	if !ok || v == nil {
+		return nil
+	}
+
+	return v.(*DBSession)
+}
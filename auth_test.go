@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSameNetwork(t *testing.T) {
+	prevV4, prevV6 := config.RemIPPrefixV4, config.RemIPPrefixV6
+	defer func() { config.RemIPPrefixV4, config.RemIPPrefixV6 = prevV4, prevV6 }()
+
+	cases := []struct {
+		v4, v6 int
+		a, b   string
+		same   bool
+	}{
+		{32, 64, "10.0.0.1", "10.0.0.1", true},
+		{32, 64, "10.0.0.1", "10.0.0.2", false},
+		{24, 64, "10.0.0.1", "10.0.0.2", true},
+		{0, 64, "10.0.0.1", "192.168.1.1", true},
+		{32, 64, "2001:db8::1", "2001:db8::2", true},
+		{32, 64, "2001:db8::1", "2001:db9::1", false},
+		{32, 128, "2001:db8::1", "2001:db8::2", false},
+		{32, 64, "10.0.0.1", "2001:db8::1", false},
+		{32, 64, "10.0.0.1", "not an address", false},
+		// out of range prefixes fail closed
+		{33, 64, "10.0.0.1", "10.0.0.1", false},
+		{-1, 64, "10.0.0.1", "192.168.1.1", false},
+		{32, 129, "2001:db8::1", "2001:db8::1", false},
+		{32, -1, "2001:db8::1", "2001:db9::1", false},
+	}
+
+	for _, tc := range cases {
+		config.RemIPPrefixV4, config.RemIPPrefixV6 = tc.v4, tc.v6
+
+		if got := sameNetwork(tc.a, tc.b); got != tc.same {
+			t.Errorf("/%v /%v %v %v: same = %v, want %v", tc.v4, tc.v6, tc.a, tc.b, got, tc.same)
+		}
+	}
+}
+
+func TestValidateConfigRemIPPrefixes(t *testing.T) {
+	cases := []struct {
+		v4, v6 int
+		valid  bool
+	}{
+		{32, 64, true},
+		{0, 0, true},
+		{32, 128, true},
+		{33, 64, false},
+		{-1, 64, false},
+		{32, 129, false},
+		{32, -1, false},
+	}
+
+	for _, tc := range cases {
+		c := *config
+		c.RemIPPrefixV4, c.RemIPPrefixV6 = tc.v4, tc.v6
+
+		if err := validateConfig(&c); (err == nil) != tc.valid {
+			t.Errorf("/%v /%v: valid = %v, want %v (%v)", tc.v4, tc.v6, err == nil, tc.valid, err)
+		}
+	}
+}
+
+func TestCachedSessionConcurrentRequests(t *testing.T) {
+	setupIngest(t)
+
+	res, dbErr := db.AddUser(&DBUser{login: "user", password: "x"})
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	userID, _ := res.LastInsertId()
+	now := time.Now().Unix()
+	session := &DBSession{ID: "session", userID: int(userID), Created: now, LastSeen: now - sessionTouchInterval, Expires: now + 3600}
+
+	if _, dbErr = db.AddSession(session); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	aa := &AudyAuth{SesCache: map[string]*AudySession{}}
+	s := aa.getSession("session")
+
+	if s == nil {
+		t.Fatal("session not found")
+	}
+
+	s.Session.LastSeen = 0
+	s.User.remIPAlert = `{"ip":"10.0.0.1","time":1}`
+
+	var wg sync.WaitGroup
+	alerts := make(chan string, 8)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if aa.getSession("session") == nil {
+				t.Error("session lost")
+			}
+
+			if alert := aa.takeRemIPAlert(s.User); len(alert) > 0 {
+				alerts <- alert
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(alerts)
+
+	if len(alerts) != 1 {
+		t.Errorf("alert taken %v times, want once", len(alerts))
+	}
+
+	if s.Session.LastSeen < now {
+		t.Errorf("last_seen = %v, want at least %v", s.Session.LastSeen, now)
+	}
+}
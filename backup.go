@@ -0,0 +1,743 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mattn/go-sqlite3"
+)
+
+// A backup is a zstd compressed tar stream holding, in this order:
+//
+//	manifest.json   AudyBackupManifest
+//	storage.db      snapshot of the database
+//	config.json
+//	blobs/<key>     avatars, album covers and, when asked for, music
+//
+// Restoring is done with the server stopped, see restoreBackup
+type AudyBackupConfig struct {
+	// Dir receives scheduled backups as audy-<time>.tar.zst
+	Dir string `json:"dir"`
+	// IntervalHours between scheduled backups, 0 turns them off
+	IntervalHours int `json:"interval_hours"`
+	// Keep is how many scheduled backups are kept, older ones are removed
+	Keep  int  `json:"keep"`
+	Music bool `json:"music"`
+}
+
+type AudyBackupManifest struct {
+	Format        int     `json:"format"`
+	Version       float32 `json:"version"`
+	SchemaVersion int     `json:"schema_version"`
+	Created       int64   `json:"created"`
+	Music         bool    `json:"music"`
+}
+
+const backupFormat int = 1
+const backupManifestName string = "manifest.json"
+const backupDBName string = "storage.db"
+const backupConfigName string = "config.json"
+const backupBlobsDir string = "blobs/"
+const backupFilePrefix string = "audy-"
+const backupFileExt string = ".tar.zst"
+const backupTimeFormat string = "20060102-150405"
+
+// music blobs are only included on request, they make up nearly all of
+// the size
+var backupBlobPrefixes []string = []string{"avatars/", "albums/"}
+
+func backupFileName(t time.Time) string {
+	return fmt.Sprint(backupFilePrefix, t.Format(backupTimeFormat), backupFileExt)
+}
+
+// snapshot copies the database to target with the SQLite online backup API.
+// The copy is done in a single step, the database only holds metadata so the
+// read lock is short
+func (w *DBWorker) snapshot(target string) error {
+	dest, err := sql.Open("sqlite3", target)
+
+	if err != nil {
+		return err
+	}
+
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer destConn.Close()
+
+	srcConn, err := w.conn.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer srcConn.Close()
+
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			b, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+
+			if err != nil {
+				return err
+			}
+
+			if _, err = b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+
+			return b.Finish()
+		})
+	})
+}
+
+func databaseSchemaVersion(path string) (int, error) {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer conn.Close()
+
+	var version int
+	err = conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+
+	return version, err
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+func writeTarBytes(tw *tar.Writer, name string, data []byte) error {
+	return writeTarFile(tw, name, int64(len(data)), time.Now(), bytes.NewReader(data))
+}
+
+func writeTarPath(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	return writeTarFile(tw, name, fi.Size(), fi.ModTime(), f)
+}
+
+// writeBackup streams a backup to out. Blobs removed while it runs are
+// skipped
+func writeBackup(out io.Writer, music bool) (*AudyBackupManifest, error) {
+	snapshot, err := ioutil.TempFile(filepath.Dir(dbPath), "storage.db.snapshot-*")
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+
+	if err = db.snapshot(snapshot.Name()); err != nil {
+		return nil, fmt.Errorf("snapshot of the database: %v", err.Error())
+	}
+
+	version, err := databaseSchemaVersion(snapshot.Name())
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &AudyBackupManifest{backupFormat, Version, version, time.Now().Unix(), music}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "\t")
+
+	if err != nil {
+		return nil, err
+	}
+
+	zw, err := zstd.NewWriter(out)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the encoder is closed on failures too, it holds goroutines and buffers
+	// until then
+	tw := tar.NewWriter(zw)
+	err = writeBackupEntries(tw, manifestBytes, snapshot.Name(), music)
+
+	if err == nil {
+		err = tw.Close()
+	}
+
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func writeBackupEntries(tw *tar.Writer, manifestBytes []byte, snapshotPath string, music bool) error {
+	if err := writeTarBytes(tw, backupManifestName, manifestBytes); err != nil {
+		return err
+	}
+
+	if err := writeTarPath(tw, backupDBName, snapshotPath); err != nil {
+		return err
+	}
+
+	if err := writeTarPath(tw, backupConfigName, configPath); err != nil {
+		return err
+	}
+
+	prefixes := backupBlobPrefixes
+
+	if music {
+		prefixes = append(prefixes, "music/")
+	}
+
+	for _, prefix := range prefixes {
+		blobs, err := store.List(prefix)
+
+		if err != nil {
+			return err
+		}
+
+		for _, b := range blobs {
+			if err = writeTarBlob(tw, b); err != nil {
+				return fmt.Errorf("blob %v: %v", b.Key, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeTarBlob(tw *tar.Writer, b *BlobInfo) error {
+	r, err := store.Open(b.Key)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	return writeTarFile(tw, backupBlobsDir+b.Key, b.Size, b.ModTime, r)
+}
+
+// writeBackupFile writes a backup next to path first, so an interrupted
+// backup never looks like a finished one
+func writeBackupFile(path string, music bool) (*AudyBackupManifest, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := writeBackup(f, music)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// scheduledBackups lists the backups in the backup folder, oldest first
+func scheduledBackups() []string {
+	files, err := ioutil.ReadDir(config.Backup.Dir)
+
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0)
+
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), backupFilePrefix) && strings.HasSuffix(f.Name(), backupFileExt) {
+			names = append(names, f.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func lastScheduledBackup() time.Time {
+	names := scheduledBackups()
+
+	if len(names) == 0 {
+		return time.Time{}
+	}
+
+	stamp := strings.TrimSuffix(strings.TrimPrefix(names[len(names)-1], backupFilePrefix), backupFileExt)
+	t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+func runScheduledBackup() error {
+	if err := os.MkdirAll(config.Backup.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	path := filepath.Join(config.Backup.Dir, backupFileName(time.Now()))
+
+	if _, err := writeBackupFile(path, config.Backup.Music); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup written to %v\n", path)
+
+	names := scheduledBackups()
+
+	for i := 0; config.Backup.Keep > 0 && i < len(names)-config.Backup.Keep; i++ {
+		if err := os.Remove(filepath.Join(config.Backup.Dir, names[i])); err != nil {
+			fmt.Printf("Unable to remove old backup %v: %v\n", names[i], err.Error())
+		}
+	}
+
+	return nil
+}
+
+// backupLoop writes a backup every IntervalHours, counting from the last
+// one in the backup folder, so restarts don't delay or repeat them
+func backupLoop() {
+	if config.Backup.IntervalHours <= 0 {
+		return
+	}
+
+	interval := time.Duration(config.Backup.IntervalHours) * time.Hour
+	next := lastScheduledBackup().Add(interval)
+
+	for {
+		time.Sleep(time.Until(next))
+
+		if err := runScheduledBackup(); err != nil {
+			fmt.Printf("Scheduled backup failed: %v\n", err.Error())
+		}
+
+		next = time.Now().Add(interval)
+	}
+}
+
+// backupEntryPath maps an archive entry to where it is extracted in the
+// staging folder. Anything a backup doesn't contain is refused
+func backupEntryPath(staging, name string) (string, error) {
+	switch name {
+	case backupDBName, backupConfigName:
+		return filepath.Join(staging, name), nil
+	}
+
+	key := strings.TrimPrefix(name, backupBlobsDir)
+
+	if key == name || !validBlobKey(key) {
+		return "", fmt.Errorf("unexpected entry %v", name)
+	}
+
+	for _, prefix := range append(backupBlobPrefixes, "music/") {
+		if strings.HasPrefix(key, prefix) {
+			return filepath.Join(staging, "blobs", filepath.FromSlash(key)), nil
+		}
+	}
+
+	return "", fmt.Errorf("unexpected entry %v", name)
+}
+
+// extractBackup unpacks a backup into staging and returns its manifest
+func extractBackup(r io.Reader, staging string) (*AudyBackupManifest, error) {
+	zr, err := zstd.NewReader(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	var manifest *AudyBackupManifest
+	seen := make(map[string]bool, 0)
+
+	for {
+		h, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("entry %v is not a regular file", h.Name)
+		}
+
+		if seen[h.Name] {
+			return nil, fmt.Errorf("entry %v is repeated", h.Name)
+		}
+
+		seen[h.Name] = true
+
+		if manifest == nil {
+			if h.Name != backupManifestName {
+				return nil, errors.New("archive doesn't start with a manifest, it isn't an Audy backup")
+			}
+
+			manifest = &AudyBackupManifest{}
+
+			if err = json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("manifest: %v", err.Error())
+			}
+
+			if manifest.Format < 1 || manifest.Format > backupFormat {
+				return nil, fmt.Errorf("backup format %v isn't supported by this build of Audy", manifest.Format)
+			}
+
+			continue
+		}
+
+		target, err := backupEntryPath(staging, h.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		f, err := os.Create(target)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.Copy(f, tr)
+
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest == nil {
+		return nil, errors.New("archive is empty")
+	}
+
+	if !seen[backupDBName] || !seen[backupConfigName] {
+		return nil, errors.New("archive misses the database or the config")
+	}
+
+	return manifest, nil
+}
+
+// checkBackupDatabase makes sure the restored database is intact and not
+// newer than this build. Older ones are migrated on the next start
+func checkBackupDatabase(path string, manifest *AudyBackupManifest) error {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	var result string
+
+	if err = conn.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+
+	if result != "ok" {
+		return fmt.Errorf("integrity check of the database failed: %v", result)
+	}
+
+	version, err := databaseSchemaVersion(path)
+
+	if err != nil {
+		return err
+	}
+
+	if version != manifest.SchemaVersion {
+		return fmt.Errorf("database schema version %v doesn't match the manifest (%v)", version, manifest.SchemaVersion)
+	}
+
+	migrations, err := loadMigrations()
+
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %v is newer than this build of Audy supports (%v)", version, len(migrations))
+	}
+
+	return nil
+}
+
+// restoredConfig is the config of the backup with the storage settings of
+// the current one, since the blobs are restored into the current store. It
+// is validated the way loadConfig would
+func restoredConfig(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	checked := *config
+
+	if err = json.Unmarshal(data, &checked); err != nil {
+		return nil, fmt.Errorf("config: %v", err.Error())
+	}
+
+	if err = validateConfig(&checked); err != nil {
+		return nil, fmt.Errorf("config: %v", err.Error())
+	}
+
+	restored := map[string]json.RawMessage{}
+
+	if err = json.Unmarshal(data, &restored); err != nil {
+		return nil, fmt.Errorf("config: %v", err.Error())
+	}
+
+	if restored["storage"], err = json.Marshal(&config.Storage); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(restored, "", "\t")
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dst, data, os.ModePerm)
+}
+
+// keepCurrentDatabase copies the current database to target. It's opened
+// directly rather than through CreateDBWorker so nothing is migrated, and a
+// leftover journal is rolled back before the copy
+func keepCurrentDatabase(target string) error {
+	conn, err := sql.Open("sqlite3", dbPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Exec(`VACUUM INTO ?`, target)
+	return err
+}
+
+// swapRestoredFiles renames the staged database and config into place,
+// keeping copies of the current ones as <name>.pre-restore-<time>.bak. When
+// the config can't be swapped the previous database is put back
+func swapRestoredFiles(stagedDB, stagedConfig string) error {
+	stamp := time.Now().Format(backupTimeFormat)
+	keptDB := fmt.Sprint(dbPath, ".pre-restore-", stamp, ".bak")
+	keptConfig := fmt.Sprint(configPath, ".pre-restore-", stamp, ".bak")
+	hadDB := false
+
+	if _, err := os.Stat(dbPath); err == nil {
+		if err = keepCurrentDatabase(keptDB); err != nil {
+			return fmt.Errorf("keeping the current database: %v", err.Error())
+		}
+
+		hadDB = true
+	}
+
+	if _, err := os.Stat(configPath); err == nil {
+		if err = copyFile(configPath, keptConfig); err != nil {
+			return fmt.Errorf("keeping the current config: %v", err.Error())
+		}
+	}
+
+	if err := os.Rename(stagedDB, dbPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(stagedConfig, configPath); err != nil {
+		if hadDB {
+			if rollbackErr := copyFile(keptDB, dbPath); rollbackErr != nil {
+				return fmt.Errorf("%v, and putting back the previous database failed: %v. It is kept in %v",
+					err.Error(), rollbackErr.Error(), keptDB)
+			}
+		} else {
+			os.Remove(dbPath)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// putRestoredBlobs moves the blobs extracted into blobsDir to the store and
+// returns how many there were
+func putRestoredBlobs(blobsDir string) (int, error) {
+	blobs := 0
+
+	err := filepath.Walk(blobsDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(blobsDir, path)
+
+		if err != nil {
+			return err
+		}
+
+		blobs++
+		return putBlobFile(filepath.ToSlash(rel), path)
+	})
+
+	return blobs, err
+}
+
+// restoreBackup replaces the database and the config with those of a backup
+// and puts its blobs into the store. The archive is fully extracted and
+// checked before anything is changed. The database and the config are then
+// swapped in, see swapRestoredFiles, and the blobs are put last, so a failed
+// restore never leaves blobs of a backup next to the previous database.
+// Putting blobs again is harmless, running the restore again finishes one
+// that failed there. Blobs that aren't in the backup are left alone.
+// It refuses to run while the server holds the database lock
+func restoreBackup(archivePath string) (*AudyBackupManifest, error) {
+	if err := lockDatabase(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(archivePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	// staged next to the database, so the final renames don't cross
+	// file systems
+	staging, err := ioutil.TempDir(filepath.Dir(dbPath), "restore-")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(staging)
+
+	manifest, err := extractBackup(f, staging)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stagedDB := filepath.Join(staging, backupDBName)
+	stagedConfig := filepath.Join(staging, backupConfigName)
+
+	if err = checkBackupDatabase(stagedDB, manifest); err != nil {
+		return nil, err
+	}
+
+	configBytes, err := restoredConfig(stagedConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ioutil.WriteFile(stagedConfig, configBytes, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err = swapRestoredFiles(stagedDB, stagedConfig); err != nil {
+		return nil, err
+	}
+
+	blobs, err := putRestoredBlobs(filepath.Join(staging, "blobs"))
+
+	if err != nil {
+		return nil, fmt.Errorf("the database and the config were restored, restoring files failed: %v. "+
+			"Run the restore again to put the remaining files", err.Error())
+	}
+
+	fmt.Printf("Restored %v files\n", blobs)
+
+	return manifest, nil
+}
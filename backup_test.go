@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func testHasUser(login string) bool {
+	_, dbErr := db.GetUserByLogin(login)
+	return dbErr == nil
+}
+
+// releaseDatabaseLock drops the lock taken by lockDatabase, which is
+// otherwise held until the process exits
+func releaseDatabaseLock() {
+	if dbLockFile != nil {
+		dbLockFile.Close()
+		dbLockFile = nil
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	openTestDB(t)
+	t.Cleanup(releaseDatabaseLock)
+
+	prevStore := store
+	defer func() { store = prevStore }()
+
+	var err error
+
+	if store, err = NewLocalBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, dbErr := db.AddUser(&DBUser{login: "kept", password: md5String("secret")}); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	avatar := avatarKey(1)
+
+	if err = store.Put(avatar, bytes.NewReader([]byte("avatar"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = writeBackupFile("backup.tar.zst", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes after the backup, which a restore takes back
+	if _, dbErr := db.AddUser(&DBUser{login: "added", password: md5String("secret")}); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if err = store.Delete(avatar); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is still running
+	if err = lockDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := dbLockFile
+	dbLockFile = nil
+
+	if _, err = restoreBackup("backup.tar.zst"); err != errDatabaseInUse {
+		t.Fatalf("restore next to a running server: %v, want %v", err, errDatabaseInUse)
+	}
+
+	server.Close()
+	db.conn.Close()
+
+	// a truncated archive fails before anything is changed
+	archive, err := ioutil.ReadFile("backup.tar.zst")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile("truncated.tar.zst", archive[:len(archive)-64], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := ioutil.ReadFile(dbPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = restoreBackup("truncated.tar.zst"); err == nil {
+		t.Fatal("truncated archive restored")
+	}
+
+	releaseDatabaseLock()
+
+	if after, _ := ioutil.ReadFile(dbPath); !bytes.Equal(before, after) {
+		t.Error("failed restore changed the database")
+	}
+
+	if blobExists(avatar) {
+		t.Error("failed restore put blobs")
+	}
+
+	if baks, _ := filepath.Glob(dbPath + ".pre-restore-*"); len(baks) != 0 {
+		t.Error("failed restore kept a copy of the database")
+	}
+
+	if _, err = restoreBackup("backup.tar.zst"); err != nil {
+		t.Fatal(err)
+	}
+
+	releaseDatabaseLock()
+	db = CreateDBWorker()
+
+	if !testHasUser("kept") || testHasUser("added") {
+		t.Error("users weren't restored to the backup")
+	}
+
+	if !blobExists(avatar) {
+		t.Error("avatar wasn't restored")
+	}
+
+	for _, path := range []string{dbPath, configPath} {
+		if baks, _ := filepath.Glob(path + ".pre-restore-*.bak"); len(baks) != 1 {
+			t.Errorf("%v: %v copies kept, want 1", path, len(baks))
+		}
+	}
+
+	if entries, _ := ioutil.ReadDir(filepath.Dir(dbPath)); len(entries) == 0 {
+		t.Fatal("db folder is empty")
+	} else {
+		for _, e := range entries {
+			if e.IsDir() {
+				t.Errorf("staging folder %v left behind", e.Name())
+			}
+		}
+	}
+}
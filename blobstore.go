@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stored files are blobs addressed by slash separated keys:
+//
+//	music/<md5>/track        audio of uploaded tracks
+//	music/<md5>/image.jpg    track picture
+//	music/<md5>/waveform.dat peaks file, see waveform.go
+//	albums/<id>.jpg          album cover
+//	avatars/<id>.jpg         user avatar
+//
+// Tracks of library folders are read from their own path and never go
+// through the store, only their derived files do
+type AudyStorageConfig struct {
+	// Type is local or s3
+	Type string `json:"type"`
+	// Root is the directory local blobs are kept in. Relative paths are
+	// resolved once on start
+	Root string            `json:"root"`
+	S3   AudyS3StoreConfig `json:"s3"`
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+type BlobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// BlobStore errors of missing blobs match fs.ErrNotExist with errors.Is
+type BlobStore interface {
+	Name() string
+	Open(key string) (BlobReader, error)
+	Put(key string, r io.Reader) error
+	Delete(key string) error
+	Stat(key string) (*BlobInfo, error)
+	// List returns the blobs whose keys start with prefix, sorted by key
+	List(prefix string) ([]*BlobInfo, error)
+}
+
+var store BlobStore
+
+func initBlobStore() {
+	var err error
+
+	switch config.Storage.Type {
+	case "", "local":
+		store, err = NewLocalBlobStore(config.Storage.Root)
+	case "s3":
+		store, err = NewS3BlobStore(&config.Storage.S3)
+	default:
+		err = fmt.Errorf("unknown storage type %q", config.Storage.Type)
+	}
+
+	if err != nil {
+		log.Fatalf("Unable to open blob store: %v\n", err.Error())
+	}
+
+	fmt.Printf("Blob store: %v\n", store.Name())
+}
+
+func trackKey(hash string) string {
+	return fmt.Sprint("music/", hash, "/track")
+}
+
+func trackImageKey(hash string) string {
+	return fmt.Sprint("music/", hash, "/image.jpg")
+}
+
+func albumCoverKey(id int) string {
+	return fmt.Sprintf("albums/%v.jpg", id)
+}
+
+func avatarKey(userID int) string {
+	return fmt.Sprintf("avatars/%v.jpg", userID)
+}
+
+func blobExists(key string) bool {
+	_, err := store.Stat(key)
+	return err == nil
+}
+
+// putBlobFile moves a local file into the store. Local stores rename it when
+// they can, so big uploads aren't copied
+func putBlobFile(key, filePath string) error {
+	if s, ok := store.(*LocalBlobStore); ok {
+		if err := s.rename(key, filePath); err == nil {
+			return nil
+		}
+	}
+
+	f, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	err = store.Put(key, f)
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filePath)
+}
+
+// copyBlobFile puts a copy of a local file into the store, leaving the file
+// in place. Local stores hard link it when they can
+func copyBlobFile(key, filePath string) error {
+	if s, ok := store.(*LocalBlobStore); ok {
+		if err := s.link(key, filePath); err == nil {
+			return nil
+		}
+	}
+
+	f, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return store.Put(key, f)
+}
+
+func putBlobBytes(key string, data []byte) error {
+	return store.Put(key, bytes.NewReader(data))
+}
+
+// removeBlobs deletes every blob under prefix
+func removeBlobs(prefix string) error {
+	blobs, err := store.List(prefix)
+
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blobs {
+		if err = store.Delete(b.Key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeTrackBlobs(hash string) error {
+	return removeBlobs(fmt.Sprint("music/", hash, "/"))
+}
+
+// localBlobFile returns a path decoders and encoders can read the blob from.
+// Remote blobs are downloaded to a temporary file, which release removes
+func localBlobFile(key string) (string, func(), error) {
+	if s, ok := store.(*LocalBlobStore); ok {
+		p := s.path(key)
+
+		if _, err := os.Stat(p); err != nil {
+			return "", nil, err
+		}
+
+		return p, func() {}, nil
+	}
+
+	r, err := store.Open(key)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile("", "audy-blob-*")
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+func validBlobKey(key string) bool {
+	if len(key) == 0 || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+func blobNotFound(key string) error {
+	return &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+}
+
+// LocalBlobStore keeps blobs as files under Root, keys being their relative
+// paths. Blobs are written to a temporary file first, so readers never see
+// half written ones
+type LocalBlobStore struct {
+	Root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if len(root) == 0 {
+		return nil, errors.New("storage root is empty")
+	}
+
+	abs, err := filepath.Abs(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(abs, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{abs}, nil
+}
+
+func (s *LocalBlobStore) Name() string {
+	return fmt.Sprint("local ", s.Root)
+}
+
+func (s *LocalBlobStore) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(key))
+}
+
+func (s *LocalBlobStore) Open(key string) (BlobReader, error) {
+	if !validBlobKey(key) {
+		return nil, blobNotFound(key)
+	}
+
+	f, err := os.Open(s.path(key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		f.Close()
+		return nil, blobNotFound(key)
+	}
+
+	return f, nil
+}
+
+func (s *LocalBlobStore) Put(key string, r io.Reader) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+
+	p := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+".tmp-*")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, r)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (s *LocalBlobStore) rename(key, filePath string) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+
+	p := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.Rename(filePath, p)
+}
+
+func (s *LocalBlobStore) link(key, filePath string) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+
+	p := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.Link(filePath, p)
+}
+
+// Delete also removes directories left empty, up to the root
+func (s *LocalBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return blobNotFound(key)
+	}
+
+	if err := os.Remove(s.path(key)); err != nil {
+		return err
+	}
+
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(s.path(dir)) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *LocalBlobStore) Stat(key string) (*BlobInfo, error) {
+	if !validBlobKey(key) {
+		return nil, blobNotFound(key)
+	}
+
+	fi, err := os.Stat(s.path(key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, blobNotFound(key)
+	}
+
+	return &BlobInfo{key, fi.Size(), fi.ModTime()}, nil
+}
+
+// List walks only the directory the prefix points into, temporary files of
+// unfinished writes are skipped
+func (s *LocalBlobStore) List(prefix string) ([]*BlobInfo, error) {
+	dir := "."
+
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		dir = prefix[:i]
+	}
+
+	blobs := make([]*BlobInfo, 0)
+
+	if dir != "." && !validBlobKey(dir) {
+		return blobs, nil
+	}
+
+	err := filepath.Walk(s.path(dir), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if fi.IsDir() || strings.Contains(fi.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, p)
+
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, &BlobInfo{key, fi.Size(), fi.ModTime()})
+		}
+
+		return nil
+	})
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Key < blobs[j].Key
+	})
+
+	return blobs, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// runCommand runs a maintenance command instead of the server, returning
+// the exit code:
+//
+//	audy backup [-music] [-o file]
+//	audy restore <file>
+//	audy check [-fix]
+func runCommand(args []string) int {
+	loadConfig()
+	initBlobStore()
+
+	// restore replaces the database, opening it would migrate the one about
+	// to be replaced
+	if args[0] != "restore" {
+		db = CreateDBWorker()
+	}
+
+	switch args[0] {
+	case "backup":
+		return cmdBackup(args[1:])
+	case "restore":
+		return cmdRestore(args[1:])
+	case "check":
+		return cmdCheck(args[1:])
+	}
+
+	fmt.Printf("Unknown command %v. Commands: backup, restore, check\n", args[0])
+	return 2
+}
+
+func cmdBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	music := fs.Bool("music", false, "include the music files")
+	out := fs.String("o", backupFileName(time.Now()), "archive to write")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	manifest, err := writeBackupFile(*out, *music)
+
+	if err != nil {
+		fmt.Printf("Backup failed: %v\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Backup of schema version %v written to %v\n", manifest.SchemaVersion, *out)
+	return 0
+}
+
+func cmdRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: audy restore <file>")
+		return 2
+	}
+
+	manifest, err := restoreBackup(fs.Arg(0))
+
+	if err != nil {
+		fmt.Printf("Restore failed: %v\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Restored backup of %v (schema version %v). Start the server to apply pending migrations\n",
+		time.Unix(manifest.Created, 0).Format(time.RFC1123), manifest.SchemaVersion)
+	return 0
+}
+
+// cmdCheck exits with 1 while findings are left
+func cmdCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "repair the fixable findings")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := checkIntegrity(context.Background(), *fix, nil)
+
+	if err != nil {
+		fmt.Printf("Integrity check failed: %v\n", err.Error())
+		return 1
+	}
+
+	printIntegrityReport(report)
+
+	if !*fix && len(report.fixableIDs()) > 0 {
+		fmt.Println("Nothing was changed. Run audy check -fix to repair the fixable findings")
+	}
+
+	if report.unfixed() > 0 {
+		return 1
+	}
+
+	return 0
+}
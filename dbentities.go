@@ -5,51 +5,160 @@ import (
 )
 
 type DBUser struct {
-	ID          int `json:"id"`
-	login       string
-	Nickanme    string `json:"nickname"`
-	password    string
-	sessionHash string
-	ip          string
-	Lang        string `json:"lang"`
-	Theme       string `json:"theme"`
-	Themes      string `json:"themes"`
-	vkCookies   string
-	VkUser      int  `json:"vk_user_id"`
-	RemIP       bool `json:"rem_ip"`
-	Autoplay    bool `json:"autoplay"`
-	IsAdmin     bool `json:"is_admin"`
-	HasAvatar   bool `json:"has_avatar"`
-	IsRoot      bool `json:"is_root"`
+	ID        int `json:"id"`
+	login     string
+	Nickanme  string `json:"nickname"`
+	password  string
+	ip        string
+	Lang      string `json:"lang"`
+	Theme     string `json:"theme"`
+	Themes    string `json:"themes"`
+	vkCookies string
+	VkUser    int  `json:"vk_user_id"`
+	RemIP     bool `json:"rem_ip"`
+	Autoplay  bool `json:"autoplay"`
+	IsAdmin   bool `json:"is_admin"`
+	HasAvatar bool `json:"has_avatar"`
+	IsRoot    bool `json:"is_root"`
+
+	subsonicPassword string
+	remIPAlert       string
+}
+
+type DBSession struct {
+	ID        string `json:"id"`
+	userID    int
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"last_seen"`
+	Expires   int64  `json:"expires"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Current   bool   `json:"current"`
 }
 
 type DBTrack struct {
-	Md5       string  `json:"md5"`
-	Artist    string  `json:"artist"`
-	Title     string  `json:"title"`
-	HasImage  bool    `json:"has_image"`
-	Lyrics    string  `json:"lyrics"`
-	Timestamp int     `json:"timestamp"`
-	Duration  float32 `json:"duration"`
+	Md5         string  `json:"md5"`
+	Artist      string  `json:"artist"`
+	Title       string  `json:"title"`
+	HasImage    bool    `json:"has_image"`
+	Lyrics      string  `json:"lyrics"`
+	Timestamp   int     `json:"timestamp"`
+	Duration    float32 `json:"duration"`
+	Format      string  `json:"format"`
+	Mime        string  `json:"mime"`
+	Album       string  `json:"album"`
+	AlbumArtist string  `json:"album_artist"`
+	TrackNumber int     `json:"track_number"`
+	DiscNumber  int     `json:"disc_number"`
+	Year        int     `json:"year"`
+	Genre       string  `json:"genre"`
+	ArtistID    int     `json:"artist_id"`
+	AlbumID     int     `json:"album_id"`
+	Loudness    float64 `json:"loudness"`
+	TrackGain   float64 `json:"track_gain"`
+	TrackPeak   float64 `json:"track_peak"`
+	AlbumGain   float64 `json:"album_gain"`
+	AlbumPeak   float64 `json:"album_peak"`
+	GainSource  string  `json:"gain_source"`
+	// External tracks belong to a library folder and are read in place
+	External bool `json:"external"`
+
+	albumGainTagged bool
+	path            string
+	fileSize        int64
+	fileModTime     int64
+	// set by analysis, empty when the audio couldn't be decoded
+	fingerprint []uint32
+}
+
+type DBJob struct {
+	ID          int    `json:"id"`
+	Type        string `json:"type"`
+	Batch       string `json:"batch"`
+	Target      string `json:"target"`
+	Payload     string `json:"payload"`
+	userID      int
+	State       string `json:"state"`
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	RunAfter    int64  `json:"run_after"`
+	Error       string `json:"error"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+}
+
+type DBLibChanges struct {
+	Revision int        `json:"revision"`
+	Reset    bool       `json:"reset"`
+	Tracks   []*DBTrack `json:"tracks"`
+	Removed  []string   `json:"removed"`
+}
+
+// DBSearchResult holds a matched track along with its highlighted fields.
+// Lyrics contains only a snippet around the match
+type DBSearchResult struct {
+	Track  *DBTrack `json:"track"`
+	Artist string   `json:"artist"`
+	Title  string   `json:"title"`
+	Album  string   `json:"album"`
+	Lyrics string   `json:"lyrics"`
+	Rank   float64  `json:"rank"`
+}
+
+type DBArtist struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	AlbumCount int    `json:"album_count"`
+}
+
+type DBAlbum struct {
+	ID         int     `json:"id"`
+	Title      string  `json:"title"`
+	ArtistID   int     `json:"artist_id"`
+	Artist     string  `json:"artist"`
+	Year       int     `json:"year"`
+	HasImage   bool    `json:"has_image"`
+	TrackCount int     `json:"track_count"`
+	Duration   float32 `json:"duration"`
 }
 
 type DBPlaylist struct {
 	ID      int    `json:"id"`
 	Name    string `json:"name"`
 	ownerID int
-	Tracks  string `json:"tracks"`
+	Tracks  []string `json:"tracks"`
+}
+
+// DBPlaylistTrack is a single playlist_tracks row
+type DBPlaylistTrack struct {
+	PlaylistID int    `json:"playlist_id"`
+	Md5        string `json:"md5"`
 }
 
 func (p *DBPlaylist) String() string {
-	return fmt.Sprintf("{ id: %v; name: %v; owner_id: %v; tracks: %v }", p.ID, p.Name, p.ownerID, fmt.Sprintf("text(%v)", len(p.Tracks)))
+	return fmt.Sprintf("{ id: %v; name: %v; owner_id: %v; tracks: %v }", p.ID, p.Name, p.ownerID, len(p.Tracks))
+}
+
+func (a *DBAlbum) String() string {
+	return fmt.Sprintf("{ id: %v; title: %v; artist_id: %v; year: %v; has_image: %t }", a.ID, a.Title, a.ArtistID, a.Year, a.HasImage)
 }
 
 func (s *DBTrack) String() string {
-	return fmt.Sprintf("{ md5: %v; artist: %v; title: %v; has_image: %t; lyrics: %v; timestamp: %v; duration: %v }",
-		s.Md5, s.Artist, s.Title, s.HasImage, fmt.Sprintf("text(%v)", len(s.Lyrics)), s.Timestamp, s.Duration)
+	return fmt.Sprintf("{ md5: %v; artist: %v; title: %v; album: %v; has_image: %t; lyrics: %v; timestamp: %v; duration: %v; format: %v }",
+		s.Md5, s.Artist, s.Title, s.Album, s.HasImage, fmt.Sprintf("text(%v)", len(s.Lyrics)), s.Timestamp, s.Duration, s.Format)
 }
 
 func (u *DBUser) String() string {
-	return fmt.Sprintf("{ id: %v; login: %v; nickname: %v; password: %v; session_hash: %v; ip: %v; lang: %v; theme: %v; vkCookies: %v; vkUser: %v; rem_ip: %t; autoplay: %t; is_admin: %t, themes: %v }",
-		u.ID, u.login, u.Nickanme, u.password, u.sessionHash, u.ip, u.Lang, u.Theme, u.vkCookies, u.VkUser, u.RemIP, u.Autoplay, u.IsAdmin, u.Themes)
+	return fmt.Sprintf("{ id: %v; login: %v; nickname: %v; password: %v; ip: %v; lang: %v; theme: %v; vkCookies: %v; vkUser: %v; rem_ip: %t; autoplay: %t; is_admin: %t, themes: %v }",
+		u.ID, u.login, u.Nickanme, u.password, u.ip, u.Lang, u.Theme, u.vkCookies, u.VkUser, u.RemIP, u.Autoplay, u.IsAdmin, u.Themes)
+}
+
+func (s *DBSession) String() string {
+	return fmt.Sprintf("{ id: %v; user_id: %v; created: %v; last_seen: %v; expires: %v; ip: %v; user_agent: %v }",
+		s.ID, s.userID, s.Created, s.LastSeen, s.Expires, s.IP, s.UserAgent)
+}
+
+func (j *DBJob) String() string {
+	return fmt.Sprintf("{ id: %v; type: %v; batch: %v; target: %v; user_id: %v; state: %v; attempts: %v/%v; error: %v }",
+		j.ID, j.Type, j.Batch, j.Target, j.userID, j.State, j.Attempts, j.MaxAttempts, j.Error)
 }
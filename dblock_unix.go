@@ -0,0 +1,32 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockDatabase takes an exclusive lock on dbLockPath, held until the process
+// exits. It fails with errDatabaseInUse while another process holds it
+func lockDatabase() error {
+	f, err := os.OpenFile(dbLockPath, os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == unix.EWOULDBLOCK {
+			return errDatabaseInUse
+		}
+
+		return err
+	}
+
+	dbLockFile = f
+	return nil
+}
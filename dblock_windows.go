@@ -0,0 +1,35 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockDatabase takes an exclusive lock on dbLockPath, held until the process
+// exits. It fails with errDatabaseInUse while another process holds it
+func lockDatabase() error {
+	f, err := os.OpenFile(dbLockPath, os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	err = windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+
+	if err != nil {
+		f.Close()
+
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return errDatabaseInUse
+		}
+
+		return err
+	}
+
+	dbLockFile = f
+	return nil
+}
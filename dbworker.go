@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"strings"
 
@@ -12,6 +14,11 @@ import (
 
 type DBWorker struct {
 	conn *sql.DB
+	fts  bool
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
 type DBWorkerError struct {
@@ -22,6 +29,28 @@ type DBWorkerError struct {
 
 const dbPath string = "db/storage.db"
 
+// dbLockPath is locked by the server and by restore, so a restore can't
+// replace the database under a running server
+const dbLockPath string = "db/storage.db.lock"
+
+var errDatabaseInUse error = errors.New("the database is in use by another Audy process, stop the server first")
+
+// dbLockFile keeps the lock taken by lockDatabase open
+var dbLockFile *os.File
+
+// highlighted search matches are wrapped into these control characters so
+// clients can mark them up without having to escape the matched text
+const searchMarkOpen string = "\x02"
+const searchMarkClose string = "\x03"
+
+const userColumns string = "id, login, nickname, password, ip, lang, theme, themes, vk_cookies, vk_user, " +
+	"rem_ip, autoplay, is_admin, subsonic_password, rem_ip_alert"
+
+const trackColumns string = "md5, artist, title, has_image, lyrics, timestamp, duration, format, mime, " +
+	"album, album_artist, track_number, disc_number, year, genre, artist_id, album_id, " +
+	"loudness, track_gain, track_peak, album_gain, album_peak, gain_source, album_gain_tagged, " +
+	"path, file_size, file_mtime"
+
 func (w *DBWorker) init() {
 	_, err := os.Stat(dbPath)
 
@@ -29,58 +58,60 @@ func (w *DBWorker) init() {
 		os.Create(dbPath)
 	}
 
-	w.conn, err = sql.Open("sqlite3", dbPath)
+	// jobs write from several goroutines, so writers wait for the lock
+	// instead of failing with "database is locked". Foreign keys are off
+	// by default in SQLite and have to be enabled on every connection
+	w.conn, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000&_txlock=immediate&_foreign_keys=on")
 
 	if err != nil {
 		log.Fatalf("error while trying to set DB connection to file %v: %v\n", dbPath, err.Error())
 		return
 	}
 
-	_, err = w.conn.Exec(`CREATE TABLE IF NOT EXISTS users (
-							id INTEGER PRIMARY KEY AUTOINCREMENT,
-							login TEXT NOT NULL DEFAULT '',
-							nickname TEXT NOT NULL DEFAULT '',
-							password TEXT NOT NULL DEFAULT '',
-							session_hash TEXT NOT NULL DEFAULT '',
-							ip TEXT NOT NULL DEFAULT '',
-							lang TEXT NOT NULL DEFAULT '',
-							theme TEXT NOT NULL DEFAULT '',
-							themes TEXT NOT NULL DEFAULT '{}',
-							vk_cookies TEXT NOT NULL DEFAULT '[]',
-							vk_user INTEGER NOT NULL DEFAULT 0,
-							rem_ip INTEGER NOT NULL DEFAULT 0,
-							autoplay INTEGER NOT NULL DEFAULT 0,
-							is_admin INTEGER NOT NULL DEFAULT 0)`)
-
-	if err != nil {
-		log.Fatalf("error while trying to create users table: %v\n", err.Error())
+	w.migrate()
+	w.initSearch()
+
+	fmt.Printf("Database loaded successfully from %v\n", dbPath)
+}
+
+// initSearch creates the FTS5 index of the library. The sqlite3 driver has
+// to be built with the sqlite_fts5 tag, otherwise search stays disabled
+func (w *DBWorker) initSearch() {
+	_, err := w.conn.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS music_fts USING fts5(
+							md5 UNINDEXED,
+							artist,
+							title,
+							album,
+							lyrics,
+							tokenize = 'unicode61 remove_diacritics 2')`)
+	if err != nil {
+		fmt.Printf("Full-text search is disabled. Unable to create music_fts table: %v\n", err.Error())
 		return
 	}
 
-	_, err = w.conn.Exec(`CREATE TABLE IF NOT EXISTS music (
-							md5 TEXT NOT NULL UNIQUE PRIMARY KEY,
-							artist TEXT NOT NULL DEFAULT '',
-							title TEXT NOT NULL DEFAULT '',
-							has_image INTEGER NOT NULL DEFAULT 0,
-							lyrics TEXT NOT NULL DEFAULT '',
-							timestamp INT NOT NULL DEFAULT (strftime('%s', 'now')),
-							duration REAL NOT NULL DEFAULT 0.0)`)
-	if err != nil {
-		log.Fatalf("error while trying to create music table: %v\n", err.Error())
+	w.fts = true
+
+	var indexed, total int
+	w.conn.QueryRow("SELECT COUNT(*) FROM music_fts").Scan(&indexed)
+	w.conn.QueryRow("SELECT COUNT(*) FROM music").Scan(&total)
+
+	if indexed == total {
 		return
 	}
 
-	_, err = w.conn.Exec(`CREATE TABLE IF NOT EXISTS playlists (
-							id INTEGER PRIMARY KEY AUTOINCREMENT,
-							name TEXT NOT NULL DEFAULT '',
-							owner_id INTEGER NOT NULL,
-							tracks TEXT NOT NULL DEFAULT '[]')`)
+	_, err = w.conn.Exec(`DELETE FROM music_fts`)
+
+	if err == nil {
+		_, err = w.conn.Exec(`INSERT INTO music_fts (md5, artist, title, album, lyrics)
+								SELECT md5, artist, title, album, lyrics FROM music`)
+	}
+
 	if err != nil {
-		log.Fatalf("error while trying to create playlists table: %v\n", err.Error())
+		log.Fatalf("error while trying to rebuild music_fts table: %v\n", err.Error())
 		return
 	}
 
-	fmt.Printf("Database loaded successfully from %v\n", dbPath)
+	fmt.Printf("Search index rebuilt for %v tracks\n", total)
 }
 
 func (err *DBWorkerError) Error() string {
@@ -148,7 +179,6 @@ func (w *DBWorker) UpdateUser(u *DBUser) (sql.Result, *DBWorkerError) {
 		SET login = ?,
 			nickname = ?,
 			password = ?,
-			session_hash = ?,
 			ip = ?,
 			lang = ?,
 			theme = ?,
@@ -162,35 +192,121 @@ func (w *DBWorker) UpdateUser(u *DBUser) (sql.Result, *DBWorkerError) {
 	`
 
 	return w.Exec(query, fmt.Sprint("update user ", u),
-		u.login, u.Nickanme, u.password, u.sessionHash, u.ip, u.Lang, u.Theme, u.Themes, u.vkCookies, u.VkUser, u.RemIP, u.Autoplay, u.IsAdmin, u.ID)
-}
-
-func (w *DBWorker) UpdateUserHash(id int, hash string) (sql.Result, *DBWorkerError) {
-	query := `
-		UPDATE users
-		SET session_hash = ?
-		WHERE id = ?
-	`
-
-	return w.Exec(query, fmt.Sprintf("update user %v hash", id), hash, id)
+		u.login, u.Nickanme, u.password, u.ip, u.Lang, u.Theme, u.Themes, u.vkCookies, u.VkUser, u.RemIP, u.Autoplay, u.IsAdmin, u.ID)
 }
 
 func (w *DBWorker) AddTrack(t *DBTrack) (sql.Result, *DBWorkerError) {
 	query := `
-		INSERT INTO music (md5, artist, title, has_image, lyrics, timestamp, duration)
-		VALUES(?1,?2,?3,?4,?5,?6,?7) 
+		INSERT INTO music (md5, artist, title, has_image, lyrics, timestamp, duration, format, mime,
+			album, album_artist, track_number, disc_number, year, genre, artist_id, album_id,
+			loudness, track_gain, track_peak, album_gain, album_peak, gain_source, album_gain_tagged,
+			path, file_size, file_mtime)
+		VALUES(?1,?2,?3,?4,?5,?6,?7,?8,?9,?10,?11,?12,?13,?14,?15,?16,?17,?18,?19,?20,?21,?22,?23,?24,?25,?26,?27) 
 		ON CONFLICT(md5) DO UPDATE SET
 		artist = ?2,
 		title = ?3,
 		has_image = ?4,
 		lyrics = ?5,
 		timestamp = ?6,
-		duration = ?7
+		duration = ?7,
+		format = ?8,
+		mime = ?9,
+		album = ?10,
+		album_artist = ?11,
+		track_number = ?12,
+		disc_number = ?13,
+		year = ?14,
+		genre = ?15,
+		artist_id = ?16,
+		album_id = ?17,
+		loudness = ?18,
+		track_gain = ?19,
+		track_peak = ?20,
+		album_gain = ?21,
+		album_peak = ?22,
+		gain_source = ?23,
+		album_gain_tagged = ?24,
+		path = ?25,
+		file_size = ?26,
+		file_mtime = ?27
 	`
 
-	res, err := w.conn.Exec(query, t.Md5, t.Artist, t.Title, t.HasImage, t.Lyrics, t.Timestamp, t.Duration)
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("adding track ", t)}
+	}
+
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM music WHERE md5 = ?", t.Md5).Scan(&exists)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, &DBWorkerError{err, query, fmt.Sprint("adding track ", t)}
+	}
+
+	if dbErr := linkTrack(tx, t); dbErr != nil {
+		tx.Rollback()
+		return nil, dbErr
+	}
+
+	res, err := tx.Exec(query, t.Md5, t.Artist, t.Title, t.HasImage, t.Lyrics, t.Timestamp, t.Duration, t.Format, t.Mime,
+		t.Album, t.AlbumArtist, t.TrackNumber, t.DiscNumber, t.Year, t.Genre, t.ArtistID, t.AlbumID,
+		t.Loudness, t.TrackGain, t.TrackPeak, t.AlbumGain, t.AlbumPeak, t.GainSource, t.albumGainTagged,
+		t.path, t.fileSize, t.fileModTime)
 
 	if err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprint("adding track ", t)}
+	}
+
+	if w.fts {
+		query = `
+			DELETE FROM music_fts
+			WHERE md5 = ?
+		`
+
+		_, err = tx.Exec(query, t.Md5)
+
+		if err == nil {
+			query = `
+				INSERT INTO music_fts (md5, artist, title, album, lyrics)
+				VALUES(?,?,?,?,?)
+			`
+
+			_, err = tx.Exec(query, t.Md5, t.Artist, t.Title, t.Album, t.Lyrics)
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return res, &DBWorkerError{err, query, fmt.Sprint("indexing track ", t)}
+		}
+	}
+
+	if t.fingerprint != nil {
+		query = `
+			INSERT OR REPLACE INTO fingerprints (md5, data)
+			VALUES(?,?)
+		`
+
+		if _, err = tx.Exec(query, t.Md5, encodeFingerprint(t.fingerprint)); err != nil {
+			tx.Rollback()
+			return res, &DBWorkerError{err, query, fmt.Sprint("adding fingerprint of track ", t.Md5)}
+		}
+	}
+
+	action := libChangeAdd
+
+	if exists > 0 {
+		action = libChangeUpdate
+	}
+
+	if dbErr := recordLibChange(tx, t.Md5, action); dbErr != nil {
+		tx.Rollback()
+		return res, dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
 		return res, &DBWorkerError{err, query, fmt.Sprint("adding track ", t)}
 	}
 
@@ -198,12 +314,7 @@ func (w *DBWorker) AddTrack(t *DBTrack) (sql.Result, *DBWorkerError) {
 }
 
 func (w *DBWorker) RemoveTrack(hash string) (sql.Result, *DBWorkerError) {
-	query := `
-		DELETE FROM music
-		WHERE md5 = ?
-	`
-
-	return w.Exec(query, fmt.Sprint("removing track ", hash), hash)
+	return w.RemoveTracks([]interface{}{hash})
 }
 
 func (w *DBWorker) RemoveTracks(hashes []interface{}) (sql.Result, *DBWorkerError) {
@@ -212,311 +323,2120 @@ func (w *DBWorker) RemoveTracks(hashes []interface{}) (sql.Result, *DBWorkerErro
 		WHERE md5 IN (%v?)
 	`, strings.Repeat("?,", len(hashes)-1))
 
-	return w.Exec(query, fmt.Sprintf("removing tracks: %v", hashes), hashes...)
-}
+	tx, err := w.conn.Begin()
 
-func (w *DBWorker) ClearLib() (sql.Result, *DBWorkerError) {
-	query := `
-		DELETE FROM music
-	`
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprintf("removing tracks: %v", hashes)}
+	}
 
-	return w.Exec(query, "clearing library")
-}
+	res, err := tx.Exec(query, hashes...)
 
-func (w *DBWorker) AddPlaylist(p *DBPlaylist) (sql.Result, *DBWorkerError) {
-	query := `
-		INSERT INTO playlists (name, owner_id, tracks)
-		VALUES(?,?,?)
-	`
+	if err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprintf("removing tracks: %v", hashes)}
+	}
 
-	return w.Exec(query, fmt.Sprint("adding playlist ", p), p.Name, p.ownerID, p.Tracks)
-}
+	if w.fts {
+		query = fmt.Sprintf(`
+			DELETE FROM music_fts
+			WHERE md5 IN (%v?)
+		`, strings.Repeat("?,", len(hashes)-1))
 
-func (w *DBWorker) UpdatePlaylist(p *DBPlaylist) (sql.Result, *DBWorkerError) {
-	query := `
-		UPDATE playlists
-		SET name = ?,
-			tracks = ?
-		WHERE id = ?
-	`
+		if _, err = tx.Exec(query, hashes...); err != nil {
+			tx.Rollback()
+			return res, &DBWorkerError{err, query, fmt.Sprintf("removing tracks from search index: %v", hashes)}
+		}
+	}
 
-	return w.Exec(query, fmt.Sprint("updating playlist ", p), p.Name, p.Tracks, p.ID)
-}
+	query = fmt.Sprintf(`
+		DELETE FROM fingerprints
+		WHERE md5 IN (%v?)
+	`, strings.Repeat("?,", len(hashes)-1))
 
-func (w *DBWorker) RemovePlaylist(id int) (sql.Result, *DBWorkerError) {
-	query := `
-		DELETE FROM playlists
-		WHERE id = ?
-	`
+	if _, err = tx.Exec(query, hashes...); err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprintf("removing fingerprints: %v", hashes)}
+	}
 
-	return w.Exec(query, fmt.Sprint("removing playlist ", id), id)
+	for _, h := range hashes {
+		if dbErr := recordLibChange(tx, fmt.Sprint(h), libChangeRemove); dbErr != nil {
+			tx.Rollback()
+			return res, dbErr
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return res, &DBWorkerError{err, query, fmt.Sprintf("removing tracks: %v", hashes)}
+	}
+
+	return res, nil
 }
 
-func (w *DBWorker) SetUserNickname(id int, nickname string) (sql.Result, *DBWorkerError) {
+func (w *DBWorker) ClearLib() (sql.Result, *DBWorkerError) {
 	query := `
-		UPDATE users
-			SET nickname = ?
-		WHERE id = ?
+		DELETE FROM music
 	`
 
-	return w.Exec(query, fmt.Sprintf("updating user [%v] nickname to: %v", id, nickname), nickname, id)
+	res, dbErr := w.Exec(query, "clearing library")
+
+	if dbErr != nil {
+		return res, dbErr
+	}
+
+	if w.fts {
+		if _, dbErr = w.Exec(`DELETE FROM music_fts`, "clearing search index"); dbErr != nil {
+			return res, dbErr
+		}
+	}
+
+	if _, dbErr = w.Exec(`DELETE FROM library_changes`, "clearing library changes"); dbErr != nil {
+		return res, dbErr
+	}
+
+	return res, recordLibChange(w.conn, "", libChangeReset)
 }
 
-func (w *DBWorker) SetUserTheme(id int, theme string) (sql.Result, *DBWorkerError) {
-	query := `
-		UPDATE users
-			SET theme = ?
-		WHERE id = ?
-	`
+const (
+	libChangeAdd    string = "add"
+	libChangeUpdate string = "update"
+	libChangeRemove string = "remove"
+	libChangeReset  string = "reset"
+)
 
-	return w.Exec(query, fmt.Sprintf("updating user [%v] theme to: \"%v\"", id, theme), theme, id)
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
-func (w *DBWorker) SetUserThemes(id int, themes, theme string) (sql.Result, *DBWorkerError) {
+// recordLibChange bumps the library revision. Only the latest change of
+// every track is kept, so the table never outgrows the library itself
+func recordLibChange(e sqlExecer, hash, action string) *DBWorkerError {
 	query := `
-		UPDATE users
-			SET themes = ?,
-				theme = ?
-		WHERE id = ?
+		DELETE FROM library_changes
+		WHERE md5 = ?
 	`
 
-	return w.Exec(query, fmt.Sprintf("updating user [%v] themes list", id), themes, theme, id)
-}
+	if _, err := e.Exec(query, hash); err != nil {
+		return &DBWorkerError{err, query, fmt.Sprintf("recording library change %v of %v", action, hash)}
+	}
 
-func (w *DBWorker) SetUserAdmin(id int, state bool) (sql.Result, *DBWorkerError) {
-	query := `
-		UPDATE users
-			SET is_admin = ?
-		WHERE id = ?
+	query = `
+		INSERT INTO library_changes (md5, action)
+		VALUES(?,?)
 	`
 
-	return w.Exec(query, fmt.Sprintf("updating user [%v] is_admin flag to: %v", id, state), state, id)
+	if _, err := e.Exec(query, hash, action); err != nil {
+		return &DBWorkerError{err, query, fmt.Sprintf("recording library change %v of %v", action, hash)}
+	}
+
+	return nil
 }
 
-func (w *DBWorker) GetUserByCreds(login, password string) (*DBUser, *DBWorkerError) {
+func (w *DBWorker) GetLibRevision() (int, *DBWorkerError) {
 	query := `
-		SELECT * FROM users
-		WHERE login = ?
-		AND password = ?
+		SELECT COALESCE(MAX(revision), 0) FROM library_changes
 	`
 
-	u := &DBUser{}
-	err := w.conn.QueryRow(query, login, password).
-		Scan(&u.ID, &u.login, &u.Nickanme, &u.password, &u.sessionHash, &u.ip, &u.Lang, &u.Theme, &u.Themes, &u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin)
+	var rev int
+	err := w.conn.QueryRow(query).Scan(&rev)
 
 	if err != nil {
-		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user ", login)}
+		return 0, &DBWorkerError{err, query, "getting library revision"}
 	}
 
-	return u, nil
+	return rev, nil
 }
 
-func (w *DBWorker) GetUser(id int) (*DBUser, *DBWorkerError) {
-	query := `
-		SELECT * FROM users
-		WHERE id = ?
-	`
+// GetLibChanges returns tracks added, updated or removed after the given
+// revision. Reset is set when the client has to download the whole library
+func (w *DBWorker) GetLibChanges(since int) (*DBLibChanges, *DBWorkerError) {
+	changes := &DBLibChanges{
+		Tracks:  []*DBTrack{},
+		Removed: []string{},
+	}
 
-	u := &DBUser{}
-	err := w.conn.QueryRow(query, id).
-		Scan(&u.ID, &u.login, &u.Nickanme, &u.password, &u.sessionHash, &u.ip, &u.Lang, &u.Theme, &u.Themes, &u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin)
+	tx, err := w.conn.Begin()
 
 	if err != nil {
-		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user ", id)}
+		return nil, &DBWorkerError{err, "", fmt.Sprint("getting library changes since ", since)}
 	}
 
-	return u, nil
-}
+	defer tx.Rollback()
 
-func (w *DBWorker) GetUserByHash(hash string) (*DBUser, *DBWorkerError) {
 	query := `
-		SELECT * FROM users
-		WHERE session_hash = ?
+		SELECT COALESCE(MAX(revision), 0),
+			COUNT(CASE WHEN action = ?1 AND revision > ?2 THEN 1 END)
+		FROM library_changes
 	`
 
-	u := &DBUser{}
-	err := w.conn.QueryRow(query, hash).
-		Scan(&u.ID, &u.login, &u.Nickanme, &u.password, &u.sessionHash, &u.ip, &u.Lang, &u.Theme, &u.Themes, &u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin)
+	var resets int
+	err = tx.QueryRow(query, libChangeReset, since).Scan(&changes.Revision, &resets)
 
 	if err != nil {
-		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user by hash ", hash)}
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting library changes since ", since)}
 	}
 
-	return u, nil
-}
+	if resets > 0 || since > changes.Revision {
+		changes.Reset = true
+		return changes, nil
+	}
 
-func (w *DBWorker) GetUsers() ([]*DBUser, *DBWorkerError) {
-	query := `
-		SELECT id, nickname, is_admin FROM users
+	query = `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE md5 IN (
+			SELECT md5 FROM library_changes
+			WHERE revision > ?
+			AND action IN (?,?)
+		)
 	`
 
-	result := []*DBUser{}
-
-	rows, err := w.conn.Query(query)
+	rows, err := tx.Query(query, since, libChangeAdd, libChangeUpdate)
 
 	if err != nil {
-		return result, &DBWorkerError{err, query, fmt.Sprint("getting users")}
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting library changes since ", since)}
 	}
 
 	for rows.Next() {
-		u := &DBUser{}
-		err = rows.
-			Scan(&u.ID, &u.Nickanme, &u.IsAdmin)
-			//Scan(&u.ID, &u.login, &u.Nickanme, &u.password, &u.sessionHash, &u.ip, &u.Lang, &u.Theme, &u.Themes, &u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin)
+		t := &DBTrack{}
 
-		if err != nil {
-			return result, &DBWorkerError{err, query, fmt.Sprint("getting users")}
+		if err = scanTrack(rows, t); err != nil {
+			rows.Close()
+			return nil, &DBWorkerError{err, query, fmt.Sprint("getting library changes since ", since)}
 		}
 
-		result = append(result, u)
+		changes.Tracks = append(changes.Tracks, t)
 	}
 
-	return result, nil
-}
+	rows.Close()
 
-func (w *DBWorker) GetUserByLogin(login string) (*DBUser, *DBWorkerError) {
-	query := `
-		SELECT * FROM users
-		WHERE login = ?
+	query = `
+		SELECT md5 FROM library_changes
+		WHERE revision > ?
+		AND action = ?
 	`
 
-	u := &DBUser{}
-	err := w.conn.QueryRow(query, login).
-		Scan(&u.ID, &u.login, &u.Nickanme, &u.password, &u.sessionHash, &u.ip, &u.Lang, &u.Theme, &u.Themes, &u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin)
+	rows, err = tx.Query(query, since, libChangeRemove)
 
 	if err != nil {
-		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user by login ", login)}
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting library changes since ", since)}
 	}
 
-	return u, nil
-}
+	defer rows.Close()
 
-func (w *DBWorker) GetTrack(hash string) (*DBTrack, *DBWorkerError) {
-	query := `
-		SELECT * FROM music
-		WHERE md5 = ?
-	`
+	for rows.Next() {
+		var hash string
 
-	t := &DBTrack{}
-	err := w.conn.QueryRow(query, hash).Scan(&t.Md5, &t.Artist, &t.Title, &t.HasImage, &t.Lyrics, &t.Timestamp, &t.Duration)
+		if err = rows.Scan(&hash); err != nil {
+			return nil, &DBWorkerError{err, query, fmt.Sprint("getting library changes since ", since)}
+		}
 
-	if err != nil {
-		return nil, &DBWorkerError{err, query, fmt.Sprint("getting track by hash ", hash)}
+		changes.Removed = append(changes.Removed, hash)
 	}
 
-	return t, nil
+	return changes, nil
 }
 
-func (w *DBWorker) GetTracks() (map[string]*DBTrack, *DBWorkerError) {
+// GetTracksPage lists tracks ordered by md5 starting after the cursor, which
+// is the md5 of the last track of the previous page
+func (w *DBWorker) GetTracksPage(cursor string, limit int) ([]*DBTrack, *DBWorkerError) {
 	query := `
-		SELECT * FROM music
-		ORDER BY timestamp DESC
+		SELECT ` + trackColumns + ` FROM music
+		WHERE md5 > ?
+		ORDER BY md5
+		LIMIT ?
 	`
 
-	result := make(map[string]*DBTrack, 0)
-	rows, err := w.conn.Query(query)
+	return w.queryTracks(query, fmt.Sprintf("getting tracks page after %v", cursor), cursor, limit)
+}
 
-	if err != nil {
-		return result, &DBWorkerError{err, query, fmt.Sprint("getting tracks")}
+// buildSearchQuery turns user input into an FTS5 query where every word is
+// a quoted prefix term, so the input can never break the MATCH syntax
+func buildSearchQuery(input string) string {
+	terms := []string{}
+
+	for _, word := range strings.Fields(input) {
+		terms = append(terms, fmt.Sprintf("\"%v\"*", strings.Replace(word, "\"", "\"\"", -1)))
 	}
 
-	for rows.Next() {
-		t := &DBTrack{}
-		err = rows.Scan(&t.Md5, &t.Artist, &t.Title, &t.HasImage, &t.Lyrics, &t.Timestamp, &t.Duration)
+	return strings.Join(terms, " ")
+}
 
-		if err != nil {
-			return result, &DBWorkerError{err, query, fmt.Sprint("getting tracks")}
-		}
+func (w *DBWorker) SearchTracks(input string, offset, limit int) ([]*DBSearchResult, int, *DBWorkerError) {
+	result := []*DBSearchResult{}
+	match := buildSearchQuery(input)
 
-		result[t.Md5] = t
-	}
+	query := `
+		SELECT COUNT(*) FROM music_fts
+		WHERE music_fts MATCH ?
+	`
 
-	return result, nil
-}
+	var total int
+	err := w.conn.QueryRow(query, match).Scan(&total)
 
-func (w *DBWorker) GetTracksByHashes(hashes []interface{}) ([]*DBTrack, *DBWorkerError) {
-	query := fmt.Sprintf(`
-		SELECT * FROM music
-		WHERE md5 IN (%v?)
-	`, strings.Repeat("?,", len(hashes)-1))
+	if err != nil {
+		return result, 0, &DBWorkerError{err, query, fmt.Sprint("counting search results for ", input)}
+	}
 
-	result := []*DBTrack{}
-	rows, err := w.conn.Query(query, hashes...)
+	query = `
+		SELECT ` + trackColumns + `, f.hl_artist, f.hl_title, f.hl_album, f.hl_lyrics, f.score FROM music
+		JOIN (
+			SELECT md5 AS fts_md5,
+				highlight(music_fts, 1, ?1, ?2) AS hl_artist,
+				highlight(music_fts, 2, ?1, ?2) AS hl_title,
+				highlight(music_fts, 3, ?1, ?2) AS hl_album,
+				snippet(music_fts, 4, ?1, ?2, '...', 12) AS hl_lyrics,
+				bm25(music_fts, 0.0, 10.0, 10.0, 5.0, 1.0) AS score
+			FROM music_fts
+			WHERE music_fts MATCH ?3
+		) f ON f.fts_md5 = music.md5
+		ORDER BY f.score
+		LIMIT ?4 OFFSET ?5
+	`
+
+	rows, err := w.conn.Query(query, searchMarkOpen, searchMarkClose, match, limit, offset)
 
 	if err != nil {
-		return result, &DBWorkerError{err, query, fmt.Sprintf("getting tracks by hashes: %v", hashes)}
+		return result, total, &DBWorkerError{err, query, fmt.Sprint("searching tracks for ", input)}
 	}
 
+	defer rows.Close()
+
 	for rows.Next() {
 		t := &DBTrack{}
-		err := rows.Scan(&t.Md5, &t.Artist, &t.Title, &t.HasImage, &t.Lyrics, &t.Timestamp, &t.Duration)
+		r := &DBSearchResult{Track: t}
+
+		err = rows.Scan(append(trackFields(t), &r.Artist, &r.Title, &r.Album, &r.Lyrics, &r.Rank)...)
+		t.External = len(t.path) > 0
 
 		if err != nil {
-			return result, &DBWorkerError{err, query, fmt.Sprintf("getting tracks by hashes: %v", hashes)}
+			return result, total, &DBWorkerError{err, query, fmt.Sprint("searching tracks for ", input)}
 		}
 
-		result = append(result, t)
+		result = append(result, r)
 	}
 
-	return result, nil
+	return result, total, nil
 }
 
-func (w *DBWorker) GetPlaylists(owner_id int) ([]*DBPlaylist, *DBWorkerError) {
+func (w *DBWorker) AddPlaylist(p *DBPlaylist) (sql.Result, *DBWorkerError) {
 	query := `
-		SELECT * FROM playlists 
-		WHERE owner_id = ?
+		INSERT INTO playlists (name, owner_id)
+		VALUES(?,?)
 	`
 
-	result := []*DBPlaylist{}
-	rows, err := w.conn.Query(query, owner_id)
+	tx, err := w.conn.Begin()
 
 	if err != nil {
-		return result, &DBWorkerError{err, query, fmt.Sprint("getting playlists of user ", owner_id)}
+		return nil, &DBWorkerError{err, query, fmt.Sprint("adding playlist ", p)}
 	}
 
-	for rows.Next() {
-		p := &DBPlaylist{}
-		err := rows.Scan(&p.ID, &p.Name, &p.ownerID, &p.Tracks)
+	res, err := tx.Exec(query, p.Name, p.ownerID)
 
-		if err != nil {
-			return result, &DBWorkerError{err, query, fmt.Sprint("getting playlists of user ", owner_id)}
-		}
+	if err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprint("adding playlist ", p)}
+	}
 
-		result = append(result, p)
+	id, _ := res.LastInsertId()
+
+	if dbErr := insertPlaylistTracks(tx, int(id), 0, p.Tracks); dbErr != nil {
+		tx.Rollback()
+		return res, dbErr
 	}
 
-	return result, nil
+	if err = tx.Commit(); err != nil {
+		return res, &DBWorkerError{err, query, fmt.Sprint("adding playlist ", p)}
+	}
+
+	return res, nil
 }
 
-func (w *DBWorker) GetPlaylist(id int) (*DBPlaylist, *DBWorkerError) {
+// UpdatePlaylist stores the name and replaces all tracks of the playlist
+func (w *DBWorker) UpdatePlaylist(p *DBPlaylist) (sql.Result, *DBWorkerError) {
 	query := `
-		SELECT * FROM playlists
+		UPDATE playlists
+		SET name = ?
 		WHERE id = ?
 	`
 
-	p := &DBPlaylist{}
-	err := w.conn.QueryRow(query, id).Scan(&p.ID, &p.Name, &p.ownerID, &p.Tracks)
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("updating playlist ", p)}
+	}
+
+	res, err := tx.Exec(query, p.Name, p.ID)
+
+	if err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprint("updating playlist ", p)}
+	}
+
+	query = `
+		DELETE FROM playlist_tracks
+		WHERE playlist_id = ?
+	`
+
+	if _, err = tx.Exec(query, p.ID); err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprint("updating playlist ", p)}
+	}
+
+	if dbErr := insertPlaylistTracks(tx, p.ID, 0, p.Tracks); dbErr != nil {
+		tx.Rollback()
+		return res, dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return res, &DBWorkerError{err, query, fmt.Sprint("updating playlist ", p)}
+	}
+
+	return res, nil
+}
+
+func (w *DBWorker) RenamePlaylist(id int, name string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE playlists
+		SET name = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("renaming playlist %v to %v", id, name), name, id)
+}
+
+type sqlQueryer interface {
+	sqlExecer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// insertPlaylistTracks writes hashes as consecutive positions starting at
+// position, which has to be free
+func insertPlaylistTracks(tx sqlExecer, playlistID, position int, hashes []string) *DBWorkerError {
+	query := `
+		INSERT INTO playlist_tracks (playlist_id, position, md5)
+		VALUES(?,?,?)
+	`
+
+	for i, h := range hashes {
+		if _, err := tx.Exec(query, playlistID, position+i, h); err != nil {
+			return &DBWorkerError{err, query, fmt.Sprintf("adding track %v to playlist %v", h, playlistID)}
+		}
+	}
+
+	return nil
+}
+
+// playlistPositions returns the positions of the tracks of a playlist in
+// their order
+func playlistPositions(tx sqlQueryer, playlistID int) ([]int, *DBWorkerError) {
+	query := `
+		SELECT position FROM playlist_tracks
+		WHERE playlist_id = ?
+		ORDER BY position
+	`
+
+	rows, err := tx.Query(query, playlistID)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting track positions of playlist ", playlistID)}
+	}
+
+	defer rows.Close()
+
+	positions := make([]int, 0)
+
+	for rows.Next() {
+		var pos int
+
+		if err = rows.Scan(&pos); err != nil {
+			return nil, &DBWorkerError{err, query, fmt.Sprint("getting track positions of playlist ", playlistID)}
+		}
+
+		positions = append(positions, pos)
+	}
+
+	return positions, nil
+}
+
+// insertPlaylistTracksAt puts hashes before the track at index, or after
+// the last one when index is past the end
+func insertPlaylistTracksAt(tx sqlQueryer, playlistID, index int, hashes []string) *DBWorkerError {
+	positions, dbErr := playlistPositions(tx, playlistID)
+
+	if dbErr != nil {
+		return dbErr
+	}
+
+	if index >= len(positions) {
+		next := 0
+
+		if len(positions) > 0 {
+			next = positions[len(positions)-1] + 1
+		}
+
+		return insertPlaylistTracks(tx, playlistID, next, hashes)
+	}
+
+	// only the tracks after the insertion point move
+	query := `
+		UPDATE playlist_tracks
+		SET position = position + ?
+		WHERE playlist_id = ?
+		AND position >= ?
+	`
+
+	if _, err := tx.Exec(query, len(hashes), playlistID, positions[index]); err != nil {
+		return &DBWorkerError{err, query, fmt.Sprint("making room in playlist ", playlistID)}
+	}
+
+	return insertPlaylistTracks(tx, playlistID, positions[index], hashes)
+}
+
+// InsertPlaylistTracks adds tracks at index, hashes must not be in the
+// playlist already
+func (w *DBWorker) InsertPlaylistTracks(playlistID, index int, hashes []string) *DBWorkerError {
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return &DBWorkerError{err, "", fmt.Sprint("inserting tracks into playlist ", playlistID)}
+	}
+
+	if dbErr := insertPlaylistTracksAt(tx, playlistID, index, hashes); dbErr != nil {
+		tx.Rollback()
+		return dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &DBWorkerError{err, "", fmt.Sprint("inserting tracks into playlist ", playlistID)}
+	}
+
+	return nil
+}
+
+func removePlaylistRange(tx sqlQueryer, playlistID, from, count int) ([]string, *DBWorkerError) {
+	positions, dbErr := playlistPositions(tx, playlistID)
+
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	if from < 0 || count < 1 || from+count > len(positions) {
+		return nil, &DBWorkerError{fmt.Errorf("range %v+%v is out of %v tracks", from, count, len(positions)), "", fmt.Sprint("removing tracks of playlist ", playlistID)}
+	}
+
+	query := `
+		SELECT md5 FROM playlist_tracks
+		WHERE playlist_id = ?
+		AND position BETWEEN ? AND ?
+		ORDER BY position
+	`
+
+	rows, err := tx.Query(query, playlistID, positions[from], positions[from+count-1])
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("removing tracks of playlist ", playlistID)}
+	}
+
+	hashes := make([]string, 0, count)
+
+	for rows.Next() {
+		var h string
+
+		if err = rows.Scan(&h); err != nil {
+			rows.Close()
+			return nil, &DBWorkerError{err, query, fmt.Sprint("removing tracks of playlist ", playlistID)}
+		}
+
+		hashes = append(hashes, h)
+	}
+
+	rows.Close()
+
+	query = `
+		DELETE FROM playlist_tracks
+		WHERE playlist_id = ?
+		AND position BETWEEN ? AND ?
+	`
+
+	if _, err = tx.Exec(query, playlistID, positions[from], positions[from+count-1]); err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("removing tracks of playlist ", playlistID)}
+	}
+
+	return hashes, nil
+}
+
+// RemovePlaylistTracks removes count tracks starting at index from
+func (w *DBWorker) RemovePlaylistTracks(playlistID, from, count int) *DBWorkerError {
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return &DBWorkerError{err, "", fmt.Sprint("removing tracks of playlist ", playlistID)}
+	}
+
+	if _, dbErr := removePlaylistRange(tx, playlistID, from, count); dbErr != nil {
+		tx.Rollback()
+		return dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &DBWorkerError{err, "", fmt.Sprint("removing tracks of playlist ", playlistID)}
+	}
+
+	return nil
+}
+
+// MovePlaylistTracks moves count tracks starting at index from so the first
+// of them ends up at index to
+func (w *DBWorker) MovePlaylistTracks(playlistID, from, count, to int) *DBWorkerError {
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return &DBWorkerError{err, "", fmt.Sprint("moving tracks of playlist ", playlistID)}
+	}
+
+	hashes, dbErr := removePlaylistRange(tx, playlistID, from, count)
+
+	if dbErr == nil {
+		dbErr = insertPlaylistTracksAt(tx, playlistID, to, hashes)
+	}
+
+	if dbErr != nil {
+		tx.Rollback()
+		return dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &DBWorkerError{err, "", fmt.Sprint("moving tracks of playlist ", playlistID)}
+	}
+
+	return nil
+}
+
+func (w *DBWorker) RemovePlaylist(id int) (sql.Result, *DBWorkerError) {
+	query := `
+		DELETE FROM playlists
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprint("removing playlist ", id), id)
+}
+
+func (w *DBWorker) SetUserNickname(id int, nickname string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET nickname = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] nickname to: %v", id, nickname), nickname, id)
+}
+
+func (w *DBWorker) SetUserTheme(id int, theme string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET theme = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] theme to: \"%v\"", id, theme), theme, id)
+}
+
+func (w *DBWorker) SetUserThemes(id int, themes, theme string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET themes = ?,
+				theme = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] themes list", id), themes, theme, id)
+}
+
+func (w *DBWorker) SetUserPassword(id int, password string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET password = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] password", id), password, id)
+}
+
+func (w *DBWorker) SetUserIP(id int, ip string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET ip = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] ip to: %v", id, ip), ip, id)
+}
+
+func (w *DBWorker) SetUserRemIPAlert(id int, alert string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET rem_ip_alert = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] rem_ip alert", id), alert, id)
+}
+
+func (w *DBWorker) SetUserSubsonicPassword(id int, password string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET subsonic_password = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] subsonic password", id), password, id)
+}
+
+func (w *DBWorker) SetUserAdmin(id int, state bool) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE users
+			SET is_admin = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating user [%v] is_admin flag to: %v", id, state), state, id)
+}
+
+// GetUserByCreds checks the plain password against the stored hash of any
+// supported algorithm. A wrong password is reported as sql.ErrNoRows
+func (w *DBWorker) GetUserByCreds(login, password string) (*DBUser, *DBWorkerError) {
+	query := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE login = ?
+	`
+
+	u := &DBUser{}
+	err := w.conn.QueryRow(query, login).
+		Scan(userFields(u)...)
+
+	if err == nil && !verifyPassword(u.password, password) {
+		err = sql.ErrNoRows
+	}
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user ", login)}
+	}
+
+	return u, nil
+}
+
+func (w *DBWorker) GetUser(id int) (*DBUser, *DBWorkerError) {
+	query := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE id = ?
+	`
+
+	u := &DBUser{}
+	err := w.conn.QueryRow(query, id).
+		Scan(userFields(u)...)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user ", id)}
+	}
+
+	return u, nil
+}
+
+func (w *DBWorker) GetUsers() ([]*DBUser, *DBWorkerError) {
+	query := `
+		SELECT id, nickname, is_admin FROM users
+	`
+
+	result := []*DBUser{}
+
+	rows, err := w.conn.Query(query)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, fmt.Sprint("getting users")}
+	}
+
+	for rows.Next() {
+		u := &DBUser{}
+		err = rows.
+			Scan(&u.ID, &u.Nickanme, &u.IsAdmin)
+			//Scan(&u.ID, &u.login, &u.Nickanme, &u.password, &u.ip, &u.Lang, &u.Theme, &u.Themes, &u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin)
+
+		if err != nil {
+			return result, &DBWorkerError{err, query, fmt.Sprint("getting users")}
+		}
+
+		result = append(result, u)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) GetUserByLogin(login string) (*DBUser, *DBWorkerError) {
+	query := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE login = ?
+	`
+
+	u := &DBUser{}
+	err := w.conn.QueryRow(query, login).
+		Scan(userFields(u)...)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting user by login ", login)}
+	}
+
+	return u, nil
+}
+
+func (w *DBWorker) GetTrack(hash string) (*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE md5 = ?
+	`
+
+	t := &DBTrack{}
+	err := scanTrack(w.conn.QueryRow(query, hash), t)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting track by hash ", hash)}
+	}
+
+	return t, nil
+}
+
+// userFields returns scan destinations in the order of userColumns
+func userFields(u *DBUser) []interface{} {
+	return []interface{}{&u.ID, &u.login, &u.Nickanme, &u.password, &u.ip, &u.Lang, &u.Theme, &u.Themes,
+		&u.vkCookies, &u.VkUser, &u.RemIP, &u.Autoplay, &u.IsAdmin, &u.subsonicPassword, &u.remIPAlert}
+}
+
+// trackFields returns scan destinations in the order of trackColumns
+func trackFields(t *DBTrack) []interface{} {
+	return []interface{}{&t.Md5, &t.Artist, &t.Title, &t.HasImage, &t.Lyrics, &t.Timestamp, &t.Duration, &t.Format, &t.Mime,
+		&t.Album, &t.AlbumArtist, &t.TrackNumber, &t.DiscNumber, &t.Year, &t.Genre, &t.ArtistID, &t.AlbumID,
+		&t.Loudness, &t.TrackGain, &t.TrackPeak, &t.AlbumGain, &t.AlbumPeak, &t.GainSource, &t.albumGainTagged,
+		&t.path, &t.fileSize, &t.fileModTime}
+}
+
+func scanTrack(r rowScanner, t *DBTrack) error {
+	err := r.Scan(trackFields(t)...)
+	t.External = len(t.path) > 0
+
+	return err
+}
+
+func (w *DBWorker) GetTracks() (map[string]*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		ORDER BY timestamp DESC
+	`
+
+	result := make(map[string]*DBTrack, 0)
+	rows, err := w.conn.Query(query)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, fmt.Sprint("getting tracks")}
+	}
+
+	for rows.Next() {
+		t := &DBTrack{}
+		err = scanTrack(rows, t)
+
+		if err != nil {
+			return result, &DBWorkerError{err, query, fmt.Sprint("getting tracks")}
+		}
+
+		result[t.Md5] = t
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) GetTracksByHashes(hashes []interface{}) ([]*DBTrack, *DBWorkerError) {
+	query := fmt.Sprintf(`
+		SELECT %v FROM music
+		WHERE md5 IN (%v?)
+	`, trackColumns, strings.Repeat("?,", len(hashes)-1))
+
+	result := []*DBTrack{}
+	rows, err := w.conn.Query(query, hashes...)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, fmt.Sprintf("getting tracks by hashes: %v", hashes)}
+	}
+
+	for rows.Next() {
+		t := &DBTrack{}
+		err := scanTrack(rows, t)
+
+		if err != nil {
+			return result, &DBWorkerError{err, query, fmt.Sprintf("getting tracks by hashes: %v", hashes)}
+		}
+
+		result = append(result, t)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) GetPlaylists(owner_id int) ([]*DBPlaylist, *DBWorkerError) {
+	query := `
+		SELECT id, name, owner_id FROM playlists
+		WHERE owner_id = ?
+	`
+
+	result := []*DBPlaylist{}
+	rows, err := w.conn.Query(query, owner_id)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, fmt.Sprint("getting playlists of user ", owner_id)}
+	}
+
+	byID := make(map[int]*DBPlaylist, 0)
+
+	for rows.Next() {
+		p := &DBPlaylist{Tracks: []string{}}
+		err := rows.Scan(&p.ID, &p.Name, &p.ownerID)
+
+		if err != nil {
+			rows.Close()
+			return result, &DBWorkerError{err, query, fmt.Sprint("getting playlists of user ", owner_id)}
+		}
+
+		result = append(result, p)
+		byID[p.ID] = p
+	}
+
+	rows.Close()
+
+	query = `
+		SELECT pt.playlist_id, pt.md5 FROM playlist_tracks pt
+		JOIN playlists p ON p.id = pt.playlist_id
+		WHERE p.owner_id = ?
+		ORDER BY pt.playlist_id, pt.position
+	`
+
+	rows, err = w.conn.Query(query, owner_id)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, fmt.Sprint("getting playlist tracks of user ", owner_id)}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var hash string
+
+		if err = rows.Scan(&id, &hash); err != nil {
+			return result, &DBWorkerError{err, query, fmt.Sprint("getting playlist tracks of user ", owner_id)}
+		}
+
+		if p, ok := byID[id]; ok {
+			p.Tracks = append(p.Tracks, hash)
+		}
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) getPlaylistTracks(p *DBPlaylist) *DBWorkerError {
+	query := `
+		SELECT md5 FROM playlist_tracks
+		WHERE playlist_id = ?
+		ORDER BY position
+	`
+
+	rows, err := w.conn.Query(query, p.ID)
+
+	if err != nil {
+		return &DBWorkerError{err, query, fmt.Sprint("getting tracks of playlist ", p.ID)}
+	}
+
+	defer rows.Close()
+
+	p.Tracks = []string{}
+
+	for rows.Next() {
+		var hash string
+
+		if err = rows.Scan(&hash); err != nil {
+			return &DBWorkerError{err, query, fmt.Sprint("getting tracks of playlist ", p.ID)}
+		}
+
+		p.Tracks = append(p.Tracks, hash)
+	}
+
+	return nil
+}
+
+func (w *DBWorker) GetPlaylist(id int) (*DBPlaylist, *DBWorkerError) {
+	query := `
+		SELECT id, name, owner_id FROM playlists
+		WHERE id = ?
+	`
+
+	p := &DBPlaylist{}
+	err := w.conn.QueryRow(query, id).Scan(&p.ID, &p.Name, &p.ownerID)
 
 	if err != nil {
 		return nil, &DBWorkerError{err, query, fmt.Sprint("getting playlist ", id)}
 	}
 
-	return p, nil
+	if dbErr := w.getPlaylistTracks(p); dbErr != nil {
+		return nil, dbErr
+	}
+
+	return p, nil
+}
+
+func (w *DBWorker) GetLibraryPlaylist(owner_id int) (*DBPlaylist, *DBWorkerError) {
+	query := `
+		SELECT id, name, owner_id FROM playlists
+		WHERE owner_id = ?
+		AND name = ?
+	`
+
+	p := &DBPlaylist{}
+	err := w.conn.QueryRow(query, owner_id, config.AllPlaylistKey).Scan(&p.ID, &p.Name, &p.ownerID)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting library playlist of owner ", owner_id)}
+	}
+
+	if dbErr := w.getPlaylistTracks(p); dbErr != nil {
+		return nil, dbErr
+	}
+
+	return p, nil
+}
+
+type sqlRowQueryer interface {
+	sqlExecer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getOrAddArtist(q sqlRowQueryer, name string) (int, *DBWorkerError) {
+	query := `
+		INSERT INTO artists (name)
+		VALUES(?)
+		ON CONFLICT(name) DO NOTHING
+	`
+
+	if _, err := q.Exec(query, name); err != nil {
+		return 0, &DBWorkerError{err, query, fmt.Sprint("adding artist ", name)}
+	}
+
+	query = `
+		SELECT id FROM artists
+		WHERE name = ?
+	`
+
+	var id int
+	err := q.QueryRow(query, name).Scan(&id)
+
+	if err != nil {
+		return 0, &DBWorkerError{err, query, fmt.Sprint("getting artist ", name)}
+	}
+
+	return id, nil
+}
+
+func getOrAddAlbum(q sqlRowQueryer, artistID int, title string, year int) (int, *DBWorkerError) {
+	query := `
+		INSERT INTO albums (artist_id, title, year)
+		VALUES(?1,?2,?3)
+		ON CONFLICT(artist_id, title) DO UPDATE SET
+		year = CASE WHEN year = 0 THEN ?3 ELSE year END
+	`
+
+	if _, err := q.Exec(query, artistID, title, year); err != nil {
+		return 0, &DBWorkerError{err, query, fmt.Sprintf("adding album %v of artist %v", title, artistID)}
+	}
+
+	query = `
+		SELECT id FROM albums
+		WHERE artist_id = ?
+		AND title = ?
+	`
+
+	var id int
+	err := q.QueryRow(query, artistID, title).Scan(&id)
+
+	if err != nil {
+		return 0, &DBWorkerError{err, query, fmt.Sprintf("getting album %v of artist %v", title, artistID)}
+	}
+
+	return id, nil
+}
+
+// linkTrack resolves the artist and album rows of a track and stores their
+// ids on it. Tracks without an album tag are left with album_id 0. AddTrack
+// links in its own transaction, so removeOrphanAlbums can't remove an album
+// between its creation and the insert of its first track
+func linkTrack(q sqlRowQueryer, t *DBTrack) *DBWorkerError {
+	artistID, dbErr := getOrAddArtist(q, t.Artist)
+
+	if dbErr != nil {
+		return dbErr
+	}
+
+	t.ArtistID = artistID
+	t.AlbumID = 0
+
+	if len(t.Album) == 0 {
+		return nil
+	}
+
+	albumArtistID := artistID
+
+	if len(t.AlbumArtist) > 0 {
+		albumArtistID, dbErr = getOrAddArtist(q, t.AlbumArtist)
+
+		if dbErr != nil {
+			return dbErr
+		}
+	}
+
+	t.AlbumID, dbErr = getOrAddAlbum(q, albumArtistID, t.Album, t.Year)
+
+	return dbErr
+}
+
+func (w *DBWorker) SetAlbumImage(id int, state bool) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE albums
+			SET has_image = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("updating album [%v] has_image flag to: %v", id, state), state, id)
+}
+
+// SetTrackLoudness stores the track gain values found by analysis or tags
+func (w *DBWorker) SetTrackLoudness(t *DBTrack) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE music
+			SET loudness = ?,
+			track_gain = ?,
+			track_peak = ?,
+			album_gain = ?,
+			album_peak = ?,
+			gain_source = ?,
+			album_gain_tagged = ?
+		WHERE md5 = ?
+	`
+
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("setting loudness of track ", t)}
+	}
+
+	res, err := tx.Exec(query, t.Loudness, t.TrackGain, t.TrackPeak, t.AlbumGain, t.AlbumPeak, t.GainSource, t.albumGainTagged, t.Md5)
+
+	if err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprint("setting loudness of track ", t)}
+	}
+
+	if dbErr := recordLibChange(tx, t.Md5, libChangeUpdate); dbErr != nil {
+		tx.Rollback()
+		return res, dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return res, &DBWorkerError{err, query, fmt.Sprint("setting loudness of track ", t)}
+	}
+
+	return res, nil
+}
+
+// UpdateAlbumGain calculates the album loudness as the duration weighted
+// energy mean of its measured tracks and stores it for every track whose
+// album gain wasn't tagged. It returns the stored gain and peak
+func (w *DBWorker) UpdateAlbumGain(albumID int) (float64, float64, *DBWorkerError) {
+	query := `
+		SELECT loudness, duration, track_peak FROM music
+		WHERE album_id = ?
+		AND gain_source IN (?, ?)
+	`
+
+	errDesc := fmt.Sprint("updating gain of album ", albumID)
+	rows, err := w.conn.Query(query, albumID, gainSourceTags, gainSourceAnalysis)
+
+	if err != nil {
+		return 0, 0, &DBWorkerError{err, query, errDesc}
+	}
+
+	var energy, duration, peak float64
+
+	for rows.Next() {
+		var loudness, trackPeak float64
+		var trackDuration float32
+
+		if err = rows.Scan(&loudness, &trackDuration, &trackPeak); err != nil {
+			rows.Close()
+			return 0, 0, &DBWorkerError{err, query, errDesc}
+		}
+
+		d := math.Max(float64(trackDuration), 1)
+		energy += d * math.Pow(10, loudness/10)
+		duration += d
+		peak = math.Max(peak, trackPeak)
+	}
+
+	rows.Close()
+
+	var gain float64 = 0
+
+	if duration > 0 {
+		gain = replayGainReference - 10*math.Log10(energy/duration)
+	}
+
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return 0, 0, &DBWorkerError{err, query, errDesc}
+	}
+
+	query = `
+		SELECT md5 FROM music
+		WHERE album_id = ?
+		AND album_gain_tagged = 0
+		AND (album_gain != ? OR album_peak != ?)
+	`
+
+	rows, err = tx.Query(query, albumID, gain, peak)
+
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, &DBWorkerError{err, query, errDesc}
+	}
+
+	hashes := []string{}
+
+	for rows.Next() {
+		var hash string
+
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, 0, &DBWorkerError{err, query, errDesc}
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	rows.Close()
+
+	query = `
+		UPDATE music
+			SET album_gain = ?,
+			album_peak = ?
+		WHERE album_id = ?
+		AND album_gain_tagged = 0
+	`
+
+	if _, err = tx.Exec(query, gain, peak, albumID); err != nil {
+		tx.Rollback()
+		return 0, 0, &DBWorkerError{err, query, errDesc}
+	}
+
+	for _, hash := range hashes {
+		if dbErr := recordLibChange(tx, hash, libChangeUpdate); dbErr != nil {
+			tx.Rollback()
+			return 0, 0, dbErr
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, &DBWorkerError{err, query, errDesc}
+	}
+
+	return gain, peak, nil
+}
+
+func (w *DBWorker) GetTracksByGainSource(source string) ([]*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE gain_source = ?
+		ORDER BY timestamp
+	`
+
+	return w.queryTracks(query, fmt.Sprint("getting tracks with gain source ", source), source)
+}
+
+func (w *DBWorker) SetTrackFingerprint(hash string, fp []uint32) (sql.Result, *DBWorkerError) {
+	query := `
+		INSERT OR REPLACE INTO fingerprints (md5, data)
+		VALUES(?,?)
+	`
+
+	return w.Exec(query, fmt.Sprint("setting fingerprint of track ", hash), hash, encodeFingerprint(fp))
+}
+
+// GetFingerprints returns the fingerprints by track hash. Tracks that
+// couldn't be decoded have an empty one
+func (w *DBWorker) GetFingerprints() (map[string][]uint32, *DBWorkerError) {
+	query := `
+		SELECT md5, data FROM fingerprints
+	`
+
+	rows, err := w.conn.Query(query)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, "getting fingerprints"}
+	}
+
+	defer rows.Close()
+
+	result := make(map[string][]uint32, 0)
+
+	for rows.Next() {
+		var hash string
+		var data []byte
+
+		if err = rows.Scan(&hash, &data); err != nil {
+			return nil, &DBWorkerError{err, query, "scanning fingerprints"}
+		}
+
+		result[hash] = decodeFingerprint(data)
+	}
+
+	return result, nil
+}
+
+// MergePlaylistTracks points every playlist entry of removed tracks to keep.
+// A playlist lists keep only once, at its first position
+func (w *DBWorker) MergePlaylistTracks(keep string, removed []string) *DBWorkerError {
+	args := make([]interface{}, 0, len(removed)+1)
+	args = append(args, keep)
+
+	for _, h := range removed {
+		args = append(args, h)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT playlist_id, md5 FROM playlist_tracks
+		WHERE md5 IN (%v?)
+		ORDER BY playlist_id, position
+	`, strings.Repeat("?,", len(removed)))
+
+	errDesc := fmt.Sprintf("merging tracks %v into %v", removed, keep)
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return &DBWorkerError{err, query, errDesc}
+	}
+
+	rows, err := tx.Query(query, args...)
+
+	if err != nil {
+		tx.Rollback()
+		return &DBWorkerError{err, query, errDesc}
+	}
+
+	// the first of the merged tracks in every playlist
+	first := make(map[int]string, 0)
+
+	for rows.Next() {
+		var id int
+		var hash string
+
+		if err = rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return &DBWorkerError{err, query, errDesc}
+		}
+
+		if _, ok := first[id]; !ok {
+			first[id] = hash
+		}
+	}
+
+	rows.Close()
+
+	for id, hash := range first {
+		if hash == keep {
+			continue
+		}
+
+		query = `
+			DELETE FROM playlist_tracks
+			WHERE playlist_id = ?
+			AND md5 = ?
+		`
+
+		if _, err = tx.Exec(query, id, keep); err == nil {
+			query = `
+				UPDATE playlist_tracks
+				SET md5 = ?
+				WHERE playlist_id = ?
+				AND md5 = ?
+			`
+
+			_, err = tx.Exec(query, keep, id, hash)
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return &DBWorkerError{err, query, errDesc}
+		}
+	}
+
+	query = fmt.Sprintf(`
+		DELETE FROM playlist_tracks
+		WHERE md5 IN (%v?)
+	`, strings.Repeat("?,", len(removed)-1))
+
+	if _, err = tx.Exec(query, args[1:]...); err != nil {
+		tx.Rollback()
+		return &DBWorkerError{err, query, errDesc}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &DBWorkerError{err, query, errDesc}
+	}
+
+	return nil
+}
+
+// RemoveOrphanAlbums drops albums and artists no track refers to anymore and
+// returns the ids of removed albums so their covers can be cleaned up
+func (w *DBWorker) RemoveOrphanAlbums() ([]int, *DBWorkerError) {
+	// a single statement, so a track can't be added to an album between
+	// finding it orphaned and removing it
+	query := `
+		DELETE FROM albums
+		WHERE NOT EXISTS (SELECT 1 FROM music WHERE music.album_id = albums.id)
+		RETURNING id
+	`
+
+	result := []int{}
+	rows, err := w.conn.Query(query)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, "removing orphan albums"}
+	}
+
+	for rows.Next() {
+		var id int
+
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return result, &DBWorkerError{err, query, "removing orphan albums"}
+		}
+
+		result = append(result, id)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return result, &DBWorkerError{err, query, "removing orphan albums"}
+	}
+
+	query = `
+		DELETE FROM artists
+		WHERE NOT EXISTS (SELECT 1 FROM music WHERE music.artist_id = artists.id)
+		AND NOT EXISTS (SELECT 1 FROM albums WHERE albums.artist_id = artists.id)
+	`
+
+	_, dbErr := w.Exec(query, "removing orphan artists")
+
+	return result, dbErr
+}
+
+const albumColumns string = `al.id, al.title, al.artist_id, ar.name, al.year, al.has_image,
+		COUNT(m.md5), COALESCE(SUM(m.duration), 0)`
+
+func scanAlbum(r rowScanner, a *DBAlbum) error {
+	return r.Scan(&a.ID, &a.Title, &a.ArtistID, &a.Artist, &a.Year, &a.HasImage, &a.TrackCount, &a.Duration)
+}
+
+func (w *DBWorker) queryAlbums(query, errDesc string, args ...interface{}) ([]*DBAlbum, *DBWorkerError) {
+	result := []*DBAlbum{}
+	rows, err := w.conn.Query(query, args...)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, errDesc}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &DBAlbum{}
+
+		if err = scanAlbum(rows, a); err != nil {
+			return result, &DBWorkerError{err, query, errDesc}
+		}
+
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) GetAlbums() ([]*DBAlbum, *DBWorkerError) {
+	query := `
+		SELECT ` + albumColumns + `
+		FROM albums al
+		JOIN artists ar ON ar.id = al.artist_id
+		LEFT JOIN music m ON m.album_id = al.id
+		GROUP BY al.id
+		ORDER BY ar.name, al.year, al.title
+	`
+
+	return w.queryAlbums(query, "getting albums")
+}
+
+func (w *DBWorker) GetAlbum(id int) (*DBAlbum, *DBWorkerError) {
+	query := `
+		SELECT ` + albumColumns + `
+		FROM albums al
+		JOIN artists ar ON ar.id = al.artist_id
+		LEFT JOIN music m ON m.album_id = al.id
+		WHERE al.id = ?
+		GROUP BY al.id
+	`
+
+	a := &DBAlbum{}
+	err := scanAlbum(w.conn.QueryRow(query, id), a)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting album ", id)}
+	}
+
+	return a, nil
+}
+
+func (w *DBWorker) GetAlbumTracks(id int) ([]*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE album_id = ?
+		ORDER BY disc_number, track_number, title
+	`
+
+	return w.queryTracks(query, fmt.Sprint("getting tracks of album ", id), id)
+}
+
+// GetArtistAlbums returns albums of the artist including compilations the
+// artist appears on
+func (w *DBWorker) GetArtistAlbums(artistID int) ([]*DBAlbum, *DBWorkerError) {
+	query := `
+		SELECT ` + albumColumns + `
+		FROM albums al
+		JOIN artists ar ON ar.id = al.artist_id
+		LEFT JOIN music m ON m.album_id = al.id
+		WHERE al.artist_id = ?1
+		OR al.id IN (SELECT album_id FROM music WHERE artist_id = ?1)
+		GROUP BY al.id
+		ORDER BY al.year, al.title
+	`
+
+	return w.queryAlbums(query, fmt.Sprint("getting albums of artist ", artistID), artistID)
+}
+
+func (w *DBWorker) GetArtist(id int) (*DBArtist, *DBWorkerError) {
+	query := `
+		SELECT ar.id, ar.name, COUNT(al.id) FROM artists ar
+		LEFT JOIN albums al ON al.artist_id = ar.id
+		WHERE ar.id = ?
+		GROUP BY ar.id
+	`
+
+	a := &DBArtist{}
+	err := w.conn.QueryRow(query, id).Scan(&a.ID, &a.Name, &a.AlbumCount)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting artist ", id)}
+	}
+
+	return a, nil
+}
+
+func (w *DBWorker) GetArtists() ([]*DBArtist, *DBWorkerError) {
+	query := `
+		SELECT ar.id, ar.name, COUNT(al.id) FROM artists ar
+		LEFT JOIN albums al ON al.artist_id = ar.id
+		GROUP BY ar.id
+		ORDER BY ar.name
+	`
+
+	result := []*DBArtist{}
+	rows, err := w.conn.Query(query)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, "getting artists"}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &DBArtist{}
+
+		if err = rows.Scan(&a.ID, &a.Name, &a.AlbumCount); err != nil {
+			return result, &DBWorkerError{err, query, "getting artists"}
+		}
+
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// likePattern escapes LIKE wildcards of the input and wraps it into %...%
+func likePattern(input string) string {
+	r := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	return fmt.Sprint("%", r.Replace(input), "%")
+}
+
+func (w *DBWorker) SearchArtists(input string, offset, limit int) ([]*DBArtist, *DBWorkerError) {
+	query := `
+		SELECT ar.id, ar.name, COUNT(al.id) FROM artists ar
+		LEFT JOIN albums al ON al.artist_id = ar.id
+		WHERE ar.name LIKE ? ESCAPE '\'
+		GROUP BY ar.id
+		ORDER BY ar.name
+		LIMIT ? OFFSET ?
+	`
+
+	result := []*DBArtist{}
+	rows, err := w.conn.Query(query, likePattern(input), limit, offset)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, fmt.Sprint("searching artists for ", input)}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &DBArtist{}
+
+		if err = rows.Scan(&a.ID, &a.Name, &a.AlbumCount); err != nil {
+			return result, &DBWorkerError{err, query, fmt.Sprint("searching artists for ", input)}
+		}
+
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) SearchAlbums(input string, offset, limit int) ([]*DBAlbum, *DBWorkerError) {
+	query := `
+		SELECT ` + albumColumns + `
+		FROM albums al
+		JOIN artists ar ON ar.id = al.artist_id
+		LEFT JOIN music m ON m.album_id = al.id
+		WHERE al.title LIKE ?1 ESCAPE '\'
+		OR ar.name LIKE ?1 ESCAPE '\'
+		GROUP BY al.id
+		ORDER BY ar.name, al.year, al.title
+		LIMIT ?2 OFFSET ?3
+	`
+
+	return w.queryAlbums(query, fmt.Sprint("searching albums for ", input), likePattern(input), limit, offset)
+}
+
+// FindTracks is a plain substring search for servers without FTS5 and for
+// clients listing the whole library with an empty query
+func (w *DBWorker) FindTracks(input string, offset, limit int) ([]*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE artist LIKE ?1 ESCAPE '\'
+		OR title LIKE ?1 ESCAPE '\'
+		OR album LIKE ?1 ESCAPE '\'
+		ORDER BY artist, album, disc_number, track_number, title
+		LIMIT ?2 OFFSET ?3
+	`
+
+	return w.queryTracks(query, fmt.Sprint("finding tracks for ", input), likePattern(input), limit, offset)
+}
+
+// GetArtistLooseTracks returns tracks of the artist that belong to no album
+func (w *DBWorker) GetArtistLooseTracks(artistID int) ([]*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE artist_id = ?
+		AND album_id = 0
+		ORDER BY title
+	`
+
+	return w.queryTracks(query, fmt.Sprint("getting tracks without album of artist ", artistID), artistID)
+}
+
+// GetFolderTracks returns the tracks indexed in place whose path starts with
+// the prefix
+func (w *DBWorker) GetFolderTracks(prefix string) ([]*DBTrack, *DBWorkerError) {
+	query := `
+		SELECT ` + trackColumns + ` FROM music
+		WHERE substr(path, 1, length(?1)) = ?1
+	`
+
+	return w.queryTracks(query, fmt.Sprint("getting tracks of library folder ", prefix), prefix)
+}
+
+func (w *DBWorker) SetTrackFileInfo(t *DBTrack) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE music
+			SET path = ?,
+			file_size = ?,
+			file_mtime = ?
+		WHERE md5 = ?
+	`
+
+	return w.Exec(query, fmt.Sprint("updating file info of track ", t.Md5), t.path, t.fileSize, t.fileModTime, t.Md5)
+}
+
+func (w *DBWorker) queryTracks(query, errDesc string, args ...interface{}) ([]*DBTrack, *DBWorkerError) {
+	result := []*DBTrack{}
+	rows, err := w.conn.Query(query, args...)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, errDesc}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		t := &DBTrack{}
+
+		if err = scanTrack(rows, t); err != nil {
+			return result, &DBWorkerError{err, query, errDesc}
+		}
+
+		result = append(result, t)
+	}
+
+	return result, nil
 }
 
-func (w *DBWorker) GetLibraryPlaylist(owner_id int) (*DBPlaylist, *DBWorkerError) {
+const sessionColumns string = "id, user_id, created, last_seen, expires, ip, user_agent"
+
+func scanSession(r rowScanner, s *DBSession) error {
+	return r.Scan(&s.ID, &s.userID, &s.Created, &s.LastSeen, &s.Expires, &s.IP, &s.UserAgent)
+}
+
+func (w *DBWorker) AddSession(s *DBSession) (sql.Result, *DBWorkerError) {
 	query := `
-		SELECT * FROM playlists
-		WHERE owner_id = ?
-		AND name = ?
+		INSERT OR REPLACE INTO sessions (` + sessionColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
 
-	p := &DBPlaylist{}
-	err := w.conn.QueryRow(query, owner_id, config.AllPlaylistKey).Scan(&p.ID, &p.Name, &p.ownerID, &p.Tracks)
+	return w.Exec(query, fmt.Sprint("adding session ", s),
+		s.ID, s.userID, s.Created, s.LastSeen, s.Expires, s.IP, s.UserAgent)
+}
+
+func (w *DBWorker) GetSession(id string) (*DBSession, *DBWorkerError) {
+	query := `
+		SELECT ` + sessionColumns + ` FROM sessions
+		WHERE id = ?
+	`
+
+	s := &DBSession{}
+	err := scanSession(w.conn.QueryRow(query, id), s)
 
 	if err != nil {
-		return nil, &DBWorkerError{err, query, fmt.Sprint("getting library playlist of owner ", owner_id)}
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting session ", id)}
 	}
 
-	return p, nil
+	return s, nil
+}
+
+func (w *DBWorker) GetUserSessions(userID int) ([]*DBSession, *DBWorkerError) {
+	query := `
+		SELECT ` + sessionColumns + ` FROM sessions
+		WHERE user_id = ?
+		ORDER BY last_seen DESC
+	`
+
+	rows, err := w.conn.Query(query, userID)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprintf("getting user [%v] sessions", userID)}
+	}
+
+	defer rows.Close()
+	result := make([]*DBSession, 0)
+
+	for rows.Next() {
+		s := &DBSession{}
+
+		if err = scanSession(rows, s); err != nil {
+			return nil, &DBWorkerError{err, query, fmt.Sprintf("scanning user [%v] sessions", userID)}
+		}
+
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) TouchSession(id string, lastSeen int64) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE sessions
+			SET last_seen = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprint("touching session ", id), lastSeen, id)
+}
+
+func (w *DBWorker) SetSessionIP(id string, ip string) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE sessions
+			SET ip = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprint("updating ip of session ", id), ip, id)
+}
+
+func (w *DBWorker) RemoveSession(id string) (sql.Result, *DBWorkerError) {
+	query := `
+		DELETE FROM sessions
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprint("removing session ", id), id)
+}
+
+func (w *DBWorker) RemoveUserSessions(userID int, exceptID string) (sql.Result, *DBWorkerError) {
+	query := `
+		DELETE FROM sessions
+		WHERE user_id = ?
+		AND id != ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("removing user [%v] sessions", userID), userID, exceptID)
+}
+
+func (w *DBWorker) RemoveExpiredSessions(now int64) (sql.Result, *DBWorkerError) {
+	query := `
+		DELETE FROM sessions
+		WHERE expires <= ?
+	`
+
+	return w.Exec(query, "removing expired sessions", now)
+}
+
+const jobColumns string = "id, type, batch, target, payload, user_id, state, attempts, max_attempts, run_after, error, created, updated"
+
+func scanJob(r rowScanner, j *DBJob) error {
+	return r.Scan(&j.ID, &j.Type, &j.Batch, &j.Target, &j.Payload, &j.userID, &j.State, &j.Attempts, &j.MaxAttempts,
+		&j.RunAfter, &j.Error, &j.Created, &j.Updated)
+}
+
+func (w *DBWorker) AddJob(j *DBJob) (sql.Result, *DBWorkerError) {
+	query := `
+		INSERT INTO jobs (type, batch, target, payload, user_id, state, attempts, max_attempts, run_after, error, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	res, dbErr := w.Exec(query, fmt.Sprint("adding job ", j),
+		j.Type, j.Batch, j.Target, j.Payload, j.userID, j.State, j.Attempts, j.MaxAttempts, j.RunAfter, j.Error, j.Created, j.Updated)
+
+	if dbErr == nil {
+		id, _ := res.LastInsertId()
+		j.ID = int(id)
+	}
+
+	return res, dbErr
+}
+
+func (w *DBWorker) GetJob(id int) (*DBJob, *DBWorkerError) {
+	query := `
+		SELECT ` + jobColumns + ` FROM jobs
+		WHERE id = ?
+	`
+
+	j := &DBJob{}
+
+	if err := scanJob(w.conn.QueryRow(query, id), j); err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("getting job ", id)}
+	}
+
+	return j, nil
+}
+
+// GetJobs returns the latest jobs, optionally only those in the given state
+func (w *DBWorker) GetJobs(state string, limit int) ([]*DBJob, *DBWorkerError) {
+	query := `
+		SELECT ` + jobColumns + ` FROM jobs
+		WHERE ?1 = '' OR state = ?1
+		ORDER BY id DESC
+		LIMIT ?2
+	`
+
+	errDesc := fmt.Sprintf("getting jobs in state [%v]", state)
+	rows, err := w.conn.Query(query, state, limit)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, errDesc}
+	}
+
+	defer rows.Close()
+	result := make([]*DBJob, 0)
+
+	for rows.Next() {
+		j := &DBJob{}
+
+		if err = scanJob(rows, j); err != nil {
+			return nil, &DBWorkerError{err, query, errDesc}
+		}
+
+		result = append(result, j)
+	}
+
+	return result, nil
+}
+
+// ClaimJob marks the oldest job that is due as running and returns it.
+// sql.ErrNoRows means there is nothing to do
+func (w *DBWorker) ClaimJob(now int64) (*DBJob, *DBWorkerError) {
+	query := `
+		SELECT ` + jobColumns + ` FROM jobs
+		WHERE state = ?
+		AND run_after <= ?
+		ORDER BY id
+		LIMIT 1
+	`
+
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, "claiming job"}
+	}
+
+	j := &DBJob{}
+
+	if err = scanJob(tx.QueryRow(query, jobStateQueued, now), j); err != nil {
+		tx.Rollback()
+		return nil, &DBWorkerError{err, query, "claiming job"}
+	}
+
+	j.State = jobStateRunning
+	j.Attempts++
+	j.Updated = now
+
+	query = `
+		UPDATE jobs
+			SET state = ?,
+			attempts = ?,
+			updated = ?
+		WHERE id = ?
+	`
+
+	if _, err = tx.Exec(query, j.State, j.Attempts, j.Updated, j.ID); err != nil {
+		tx.Rollback()
+		return nil, &DBWorkerError{err, query, fmt.Sprint("claiming job ", j)}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("claiming job ", j)}
+	}
+
+	return j, nil
+}
+
+func (w *DBWorker) UpdateJobState(j *DBJob) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE jobs
+			SET state = ?,
+			attempts = ?,
+			run_after = ?,
+			error = ?,
+			updated = ?
+		WHERE id = ?
+	`
+
+	return w.Exec(query, fmt.Sprint("updating job ", j), j.State, j.Attempts, j.RunAfter, j.Error, j.Updated, j.ID)
+}
+
+// SetQueuedJobState changes the state of a job only while it is still queued,
+// so a worker that claimed it in the meantime isn't overridden
+func (w *DBWorker) SetQueuedJobState(id int, state string, now int64) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE jobs
+			SET state = ?,
+			updated = ?
+		WHERE id = ?
+		AND state = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("setting queued job [%v] state to %v", id, state), state, now, id, jobStateQueued)
+}
+
+// RequeueRunningJobs puts back jobs the server was running when it stopped
+func (w *DBWorker) RequeueRunningJobs(now int64) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE jobs
+			SET state = ?,
+			updated = ?
+		WHERE state = ?
+	`
+
+	return w.Exec(query, "requeueing interrupted jobs", jobStateQueued, now, jobStateRunning)
+}
+
+func (w *DBWorker) HasActiveJob(jobType, target string) (bool, *DBWorkerError) {
+	query := `
+		SELECT COUNT(*) FROM jobs
+		WHERE type = ?
+		AND target = ?
+		AND state IN (?, ?)
+	`
+
+	var count int
+	err := w.conn.QueryRow(query, jobType, target, jobStateQueued, jobStateRunning).Scan(&count)
+
+	if err != nil {
+		return false, &DBWorkerError{err, query, fmt.Sprintf("checking active %v jobs of %v", jobType, target)}
+	}
+
+	return count > 0, nil
+}
+
+func (w *DBWorker) CountActiveBatchJobs(batch string) (int, *DBWorkerError) {
+	query := `
+		SELECT COUNT(*) FROM jobs
+		WHERE batch = ?
+		AND state IN (?, ?)
+	`
+
+	var count int
+	err := w.conn.QueryRow(query, batch, jobStateQueued, jobStateRunning).Scan(&count)
+
+	if err != nil {
+		return 0, &DBWorkerError{err, query, fmt.Sprint("counting active jobs of batch ", batch)}
+	}
+
+	return count, nil
+}
+
+func (w *DBWorker) RemoveFinishedJobs(before int64) (sql.Result, *DBWorkerError) {
+	query := `
+		DELETE FROM jobs
+		WHERE state IN (?, ?, ?)
+		AND updated < ?
+	`
+
+	return w.Exec(query, "removing finished jobs", jobStateDone, jobStateFailed, jobStateCancelled, before)
+}
+
+func (w *DBWorker) SetTrackDuration(hash string, duration float32) (sql.Result, *DBWorkerError) {
+	query := `
+		UPDATE music
+			SET duration = ?
+		WHERE md5 = ?
+	`
+
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return nil, &DBWorkerError{err, query, fmt.Sprint("setting duration of track ", hash)}
+	}
+
+	res, err := tx.Exec(query, duration, hash)
+
+	if err != nil {
+		tx.Rollback()
+		return res, &DBWorkerError{err, query, fmt.Sprint("setting duration of track ", hash)}
+	}
+
+	if dbErr := recordLibChange(tx, hash, libChangeUpdate); dbErr != nil {
+		tx.Rollback()
+		return res, dbErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return res, &DBWorkerError{err, query, fmt.Sprint("setting duration of track ", hash)}
+	}
+
+	return res, nil
+}
+
+func (w *DBWorker) queryIDs(query, errDesc string, args ...interface{}) ([]int, *DBWorkerError) {
+	result := []int{}
+	rows, err := w.conn.Query(query, args...)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, errDesc}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+
+		if err = rows.Scan(&id); err != nil {
+			return result, &DBWorkerError{err, query, errDesc}
+		}
+
+		result = append(result, id)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) GetAlbumIDs() ([]int, *DBWorkerError) {
+	return w.queryIDs("SELECT id FROM albums", "getting album ids")
+}
+
+func (w *DBWorker) GetUserIDs() ([]int, *DBWorkerError) {
+	return w.queryIDs("SELECT id FROM users", "getting user ids")
+}
+
+// GetOrphanPlaylists returns the playlists whose owner no longer exists
+func (w *DBWorker) GetOrphanPlaylists() ([]int, *DBWorkerError) {
+	query := `
+		SELECT id FROM playlists
+		WHERE owner_id NOT IN (SELECT id FROM users)
+	`
+
+	return w.queryIDs(query, "getting orphan playlists")
+}
+
+// GetDanglingPlaylistTracks returns the playlist_tracks rows pointing to a
+// missing track or playlist. Foreign keys keep new ones from appearing, but
+// databases written without them enforced may still have some
+func (w *DBWorker) GetDanglingPlaylistTracks() ([]*DBPlaylistTrack, *DBWorkerError) {
+	query := `
+		SELECT playlist_id, md5 FROM playlist_tracks
+		WHERE md5 NOT IN (SELECT md5 FROM music)
+		OR playlist_id NOT IN (SELECT id FROM playlists)
+		ORDER BY playlist_id, position
+	`
+
+	result := []*DBPlaylistTrack{}
+	rows, err := w.conn.Query(query)
+
+	if err != nil {
+		return result, &DBWorkerError{err, query, "getting dangling playlist tracks"}
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		pt := &DBPlaylistTrack{}
+
+		if err = rows.Scan(&pt.PlaylistID, &pt.Md5); err != nil {
+			return result, &DBWorkerError{err, query, "getting dangling playlist tracks"}
+		}
+
+		result = append(result, pt)
+	}
+
+	return result, nil
+}
+
+func (w *DBWorker) RemovePlaylistTrack(playlistID int, hash string) (sql.Result, *DBWorkerError) {
+	query := `
+		DELETE FROM playlist_tracks
+		WHERE playlist_id = ?
+		AND md5 = ?
+	`
+
+	return w.Exec(query, fmt.Sprintf("removing track %v from playlist %v", hash, playlistID), playlistID, hash)
 }
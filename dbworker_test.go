@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	var n int
+
+	if err := db.conn.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestAddTrackLinksInItsTransaction(t *testing.T) {
+	openTestDB(t)
+
+	kept := &DBTrack{Md5: md5String("kept"), Artist: "Artist", Title: "Kept", Album: "Kept"}
+
+	if _, dbErr := db.AddTrack(kept); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if kept.ArtistID == 0 || kept.AlbumID == 0 {
+		t.Fatalf("track wasn't linked: artist %v, album %v", kept.ArtistID, kept.AlbumID)
+	}
+
+	failIngest(t)
+
+	failed := &DBTrack{Md5: md5String("failed"), Artist: "Other", Title: "Failed", Album: "Failed"}
+
+	if _, dbErr := db.AddTrack(failed); dbErr == nil {
+		t.Fatal("insert succeeded")
+	}
+
+	if n := countRows(t, `SELECT COUNT(*) FROM albums WHERE title = 'Failed'`); n != 0 {
+		t.Error("album of a failed insert was kept")
+	}
+
+	if n := countRows(t, `SELECT COUNT(*) FROM artists WHERE name = 'Other'`); n != 0 {
+		t.Error("artist of a failed insert was kept")
+	}
+
+	orphan, dbErr := getOrAddAlbum(db.conn, kept.ArtistID, "Orphan", 0)
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	ids, dbErr := db.RemoveOrphanAlbums()
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if len(ids) != 1 || ids[0] != orphan {
+		t.Errorf("removed albums %v, want [%v]", ids, orphan)
+	}
+
+	if n := countRows(t, `SELECT COUNT(*) FROM albums WHERE id = ?`, kept.AlbumID); n != 1 {
+		t.Error("album in use was removed")
+	}
+}
+
+func TestRemoveOrphanAlbumsWhileAdding(t *testing.T) {
+	openTestDB(t)
+
+	tracks := 30
+	done := make(chan bool)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, dbErr := db.RemoveOrphanAlbums(); dbErr != nil {
+				t.Error(dbErr.Error())
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < tracks; i++ {
+		tr := &DBTrack{Md5: md5String(fmt.Sprint(i)), Artist: fmt.Sprint("Artist ", i), Album: fmt.Sprint("Album ", i)}
+
+		if _, dbErr := db.AddTrack(tr); dbErr != nil {
+			t.Fatal(dbErr.Error())
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	dangling := countRows(t, `SELECT COUNT(*) FROM music
+		WHERE album_id NOT IN (SELECT id FROM albums)
+		OR artist_id NOT IN (SELECT id FROM artists)`)
+
+	if dangling != 0 {
+		t.Errorf("%v tracks point at removed albums or artists", dangling)
+	}
+}
+
+// testGappedPlaylist adds a playlist of tracks a to f and merges d into b,
+// which leaves a gap at the position of d
+func testGappedPlaylist(t *testing.T) int {
+	openTestDB(t)
+
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	hashes := make([]string, len(names))
+
+	for i, name := range names {
+		hashes[i] = md5String(name)
+
+		if _, dbErr := db.AddTrack(&DBTrack{Md5: hashes[i], Artist: "Artist", Title: name, Album: "Album"}); dbErr != nil {
+			t.Fatal(dbErr.Error())
+		}
+	}
+
+	res, dbErr := db.AddPlaylist(&DBPlaylist{Name: "gaps", ownerID: 1, Tracks: hashes[:6]})
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if dbErr = db.MergePlaylistTracks(hashes[1], hashes[3:4]); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	id, _ := res.LastInsertId()
+
+	if got := testPlaylistNames(t, int(id)); got != "a b c e f" {
+		t.Fatalf("merged playlist is %v", got)
+	}
+
+	return int(id)
+}
+
+// testPlaylistNames lists the titles of the tracks of a playlist in order
+func testPlaylistNames(t *testing.T, id int) string {
+	p, dbErr := db.GetPlaylist(id)
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	names := make([]string, len(p.Tracks))
+
+	for i, h := range p.Tracks {
+		names[i] = testTrackTitle(t, h)
+	}
+
+	return strings.Join(names, " ")
+}
+
+func testTrackTitle(t *testing.T, hash string) string {
+	var title string
+
+	if err := db.conn.QueryRow(`SELECT title FROM music WHERE md5 = ?`, hash).Scan(&title); err != nil {
+		t.Fatal(err)
+	}
+
+	return title
+}
+
+func TestPlaylistEditsAroundGaps(t *testing.T) {
+	hashes := func(names ...string) []string {
+		result := make([]string, len(names))
+
+		for i, name := range names {
+			result[i] = md5String(name)
+		}
+
+		return result
+	}
+
+	cases := []struct {
+		name string
+		edit func(id int) *DBWorkerError
+		want string
+	}{
+		{"move over the gap to the start", func(id int) *DBWorkerError { return db.MovePlaylistTracks(id, 3, 2, 0) }, "e f a b c"},
+		{"move the first track to the end", func(id int) *DBWorkerError { return db.MovePlaylistTracks(id, 0, 1, 4) }, "b c e f a"},
+		{"move before the gap", func(id int) *DBWorkerError { return db.MovePlaylistTracks(id, 2, 1, 3) }, "a b e c f"},
+		{"move across the gap", func(id int) *DBWorkerError { return db.MovePlaylistTracks(id, 1, 2, 2) }, "a e b c f"},
+		{"insert after the gap", func(id int) *DBWorkerError { return db.InsertPlaylistTracks(id, 3, hashes("g", "h")) }, "a b c g h e f"},
+		{"insert before the gap", func(id int) *DBWorkerError { return db.InsertPlaylistTracks(id, 2, hashes("g")) }, "a b g c e f"},
+		{"insert past the end", func(id int) *DBWorkerError { return db.InsertPlaylistTracks(id, 10, hashes("g")) }, "a b c e f g"},
+		{"remove across the gap", func(id int) *DBWorkerError { return db.RemovePlaylistTracks(id, 2, 2) }, "a b f"},
+		{"remove the tail", func(id int) *DBWorkerError { return db.RemovePlaylistTracks(id, 3, 2) }, "a b c"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			id := testGappedPlaylist(t)
+
+			if dbErr := tc.edit(id); dbErr != nil {
+				t.Fatal(dbErr.Error())
+			}
+
+			if got := testPlaylistNames(t, id); got != tc.want {
+				t.Errorf("playlist is %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlaylistRangeOutOfBounds(t *testing.T) {
+	id := testGappedPlaylist(t)
+
+	ranges := [][2]int{{4, 2}, {-1, 1}, {0, 0}, {5, 1}}
+
+	for _, r := range ranges {
+		if dbErr := db.RemovePlaylistTracks(id, r[0], r[1]); dbErr == nil {
+			t.Errorf("removed %v+%v", r[0], r[1])
+		}
+
+		if dbErr := db.MovePlaylistTracks(id, r[0], r[1], 0); dbErr == nil {
+			t.Errorf("moved %v+%v", r[0], r[1])
+		}
+	}
+
+	if got := testPlaylistNames(t, id); got != "a b c e f" {
+		t.Errorf("playlist changed to %v", got)
+	}
+}
+
+func TestRefreshAlbumGainReplacesLibTracks(t *testing.T) {
+	openTestDB(t)
+
+	track := &DBTrack{Md5: md5String("gain"), Artist: "Artist", Title: "Gain", Album: "Album", Duration: 100, Loudness: -10, GainSource: gainSourceAnalysis}
+
+	if _, dbErr := db.AddTrack(track); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	setLibTrack(track)
+	defer removeLibTrack(track.Md5)
+
+	// readers keep the track they got while the album gain is refreshed
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			if lt, ok := libTrack(track.Md5); ok && lt.AlbumGain != 0 && lt == track {
+				t.Error("shared track changed")
+			}
+		}
+
+		done <- true
+	}()
+
+	refreshAlbumGain(track.AlbumID)
+	<-done
+
+	if track.AlbumGain != 0 {
+		t.Error("refresh changed the track in place")
+	}
+
+	if lt, ok := libTrack(track.Md5); !ok || lt == track || lt.AlbumGain == 0 {
+		t.Errorf("library track wasn't replaced with the album gain")
+	}
+}
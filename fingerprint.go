@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"sort"
+)
+
+// Fingerprints follow the idea of Chromaprint. The audio is reduced to a
+// chroma image, the energy of the 12 pitch classes over time, and every frame
+// is hashed into 32 bits by comparing neighbouring pitch classes and frames.
+// Re-encoded or re-tagged copies of a song give nearly the same bits, so the
+// share of equal bits tells how alike two tracks sound
+const fingerprintRate int = 11025
+const fingerprintFrameSize int = 4096
+const fingerprintHop int = fingerprintFrameSize / 3
+const fingerprintMaxSeconds int = 120
+const fingerprintMinFreq float64 = 28
+const fingerprintMaxFreq float64 = 3520
+
+// tracks are compared shifted by up to this many frames, about 5 seconds,
+// to cover different leading silence
+const fingerprintMaxOffset int = 40
+
+// tracks at least this similar are listed as duplicates
+const duplicateSimilarity float64 = 0.8
+
+type fingerprintBuilder struct {
+	factor   int
+	maxLen   int
+	acc      float64
+	accCount int
+	read     int
+	window   []float64
+	classes  []int
+	buf      []float64
+	chroma   [][12]float64
+}
+
+func (fp *fingerprintBuilder) start(rate, channels int) {
+	// averaging groups of samples brings the rate close to fingerprintRate
+	fp.factor = int(math.Max(1, math.Round(float64(rate)/float64(fingerprintRate))))
+	effRate := float64(rate) / float64(fp.factor)
+	fp.maxLen = fingerprintMaxSeconds * int(effRate)
+
+	fp.window = make([]float64, fingerprintFrameSize)
+
+	for i := range fp.window {
+		fp.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrameSize-1))
+	}
+
+	fp.classes = make([]int, fingerprintFrameSize/2)
+
+	for k := range fp.classes {
+		freq := float64(k) * effRate / float64(fingerprintFrameSize)
+		fp.classes[k] = -1
+
+		if freq >= fingerprintMinFreq && freq <= fingerprintMaxFreq {
+			note := int(math.Round(12*math.Log2(freq/440))) + 69
+			fp.classes[k] = (note%12 + 12) % 12
+		}
+	}
+
+	fp.buf = make([]float64, 0, fingerprintFrameSize)
+}
+
+func (fp *fingerprintBuilder) addFrame(frame []float64) {
+	if fp.read >= fp.maxLen {
+		return
+	}
+
+	mono := 0.0
+
+	for _, x := range frame {
+		mono += x
+	}
+
+	fp.acc += mono / float64(len(frame))
+	fp.accCount++
+
+	if fp.accCount < fp.factor {
+		return
+	}
+
+	fp.buf = append(fp.buf, fp.acc/float64(fp.factor))
+	fp.acc, fp.accCount = 0, 0
+	fp.read++
+
+	if len(fp.buf) == fingerprintFrameSize {
+		fp.addChroma()
+		fp.buf = append(fp.buf[:0], fp.buf[fingerprintHop:]...)
+	}
+}
+
+func (fp *fingerprintBuilder) addChroma() {
+	spectrum := make([]complex128, fingerprintFrameSize)
+
+	for i, x := range fp.buf {
+		spectrum[i] = complex(x*fp.window[i], 0)
+	}
+
+	fft(spectrum)
+
+	var chroma [12]float64
+	norm := 0.0
+
+	for k, class := range fp.classes {
+		if class >= 0 {
+			e := cmplx.Abs(spectrum[k])
+			chroma[class] += e * e
+		}
+	}
+
+	for _, e := range chroma {
+		norm += e * e
+	}
+
+	// silence stays all zero
+	if norm = math.Sqrt(norm); norm > 1e-9 {
+		for i := range chroma {
+			chroma[i] /= norm
+		}
+	}
+
+	fp.chroma = append(fp.chroma, chroma)
+}
+
+func (fp *fingerprintBuilder) result() []uint32 {
+	n := len(fp.chroma)
+
+	if n < 3 {
+		return []uint32{}
+	}
+
+	// a short moving average takes out jitter between frames
+	smooth := make([][12]float64, n)
+
+	for t := range fp.chroma {
+		count := 0.0
+
+		for d := -1; d <= 1; d++ {
+			if t+d < 0 || t+d >= n {
+				continue
+			}
+
+			for i := 0; i < 12; i++ {
+				smooth[t][i] += fp.chroma[t+d][i]
+			}
+
+			count++
+		}
+
+		for i := 0; i < 12; i++ {
+			smooth[t][i] /= count
+		}
+	}
+
+	result := make([]uint32, 0, n-1)
+
+	for t := 1; t < n; t++ {
+		cur, prev := smooth[t], smooth[t-1]
+		var h uint32
+
+		for i := 0; i < 12; i++ {
+			j := (i + 1) % 12
+
+			if cur[i] > prev[i] {
+				h |= 1 << uint(i)
+			}
+
+			if cur[i] > cur[j] {
+				h |= 1 << uint(12+i)
+			}
+
+			if i < 8 && cur[i]-cur[j] > prev[i]-prev[j] {
+				h |= 1 << uint(24+i)
+			}
+		}
+
+		result = append(result, h)
+	}
+
+	return result
+}
+
+// fft is an in place radix-2 transform, len(x) has to be a power of two
+func fft(x []complex128) {
+	n := len(x)
+
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+
+		j ^= bit
+
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+func encodeFingerprint(fp []uint32) []byte {
+	data := make([]byte, len(fp)*4)
+
+	for i, h := range fp {
+		binary.LittleEndian.PutUint32(data[i*4:], h)
+	}
+
+	return data
+}
+
+func decodeFingerprint(data []byte) []uint32 {
+	fp := make([]uint32, len(data)/4)
+
+	for i := range fp {
+		fp[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+
+	return fp
+}
+
+// fingerprintSimilarity returns the share of equal bits of two fingerprints
+// at their best alignment, around 0.5 for unrelated tracks
+func fingerprintSimilarity(a, b []uint32) float64 {
+	minLen := len(a)
+
+	if len(b) < minLen {
+		minLen = len(b)
+	}
+
+	best := 0.0
+
+	for offset := -fingerprintMaxOffset; offset <= fingerprintMaxOffset; offset++ {
+		diff, count := 0, 0
+
+		for i := range a {
+			j := i + offset
+
+			if j < 0 || j >= len(b) {
+				continue
+			}
+
+			diff += bits.OnesCount32(a[i] ^ b[j])
+			count++
+		}
+
+		// alignments overlapping too little say nothing
+		if count == 0 || count < minLen/2 {
+			continue
+		}
+
+		if s := 1 - float64(diff)/float64(count*32); s > best {
+			best = s
+		}
+	}
+
+	return best
+}
+
+type AudyDuplicate struct {
+	Track *DBTrack `json:"track"`
+	// similarity to the first track of the cluster
+	Similarity float64 `json:"similarity"`
+}
+
+type AudyDuplicateCluster struct {
+	Tracks []*AudyDuplicate `json:"tracks"`
+}
+
+// findDuplicates groups tracks that sound alike. Only tracks of about the
+// same duration are compared. The first track of a cluster is the one with
+// the highest bitrate, the suggested one to keep
+func findDuplicates(fingerprints map[string][]uint32) []*AudyDuplicateCluster {
+	tracks := make([]*DBTrack, 0, len(fingerprints))
+
+	for hash, fp := range fingerprints {
+		if t, ok := libTrack(hash); ok && len(fp) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Duration < tracks[j].Duration
+	})
+
+	parent := make(map[string]string, 0)
+	var find func(h string) string
+	find = func(h string) string {
+		if p, ok := parent[h]; ok && p != h {
+			parent[h] = find(p)
+			return parent[h]
+		}
+
+		return h
+	}
+
+	for i, a := range tracks {
+		maxDiff := math.Max(3, float64(a.Duration)*0.03)
+
+		for _, b := range tracks[i+1:] {
+			if float64(b.Duration-a.Duration) > maxDiff {
+				break
+			}
+
+			if fingerprintSimilarity(fingerprints[a.Md5], fingerprints[b.Md5]) >= duplicateSimilarity {
+				parent[find(b.Md5)] = find(a.Md5)
+			}
+		}
+	}
+
+	groups := make(map[string][]*DBTrack, 0)
+
+	for _, t := range tracks {
+		root := find(t.Md5)
+		groups[root] = append(groups[root], t)
+	}
+
+	clusters := make([]*AudyDuplicateCluster, 0)
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		sort.SliceStable(group, func(i, j int) bool {
+			return trackBitRate(group[i]) > trackBitRate(group[j])
+		})
+
+		keep := fingerprints[group[0].Md5]
+		cluster := &AudyDuplicateCluster{[]*AudyDuplicate{{group[0], 1}}}
+
+		for _, t := range group[1:] {
+			cluster.Tracks = append(cluster.Tracks, &AudyDuplicate{t, fingerprintSimilarity(keep, fingerprints[t.Md5])})
+		}
+
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return len(clusters[i].Tracks) > len(clusters[j].Tracks)
+	})
+
+	return clusters
+}
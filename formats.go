@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+type AudyFormat struct {
+	Name string
+	Ext  string
+	Mime string
+}
+
+var audioFormats map[string]*AudyFormat = map[string]*AudyFormat{
+	"mp3":  {"mp3", ".mp3", "audio/mpeg"},
+	"flac": {"flac", ".flac", "audio/flac"},
+	"ogg":  {"ogg", ".ogg", "audio/ogg"},
+	"opus": {"opus", ".opus", "audio/ogg; codecs=opus"},
+	"m4a":  {"m4a", ".m4a", "audio/mp4"},
+	"wav":  {"wav", ".wav", "audio/wav"},
+}
+
+var audioExts map[string]string = map[string]string{
+	".mp3":  "mp3",
+	".flac": "flac",
+	".ogg":  "ogg",
+	".oga":  "ogg",
+	".opus": "opus",
+	".m4a":  "m4a",
+	".mp4":  "m4a",
+	".wav":  "wav",
+}
+
+var errUnknownFormat error = errors.New("unknown audio container")
+
+// wavMaxFmtSize bounds the fmt chunk read into memory, the largest real one
+// (WAVE_FORMAT_EXTENSIBLE) is 40 bytes
+const wavMaxFmtSize int64 = 64
+
+// isAdtsHeader reports raw ADTS AAC frames, which share the mp3 frame sync but
+// always have the layer bits set to 0
+func isAdtsHeader(header []byte) bool {
+	return len(header) >= 2 && header[0] == 0xff && header[1]&0xf6 == 0xf0
+}
+
+// isMp3Header reports an mpeg audio frame sync with a valid layer
+func isMp3Header(header []byte) bool {
+	return len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0 && header[1]&0x06 != 0
+}
+
+func isAudioFileName(name string) bool {
+	_, ok := audioExts[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+func getFormat(name string) *AudyFormat {
+	if f, ok := audioFormats[name]; ok {
+		return f
+	}
+
+	return audioFormats["mp3"]
+}
+
+// detectTrackFormat sniffs the container by its magic bytes. ID3v2 tags are
+// skipped since they may precede both mp3 frames and flac streams.
+func detectTrackFormat(r io.ReadSeeker) (*AudyFormat, error) {
+	header := make([]byte, 36)
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	n, err := io.ReadFull(r, header)
+
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	header = header[:n]
+	var offset int64 = 0
+
+	if len(header) >= 10 && string(header[:3]) == "ID3" {
+		offset = 10 + (int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 | int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f))
+
+		if header[5]&0x10 != 0 {
+			offset += 10
+		}
+
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		header = make([]byte, 4)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		if string(header) == "fLaC" {
+			return audioFormats["flac"], nil
+		} else if isAdtsHeader(header) {
+			return nil, errUnknownFormat
+		}
+
+		return audioFormats["mp3"], nil
+	}
+
+	switch {
+	case len(header) >= 4 && string(header[:4]) == "fLaC":
+		return audioFormats["flac"], nil
+	case len(header) >= 36 && string(header[:4]) == "OggS":
+		if bytes.HasPrefix(header[28:], []byte("OpusHead")) {
+			return audioFormats["opus"], nil
+		} else if bytes.HasPrefix(header[28:], []byte("\x01vorbis")) {
+			return audioFormats["ogg"], nil
+		}
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return audioFormats["wav"], nil
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return audioFormats["m4a"], nil
+	case isAdtsHeader(header):
+		// raw AAC has no format of its own here and can't be read as mp3
+		return nil, errUnknownFormat
+	case isMp3Header(header):
+		return audioFormats["mp3"], nil
+	}
+
+	return nil, errUnknownFormat
+}
+
+func calcFormatDuration(format *AudyFormat, r io.ReadSeeker) (float32, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	switch format.Name {
+	case "mp3":
+		return calcTrackDuration(bufio.NewReaderSize(r, 1024*1024))
+	case "flac":
+		return calcFlacDuration(r)
+	case "ogg", "opus":
+		return calcOggDuration(r, format.Name == "opus")
+	case "m4a":
+		return calcMp4Duration(r)
+	case "wav":
+		return calcWavDuration(r)
+	}
+
+	return 0, errUnknownFormat
+}
+
+func calcFlacDuration(r io.ReadSeeker) (float32, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(br, magic); err != nil {
+			return 0, err
+		}
+
+		if string(magic) == "fLaC" {
+			break
+		}
+
+		if string(magic[:3]) != "ID3" {
+			return 0, errors.New("flac stream marker not found")
+		}
+
+		id3 := make([]byte, 6)
+		if _, err := io.ReadFull(br, id3); err != nil {
+			return 0, err
+		}
+
+		size := int(id3[2]&0x7f)<<21 | int(id3[3]&0x7f)<<14 | int(id3[4]&0x7f)<<7 | int(id3[5]&0x7f)
+
+		if id3[1]&0x10 != 0 {
+			size += 10
+		}
+
+		if _, err := br.Discard(size); err != nil {
+			return 0, err
+		}
+	}
+
+	// STREAMINFO is always the first metadata block
+	block := make([]byte, 4+34)
+	if _, err := io.ReadFull(br, block); err != nil {
+		return 0, err
+	}
+
+	if block[0]&0x7f != 0 {
+		return 0, errors.New("flac STREAMINFO block not found")
+	}
+
+	info := block[4:]
+	sampleRate := uint64(info[10])<<12 | uint64(info[11])<<4 | uint64(info[12])>>4
+	totalSamples := uint64(info[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+
+	if sampleRate == 0 {
+		return 0, errors.New("flac sample rate is zero")
+	}
+
+	return float32(float64(totalSamples) / float64(sampleRate)), nil
+}
+
+func calcOggDuration(r io.ReadSeeker, opus bool) (float32, error) {
+	header := make([]byte, 27)
+	var sampleRate uint32 = 48000
+	var preSkip uint16 = 0
+	var granule int64 = -1
+	first := true
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			return 0, err
+		}
+
+		if string(header[:4]) != "OggS" {
+			return 0, errors.New("ogg page capture pattern not found")
+		}
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return 0, err
+		}
+
+		var bodySize int64 = 0
+		for _, s := range segments {
+			bodySize += int64(s)
+		}
+
+		if first {
+			body := make([]byte, bodySize)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return 0, err
+			}
+
+			if opus && len(body) >= 12 {
+				preSkip = binary.LittleEndian.Uint16(body[10:12])
+			} else if !opus && len(body) >= 16 {
+				sampleRate = binary.LittleEndian.Uint32(body[12:16])
+			}
+
+			first = false
+		} else if _, err := r.Seek(bodySize, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+
+		if pos := int64(binary.LittleEndian.Uint64(header[6:14])); pos >= 0 {
+			granule = pos
+		}
+	}
+
+	if granule < 0 || sampleRate == 0 {
+		return 0, errors.New("ogg granule position not found")
+	}
+
+	return float32(float64(granule-int64(preSkip)) / float64(sampleRate)), nil
+}
+
+func calcMp4Duration(r io.ReadSeeker) (float32, error) {
+	return findMp4Duration(r, -1, []string{"moov", "mvhd"})
+}
+
+func findMp4Duration(r io.ReadSeeker, limit int64, path []string) (float32, error) {
+	header := make([]byte, 8)
+	var read int64 = 0
+
+	for limit < 0 || read < limit {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		name := string(header[4:8])
+		headerSize := int64(8)
+
+		if size == 1 {
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return 0, err
+			}
+
+			size = int64(binary.BigEndian.Uint64(ext))
+			headerSize = 16
+		}
+
+		if size < headerSize && size != 0 {
+			return 0, fmt.Errorf("mp4 box %v has invalid size %v", name, size)
+		}
+
+		if name == path[0] {
+			if len(path) > 1 {
+				return findMp4Duration(r, size-headerSize, path[1:])
+			}
+
+			return readMp4Mvhd(r)
+		}
+
+		if size == 0 {
+			break
+		}
+
+		if _, err := r.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+
+		read += size
+	}
+
+	return 0, fmt.Errorf("mp4 box %v not found", path[0])
+}
+
+func readMp4Mvhd(r io.Reader) (float32, error) {
+	version := make([]byte, 4)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return 0, err
+	}
+
+	var timescale, duration uint64
+
+	if version[0] == 1 {
+		buf := make([]byte, 28)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+
+		timescale = uint64(binary.BigEndian.Uint32(buf[16:20]))
+		duration = binary.BigEndian.Uint64(buf[20:28])
+	} else {
+		buf := make([]byte, 16)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+
+		timescale = uint64(binary.BigEndian.Uint32(buf[8:12]))
+		duration = uint64(binary.BigEndian.Uint32(buf[12:16]))
+	}
+
+	if timescale == 0 {
+		return 0, errors.New("mp4 timescale is zero")
+	}
+
+	return float32(float64(duration) / float64(timescale)), nil
+}
+
+func calcWavDuration(r io.ReadSeeker) (float32, error) {
+	riff := make([]byte, 12)
+	if _, err := io.ReadFull(r, riff); err != nil {
+		return 0, err
+	}
+
+	chunk := make([]byte, 8)
+	var byteRate uint32 = 0
+
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, err
+		}
+
+		id := string(chunk[:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size > wavMaxFmtSize {
+				return 0, errors.New("wav fmt chunk is too large")
+			}
+
+			fmtChunk := make([]byte, size)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return 0, err
+			}
+
+			if len(fmtChunk) >= 12 {
+				byteRate = binary.LittleEndian.Uint32(fmtChunk[8:12])
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0, errors.New("wav byte rate not found before data chunk")
+			}
+
+			return float32(float64(size) / float64(byteRate)), nil
+		default:
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return 0, err
+			}
+		}
+
+		if size%2 == 1 {
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
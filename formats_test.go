@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testWav builds a RIFF header followed by a fmt chunk of the given size and
+// a data chunk of one second of 16 bit mono at 8 kHz
+func testWav(fmtSize uint32) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString("RIFF")
+	binary.Write(b, binary.LittleEndian, uint32(0))
+	b.WriteString("WAVEfmt ")
+	binary.Write(b, binary.LittleEndian, fmtSize)
+
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:2], 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:4], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:8], 8000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], 16000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:14], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:16], 16)
+	b.Write(fmtChunk)
+
+	b.WriteString("data")
+	binary.Write(b, binary.LittleEndian, uint32(16000))
+	b.Write(make([]byte, 16000))
+
+	return b.Bytes()
+}
+
+func TestDetectTrackFormat(t *testing.T) {
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), 0xff, 0xf1, 0x50, 0x80)
+
+	cases := []struct {
+		name   string
+		header []byte
+		format string
+	}{
+		{"mp3 layer 3", []byte{0xff, 0xfb, 0x90, 0x64}, "mp3"},
+		{"mp3 mpeg 2 layer 3", []byte{0xff, 0xf3, 0x90, 0x64}, "mp3"},
+		{"mp3 layer 2", []byte{0xff, 0xfd, 0x90, 0x64}, "mp3"},
+		{"adts mpeg 4", []byte{0xff, 0xf1, 0x50, 0x80}, ""},
+		{"adts mpeg 2", []byte{0xff, 0xf9, 0x50, 0x80}, ""},
+		{"adts after id3", id3, ""},
+		{"reserved layer", []byte{0xff, 0xe8, 0x90, 0x64}, ""},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "flac"},
+		{"wav", testWav(16)[:36], "wav"},
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A "), "m4a"},
+		{"garbage", []byte("not audio at all"), ""},
+	}
+
+	for _, tc := range cases {
+		f, err := detectTrackFormat(bytes.NewReader(tc.header))
+
+		if len(tc.format) == 0 {
+			if err != errUnknownFormat {
+				t.Errorf("%v: detected %v, want unknown format", tc.name, f)
+			}
+		} else if err != nil || f.Name != tc.format {
+			t.Errorf("%v: detected %v (%v), want %v", tc.name, f, err, tc.format)
+		}
+	}
+}
+
+func TestWavFmtChunkSize(t *testing.T) {
+	duration, err := calcWavDuration(bytes.NewReader(testWav(16)))
+
+	if err != nil || duration != 1 {
+		t.Fatalf("duration = %v (%v), want 1", duration, err)
+	}
+
+	// a fmt chunk claiming 4 GiB must be refused before anything is allocated
+	huge := testWav(0xffffffff)
+
+	if _, err = calcWavDuration(bytes.NewReader(huge)); err == nil {
+		t.Error("calcWavDuration accepted an oversized fmt chunk")
+	}
+
+	if err = readWav(bytes.NewReader(huge), nil); err == nil {
+		t.Error("readWav accepted an oversized fmt chunk")
+	}
+}
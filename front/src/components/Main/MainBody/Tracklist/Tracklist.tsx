@@ -126,8 +126,14 @@ function Tracklist(props: TracklistProps) {
                     });
                 } else {
                     const tracks = currentPl.tracks.filter(t => t !== track.md5);
+                    const index = currentPl.tracks.indexOf(track.md5);
+
+                    // the library playlist is only partly stored, it is saved as a whole
                     utils.confirmT("confirm_remove_track", {trackName: utils.formatTrack(track), plName: currentPl.name}, () => {
-                        return PlaylistApi.update(currentPl.dbId, tracks).then(() => {
+                        const req = currentPl.id === -1 ? PlaylistApi.update(currentPl.dbId, tracks) :
+                            PlaylistApi.removeTracks(currentPl.dbId, index, 1);
+
+                        return req.then(() => {
                             dispatch(playlistsActions.updateTracks({
                                 id: currentPl.id,
                                 tracks
@@ -356,9 +362,14 @@ function Tracklist(props: TracklistProps) {
             setDragging(false);
 
             if(movingTrack !== null) {
-                if(movingTrack.index !== currentPl.tracks.indexOf(movingTrack.track.md5)) {
+                const newIndex = currentPl.tracks.indexOf(movingTrack.track.md5);
+
+                if(movingTrack.index !== newIndex) {
                     const pl = currentPl;
-                    PlaylistApi.update(pl.dbId, pl.tracks).then(newDbId => {
+                    const req = pl.id === -1 ? PlaylistApi.update(pl.dbId, pl.tracks) :
+                        PlaylistApi.moveTracks(pl.dbId, movingTrack.index, 1, newIndex);
+
+                    req.then(newDbId => {
                         if(newDbId && pl.id === -1 && newDbId > 0) {
                             dispatch(playlistsActions.setLibId(newDbId));
                         }
@@ -98,8 +98,9 @@ function Sidebar(props: SidebarProps) {
             return;
         }
 
-        const tracks = [...tracksDragging.filter(t => !pl.tracks.includes(t)),...pl.tracks];
-        const diff = tracks.length - pl.tracks.length;
+        const added = tracksDragging.filter(t => !pl.tracks.includes(t));
+        const tracks = [...added, ...pl.tracks];
+        const diff = added.length;
 
         if(diff === 0) {
             utils.alertWarn(t("no_new_tracks_added"));
@@ -107,7 +108,7 @@ function Sidebar(props: SidebarProps) {
         }
 
         const droppedPl = pl;
-        PlaylistApi.update(pl.dbId, tracks).then(() => {
+        PlaylistApi.insertTracks(pl.dbId, 0, added).then(() => {
             dispatch(playlistsActions.updateTracks({
                 id: droppedPl.id, 
                 tracks
@@ -16,6 +16,9 @@ interface UploadProps extends ModalBase {
 }
 
 const cancellationEvents = ["dragenter", "dragleave", "drop", "dragover"];
+const audioExts = [".mp3", ".flac", ".ogg", ".oga", ".opus", ".m4a", ".mp4", ".wav"];
+const archiveExts = [".zip", ".tar", ".tar.gz", ".tgz"];
+const uploadExts = audioExts.concat(archiveExts);
 function cancellationEvent(e: Event) {
     e.preventDefault();
 }
@@ -42,7 +45,7 @@ const Upload = React.forwardRef<HTMLDivElement, UploadProps>((props, ref) => {
         const checkedFiles: UploadFile[] = [];
 
         for(const file of files) {
-            if(file.name.endsWith(".mp3")) {
+            if(uploadExts.some(ext => file.name.toLowerCase().endsWith(ext))) {
                 checkedFiles.push({
                     file,
                     id: file.name + file.size + file.lastModified,
@@ -86,7 +89,7 @@ const Upload = React.forwardRef<HTMLDivElement, UploadProps>((props, ref) => {
     const handleNeedToSelectFiles = useCallback(() => {
         utils.fileDialog({
             multiple: true,
-            exts: [".mp3"]
+            exts: uploadExts
         }).then(files => {
             handleFilesChosen(Array.from(files));
         }).catch(() => {});
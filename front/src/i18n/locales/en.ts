@@ -138,7 +138,7 @@ const en = {
         "reconnect_counter": "Reconnecting in <strong>{{counter}}</strong>...",
         "already_connected": "You're already connected",
         "loading": "Loading Audy...",
-        "already_connected_desc": "You can only have 1 tab being active",
+        "already_connected_desc": "You have too many Audy tabs open. Close them all to continue here",
         "destroyed": "This Audy tab has been destroyed",
         "destroyed_desc": "You can only close it"
     },
@@ -149,7 +149,7 @@ const en = {
         "ftp_upload_no_valid_files": "No valid files found for FTP upload",
         "validation": "Unable to validate your input",
         "no_file": "Unable to open or read your uploaded file",
-        "unsupported_format": "Uploaded file was not in .mp3 format",
+        "unsupported_format": "Uploaded file format is not supported (mp3, flac, ogg, opus, m4a and wav are allowed)",
         "ftp_upload_already_in_process": "FTP upload is already active",
         "ftp_upload_dir_read": "Unable to read ftp_upload directory on server",
         "ftp_upload_dir_make": "Unable to make ftp_upload directory on server",
@@ -177,7 +177,40 @@ const en = {
         "no_avatar_file": "Unable to find your avatar file",
         "login_already_taken": "This username has been already taken. Please pick another username",
         "saving_config": "An error occurred while trying to save configuration file",
-        "theme_key_invalid": "One of your themes has not passed keys validation"
+        "theme_key_invalid": "One of your themes has not passed keys validation",
+        "album_not_found": "Album was not found. Please reload this browser tab",
+        "artist_not_found": "Artist was not found. Please reload this browser tab",
+        "search_unavailable": "Search is not available on this Audy server",
+        "unable_to_generate_password": "Unable to generate password",
+        "unable_to_hash_password": "Unable to hash password",
+        "session_not_found": "Session not found",
+        "job_not_found": "Job not found",
+        "job_not_cancellable": "Job has already finished",
+        "job_not_retryable": "Only failed or cancelled jobs can be retried",
+        "external_tracks_read_only": "Tracks from library folders are read-only and can't be removed",
+        "no_library_folders": "No library folders are configured",
+        "library_folder_unavailable": "Library folder is unavailable",
+        "unsupported_tus_version": "Unsupported upload protocol version",
+        "invalid_upload_length": "Invalid upload size",
+        "upload_too_large": "File is too large to upload",
+        "invalid_upload_metadata": "Invalid upload metadata",
+        "invalid_checksum": "Invalid checksum",
+        "upload_create": "Unable to start the upload",
+        "upload_not_found": "Upload not found or expired",
+        "upload_offset_mismatch": "Upload is out of sync with the server",
+        "upload_locked": "Upload is already in progress",
+        "invalid_content_type": "Invalid content type",
+        "unsupported_checksum": "Unsupported checksum algorithm",
+        "write_file": "Unable to write the file",
+        "checksum_mismatch": "Uploaded file is damaged, checksum doesn't match",
+        "create_dir": "Unable to create a directory",
+        "archive_too_many_entries": "Archive has too many files",
+        "archive_unsafe_path": "Archive contains files with unsafe paths",
+        "archive_too_large": "Archive contents are too large",
+        "archive_read": "Unable to read the archive",
+        "archive_no_tracks": "Archive has no tracks",
+        "move_file": "Unable to move the file",
+        "open_file": "Unable to open the file"
     },
     errorh: {
         "db": "Database error",
@@ -188,20 +221,22 @@ const en = {
         "confirm_logout": "Are you sure you want to log out?",
         "confirm_remove_tracks": "Are you sure you want to remove {{count}} tracks from \"{{plName}}\"?",
         "confirm_remove_track": "Are you sure you want to remove track \"{{trackName}}\" from \"{{plName}}\"?",
-        "ftp_upload_help": "FTP upload allows you to grab files from server directory (%AudyServerDir% / upload / ftp_upload). Any valid .mp3 format files will be processed and added to your library. Click Start button to begin.",
+        "ftp_upload_help": "FTP upload allows you to grab files from server directory (%AudyServerDir% / upload / ftp_upload). Any valid audio files (mp3, flac, ogg, opus, m4a, wav) will be processed and added to your library. Click Start button to begin.",
         "confirm_remove_avatar": "Are you sure you want to remove your avatar?",
         "confirm_remove_theme": "Are you sure you want to remove theme \"{{tName}}\"",
         "password_resetted": "Password for user {{user}} has been resetted to: {{newPassword}}",
         "confirm_set_admin": "Are you sure you want to revoke user \"{{user}}\" admin rights?",
         "confirm_unset_admin": "Are you sure you want to grant user \"{{user}}\" admin rights?",
         "confirm_remove_user": "Are you sure you want to remove user \"{{user}}\"?",
-        "confirm_reset_password": "Are you sure you want to reset password of user \"{{user}}\"?"
+        "confirm_reset_password": "Are you sure you want to reset password of user \"{{user}}\"?",
+        "rem_ip_alert": "Your session was used from another address ({{ip}}) on {{date}} while \"Log out if IP changed\" was on, so it has been closed."
     },
     msgh: {
         "default": "System message",
         "default_confirm": "Please confirm your action",
         "confirm_logout": "Goodbye?",
         "ftp_upload_help": "FTP upload help",
+        "rem_ip_alert": "Session closed",
     },
     tracksSort: {
         [TracksSort.CUSTOM]: "My sort",
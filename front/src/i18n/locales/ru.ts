@@ -138,7 +138,7 @@ const en = {
         "reconnect_counter": "Повторная попытка через <strong>{{counter}}</strong>...",
         "already_connected": "Вы уже подключены",
         "loading": "Загрузка Audy...",
-        "already_connected_desc": "Вы можете держать только 1 вкладку с Audy активной",
+        "already_connected_desc": "У вас открыто слишком много вкладок с Audy. Закройте их все, чтобы продолжить здесь",
         "destroyed": "Эта вкладка была уничтожена",
         "destroyed_desc": "Пожалуйста, просто закройте её"
     },
@@ -149,7 +149,7 @@ const en = {
         "ftp_upload_no_valid_files": "Не удалось найти хотя бы 1 подходящий файл в папке FTP",
         "validation": "Введенные вами данные не прошли валидацию",
         "no_file": "Не удалось открыть или прочитать загруженный вами файл",
-        "unsupported_format": "Загруженный файл был не в формате .mp3",
+        "unsupported_format": "Формат загруженного файла не поддерживается (допустимы mp3, flac, ogg, opus, m4a и wav)",
         "ftp_upload_already_in_process": "FTP загрузка уже активна. Дождитесь ее завершения",
         "ftp_upload_dir_read": "Не удалось считать директорию ftp_upload на сервере",
         "ftp_upload_dir_make": "Не удалось создать директорию ftp_upload на сервере",
@@ -177,7 +177,40 @@ const en = {
         "no_avatar_file": "Не удалось найти файл с вашим аватаром",
         "login_already_taken": "Это имя пользователя уже занято. Выберите другое",
         "saving_config": "Произошла ошибка при попытке сохранить конфигурационный файл этого сервера Audy",
-        "theme_key_invalid": "Одна из ваших тем не прошла валидацию"
+        "theme_key_invalid": "Одна из ваших тем не прошла валидацию",
+        "album_not_found": "Альбом не найден. Попробуйте обновить страницу",
+        "artist_not_found": "Исполнитель не найден. Попробуйте обновить страницу",
+        "search_unavailable": "Поиск недоступен на этом сервере Audy",
+        "unable_to_generate_password": "Не удалось сгенерировать пароль",
+        "unable_to_hash_password": "Не удалось захешировать пароль",
+        "session_not_found": "Сессия не найдена",
+        "job_not_found": "Задача не найдена",
+        "job_not_cancellable": "Задача уже завершена",
+        "job_not_retryable": "Повторить можно только завершившиеся ошибкой или отменённые задачи",
+        "external_tracks_read_only": "Треки из папок библиотеки доступны только для чтения и не могут быть удалены",
+        "no_library_folders": "Папки библиотеки не настроены",
+        "library_folder_unavailable": "Папка библиотеки недоступна",
+        "unsupported_tus_version": "Неподдерживаемая версия протокола загрузки",
+        "invalid_upload_length": "Неверный размер загрузки",
+        "upload_too_large": "Файл слишком большой для загрузки",
+        "invalid_upload_metadata": "Неверные метаданные загрузки",
+        "invalid_checksum": "Неверная контрольная сумма",
+        "upload_create": "Не удалось начать загрузку",
+        "upload_not_found": "Загрузка не найдена или устарела",
+        "upload_offset_mismatch": "Загрузка рассинхронизирована с сервером",
+        "upload_locked": "Загрузка уже выполняется",
+        "invalid_content_type": "Неверный тип содержимого",
+        "unsupported_checksum": "Неподдерживаемый алгоритм контрольной суммы",
+        "write_file": "Не удалось записать файл",
+        "checksum_mismatch": "Загруженный файл поврежден, контрольная сумма не совпадает",
+        "create_dir": "Не удалось создать папку",
+        "archive_too_many_entries": "В архиве слишком много файлов",
+        "archive_unsafe_path": "Архив содержит файлы с небезопасными путями",
+        "archive_too_large": "Содержимое архива слишком большое",
+        "archive_read": "Не удалось прочитать архив",
+        "archive_no_tracks": "В архиве нет треков",
+        "move_file": "Не удалось переместить файл",
+        "open_file": "Не удалось открыть файл"
     },
     errorh: {
         "db": "Ошибка БД",
@@ -188,20 +221,22 @@ const en = {
         "confirm_logout": "Вы действительно хотите выйти из аккаунта?",
         "confirm_remove_tracks": "Вы действительно хотите удалить {{count}} треков из \"{{plName}}\"?",
         "confirm_remove_track": "Вы действительно хотите удалить трек \"{{trackName}}\" из \"{{plName}}\"?",
-        "ftp_upload_help": "Загрузка по FTP позволяет вам просканировать серверную папку (%AudyServerDir% / upload / ftp_upload). Все подходящие файлы формата .mp3 будут обработаны и добавлены в библиотеку этого сервера Audy. Просто нажмите кнопку Начать, чтобы запустить этот процесс.",
+        "ftp_upload_help": "Загрузка по FTP позволяет вам просканировать серверную папку (%AudyServerDir% / upload / ftp_upload). Все подходящие аудиофайлы (mp3, flac, ogg, opus, m4a, wav) будут обработаны и добавлены в библиотеку этого сервера Audy. Просто нажмите кнопку Начать, чтобы запустить этот процесс.",
         "confirm_remove_avatar": "Вы действительно хотите удалить свой аватар?",
         "confirm_remove_theme": "Вы действительно хотите удалить тему \"{{tName}}\"",
         "password_resetted": "Пароль пользователя {{user}} был успешно сброшен на: {{newPassword}}",
         "confirm_set_admin": "Вы действительно хотите лишить пользователя \"{{user}}\" прав администратора?",
         "confirm_unset_admin": "Вы действительно хотите дать пользователю \"{{user}}\" права администратора?",
         "confirm_remove_user": "Вы действительно хотите удалить пользователя \"{{user}}\"?",
-        "confirm_reset_password": "Вы действительно хотите сбросить пароль пользователя \"{{user}}\"?"
+        "confirm_reset_password": "Вы действительно хотите сбросить пароль пользователя \"{{user}}\"?",
+        "rem_ip_alert": "Ваша сессия была использована с другого адреса ({{ip}}) {{date}} при включенной опции \"Выйти из аккаунта при смене IP адреса\", поэтому она была закрыта."
     },
     msgh: {
         "default": "Системное сообщение",
         "default_confirm": "Пожалуйста, подтвердите ваше действие",
         "confirm_logout": "До свидания?",
         "ftp_upload_help": "Справка о загрузке по FTP",
+        "rem_ip_alert": "Сессия закрыта",
     },
     tracksSort: {
         [TracksSort.CUSTOM]: "Своя сортировка",
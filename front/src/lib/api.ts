@@ -1,6 +1,7 @@
 import axios, { AxiosRequestConfig, AxiosResponse } from 'axios';
-import { Playlist, StringMapObject, UploadFile, UserTheme, ServerData, AppLanguages, TKey, UserInTable } from './types';
+import { Playlist, StringMapObject, UploadFile, UserTheme, ServerData, AppLanguages, TKey, UserInTable, Album, Artist, Track, SearchResult, Session, TranscodeProfile, Job, JobState, DuplicateCluster } from './types';
 import utils from '../lib/utils';
+import { LibChanges } from './libcache';
 
 type RequestParams = FormData | StringMapObject<string | File | boolean | number | any[] | Blob>
 type DefaultResponse<D = any> = {
@@ -89,8 +90,40 @@ const Api = {
         });
     },
 
-    closech() {
-        return Api.alertedReq("closech");
+    setTranscodeProfiles(profiles: TranscodeProfile[]) {
+        return Api.alertedReq("settranscodeprofiles", {
+            profiles: JSON.stringify(profiles)
+        });
+    },
+
+    setLibraryFolders(folders: string[]) {
+        return Api.alertedReq("setlibraryfolders", {
+            folders: JSON.stringify(folders)
+        });
+    },
+
+    rescanLibrary() {
+        return Api.alertedReq("rescanlibrary");
+    },
+
+    getJobs(state?: JobState) {
+        return Api.alertedReq<Job[]>("getjobs", state ? {state} : undefined);
+    },
+
+    cancelJob(id: number) {
+        return Api.alertedReq("canceljob", {
+            id
+        });
+    },
+
+    retryJob(id: number) {
+        return Api.alertedReq("retryjob", {
+            id
+        });
+    },
+
+    closech(id?: string) {
+        return Api.alertedReq("closech", id ? {id} : undefined);
     }
 };
 
@@ -124,6 +157,32 @@ export const UserApi = {
         });
     },
 
+    getSessions() {
+        return Api.alertedReq<Session[]>("getsessions");
+    },
+
+    revokeSession(id: string) {
+        return Api.alertedReq("revokesession", {
+            id
+        });
+    },
+
+    revokeSessions(except_current: boolean) {
+        return Api.alertedReq("revokesessions", {
+            except_current
+        });
+    },
+
+    revokeUserSessions(id: number) {
+        return Api.alertedReq("revokeusersessions", {
+            id
+        });
+    },
+
+    genSubsonicPassword() {
+        return Api.alertedReq<{login: string, password: string}>("gensubsonicpassword");
+    },
+
     resetPassword(id: number) {
         return Api.alertedReq<{newPassword: string}>("resetpassword", {
             id
@@ -194,6 +253,30 @@ export const PlaylistApi = {
         });
     },
 
+    insertTracks(id: number, index: number, hashes: string[]) {
+        return Api.alertedReq<number>("insertpltracks", {
+            id, index, hashes
+        });
+    },
+
+    appendTracks(id: number, hashes: string[]) {
+        return Api.alertedReq<number>("appendpltracks", {
+            id, hashes
+        });
+    },
+
+    moveTracks(id: number, from: number, count: number, to: number) {
+        return Api.alertedReq<number>("movepltracks", {
+            id, from, count, to
+        });
+    },
+
+    removeTracks(id: number, from: number, count: number) {
+        return Api.alertedReq<number>("removepltracks", {
+            id, from, count
+        });
+    },
+
     add(name: string, tracks: string[]) {
         const tracksJSON = JSON.stringify(tracks);
         return Api.alertedReq<number>("addpl", {
@@ -223,6 +306,17 @@ export const TrackApi = {
         });
     },
 
+    getDuplicates() {
+        return Api.alertedReq<DuplicateCluster[]>("getduplicates");
+    },
+
+    merge(keep: string, hashes: string[]) {
+        return Api.alertedReq("mergetracks", {
+            keep,
+            hashes
+        });
+    },
+
     update(hash: string, artist: string, title: string) {
         return Api.req("updatetrack", {
             hash,
@@ -248,6 +342,49 @@ export const TrackApi = {
         return Api.alertedReq("ftp_upload");
     }
 };
+
+export const LibraryApi = {
+    getAlbums() {
+        return Api.req<Album[]>("getalbums");
+    },
+
+    getAlbum(id: number) {
+        return Api.req<{album: Album, tracks: Track[]}>("getalbum", {
+            id
+        });
+    },
+
+    getArtists() {
+        return Api.req<Artist[]>("getartists");
+    },
+
+    getArtistAlbums(id: number) {
+        return Api.req<{artist: Artist, albums: Album[]}>("getartistalbums", {
+            id
+        });
+    },
+
+    getTracks(cursor: string, limit: number) {
+        return Api.req<{tracks: Track[], cursor: string, revision: number}>("tracks", {
+            cursor,
+            limit
+        });
+    },
+
+    getChanges(since: number) {
+        return Api.req<LibChanges>("libchanges", {
+            since
+        });
+    },
+
+    search(query: string, offset: number, limit: number) {
+        return Api.req<{total: number, offset: number, results: SearchResult[]}>("search", {
+            query,
+            offset,
+            limit
+        });
+    }
+};
 /*
 export const VkApi = {
     search(query) {
@@ -0,0 +1,61 @@
+import { StringMapObject, Track } from './types';
+
+type CachedLib = {
+    revision: number,
+    lib: StringMapObject<Track>
+}
+
+export type LibChanges = {
+    revision: number,
+    reset: boolean,
+    tracks: Track[],
+    removed: string[]
+}
+
+const storageKey = "libCache";
+
+const libcache = {
+    load(): CachedLib | null {
+        const raw = window.localStorage.getItem(storageKey);
+
+        if(!raw) {
+            return null;
+        }
+
+        try {
+            return JSON.parse(raw);
+        } catch {
+            libcache.clear();
+            return null;
+        }
+    },
+
+    save(revision: number, lib: StringMapObject<Track>) {
+        try {
+            window.localStorage.setItem(storageKey, JSON.stringify({revision, lib}));
+        } catch {
+            // library does not fit into the storage quota, sync it fully next time
+            libcache.clear();
+        }
+    },
+
+    clear() {
+        window.localStorage.removeItem(storageKey);
+    },
+
+    apply(lib: StringMapObject<Track>, changes: LibChanges) {
+        const result = {...lib};
+
+        for(const t of changes.tracks) {
+            result[t.md5] = t;
+        }
+
+        for(const hash of changes.removed) {
+            delete result[hash];
+        }
+
+        return result;
+    }
+};
+
+export default libcache;
@@ -9,51 +9,66 @@ import i18n from '../i18n';
 import { play, removeTracks, setUser, uploadTrack } from '../store/thunks';
 import utils from './utils';
 import { uploadActions } from '../store/reducers/upload';
+import libcache, { LibChanges } from './libcache';
+import { LibraryApi } from './api';
 
 type SSEHandler = (data: any) => void
 
 type SSE = {
     handlers: {[key: string]: SSEHandler},
     stream: EventSource | null,
+    listenerId: string | null,
     close: () => void
     init: () => void
 }
 
-type RawPlaylist = Playlist & {
-    tracks: string
-}
-
 type RawUserState = UserState & {
     themes: string
 }
 
 export interface SSEHandlerDataInit {
-    playlists: RawPlaylist[],
+    playlists: Playlist[],
     u: RawUserState,
     apk: string,
     lib: string,
+    changes: LibChanges | null,
+    revision: number,
     custom_app_title: string,
+    rem_ip_alert: {ip: string, time: number} | null,
+    listener_id: string,
 }
 
 export interface SSEHandlerDataTrackLyrics {
     hash: string,
-    lyrics: string
+    lyrics: string,
+    revision: number
 }
 
 export interface FTPUFile {
     fileName: string,
     key: string,
-    success: boolean
+    success: boolean,
+    job_id: number
 }
 
 export interface SSEHandlerDataTrackUpdate {
     hash: string,
     title: string,
-    artist: string
+    artist: string,
+    album: string,
+    album_artist: string,
+    artist_id: number,
+    album_id: number,
+    revision: number
+}
+
+function saveLibCache(revision: number) {
+    libcache.save(revision, store.getState().tracks.lib);
 }
 
 const sse: SSE = {
     stream: null,
+    listenerId: null,
     close() {
         if(sse.stream != null && sse.stream.readyState !== EventSource.CLOSED) {
             sse.stream.close();
@@ -64,7 +79,10 @@ const sse: SSE = {
         store.dispatch(rootActions.setAppState(LoadingState.LOADING));
         sse.close();
 
-        sse.stream = new EventSource(process.env.REACT_APP_PROXY + "api/init", {
+        const cached = libcache.load();
+        const query = cached ? "?rev=" + cached.revision : "";
+
+        sse.stream = new EventSource(process.env.REACT_APP_PROXY + "api/init" + query, {
             withCredentials: process.env.NODE_ENV === "development"
         });
 
@@ -122,10 +140,20 @@ const sse: SSE = {
     },
     handlers: {
         init(data: SSEHandlerDataInit) {
+            sse.listenerId = data.listener_id;
             store.dispatch(playlistsActions.setApk(data.apk));
 
-            const lib: StringMapObject<Track> = JSON.parse(data.lib);
+            const cached = libcache.load();
+            let lib: StringMapObject<Track>;
+
+            if(data.changes && cached) {
+                lib = libcache.apply(cached.lib, data.changes);
+            } else {
+                lib = JSON.parse(data.lib);
+            }
+
             store.dispatch(tracksActions.setLib(lib));
+            libcache.save(data.revision, lib);
 
             const playlists: StringMapObject<Playlist> = {};
 
@@ -135,18 +163,11 @@ const sse: SSE = {
                 const rawpl = data.playlists[i];
                 const pl: Playlist = {
                     dbId: rawpl.dbId,
-                    tracks: [],
+                    tracks: rawpl.tracks.filter(t => lib[t]),
                     id: rawpl.id,
                     name: rawpl.name
                 };
 
-                try {
-                    pl.tracks = JSON.parse(rawpl.tracks);
-                } catch {
-                    console.warn("Playlist " + pl.name + " tracks json parsing error. We need to clear it's tracks now :(");
-                }
-
-                pl.tracks = pl.tracks.filter(t => lib[t]);
                 pl.dbId = pl.id;
 
                 if(pl.name === data.apk) {
@@ -222,20 +243,73 @@ const sse: SSE = {
             store.dispatch(playlistsActions.setPlaybacked(reservedPlaylist));
             
             store.dispatch(rootActions.init(data));
+
+            if(data.rem_ip_alert) {
+                utils.messageBoxT("rem_ip_alert", {
+                    ip: data.rem_ip_alert.ip,
+                    date: new Date(data.rem_ip_alert.time * 1000).toLocaleString()
+                });
+            }
         },
-        track_add(data: {track: Track}) {
+        lib_changed(data: {revision: number}) {
+            const cached = libcache.load();
+
+            if(!cached) {
+                sse.init();
+                return;
+            }
+
+            if(cached.revision >= data.revision) {
+                return;
+            }
+
+            LibraryApi.getChanges(cached.revision).then(changes => {
+                if(changes.reset) {
+                    sse.init();
+                    return;
+                }
+
+                const lib = store.getState().tracks.lib;
+
+                for(const t of changes.tracks) {
+                    if(lib[t.md5]) {
+                        store.dispatch(tracksActions.upload(t));
+                    } else {
+                        store.dispatch(uploadTrack(t));
+                    }
+                }
+
+                if(changes.removed.length > 0) {
+                    store.dispatch(removeTracks(changes.removed));
+                }
+
+                saveLibCache(changes.revision);
+            }).catch(() => {
+                console.warn("[SSE] Unable to fetch library changes");
+            });
+        },
+        track_add(data: {track: Track, revision: number}) {
             store.dispatch(uploadTrack(data.track));
+            saveLibCache(data.revision);
         },
-        tracks_remove(data: {hashes: string[]}) {
+        tracks_remove(data: {hashes: string[], revision: number}) {
             store.dispatch(removeTracks(data.hashes));
+            saveLibCache(data.revision);
+        },
+        tracks_merged(data: {keep: string, removed: string[], revision: number}) {
+            store.dispatch(playlistsActions.mergeTracks(data));
+            store.dispatch(removeTracks(data.removed));
+            saveLibCache(data.revision);
         },
         track_update(data: SSEHandlerDataTrackUpdate) {
             store.dispatch(tracksActions.updateTrack(data));
+            saveLibCache(data.revision);
         },
         track_lyrics(data: SSEHandlerDataTrackLyrics) {
             store.dispatch(tracksActions.updateLyrics(data));
+            saveLibCache(data.revision);
         },
-        ftpu_start(data: {files: number}) {
+        ftpu_start(data: {files: number, batch: string}) {
             if(data.files > 0) {
                 store.dispatch(uploadActions.setFtpUploadState(true));
             } else {
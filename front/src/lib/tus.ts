@@ -0,0 +1,129 @@
+import axios, { AxiosError, AxiosRequestConfig } from 'axios';
+import { ApiError } from './api';
+import { UploadFile } from './types';
+
+// Minimal client of the tus 1.0 protocol served at /api/upload/tus. Uploads
+// are sent in chunks and resumed after network errors or page reloads from
+// the last offset the server confirmed
+const endpoint = "/api/upload/tus";
+const chunkSize = 8 * 1024 * 1024;
+const retryDelays = [1000, 3000, 5000, 10000, 20000];
+const tusHeaders = {"Tus-Resumable": "1.0.0"};
+
+function storageKey(f: File) {
+    return ["tus", f.name, f.size, f.lastModified].join(":");
+}
+
+function encodeMetadata(value: string) {
+    return btoa(unescape(encodeURIComponent(value)));
+}
+
+function sleep(ms: number) {
+    return new Promise(r => setTimeout(r, ms));
+}
+
+function toApiError(err: AxiosError) {
+    const data = err.response?.data;
+
+    if(data && data.key) {
+        return new ApiError(data.key, data.error);
+    }
+
+    return new ApiError("http", err.message);
+}
+
+function retryable(err: AxiosError) {
+    const status = err.response?.status;
+
+    // no response means the connection dropped
+    return !status || status >= 500 || status === 409 || status === 423;
+}
+
+const tus = {
+    async upload(file: UploadFile, progressCallback?: (loaded: number) => void) {
+        const key = storageKey(file.file);
+        const options: AxiosRequestConfig = {
+            cancelToken: file.ct?.token
+        };
+
+        let url = window.localStorage.getItem(key);
+        let offset = 0;
+        let retries = 0;
+
+        for(;;) {
+            try {
+                if(url === null) {
+                    const res = await axios.post(endpoint, null, {...options, headers: {
+                        ...tusHeaders,
+                        "Upload-Length": file.file.size,
+                        "Upload-Metadata": "filename " + encodeMetadata(file.file.name)
+                    }});
+
+                    url = res.headers["location"] as string;
+
+                    if(!url) {
+                        throw new ApiError(res.data?.key ?? "http", res.data?.error);
+                    }
+
+                    offset = 0;
+                    window.localStorage.setItem(key, url);
+                } else {
+                    const res = await axios.head(url, {...options, headers: tusHeaders});
+                    offset = parseInt(res.headers["upload-offset"]);
+                }
+
+                while(offset < file.file.size) {
+                    const from = offset;
+                    const res = await axios.patch(url, file.file.slice(from, from + chunkSize), {...options,
+                        headers: {
+                            ...tusHeaders,
+                            "Content-Type": "application/offset+octet-stream",
+                            "Upload-Offset": from
+                        },
+                        onUploadProgress: (e: ProgressEvent) => progressCallback?.(from + e.loaded)
+                    });
+
+                    offset = parseInt(res.headers["upload-offset"]);
+                    retries = 0;
+                }
+
+                window.localStorage.removeItem(key);
+                return;
+            } catch(err) {
+                if(err instanceof ApiError) {
+                    window.localStorage.removeItem(key);
+                    throw err;
+                }
+
+                if(axios.isCancel(err)) {
+                    if(url !== null) {
+                        axios.delete(url, {headers: tusHeaders}).catch(() => {});
+                    }
+
+                    window.localStorage.removeItem(key);
+                    throw new ApiError("http", err.message);
+                }
+
+                const status = err.response?.status;
+
+                // the upload expired, it starts over
+                if(status === 404 && url !== null && retries < retryDelays.length) {
+                    window.localStorage.removeItem(key);
+                    url = null;
+                    retries++;
+                    continue;
+                }
+
+                if(retryable(err) && retries < retryDelays.length) {
+                    await sleep(retryDelays[retries++]);
+                    continue;
+                }
+
+                window.localStorage.removeItem(key);
+                throw toApiError(err);
+            }
+        }
+    }
+};
+
+export default tus;
@@ -55,7 +55,50 @@ export type Track = {
     duration: number,
     has_image: boolean,
     timestamp: number,
-    lyrics: string
+    lyrics: string,
+    format: string,
+    mime: string,
+    album: string,
+    album_artist: string,
+    track_number: number,
+    disc_number: number,
+    year: number,
+    genre: string,
+    artist_id: number,
+    album_id: number,
+    loudness: number,
+    track_gain: number,
+    track_peak: number,
+    album_gain: number,
+    album_peak: number,
+    gain_source: "" | "tags" | "analysis" | "failed",
+    external: boolean
+}
+
+export type Album = {
+    id: number,
+    title: string,
+    artist_id: number,
+    artist: string,
+    year: number,
+    has_image: boolean,
+    track_count: number,
+    duration: number
+}
+
+export type SearchResult = {
+    track: Track,
+    artist: string,
+    title: string,
+    album: string,
+    lyrics: string,
+    rank: number
+}
+
+export type Artist = {
+    id: number,
+    name: string,
+    album_count: number
 }
 
 export type UserTheme = {
@@ -71,6 +114,48 @@ export type UserInTable = {
     id: number
 }
 
+export type Session = {
+    id: string,
+    created: number,
+    last_seen: number,
+    expires: number,
+    ip: string,
+    user_agent: string,
+    current: boolean
+}
+
+export type JobState = "queued" | "running" | "done" | "failed" | "cancelled"
+
+export type Duplicate = {
+    track: Track,
+    similarity: number
+}
+
+export type DuplicateCluster = {
+    tracks: Duplicate[]
+}
+
+export type Job = {
+    id: number,
+    type: string,
+    batch: string,
+    target: string,
+    payload: string,
+    state: JobState,
+    attempts: number,
+    max_attempts: number,
+    run_after: number,
+    error: string,
+    created: number,
+    updated: number
+}
+
+export type TranscodeProfile = {
+    name: string,
+    format: string,
+    bit_rate: number
+}
+
 export type ServerData = {
     users: UserInTable[],
     vars: {
@@ -78,6 +163,9 @@ export type ServerData = {
         session_time: number,
         custom_app_title: string
     },
+    transcoder: string,
+    transcode_profiles: TranscodeProfile[],
+    library_folders: string[],
     fetched: boolean
 }
 
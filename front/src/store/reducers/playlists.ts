@@ -76,6 +76,14 @@ const playlists = createSlice({
         upload(state, action: PayloadAction<Track>) {
             state.list[-1].tracks.splice(0, 0, action.payload.md5);
         },
+        mergeTracks(state, action: PayloadAction<{keep: string, removed: string[]}>) {
+            const {keep, removed} = action.payload;
+
+            for(let k in state.list) {
+                const tracks = state.list[k].tracks.map(t => removed.includes(t) ? keep : t);
+                state.list[k].tracks = tracks.filter((t, i) => t !== keep || tracks.indexOf(t) === i);
+            }
+        },
         removeTracks(state, action: PayloadAction<string[]>) {
             for(let k in state.list) {
                 state.list[k].tracks = state.list[k].tracks.filter(t => !action.payload.includes(t));
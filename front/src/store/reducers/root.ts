@@ -37,6 +37,9 @@ const initialState: RootState = {
             default_language: "",
             session_time: 0
         },
+        transcoder: "",
+        transcode_profiles: [],
+        library_folders: [],
         fetched: false
     },
     bgUrl: "/img/default_album.png",
@@ -74,6 +74,10 @@ const tracks = createSlice({
             if(state.lib[action.payload.hash]) {
                 state.lib[action.payload.hash].title = action.payload.title;
                 state.lib[action.payload.hash].artist = action.payload.artist;
+                state.lib[action.payload.hash].album = action.payload.album;
+                state.lib[action.payload.hash].album_artist = action.payload.album_artist;
+                state.lib[action.payload.hash].artist_id = action.payload.artist_id;
+                state.lib[action.payload.hash].album_id = action.payload.album_id;
             }
         },
         setSrc(state, action: PayloadAction<Track | null>) {
@@ -1,6 +1,7 @@
 import { AppThunk, store } from ".";
 import i18n from "../i18n";
-import { ApiError, TrackApi } from "../lib/api";
+import { ApiError } from "../lib/api";
+import tus from "../lib/tus";
 import { FileState, TracksRepeat } from "../lib/enums";
 import { Track, UploadFile } from "../lib/types";
 import utils from "../lib/utils";
@@ -66,8 +67,8 @@ export const queueNextHttp = (): AppThunk => dispatch => {
     }
 
     dispatch(uploadActions.setLoadedCurrent(0));
-    TrackApi.upload(nextFile, progress => {
-        dispatch(uploadActions.setLoadedCurrent(progress.loaded));
+    tus.upload(nextFile, loaded => {
+        dispatch(uploadActions.setLoadedCurrent(loaded));
     }).then(() => {
         dispatch(uploadActions.setCurrentFileDone());
         dispatch(queueNextHttp());
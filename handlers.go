@@ -1,8 +1,10 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	cryptorand "crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +12,14 @@ import (
 	"io/ioutil"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
@@ -20,14 +27,6 @@ import (
 
 type AudyHandlers struct{}
 
-type AudyChanListener struct {
-	Channel      chan interface{}
-	User         *DBUser
-	ChCtx        *gin.Context
-	Id           string
-	Disconnected bool
-}
-
 type AudyTheme struct {
 	Name   string            `json:"name"`
 	Id     string            `json:"id"`
@@ -35,13 +34,6 @@ type AudyTheme struct {
 	Vars   map[string]string `json:"vars"`
 }
 
-const sampleRate int = 48000
-const chunkSize int64 = 1024 * 500
-
-var ftpUploadInProcess bool = false
-
-var channels map[int]*AudyChanListener = make(map[int]*AudyChanListener, 0)
-
 func R_music(c *gin.Context) {
 	u := auth.GetUser(c)
 
@@ -49,92 +41,99 @@ func R_music(c *gin.Context) {
 		return
 	}
 
-	c.Header("Connection", "keep-alive")
-	c.Header("Content-Type", "audio/mpeg")
-	c.Header("Accept-Ranges", "bytes")
-
-	filePath := fmt.Sprint("db/music/", c.Param("file"), "/track")
+	maxBitRate, _ := strconv.Atoi(c.Query("maxBitRate"))
+	format := c.Query("format")
 
-	fi, err := os.Stat(filePath)
-
-	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+	if maxBitRate > 0 || len(format) > 0 {
+		serveTranscodedTrack(c, c.Param("file"), format, maxBitRate)
 		return
 	}
 
-	f, err := os.OpenFile(filePath, os.O_RDONLY, os.ModePerm)
+	serveTrack(c, c.Param("file"))
+}
+
+// serveTrack streams the track file. Range, If-Range, If-None-Match and
+// If-Modified-Since are handled by http.ServeContent, the md5 being the hash
+// of the file contents makes a strong ETag
+func serveTrack(c *gin.Context, hash string) {
+	mime := getFormat("mp3").Mime
 
-	if err != nil {
-		fmt.Printf("error while opening file %v: %v\n", filePath, err.Error())
-		return
+	if t, ok := libTrack(hash); ok && len(t.Mime) > 0 {
+		mime = t.Mime
 	}
 
-	defer f.Close()
+	f, info, err := openTrackInfo(hash)
 
 	if err != nil {
-		fmt.Printf("error while getting file %v stat: %v", filePath, err.Error())
+		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
-	rangeHeader := c.Request.Header.Get("Range")
-	rangeHeader = strings.Replace(rangeHeader, "bytes=", "", -1)
+	defer f.Close()
 
-	parts := strings.Split(rangeHeader, "-")
-	var bytes0, bytes1 int64 = 0, fi.Size()
+	c.Header("Content-Type", mime)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", fmt.Sprintf("%q", hash))
+	c.Header("Cache-Control", "private, no-cache")
 
-	if len(parts) == 2 {
-		bytes0, err = strconv.ParseInt(parts[0], 10, 64)
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime, f)
+}
 
-		if err != nil {
-			fmt.Printf("error while parsing byte range 0 (%v): %v\n", parts[0], err.Error())
-			c.Status(http.StatusInternalServerError)
-			return
-		}
+// openTrackInfo opens the track file of hash along with its size and
+// modification time
+func openTrackInfo(hash string) (BlobReader, *BlobInfo, error) {
+	var info *BlobInfo
+	var err error
 
-		if len(parts[1]) > 0 {
-			bytes1, err = strconv.ParseInt(parts[1], 10, 64)
+	if t, ok := libTrack(hash); ok {
+		info, err = statTrack(t)
+	} else {
+		info, err = store.Stat(trackKey(hash))
+	}
 
-			if err != nil {
-				fmt.Printf("error while parsing byte range 1 (%v): %v\n", parts[1], err.Error())
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-		}
+	if err != nil {
+		return nil, nil, err
 	}
 
-	diff := bytes1 - bytes0
+	f, err := openTrackByHash(hash)
 
-	if diff < 0 {
-		fmt.Printf("byte range 0 is higher than 1 (%v)\n", parts)
-		c.Status(http.StatusInternalServerError)
-		return
-	} else if diff > chunkSize {
-		diff = chunkSize
-		bytes1 = bytes0 + chunkSize
-	}
+	return f, info, err
+}
 
-	bufSize := sampleRate
+// serveBlob sends the blob at key, or the fallback file when there is no such
+// blob. An empty fallback answers 404
+func serveBlob(c *gin.Context, key, fallback string) {
+	info, err := store.Stat(key)
+	var f BlobReader
 
-	if diff < int64(sampleRate) {
-		bufSize = int(diff)
+	if err == nil {
+		f, err = store.Open(key)
 	}
 
-	if bytes1 == fi.Size() {
-		bytes1--
+	if err != nil {
+		if len(fallback) > 0 {
+			c.File(fallback)
+		} else {
+			c.AbortWithStatus(http.StatusNotFound)
+		}
+
+		return
 	}
 
-	c.Header("Content-Length", fmt.Sprint(diff))
-	c.Header("Content-Range", fmt.Sprintf("bytes %v-%v/%v", bytes0, bytes1, fi.Size()))
+	defer f.Close()
 
-	f.Seek(bytes0, 0)
+	http.ServeContent(c.Writer, c.Request, path.Base(key), info.ModTime, f)
+}
 
-	reader := bufio.NewReaderSize(io.LimitReader(f, diff), bufSize)
+// attachmentDisposition names a download the way gin's FileAttachment does
+func attachmentDisposition(name string) string {
+	for _, r := range name {
+		if r > unicode.MaxASCII {
+			return "attachment; filename*=UTF-8''" + url.QueryEscape(name)
+		}
+	}
 
-	c.Status(http.StatusPartialContent)
-	c.Stream(func(w io.Writer) bool {
-		reader.WriteTo(w)
-		return false
-	})
+	return fmt.Sprintf("attachment; filename=%q", name)
 }
 
 func R_upload(c *gin.Context) {
@@ -151,8 +150,10 @@ func R_upload(c *gin.Context) {
 		return
 	}
 
-	if !strings.HasSuffix(strings.ToLower(trackFile.Filename), ".mp3") {
-		sendErr(c, "unsupported_format", "Uploaded file was not in .mp3 extension")
+	isArchive := isArchiveFileName(trackFile.Filename)
+
+	if !isArchive && !isAudioFileName(trackFile.Filename) {
+		sendErr(c, "unsupported_format", fmt.Sprintf("Uploaded file %v has unsupported extension", trackFile.Filename))
 		return
 	}
 
@@ -161,24 +162,40 @@ func R_upload(c *gin.Context) {
 		os.Mkdir("upload/ftp_upload", os.ModePerm)
 	}
 
-	filePath := fmt.Sprint("upload/", trackFile.Filename)
+	filePath := fmt.Sprint("upload/", filepath.Base(trackFile.Filename))
 	c.SaveUploadedFile(trackFile, filePath)
 
-	track, procErr := processTrack(filePath, trackFile.Filename)
+	if isArchive {
+		results, procErr := ingestArchive(filePath, trackFile.Filename)
+
+		if procErr != nil {
+			sendErr(c, procErr.key, procErr.Error())
+			return
+		}
+
+		sendRes(c, results)
+		return
+	}
+
+	// kept by processTrack when it fails, nothing retries it here
+	defer os.Remove(filePath)
+
+	track, procErr := processTrack(filePath, trackFile.Filename, "")
 
 	if procErr != nil {
 		sendErr(c, procErr.key, procErr.Error())
 		return
 	}
 
-	lib[track.Md5] = track
+	setLibTrack(track)
 
-	updateLibCache()
+	invalidateLibCache()
 
 	SendMessageAll(&gin.H{
 		"type": "track_add",
 		"data": &gin.H{
-			"track": track,
+			"track":    track,
+			"revision": libRevision(),
 		},
 	})
 
@@ -192,11 +209,6 @@ func R_ftpupload(c *gin.Context) {
 		return
 	}
 
-	if ftpUploadInProcess {
-		sendErr(c, "ftp_upload_already_in_process", "")
-		return
-	}
-
 	files := make([]os.FileInfo, 0)
 	rawFiles, err := ioutil.ReadDir("upload/ftp_upload")
 
@@ -205,17 +217,28 @@ func R_ftpupload(c *gin.Context) {
 		return
 	}
 
-	if _, err := os.Stat("db/music"); os.IsNotExist(err) {
-		os.Mkdir("db/music", os.ModePerm)
-	}
-
 	if err != nil {
 		sendErrAndPrint(c, "ftp_upload_dir_make", fmt.Sprintf("Error while trying to make not existing music dir: %v\n", err.Error()))
 		return
 	}
 
+	inProcess := false
+
 	for _, f := range rawFiles {
-		if f.IsDir() || !strings.HasSuffix(strings.ToLower(f.Name()), ".mp3") {
+		if f.IsDir() || !(isAudioFileName(f.Name()) || isArchiveFileName(f.Name())) {
+			continue
+		}
+
+		// files of an earlier upload that are still waiting aren't queued twice
+		active, dbErr := db.HasActiveJob(jobTypeIngest, fmt.Sprint("upload/ftp_upload/", f.Name()))
+
+		if dbErr != nil {
+			sendDBErrorAndPrint(c, dbErr)
+			return
+		}
+
+		if active {
+			inProcess = true
 			continue
 		}
 
@@ -223,322 +246,819 @@ func R_ftpupload(c *gin.Context) {
 	}
 
 	if len(files) == 0 {
-		sendErr(c, "ftp_upload_no_files", "")
+		if inProcess {
+			sendErr(c, "ftp_upload_already_in_process", "")
+		} else {
+			sendErr(c, "ftp_upload_no_files", "")
+		}
 		return
 	}
 
-	var acl *AudyChanListener = nil
-	if _, ok := channels[u.ID]; ok {
-		acl = channels[u.ID]
+	batch := genId()
 
-		if !acl.Disconnected {
-			acl.SendMessage(&gin.H{
-				"type": "ftpu_start",
-				"data": &gin.H{
-					"files": len(files),
-				},
-			})
+	for _, file := range files {
+		path := fmt.Sprint("upload/ftp_upload/", file.Name())
+		_, dbErr := jobQueue.Enqueue(jobTypeIngest, batch, path, u.ID, &ingestJobPayload{path, file.Name(), ingestSourceFtp, "", ""})
+
+		if dbErr != nil {
+			sendDBErrorAndPrint(c, dbErr)
+			return
 		}
 	}
 
-	go func() {
-		defer loadLib()
-		ftpUploadInProcess = true
-
-		for _, file := range files {
-			fileName := file.Name()
-			path := fmt.Sprint("upload/ftp_upload/", fileName)
+	hub.SendUser(u.ID, &gin.H{
+		"type": "ftpu_start",
+		"data": &gin.H{
+			"files": len(files),
+			"batch": batch,
+		},
+	})
 
-			track, procErr := processTrack(path, fileName)
-			success := true
-			errKey := ""
+	sendSuccess(c)
+}
 
-			if procErr != nil {
-				errKey = procErr.key
-				success = false
-			} else {
-				SendMessageAll(&gin.H{
-					"type": "track_add",
-					"data": &gin.H{
-						"track": track,
-					},
-				})
-			}
+func R_getjobs(c *gin.Context) {
+	u := auth.GetUser(c)
 
-			if !acl.Disconnected {
-				acl.SendMessage(&gin.H{
-					"type": "ftpu_file_processed",
-					"data": &gin.H{
-						"fileName": fileName,
-						"key":      errKey,
-						"success":  success,
-					},
-				})
-			}
-		}
+	if !u.checkAdmin(c) {
+		return
+	}
 
-		ftpUploadInProcess = false
-		if !acl.Disconnected {
-			acl.SendMessage(&gin.H{
-				"type": "ftpu_done",
-				"data": nil,
-			})
-		}
-	}()
+	state := c.PostForm("state")
 
-	sendSuccess(c)
-}
+	switch state {
+	case "", jobStateQueued, jobStateRunning, jobStateDone, jobStateFailed, jobStateCancelled:
+	default:
+		sendValidationError(c, fmt.Sprintf("state: %v", state), errors.New("Unknown job state"))
+		return
+	}
 
-func R_login(c *gin.Context) {
-	u := auth.GetUser(c)
+	jobs, dbErr := db.GetJobs(state, 500)
 
-	if u != nil {
-		sendErr(c, "already_logged_in", "")
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
 		return
 	}
 
-	login := c.PostForm("login")
-	password := c.PostForm("password")
+	sendRes(c, jobs)
+}
 
-	err := validateMany(
-		nv(login, 3, 20),
-		nv(password, 3, 20),
-	)
+// getJobParam loads the job given in the id param, sending the error itself
+func getJobParam(c *gin.Context) *DBJob {
+	id, err := strconv.Atoi(c.PostForm("id"))
 
 	if err != nil {
-		sendValidationError(c, fmt.Sprintf("login: %v; password: %v", login, strings.Repeat("*", len(password))), err)
-		return
+		sendValidationError(c, fmt.Sprintf("id: %v", c.PostForm("id")), err)
+		return nil
 	}
 
-	u, dbErr := db.GetUserByCreds(login, md5String(password))
+	job, dbErr := db.GetJob(id)
 
 	if dbErr != nil {
 		if dbErr.underlying == sql.ErrNoRows {
-			sendErr(c, "incorrect_login_password", "")
+			sendErr(c, "job_not_found", "")
 		} else {
 			sendDBErrorAndPrint(c, dbErr)
 		}
+		return nil
+	}
+
+	return job
+}
+
+func R_canceljob(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
 		return
 	}
 
-	hash := genHash()
+	job := getJobParam(c)
 
-	_, dbErr = db.UpdateUserHash(u.ID, hash)
+	if job == nil {
+		return
+	}
+
+	cancelled, dbErr := jobQueue.Cancel(job)
 
 	if dbErr != nil {
 		sendDBErrorAndPrint(c, dbErr)
 		return
 	}
 
-	c.SetCookie("session_hash", hash, config.SessionTime*60*60, "/", "", false, true)
+	if !cancelled {
+		sendErr(c, "job_not_cancellable", "")
+		return
+	}
+
 	sendSuccess(c)
 }
 
-func R_logout(c *gin.Context) {
+func R_retryjob(c *gin.Context) {
 	u := auth.GetUser(c)
 
-	if !u.check(c) {
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	job := getJobParam(c)
+
+	if job == nil {
+		return
+	}
+
+	if job.State != jobStateFailed && job.State != jobStateCancelled {
+		sendErr(c, "job_not_retryable", "")
 		return
 	}
 
-	delete(auth.SesCache, u.sessionHash)
+	if dbErr := jobQueue.Retry(job); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
 
-	c.SetCookie("session_hash", "", -1, "/", "", false, true)
 	sendSuccess(c)
 }
 
-func R_updatetrack(c *gin.Context) {
+func R_login(c *gin.Context) {
 	u := auth.GetUser(c)
 
-	if !u.checkAdmin(c) {
+	if u != nil {
+		sendErr(c, "already_logged_in", "")
 		return
 	}
 
-	hash := c.PostForm("hash")
-	newArtist := c.PostForm("artist")
-	newTitle := c.PostForm("title")
+	login := c.PostForm("login")
+	password := c.PostForm("password")
 
 	err := validateMany(
-		nv(hash, 1),
-		nv(newArtist, 1),
-		nv(newTitle, 1),
+		nv(login, 3, 20),
+		nv(password, 3, 20),
 	)
 
 	if err != nil {
-		sendValidationError(c, fmt.Sprintf("hash: %v; artist: %v; title: %v", hash, newArtist, newTitle), err)
+		sendValidationError(c, fmt.Sprintf("login: %v; password: %v", login, strings.Repeat("*", len(password))), err)
 		return
 	}
 
-	t, dbErr := db.GetTrack(hash)
+	u, dbErr := db.GetUserByCreds(login, password)
 
 	if dbErr != nil {
 		if dbErr.underlying == sql.ErrNoRows {
-			sendErr(c, "track_not_found", "")
+			sendErr(c, "incorrect_login_password", "")
 		} else {
 			sendDBErrorAndPrint(c, dbErr)
 		}
 		return
 	}
 
-	if t.Artist == newArtist && t.Title == newTitle {
-		sendErr(c, "no_changes", "")
-		return
+	if passwordNeedsRehash(u.password) {
+		rehashed, err := hashPassword(password)
+
+		if err != nil {
+			fmt.Printf("Unable to rehash password of user %v: %v\n", u.login, err.Error())
+		} else if _, dbErr = db.SetUserPassword(u.ID, rehashed); dbErr != nil {
+			dbErr.Print()
+		}
 	}
 
-	t.Title = newTitle
-	t.Artist = newArtist
+	u.ip = c.ClientIP()
 
-	_, dbErr = db.AddTrack(t)
+	if _, dbErr = db.SetUserIP(u.ID, u.ip); dbErr != nil {
+		dbErr.Print()
+	}
 
-	if err != nil {
+	dbErr = auth.CreateSession(c, u)
+
+	if dbErr != nil {
 		sendDBErrorAndPrint(c, dbErr)
 		return
 	}
 
-	lib[t.Md5] = t
-	updateLibCache()
-
-	SendMessageAll(&gin.H{
-		"type": "track_update",
-		"data": &gin.H{
-			"hash":   t.Md5,
-			"title":  t.Title,
-			"artist": t.Artist,
-		},
-	})
-
 	sendSuccess(c)
 }
 
-func R_removetracks(c *gin.Context) {
+func R_logout(c *gin.Context) {
 	u := auth.GetUser(c)
 
-	if !u.checkAdmin(c) {
+	if !u.check(c) {
 		return
 	}
 
-	hashes := c.PostFormArray("hashes[]")
-
-	if len(hashes) == 0 {
-		sendValidationError(c, fmt.Sprintf("hashes: %v", hashes), errors.New("Hashes list was empty"))
-		return
+	if s := auth.GetSession(c); s != nil {
+		if dbErr := auth.RevokeSession(s.ID); dbErr != nil {
+			dbErr.Print()
+		}
 	}
 
-	iArray := make([]interface{}, len(hashes))
-	for i, v := range hashes {
-		iArray[i] = v
-	}
+	c.SetCookie(SessionCookie, "", -1, "/", "", false, true)
+	sendSuccess(c)
+}
 
-	tracks, dbErr := db.GetTracksByHashes(iArray)
+func R_getsessions(c *gin.Context) {
+	u := auth.GetUser(c)
 
-	if len(tracks) == 0 {
-		sendSuccess(c)
+	if !u.check(c) {
 		return
 	}
 
-	iArray = make([]interface{}, len(tracks))
-
-	for i, v := range tracks {
-		iArray[i] = v.Md5
-	}
-
-	_, dbErr = db.RemoveTracks(iArray)
+	sessions, dbErr := db.GetUserSessions(u.ID)
 
 	if dbErr != nil {
 		sendDBErrorAndPrint(c, dbErr)
 		return
 	}
 
-	for _, t := range tracks {
-		trackPath := fmt.Sprint("db/music/", t.Md5)
-		err := os.RemoveAll(trackPath)
-
-		if err != nil {
-			sendErrAndPrint(c, "removing_tracks",
-				fmt.Sprintf("An error occurred while trying to remove track %v at path %v: %v\n", fmt.Sprint(t.Artist, " - ", t.Title), trackPath, err.Error()))
-			return
+	if current := auth.GetSession(c); current != nil {
+		for _, s := range sessions {
+			s.Current = s.ID == current.ID
 		}
-
-		delete(lib, t.Md5)
 	}
 
-	updateLibCache()
-
-	SendMessageAll(&gin.H{
-		"type": "tracks_remove",
-		"data": &gin.H{
-			"hashes": iArray,
-		},
-	})
-
-	sendSuccess(c)
+	sendRes(c, sessions)
 }
 
-func R_setlyrics(c *gin.Context) {
+func R_revokesession(c *gin.Context) {
 	u := auth.GetUser(c)
 
-	if !u.checkAdmin(c) {
+	if !u.check(c) {
 		return
 	}
 
-	hash := c.PostForm("hash")
-	newLyrics := c.PostForm("lyrics")
+	id := c.PostForm("id")
 
-	if len(hash) == 0 {
-		sendValidationError(c, fmt.Sprintf("hash: %v; lyrics: %v", hash, newLyrics), errors.New("Given hash was empty"))
+	if err := validate(nv(id, 1)); err != nil {
+		sendValidationError(c, fmt.Sprint("id: ", id), err)
 		return
 	}
 
-	t, err := db.GetTrack(hash)
+	s, dbErr := db.GetSession(id)
 
-	if err != nil {
-		if err.underlying == sql.ErrNoRows {
-			sendErr(c, "track_not_found", "")
-		} else {
-			sendDBErrorAndPrint(c, err)
-		}
+	if dbErr != nil && dbErr.underlying != sql.ErrNoRows {
+		sendDBErrorAndPrint(c, dbErr)
 		return
 	}
 
-	if newLyrics == t.Lyrics {
-		sendErr(c, "no_changes", "")
+	if s == nil || s.userID != u.ID {
+		sendErr(c, "session_not_found", "")
 		return
 	}
 
-	t.Lyrics = newLyrics
-	_, err = db.AddTrack(t)
-
-	if err != nil {
-		sendDBErrorAndPrint(c, err)
+	if dbErr = auth.RevokeSession(id); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
 		return
 	}
 
-	lib[t.Md5] = t
-	updateLibCache()
-
-	SendMessageAll(&gin.H{
-		"type": "track_lyrics",
-		"data": &gin.H{
-			"hash":   hash,
-			"lyrics": newLyrics,
-		},
-	})
+	if current := auth.GetSession(c); current != nil && current.ID == id {
+		c.SetCookie(SessionCookie, "", -1, "/", "", false, true)
+	}
 
 	sendSuccess(c)
 }
 
-func R_addpl(c *gin.Context) {
+func R_revokesessions(c *gin.Context) {
 	u := auth.GetUser(c)
 
 	if !u.check(c) {
 		return
 	}
 
-	newName := c.PostForm("name")
-	newTracks := c.PostForm("tracks")
+	exceptCurrent := c.PostForm("except_current")
 
-	err := validateMany(
-		nv(newName, 1, 30),
+	if err := validate(nv(exceptCurrent, 4, 5)); err != nil {
+		sendValidationError(c, fmt.Sprint("except_current: ", exceptCurrent), err)
+		return
+	}
+
+	exceptID := ""
+
+	if current := auth.GetSession(c); current != nil && exceptCurrent == "true" {
+		exceptID = current.ID
+	}
+
+	if dbErr := auth.RevokeUserSessions(u.ID, exceptID); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	if len(exceptID) == 0 {
+		c.SetCookie(SessionCookie, "", -1, "/", "", false, true)
+	}
+
+	sendSuccess(c)
+}
+
+func R_revokeusersessions(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	newID := c.PostForm("id")
+	uID, err := strconv.Atoi(newID)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprint("id: ", newID), err)
+		return
+	}
+
+	user, dbErr := db.GetUser(uID)
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendErr(c, "user_not_found", "")
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+		}
+
+		return
+	}
+
+	if user.login == config.RootUser && !u.IsRoot {
+		sendErr(c, "cannot_modify_root_user", "")
+		return
+	}
+
+	if dbErr = auth.RevokeUserSessions(uID, ""); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	hub.DisconnectUser(uID, &gin.H{
+		"type": "kick",
+		"data": nil,
+	})
+
+	sendSuccess(c)
+}
+
+func R_updatetrack(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	hash := c.PostForm("hash")
+	newArtist := c.PostForm("artist")
+	newTitle := c.PostForm("title")
+	newAlbum, hasAlbum := c.GetPostForm("album")
+	newAlbumArtist, hasAlbumArtist := c.GetPostForm("album_artist")
+
+	err := validateMany(
+		nv(hash, 1),
+		nv(newArtist, 1),
+		nv(newTitle, 1),
+	)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("hash: %v; artist: %v; title: %v", hash, newArtist, newTitle), err)
+		return
+	}
+
+	t, dbErr := db.GetTrack(hash)
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendErr(c, "track_not_found", "")
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+		}
+		return
+	}
+
+	if !hasAlbum {
+		newAlbum = t.Album
+	}
+
+	if !hasAlbumArtist {
+		newAlbumArtist = t.AlbumArtist
+	}
+
+	if t.Artist == newArtist && t.Title == newTitle && t.Album == newAlbum && t.AlbumArtist == newAlbumArtist {
+		sendErr(c, "no_changes", "")
+		return
+	}
+
+	t.Title = newTitle
+	t.Artist = newArtist
+	t.Album = newAlbum
+	t.AlbumArtist = newAlbumArtist
+	oldAlbumID := t.AlbumID
+
+	_, dbErr = db.AddTrack(t)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	applyAlbumCover(t)
+	removeOrphanAlbums()
+
+	setLibTrack(t)
+
+	if t.AlbumID != oldAlbumID {
+		refreshAlbumGain(oldAlbumID)
+		refreshAlbumGain(t.AlbumID)
+	}
+
+	invalidateLibCache()
+
+	SendMessageAll(&gin.H{
+		"type": "track_update",
+		"data": &gin.H{
+			"hash":         t.Md5,
+			"title":        t.Title,
+			"artist":       t.Artist,
+			"album":        t.Album,
+			"album_artist": t.AlbumArtist,
+			"artist_id":    t.ArtistID,
+			"album_id":     t.AlbumID,
+			"revision":     libRevision(),
+		},
+	})
+
+	sendSuccess(c)
+}
+
+func R_removetracks(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	hashes := c.PostFormArray("hashes[]")
+
+	if len(hashes) == 0 {
+		sendValidationError(c, fmt.Sprintf("hashes: %v", hashes), errors.New("Hashes list was empty"))
+		return
+	}
+
+	iArray := make([]interface{}, len(hashes))
+	for i, v := range hashes {
+		iArray[i] = v
+	}
+
+	tracks, dbErr := db.GetTracksByHashes(iArray)
+
+	if len(tracks) == 0 {
+		sendSuccess(c)
+		return
+	}
+
+	for _, t := range tracks {
+		if t.External {
+			sendErr(c, "external_tracks_read_only", fmt.Sprint("Track ", t.Md5, " belongs to a library folder"))
+			return
+		}
+	}
+
+	iArray = make([]interface{}, len(tracks))
+
+	for i, v := range tracks {
+		iArray[i] = v.Md5
+	}
+
+	_, dbErr = db.RemoveTracks(iArray)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	for _, t := range tracks {
+		err := removeTrackBlobs(t.Md5)
+
+		if err != nil {
+			sendErrAndPrint(c, "removing_tracks",
+				fmt.Sprintf("An error occurred while trying to remove track %v: %v\n", fmt.Sprint(t.Artist, " - ", t.Title), err.Error()))
+			return
+		}
+
+		removeTranscodeCache(t.Md5)
+		removeLibTrack(t.Md5)
+	}
+
+	albums := make(map[int]bool, 0)
+
+	for _, t := range tracks {
+		if !albums[t.AlbumID] {
+			albums[t.AlbumID] = true
+			refreshAlbumGain(t.AlbumID)
+		}
+	}
+
+	removeOrphanAlbums()
+	invalidateLibCache()
+
+	SendMessageAll(&gin.H{
+		"type": "tracks_remove",
+		"data": &gin.H{
+			"hashes":   iArray,
+			"revision": libRevision(),
+		},
+	})
+
+	sendSuccess(c)
+}
+
+func R_getduplicates(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	fingerprints, dbErr := db.GetFingerprints()
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, findDuplicates(fingerprints))
+}
+
+// R_mergetracks keeps one track of a set of duplicates. Playlists listing
+// the others get the kept track instead, then the others are removed
+func R_mergetracks(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	keep := c.PostForm("keep")
+	hashes := c.PostFormArray("hashes[]")
+
+	if len(hashes) == 0 {
+		sendValidationError(c, fmt.Sprintf("hashes: %v", hashes), errors.New("Hashes list was empty"))
+		return
+	}
+
+	keepTrack, ok := libTrack(keep)
+
+	if !ok {
+		sendErr(c, "track_not_found", fmt.Sprint("Track ", keep, " was not found"))
+		return
+	}
+
+	tracks := make([]*DBTrack, 0, len(hashes))
+	removed := make([]string, 0, len(hashes))
+	seen := map[string]bool{keep: true}
+
+	for _, h := range hashes {
+		t, ok := libTrack(h)
+
+		if !ok {
+			sendErr(c, "track_not_found", fmt.Sprint("Track ", h, " was not found"))
+			return
+		}
+
+		if seen[h] {
+			continue
+		}
+
+		seen[h] = true
+
+		if t.External {
+			sendErr(c, "external_tracks_read_only", fmt.Sprint("Track ", t.Md5, " belongs to a library folder"))
+			return
+		}
+
+		tracks = append(tracks, t)
+		removed = append(removed, h)
+	}
+
+	if len(tracks) == 0 {
+		sendErr(c, "no_changes", fmt.Sprint("Nothing to merge into track ", keepTrack.Md5))
+		return
+	}
+
+	if dbErr := db.MergePlaylistTracks(keep, removed); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	if dbErr := dropTracks(tracks); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	removeOrphanAlbums()
+	invalidateLibCache()
+
+	SendMessageAll(&gin.H{
+		"type": "tracks_merged",
+		"data": &gin.H{
+			"keep":     keep,
+			"removed":  removed,
+			"revision": libRevision(),
+		},
+	})
+
+	sendSuccess(c)
+}
+
+func R_setlyrics(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	hash := c.PostForm("hash")
+	newLyrics := c.PostForm("lyrics")
+
+	if len(hash) == 0 {
+		sendValidationError(c, fmt.Sprintf("hash: %v; lyrics: %v", hash, newLyrics), errors.New("Given hash was empty"))
+		return
+	}
+
+	t, err := db.GetTrack(hash)
+
+	if err != nil {
+		if err.underlying == sql.ErrNoRows {
+			sendErr(c, "track_not_found", "")
+		} else {
+			sendDBErrorAndPrint(c, err)
+		}
+		return
+	}
+
+	if newLyrics == t.Lyrics {
+		sendErr(c, "no_changes", "")
+		return
+	}
+
+	t.Lyrics = newLyrics
+	_, err = db.AddTrack(t)
+
+	if err != nil {
+		sendDBErrorAndPrint(c, err)
+		return
+	}
+
+	setLibTrack(t)
+	invalidateLibCache()
+
+	SendMessageAll(&gin.H{
+		"type": "track_lyrics",
+		"data": &gin.H{
+			"hash":     hash,
+			"lyrics":   newLyrics,
+			"revision": libRevision(),
+		},
+	})
+
+	sendSuccess(c)
+}
+
+func R_search(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	if !db.fts {
+		sendErr(c, "search_unavailable", "")
+		return
+	}
+
+	query := strings.TrimSpace(c.PostForm("query"))
+	newOffset := c.DefaultPostForm("offset", "0")
+	newLimit := c.DefaultPostForm("limit", "50")
+
+	err := validate(nv(query, 1, 200))
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("query: %v", query), err)
+		return
+	}
+
+	offset, err := strconv.Atoi(newOffset)
+
+	if err == nil && offset < 0 {
+		err = errors.New("Offset must not be negative")
+	}
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("offset: %v", newOffset), err)
+		return
+	}
+
+	limit, err := strconv.Atoi(newLimit)
+
+	if err == nil && (limit < 1 || limit > 200) {
+		err = errors.New("Limit must be in range between 1 and 200")
+	}
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("limit: %v", newLimit), err)
+		return
+	}
+
+	results, total, dbErr := db.SearchTracks(query, offset, limit)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, &gin.H{
+		"total":   total,
+		"offset":  offset,
+		"results": results,
+	})
+}
+
+func R_tracks(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	cursor := c.PostForm("cursor")
+	newLimit := c.DefaultPostForm("limit", "500")
+
+	limit, err := strconv.Atoi(newLimit)
+
+	if err == nil && (limit < 1 || limit > 5000) {
+		err = errors.New("Limit must be in range between 1 and 5000")
+	}
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("limit: %v", newLimit), err)
+		return
+	}
+
+	revision := libRevision()
+	tracks, dbErr := db.GetTracksPage(cursor, limit)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	nextCursor := ""
+
+	if len(tracks) == limit {
+		nextCursor = tracks[len(tracks)-1].Md5
+	}
+
+	sendRes(c, &gin.H{
+		"tracks":   tracks,
+		"cursor":   nextCursor,
+		"revision": revision,
+	})
+}
+
+func R_libchanges(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	newSince := c.PostForm("since")
+	since, err := strconv.Atoi(newSince)
+
+	if err == nil && since < 0 {
+		err = errors.New("Revision must not be negative")
+	}
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("since: %v", newSince), err)
+		return
+	}
+
+	changes, dbErr := db.GetLibChanges(since)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, changes)
+}
+
+func R_addpl(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	newName := c.PostForm("name")
+	newTracks := c.PostForm("tracks")
+
+	err := validateMany(
+		nv(newName, 1, 30),
 		nv(newTracks, 2),
 	)
 
@@ -547,11 +1067,17 @@ func R_addpl(c *gin.Context) {
 		return
 	}
 
+	tracks, ok := parsePlaylistTracks(c, newTracks)
+
+	if !ok {
+		return
+	}
+
 	pl := &DBPlaylist{
 		ID:      0,
 		Name:    newName,
 		ownerID: u.ID,
-		Tracks:  newTracks,
+		Tracks:  tracks,
 	}
 
 	res, dbErr := db.AddPlaylist(pl)
@@ -608,154 +1134,400 @@ func R_removepl(c *gin.Context) {
 		return
 	}
 
-	sendSuccess(c)
+	sendSuccess(c)
+}
+
+func R_renamepl(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	newID := c.PostForm("id")
+	newName := c.PostForm("name")
+
+	plID, err := strconv.Atoi(newID)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("id: %v", newID), err)
+		return
+	}
+
+	err = validate(nv(newName, 1, 30))
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("name: %v", newName), err)
+		return
+	}
+
+	pl, dbErr := db.GetPlaylist(plID)
+
+	if pl != nil {
+		if pl.ownerID != u.ID {
+			sendErr(c, "playlist_not_found", "")
+			return
+		}
+
+		if pl.Name == config.AllPlaylistKey {
+			sendErr(c, "ap_rename_unallowed", "")
+			return
+		}
+
+		if pl.Name == newName {
+			sendErr(c, "no_changes", "")
+			return
+		}
+
+		_, dbErr = db.RenamePlaylist(pl.ID, newName)
+
+		if dbErr == nil {
+			sendSuccess(c)
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+		}
+	} else if dbErr.underlying != sql.ErrNoRows {
+		sendErr(c, "playlist_not_found", "")
+	} else {
+		sendDBErrorAndPrint(c, dbErr)
+	}
+}
+
+func R_updatepl(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	newID := c.PostForm("id")
+	newTracks := c.PostForm("tracks")
+
+	plID, err := strconv.Atoi(newID)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("id: %v", newID), err)
+		return
+	}
+
+	err = validate(nv(newTracks, 2))
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("tracks: %v", newTracks), err)
+		return
+	}
+
+	tracks, ok := parsePlaylistTracks(c, newTracks)
+
+	if !ok {
+		return
+	}
+
+	if plID < 0 {
+		pl, dbErr := db.GetLibraryPlaylist(u.ID)
+
+		if pl != nil {
+			pl.Tracks = tracks
+
+			_, dbErr := db.UpdatePlaylist(pl)
+
+			if dbErr != nil {
+				sendDBErrorAndPrint(c, dbErr)
+				return
+			}
+
+			plID = pl.ID
+		} else if dbErr.underlying == sql.ErrNoRows {
+			pl = &DBPlaylist{
+				ID:      0,
+				Name:    config.AllPlaylistKey,
+				ownerID: u.ID,
+				Tracks:  tracks,
+			}
+
+			res, dbErr := db.AddPlaylist(pl)
+
+			if dbErr != nil {
+				sendDBErrorAndPrint(c, dbErr)
+				return
+			}
+
+			lastId, _ := res.LastInsertId()
+			plID = int(lastId)
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+			return
+		}
+	} else {
+		pl, dbErr := db.GetPlaylist(plID)
+
+		if dbErr != nil {
+			if dbErr.underlying == sql.ErrNoRows {
+				sendErr(c, "playlist_not_found", "")
+			} else {
+				sendDBErrorAndPrint(c, dbErr)
+			}
+
+			return
+		}
+
+		if pl.ownerID != u.ID {
+			sendErr(c, "playlist_not_found", "")
+			return
+		}
+
+		pl.Tracks = tracks
+
+		_, dbErr = db.UpdatePlaylist(pl)
+
+		if dbErr != nil {
+			sendDBErrorAndPrint(c, dbErr)
+			return
+		}
+	}
+
+	sendRes(c, plID)
+}
+
+// parsePlaylistTracks decodes the JSON list of hashes sent for a playlist.
+// Unknown tracks are refused and repeated ones are listed once
+func parsePlaylistTracks(c *gin.Context, raw string) ([]string, bool) {
+	hashes := []string{}
+
+	if err := json.Unmarshal([]byte(raw), &hashes); err != nil {
+		sendErr(c, "incorrect_json", err.Error())
+		return nil, false
+	}
+
+	return checkPlaylistTracks(c, hashes, nil)
+}
+
+// checkPlaylistTracks makes sure every hash is a track of the library and
+// leaves out repeated ones and those in existing
+func checkPlaylistTracks(c *gin.Context, hashes, existing []string) ([]string, bool) {
+	seen := make(map[string]bool, len(hashes)+len(existing))
+	result := make([]string, 0, len(hashes))
+
+	for _, h := range existing {
+		seen[h] = true
+	}
+
+	for _, h := range hashes {
+		if _, ok := libTrack(h); !ok {
+			sendErr(c, "track_not_found", fmt.Sprint("Track ", h, " was not found"))
+			return nil, false
+		}
+
+		if !seen[h] {
+			seen[h] = true
+			result = append(result, h)
+		}
+	}
+
+	return result, true
+}
+
+// userPlaylist loads a playlist of the user from the id form value. Negative
+// ids stand for the library playlist
+func userPlaylist(c *gin.Context, u *DBUser) *DBPlaylist {
+	rawID := c.PostForm("id")
+	id, err := strconv.Atoi(rawID)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprint("id: ", rawID), errors.New("Given playlist id is not convertable to type integer"))
+		return nil
+	}
+
+	var pl *DBPlaylist
+	var dbErr *DBWorkerError
+
+	if id < 0 {
+		pl, dbErr = db.GetLibraryPlaylist(u.ID)
+	} else {
+		pl, dbErr = db.GetPlaylist(id)
+	}
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendErr(c, "playlist_not_found", "")
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+		}
+
+		return nil
+	}
+
+	if pl.ownerID != u.ID {
+		sendErr(c, "playlist_not_found", "")
+		return nil
+	}
+
+	return pl
+}
+
+// postFormInts reads integer form values, all of them are required
+func postFormInts(c *gin.Context, names ...string) ([]int, bool) {
+	result := make([]int, len(names))
+
+	for i, name := range names {
+		v, err := strconv.Atoi(c.PostForm(name))
+
+		if err != nil || v < 0 {
+			sendValidationError(c, fmt.Sprintf("%v: %v", name, c.PostForm(name)), errors.New("Expected a non negative integer"))
+			return nil, false
+		}
+
+		result[i] = v
+	}
+
+	return result, true
+}
+
+func R_insertpltracks(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	pl := userPlaylist(c, u)
+
+	if pl == nil {
+		return
+	}
+
+	values, ok := postFormInts(c, "index")
+
+	if !ok {
+		return
+	}
+
+	hashes, ok := checkPlaylistTracks(c, c.PostFormArray("hashes[]"), pl.Tracks)
+
+	if !ok {
+		return
+	}
+
+	if len(hashes) == 0 {
+		sendErr(c, "no_changes", "")
+		return
+	}
+
+	if dbErr := db.InsertPlaylistTracks(pl.ID, values[0], hashes); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, pl.ID)
+}
+
+func R_appendpltracks(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	pl := userPlaylist(c, u)
+
+	if pl == nil {
+		return
+	}
+
+	hashes, ok := checkPlaylistTracks(c, c.PostFormArray("hashes[]"), pl.Tracks)
+
+	if !ok {
+		return
+	}
+
+	if len(hashes) == 0 {
+		sendErr(c, "no_changes", "")
+		return
+	}
+
+	if dbErr := db.InsertPlaylistTracks(pl.ID, len(pl.Tracks), hashes); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, pl.ID)
 }
 
-func R_renamepl(c *gin.Context) {
+// R_movepltracks moves count tracks starting at from, so that the first of
+// them ends up at index to
+func R_movepltracks(c *gin.Context) {
 	u := auth.GetUser(c)
 
 	if !u.check(c) {
 		return
 	}
 
-	newID := c.PostForm("id")
-	newName := c.PostForm("name")
-
-	plID, err := strconv.Atoi(newID)
+	pl := userPlaylist(c, u)
 
-	if err != nil {
-		sendValidationError(c, fmt.Sprintf("id: %v", newID), err)
+	if pl == nil {
 		return
 	}
 
-	err = validate(nv(newName, 1, 30))
+	values, ok := postFormInts(c, "from", "count", "to")
 
-	if err != nil {
-		sendValidationError(c, fmt.Sprintf("name: %v", newName), err)
+	if !ok {
 		return
 	}
 
-	pl, dbErr := db.GetPlaylist(plID)
-
-	if pl != nil {
-		if pl.ownerID != u.ID {
-			sendErr(c, "playlist_not_found", "")
-			return
-		}
-
-		if pl.Name == config.AllPlaylistKey {
-			sendErr(c, "ap_rename_unallowed", "")
-			return
-		}
+	from, count, to := values[0], values[1], values[2]
 
-		if pl.Name == newName {
-			sendErr(c, "no_changes", "")
-			return
-		}
+	if count == 0 || from+count > len(pl.Tracks) || to+count > len(pl.Tracks) {
+		sendValidationError(c, fmt.Sprintf("from: %v; count: %v; to: %v", from, count, to),
+			fmt.Errorf("Range is out of the %v tracks of the playlist", len(pl.Tracks)))
+		return
+	}
 
-		pl.Name = newName
-		_, dbErr = db.UpdatePlaylist(pl)
+	if from == to {
+		sendErr(c, "no_changes", "")
+		return
+	}
 
-		if dbErr == nil {
-			sendSuccess(c)
-		} else {
-			sendDBErrorAndPrint(c, dbErr)
-		}
-	} else if dbErr.underlying != sql.ErrNoRows {
-		sendErr(c, "playlist_not_found", "")
-	} else {
+	if dbErr := db.MovePlaylistTracks(pl.ID, from, count, to); dbErr != nil {
 		sendDBErrorAndPrint(c, dbErr)
+		return
 	}
+
+	sendRes(c, pl.ID)
 }
 
-func R_updatepl(c *gin.Context) {
+func R_removepltracks(c *gin.Context) {
 	u := auth.GetUser(c)
 
 	if !u.check(c) {
 		return
 	}
 
-	newID := c.PostForm("id")
-	newTracks := c.PostForm("tracks")
-
-	plID, err := strconv.Atoi(newID)
+	pl := userPlaylist(c, u)
 
-	if err != nil {
-		sendValidationError(c, fmt.Sprintf("id: %v", newID), err)
+	if pl == nil {
 		return
 	}
 
-	err = validate(nv(newTracks, 2))
+	values, ok := postFormInts(c, "from", "count")
 
-	if err != nil {
-		sendValidationError(c, fmt.Sprintf("tracks: %v", newTracks), err)
+	if !ok {
 		return
 	}
 
-	if plID < 0 {
-		pl, dbErr := db.GetLibraryPlaylist(u.ID)
-
-		if pl != nil {
-			pl.Tracks = newTracks
-
-			_, dbErr := db.UpdatePlaylist(pl)
-
-			if dbErr != nil {
-				sendDBErrorAndPrint(c, dbErr)
-				return
-			}
-
-			plID = pl.ID
-		} else if dbErr.underlying == sql.ErrNoRows {
-			pl = &DBPlaylist{
-				ID:      0,
-				Name:    config.AllPlaylistKey,
-				ownerID: u.ID,
-				Tracks:  newTracks,
-			}
-
-			res, dbErr := db.AddPlaylist(pl)
-
-			if dbErr != nil {
-				sendDBErrorAndPrint(c, dbErr)
-				return
-			}
-
-			lastId, _ := res.LastInsertId()
-			plID = int(lastId)
-		} else {
-			sendDBErrorAndPrint(c, dbErr)
-			return
-		}
-	} else {
-		pl, dbErr := db.GetPlaylist(plID)
-
-		if dbErr != nil {
-			if dbErr.underlying == sql.ErrNoRows {
-				sendErr(c, "playlist_not_found", "")
-			} else {
-				sendDBErrorAndPrint(c, dbErr)
-			}
-
-			return
-		}
-
-		if pl.ownerID != u.ID {
-			sendErr(c, "playlist_not_found", "")
-			return
-		}
-
-		pl.Tracks = newTracks
+	from, count := values[0], values[1]
 
-		_, dbErr = db.UpdatePlaylist(pl)
+	if count == 0 || from+count > len(pl.Tracks) {
+		sendValidationError(c, fmt.Sprintf("from: %v; count: %v", from, count),
+			fmt.Errorf("Range is out of the %v tracks of the playlist", len(pl.Tracks)))
+		return
+	}
 
-		if dbErr != nil {
-			sendDBErrorAndPrint(c, dbErr)
-			return
-		}
+	if dbErr := db.RemovePlaylistTracks(pl.ID, from, count); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
 	}
 
-	sendRes(c, plID)
+	sendRes(c, pl.ID)
 }
 
 func R_resetpassword(c *gin.Context) {
@@ -796,7 +1568,12 @@ func R_resetpassword(c *gin.Context) {
 	}
 
 	newPassword := genPassword()
-	newU.password = md5String(newPassword)
+	newU.password, err = hashPassword(newPassword)
+
+	if err != nil {
+		sendErr(c, "unable_to_hash_password", err.Error())
+		return
+	}
 
 	_, dbErr = db.UpdateUser(newU)
 
@@ -830,12 +1607,17 @@ func R_changepassword(c *gin.Context) {
 		return
 	}
 
-	if u.password != md5String(oldPassword) {
+	if !verifyPassword(u.password, oldPassword) {
 		sendErr(c, "old_password_incorrect", "")
 		return
 	}
 
-	u.password = md5String(newPassword)
+	u.password, err = hashPassword(newPassword)
+
+	if err != nil {
+		sendErr(c, "unable_to_hash_password", err.Error())
+		return
+	}
 
 	_, dbErr := db.UpdateUser(u)
 
@@ -847,6 +1629,37 @@ func R_changepassword(c *gin.Context) {
 	sendSuccess(c)
 }
 
+// R_gensubsonicpassword issues a new app password for Subsonic clients. It's
+// kept in plain text so clients may use token authentication with it
+func R_gensubsonicpassword(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	buf := make([]byte, 12)
+
+	if _, err := cryptorand.Read(buf); err != nil {
+		sendErr(c, "unable_to_generate_password", err.Error())
+		return
+	}
+
+	password := hex.EncodeToString(buf)
+
+	if _, dbErr := db.SetUserSubsonicPassword(u.ID, password); dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	u.subsonicPassword = password
+
+	sendRes(c, &gin.H{
+		"login":    u.login,
+		"password": password,
+	})
+}
+
 func R_updateuser(c *gin.Context) {
 	u := auth.GetUser(c)
 
@@ -885,20 +1698,19 @@ func R_updateuser(c *gin.Context) {
 	}
 
 	newUser := &DBUser{
-		password:    u.password,
-		sessionHash: u.sessionHash,
-		ip:          u.ip,
-		vkCookies:   u.vkCookies,
-		ID:          u.ID,
-		login:       u.login,
-		Theme:       u.Theme,
-		VkUser:      u.VkUser,
-		IsAdmin:     u.IsAdmin,
-		Lang:        newLang,
-		RemIP:       remip,
-		Autoplay:    autoplay,
-		Nickanme:    u.Nickanme,
-		Themes:      u.Themes,
+		password:  u.password,
+		ip:        u.ip,
+		vkCookies: u.vkCookies,
+		ID:        u.ID,
+		login:     u.login,
+		Theme:     u.Theme,
+		VkUser:    u.VkUser,
+		IsAdmin:   u.IsAdmin,
+		Lang:      newLang,
+		RemIP:     remip,
+		Autoplay:  autoplay,
+		Nickanme:  u.Nickanme,
+		Themes:    u.Themes,
 	}
 
 	_, dbErr := db.UpdateUser(newUser)
@@ -908,6 +1720,17 @@ func R_updateuser(c *gin.Context) {
 		return
 	}
 
+	// the current session gets bound to the address it's used from right now
+	if remip && !u.RemIP {
+		if s := auth.GetSession(c); s != nil {
+			s.IP = c.ClientIP()
+
+			if _, dbErr = db.SetSessionIP(s.ID, s.IP); dbErr != nil {
+				dbErr.Print()
+			}
+		}
+	}
+
 	u.Autoplay = autoplay
 	u.RemIP = remip
 	u.Lang = newLang
@@ -1051,18 +1874,16 @@ func R_removeuser(c *gin.Context) {
 		return
 	}
 
-	avatarFile := fmt.Sprintf("db/avatars/%v.jpg", uID)
+	store.Delete(avatarKey(uID))
 
-	if _, err := os.Stat(avatarFile); os.IsExist(err) {
-		os.Remove(avatarFile)
+	if dbErr = auth.RevokeUserSessions(uID, ""); dbErr != nil {
+		dbErr.Print()
 	}
 
-	if _, ok := channels[u.ID]; ok {
-		channels[u.ID].SendMessage(&gin.H{
-			"type": "kick",
-			"data": nil,
-		})
-	}
+	hub.DisconnectUser(uID, &gin.H{
+		"type": "kick",
+		"data": nil,
+	})
 
 	sendSuccess(c)
 }
@@ -1095,18 +1916,168 @@ func R_albumimage(c *gin.Context) {
 		return
 	}
 
-	hash := c.Param("hash")
-	hash = strings.Replace(hash, "/", "", -1)
-	hash = strings.Replace(hash, ".", "", -1)
-	hash = strings.Replace(hash, "*", "", -1)
+	hash := c.Param("hash")
+	hash = strings.Replace(hash, "/", "", -1)
+	hash = strings.Replace(hash, ".", "", -1)
+	hash = strings.Replace(hash, "*", "", -1)
+
+	key := trackImageKey(hash)
+
+	if t, ok := libTrack(hash); ok && t.AlbumID > 0 && blobExists(albumCoverKey(t.AlbumID)) {
+		key = albumCoverKey(t.AlbumID)
+	}
+
+	serveBlob(c, key, "front/dist/img/default_album.png")
+}
+
+func R_albumcover(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	serveBlob(c, albumCoverKey(id), "front/dist/img/default_album.png")
+}
+
+// R_waveform serves the peaks file of a track. Waveforms never change once
+// generated, so clients may cache them for good
+func R_waveform(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	hash := c.Param("hash")
+
+	if _, ok := libTrack(hash); !ok || !hasWaveform(hash) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	serveBlob(c, waveformKey(hash), "")
+}
+
+func R_getalbums(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	albums, dbErr := db.GetAlbums()
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, albums)
+}
+
+func R_getalbum(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	newID := c.PostForm("id")
+	id, err := strconv.Atoi(newID)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprint("id: ", newID), err)
+		return
+	}
+
+	album, dbErr := db.GetAlbum(id)
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendErr(c, "album_not_found", "")
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+		}
+		return
+	}
+
+	tracks, dbErr := db.GetAlbumTracks(id)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, &gin.H{
+		"album":  album,
+		"tracks": tracks,
+	})
+}
+
+func R_getartists(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	artists, dbErr := db.GetArtists()
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, artists)
+}
+
+func R_getartistalbums(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.check(c) {
+		return
+	}
+
+	newID := c.PostForm("id")
+	id, err := strconv.Atoi(newID)
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprint("id: ", newID), err)
+		return
+	}
 
-	dbPath := fmt.Sprint("db/music/", hash, "/image.jpg")
+	artist, dbErr := db.GetArtist(id)
 
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		c.File("front/dist/img/default_album.png")
-	} else {
-		c.File(dbPath)
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendErr(c, "artist_not_found", "")
+		} else {
+			sendDBErrorAndPrint(c, dbErr)
+		}
+		return
+	}
+
+	albums, dbErr := db.GetArtistAlbums(id)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
 	}
+
+	sendRes(c, &gin.H{
+		"artist": artist,
+		"albums": albums,
+	})
 }
 
 func R_avatar(c *gin.Context) {
@@ -1116,12 +2087,7 @@ func R_avatar(c *gin.Context) {
 		return
 	}
 
-	avatarFile := fmt.Sprintf("db/avatars/%v.jpg", u.ID)
-	if _, err := os.Stat(avatarFile); os.IsNotExist(err) {
-		c.File("front/dist/img/default_avatar.png")
-	} else {
-		c.File(avatarFile)
-	}
+	serveBlob(c, avatarKey(u.ID), "front/dist/img/default_avatar.png")
 }
 
 /*
@@ -1343,72 +2309,103 @@ func R_init(c *gin.Context) {
 	c.Header("Connection", "keep-alive")
 	c.Header("Content-Type", "text/event-stream")
 
-	if _, ok := channels[u.ID]; ok {
-		c.SSEvent("message", &gin.H{
-			"type": "error",
-			"data": &gin.H{
-				"key":   "already_connected",
-				"error": "This user is already connected to channel",
-			},
-		})
+	var pls []*DBPlaylist
+	var plsErr *DBWorkerError
 
-		return
-	}
+	/*queueCount := 0
 
-	ch := make(chan interface{}, 10)
-	acl := &AudyChanListener{
-		Channel:      ch,
-		User:         u,
-		ChCtx:        c,
-		Disconnected: false,
-	}
+	if _, ok := vkQueue[u.ID]; ok {
+		queueCount = len(vkQueue[u.ID].queue)
+	}*/
 
-	channels[u.ID] = acl
+	// the library is read while the listener is added, so every change made
+	// after it was read reaches the client after init
+	acl := hub.Add(u, c, func(acl *AudyChanListener) *gin.H {
+		if pls, plsErr = db.GetPlaylists(u.ID); plsErr != nil && plsErr.underlying != sql.ErrNoRows {
+			return nil
+		}
 
-	pls, err := db.GetPlaylists(u.ID)
+		// clients that have a cached library pass its revision and receive
+		// only the changes made since then
+		var changes *DBLibChanges = nil
+		libData := ""
 
-	if err != nil {
-		if err.underlying != sql.ErrNoRows {
-			sendDBErrorAndPrint(c, err)
-			return
+		if since, err := strconv.Atoi(c.Query("rev")); err == nil && since >= 0 {
+			var dbErr *DBWorkerError
+			changes, dbErr = db.GetLibChanges(since)
+
+			if dbErr != nil {
+				dbErr.Print()
+				changes = nil
+			} else if changes.Reset {
+				changes = nil
+			}
 		}
-	}
 
-	/*queueCount := 0
+		revision := libRevision()
 
-	if _, ok := vkQueue[u.ID]; ok {
-		queueCount = len(vkQueue[u.ID].queue)
-	}*/
+		if changes == nil {
+			libData = getLibJSON()
+		} else {
+			revision = changes.Revision
+		}
 
-	go func() {
-		ch <- &gin.H{
+		var remIPAlert *RemIPAlert = nil
+
+		if alert := auth.takeRemIPAlert(u); len(alert) > 0 {
+			remIPAlert = &RemIPAlert{}
+
+			if err := json.Unmarshal([]byte(alert), remIPAlert); err != nil {
+				fmt.Printf("Unable to parse rem_ip alert of user %v: %v\n", u.login, err.Error())
+				remIPAlert = nil
+			}
+		}
+
+		return &gin.H{
 			"type": "init",
 			"data": &gin.H{
-				"lib":              libJSONCache,
+				"lib":              libData,
+				"changes":          changes,
+				"revision":         revision,
 				"playlists":        pls,
 				"apk":              config.AllPlaylistKey,
 				"u":                u,
 				"custom_app_title": config.CustomAppTitle,
+				"rem_ip_alert":     remIPAlert,
+				"listener_id":      acl.Id,
 			},
 		}
+	})
 
-		select {
-		case <-c.Request.Context().Done():
-			if !acl.Disconnected {
-				close(ch)
-				acl.Disconnected = true
-			}
+	if acl == nil {
+		c.SSEvent("message", &gin.H{
+			"type": "error",
+			"data": &gin.H{
+				"key":   "already_connected",
+				"error": fmt.Sprintf("This user already has %v connected channels", maxListenersPerUser),
+			},
+		})
 
-			delete(channels, u.ID)
+		return
+	}
 
-			if gin.Mode() == gin.DebugMode {
-				fmt.Printf("User %v disconnected\n", u.login)
-			}
+	if plsErr != nil && plsErr.underlying != sql.ErrNoRows {
+		hub.Remove(acl)
+		sendDBErrorAndPrint(c, plsErr)
+		return
+	}
+
+	go func() {
+		<-c.Request.Context().Done()
+		hub.Remove(acl)
+
+		if gin.Mode() == gin.DebugMode {
+			fmt.Printf("User %v disconnected listener %v\n", u.login, acl.Id)
 		}
 	}()
 
-	acl.Disconnected = c.Stream(func(w io.Writer) bool {
-		if msg, ok := <-ch; ok {
+	c.Stream(func(w io.Writer) bool {
+		if msg, ok := <-acl.Channel; ok {
 			c.SSEvent("message", msg)
 			return true
 		}
@@ -1424,21 +2421,31 @@ func R_closech(c *gin.Context) {
 		return
 	}
 
-	if _, ok := channels[u.ID]; !ok {
-		sendErr(c, "channel_not_found", fmt.Sprintf("No channel found for user %v", u.login))
-		return
-	}
-
-	channels[u.ID].SendMessage(&gin.H{
+	destroy := &gin.H{
 		"type": "destroy",
 		"data": nil,
-	})
+	}
+
+	// without a listener id all channels of the user are closed
+	if id := c.PostForm("id"); len(id) > 0 {
+		acl := hub.Get(u.ID, id)
+
+		if acl == nil {
+			sendErr(c, "channel_not_found", fmt.Sprintf("No channel %v found for user %v", id, u.login))
+			return
+		}
+
+		acl.SendMessage(destroy)
+		hub.Remove(acl)
+	} else {
+		if len(hub.UserListeners(u.ID)) == 0 {
+			sendErr(c, "channel_not_found", fmt.Sprintf("No channel found for user %v", u.login))
+			return
+		}
 
-	if !channels[u.ID].Disconnected {
-		channels[u.ID].ChCtx.Abort()
+		hub.DisconnectUser(u.ID, destroy)
 	}
 
-	delete(channels, u.ID)
 	sendSuccess(c)
 }
 
@@ -1456,13 +2463,15 @@ func R_download(c *gin.Context) {
 		return
 	}
 
-	filePath := fmt.Sprint("db/music/", hash, "/track")
+	f, info, err := openTrackInfo(hash)
 
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if err != nil {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
+	defer f.Close()
+
 	t, dbErr := db.GetTrack(hash)
 
 	if dbErr != nil {
@@ -1470,9 +2479,11 @@ func R_download(c *gin.Context) {
 		return
 	}
 
-	saveName := fmt.Sprint(t.Artist, " - ", t.Title, ".mp3")
+	saveName := fmt.Sprint(t.Artist, " - ", t.Title, getFormat(t.Format).Ext)
 
-	c.FileAttachment(filePath, saveName)
+	c.Header("Content-Type", t.Mime)
+	c.Header("Content-Disposition", attachmentDisposition(saveName))
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime, f)
 }
 
 func R_changenickname(c *gin.Context) {
@@ -1543,14 +2554,13 @@ func R_changeavatar(c *gin.Context) {
 		image = imaging.Resize(image, 512, 512, imaging.Lanczos)
 	}
 
-	filePath := fmt.Sprintf("db/avatars/%v.jpg", u.ID)
+	buf := &bytes.Buffer{}
+	err = imaging.Encode(buf, image, imaging.JPEG, imaging.JPEGQuality(80))
 
-	if _, err := os.Stat("db/avatars"); os.IsNotExist(err) {
-		os.Mkdir("db/avatars", os.ModePerm)
+	if err == nil {
+		err = putBlobBytes(avatarKey(u.ID), buf.Bytes())
 	}
 
-	err = imaging.Save(image, filePath, imaging.JPEGQuality(80))
-
 	if err != nil {
 		sendErr(c, "unable_to_encode_image", err.Error())
 		return
@@ -1567,13 +2577,12 @@ func R_removeavatar(c *gin.Context) {
 		return
 	}
 
-	fileName := fmt.Sprintf("db/avatars/%v.jpg", u.ID)
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+	if !blobExists(avatarKey(u.ID)) {
 		sendErr(c, "no_avatar_file", "")
 		return
 	}
 
-	err := os.Remove(fileName)
+	err := store.Delete(avatarKey(u.ID))
 
 	if err != nil {
 		sendErr(c, "avatar_remove", err.Error())
@@ -1624,9 +2633,16 @@ func R_adduser(c *gin.Context) {
 		isAdmin = true
 	}
 
+	hashedPassword, err := hashPassword(newPassword)
+
+	if err != nil {
+		sendErr(c, "unable_to_hash_password", err.Error())
+		return
+	}
+
 	newUser := &DBUser{
 		login:    newLogin,
-		password: md5String(newPassword),
+		password: hashedPassword,
 		IsAdmin:  isAdmin,
 	}
 
@@ -1666,9 +2682,220 @@ func R_getserverdata(c *gin.Context) {
 			"session_time":     config.SessionTime,
 			"custom_app_title": config.CustomAppTitle,
 		},
+		"transcoder":         getTranscoder().Name(),
+		"transcode_profiles": config.Transcode.Profiles,
+		"library_folders":    config.LibraryFolders,
 	})
 }
 
+func R_setlibraryfolders(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	rawFolders := c.PostForm("folders")
+	folders := make([]string, 0)
+
+	if err := json.Unmarshal([]byte(rawFolders), &folders); err != nil {
+		sendValidationError(c, fmt.Sprint("folders: ", rawFolders), err)
+		return
+	}
+
+	if err := validateLibraryFolders(folders); err != nil {
+		sendValidationError(c, fmt.Sprint("folders: ", rawFolders), err)
+		return
+	}
+
+	kept := make(map[string]bool, len(folders))
+
+	for i, folder := range folders {
+		folders[i] = filepath.Clean(folder)
+		kept[folders[i]] = true
+	}
+
+	removed := false
+
+	for _, folder := range config.LibraryFolders {
+		if kept[filepath.Clean(folder)] {
+			continue
+		}
+
+		tracks, dbErr := db.GetFolderTracks(libraryFolderPrefix(folder))
+
+		if dbErr != nil {
+			sendDBErrorAndPrint(c, dbErr)
+			return
+		}
+
+		if dbErr = dropTracks(tracks); dbErr != nil {
+			sendDBErrorAndPrint(c, dbErr)
+			return
+		}
+
+		removed = removed || len(tracks) > 0
+	}
+
+	config.LibraryFolders = folders
+
+	if err := saveConfig(); err != nil {
+		sendErr(c, "saving_config", err.Error())
+		return
+	}
+
+	if removed {
+		removeOrphanAlbums()
+		invalidateLibCache()
+
+		SendMessageAll(&gin.H{
+			"type": "lib_changed",
+			"data": &gin.H{
+				"revision": libRevision(),
+			},
+		})
+	}
+
+	scanLibraryFolders()
+	sendSuccess(c)
+}
+
+func R_rescanlibrary(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	if len(config.LibraryFolders) == 0 {
+		sendErr(c, "no_library_folders", "")
+		return
+	}
+
+	scanLibraryFolders()
+	sendSuccess(c)
+}
+
+// R_checkintegrity starts a dry run of the integrity check as a job, see
+// R_getintegrityreport for its findings
+func R_checkintegrity(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	startIntegrityJob(c, u, &integrityJobPayload{})
+}
+
+func R_getintegrityreport(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	report, err := loadIntegrityReport()
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendErr(c, "no_integrity_report", "")
+		} else {
+			sendErrAndPrint(c, "integrity_report", err.Error())
+		}
+		return
+	}
+
+	sendRes(c, report)
+}
+
+// R_repairintegrity fixes the fixable findings of the report given in the
+// report param, which has to be the latest one. Findings are checked again
+// before being fixed, and new ones are only reported
+func R_repairintegrity(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	id, err := strconv.Atoi(c.PostForm("report"))
+
+	if err != nil {
+		sendValidationError(c, fmt.Sprintf("report: %v", c.PostForm("report")), err)
+		return
+	}
+
+	report, err := loadIntegrityReport()
+
+	if err != nil || report.ID == 0 || report.ID != id {
+		sendErr(c, "integrity_report_outdated", "")
+		return
+	}
+
+	if len(report.fixableIDs()) == 0 {
+		sendErr(c, "nothing_to_repair", "")
+		return
+	}
+
+	startIntegrityJob(c, u, &integrityJobPayload{report.ID})
+}
+
+func startIntegrityJob(c *gin.Context, u *DBUser, payload *integrityJobPayload) {
+	active, dbErr := db.HasActiveJob(jobTypeIntegrityCheck, "")
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	if active {
+		sendErr(c, "integrity_check_running", "")
+		return
+	}
+
+	job, dbErr := jobQueue.Enqueue(jobTypeIntegrityCheck, "", "", u.ID, payload)
+
+	if dbErr != nil {
+		sendDBErrorAndPrint(c, dbErr)
+		return
+	}
+
+	sendRes(c, job)
+}
+
+func R_settranscodeprofiles(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	rawProfiles := c.PostForm("profiles")
+	profiles := make([]AudyTranscodeProfile, 0)
+
+	if err := json.Unmarshal([]byte(rawProfiles), &profiles); err != nil {
+		sendValidationError(c, fmt.Sprint("profiles: ", rawProfiles), err)
+		return
+	}
+
+	if err := validateTranscodeProfiles(profiles); err != nil {
+		sendValidationError(c, fmt.Sprint("profiles: ", rawProfiles), err)
+		return
+	}
+
+	config.Transcode.Profiles = profiles
+
+	if err := saveConfig(); err != nil {
+		sendErr(c, "saving_config", err.Error())
+		return
+	}
+
+	purgeTranscodeCache()
+
+	sendSuccess(c)
+}
+
 func R_setserverdata(c *gin.Context) {
 	u := auth.GetUser(c)
 
@@ -1765,5 +2992,32 @@ func R_setadmin(c *gin.Context) {
 		return
 	}
 
+	auth.EvictUser(id)
 	sendSuccess(c)
 }
+
+// R_backup streams a backup of the database, the config and the stored
+// files, music included with music=1. Once the archive has started there is
+// no way to report an error, the archive is then left without its end and
+// is refused by restore
+func R_backup(c *gin.Context) {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return
+	}
+
+	c.Header("Content-Type", "application/zstd")
+	c.Header("Content-Disposition", attachmentDisposition(backupFileName(time.Now())))
+
+	if _, err := writeBackup(c.Writer, c.Query("music") == "1"); err != nil {
+		if !c.Writer.Written() {
+			c.Header("Content-Type", "")
+			c.Header("Content-Disposition", "")
+			sendErrAndPrint(c, "backup", err.Error())
+			return
+		}
+
+		fmt.Printf("Backup download failed: %v\n", err.Error())
+	}
+}
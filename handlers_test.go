@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testTrackHash string = "0123456789abcdef0123456789abcdef"
+
+// testS3Server answers HEAD and ranged GET requests of a path style bucket
+// the way S3 does, which is what S3BlobStore.Open reads through
+type testS3Server struct {
+	objects map[string][]byte
+	modTime time.Time
+}
+
+func (s *testS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+
+	if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	http.ServeContent(w, r, "", s.modTime, bytes.NewReader(data))
+}
+
+func testTrackData() []byte {
+	data := make([]byte, 1000)
+
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	return data
+}
+
+func testLocalStore(t *testing.T, data []byte) BlobStore {
+	s, err := NewLocalBlobStore(t.TempDir())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Put(trackKey(testTrackHash), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func testS3Store(t *testing.T, data []byte) BlobStore {
+	srv := httptest.NewServer(&testS3Server{
+		objects: map[string][]byte{trackKey(testTrackHash): data},
+		modTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	t.Cleanup(srv.Close)
+
+	s, err := NewS3BlobStore(&AudyS3StoreConfig{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// readByteRanges returns the bodies and Content-Range headers of the parts
+// of a multipart/byteranges response
+func readByteRanges(t *testing.T, res *httptest.ResponseRecorder) ([]string, []string) {
+	mediaType, params, err := mime.ParseMediaType(res.Header().Get("Content-Type"))
+
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", res.Header().Get("Content-Type"))
+	}
+
+	bodies, ranges := []string{}, []string{}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+
+	for {
+		part, err := mr.NextPart()
+
+		if err != nil {
+			break
+		}
+
+		body, _ := ioutil.ReadAll(part)
+		bodies = append(bodies, string(body))
+		ranges = append(ranges, part.Header.Get("Content-Range"))
+	}
+
+	return bodies, ranges
+}
+
+func TestServeTrack(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	data := testTrackData()
+	size := len(data)
+	etag := fmt.Sprintf("%q", testTrackHash)
+
+	cases := []struct {
+		name    string
+		hash    string
+		headers map[string]string
+		status  int
+		// body and contentRange of single part responses, parts of
+		// multipart/byteranges ones
+		body         string
+		contentRange string
+		parts        []string
+	}{
+		{
+			name:   "whole file",
+			status: http.StatusOK,
+			body:   string(data),
+		},
+		{
+			name:         "single range",
+			headers:      map[string]string{"Range": "bytes=10-19"},
+			status:       http.StatusPartialContent,
+			body:         string(data[10:20]),
+			contentRange: fmt.Sprintf("bytes 10-19/%v", size),
+		},
+		{
+			name:         "open range",
+			headers:      map[string]string{"Range": "bytes=990-"},
+			status:       http.StatusPartialContent,
+			body:         string(data[990:]),
+			contentRange: fmt.Sprintf("bytes 990-999/%v", size),
+		},
+		{
+			name:         "suffix range",
+			headers:      map[string]string{"Range": "bytes=-5"},
+			status:       http.StatusPartialContent,
+			body:         string(data[size-5:]),
+			contentRange: fmt.Sprintf("bytes 995-999/%v", size),
+		},
+		{
+			name:    "multiple ranges",
+			headers: map[string]string{"Range": "bytes=0-3,500-509,-2"},
+			status:  http.StatusPartialContent,
+			parts:   []string{string(data[0:4]), string(data[500:510]), string(data[size-2:])},
+		},
+		{
+			name:         "if-range matching etag",
+			headers:      map[string]string{"Range": "bytes=100-199", "If-Range": etag},
+			status:       http.StatusPartialContent,
+			body:         string(data[100:200]),
+			contentRange: fmt.Sprintf("bytes 100-199/%v", size),
+		},
+		{
+			name:    "if-range stale etag",
+			headers: map[string]string{"Range": "bytes=100-199", "If-Range": `"stale"`},
+			status:  http.StatusOK,
+			body:    string(data),
+		},
+		{
+			name:    "if-none-match",
+			headers: map[string]string{"If-None-Match": etag},
+			status:  http.StatusNotModified,
+		},
+		{
+			name:    "if-none-match stale",
+			headers: map[string]string{"If-None-Match": `"stale"`},
+			status:  http.StatusOK,
+			body:    string(data),
+		},
+		{
+			name:         "unsatisfiable range",
+			headers:      map[string]string{"Range": fmt.Sprintf("bytes=%v-", size+10)},
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			contentRange: fmt.Sprintf("bytes */%v", size),
+		},
+		{
+			name:   "unknown track",
+			hash:   "ffffffffffffffffffffffffffffffff",
+			status: http.StatusNotFound,
+		},
+	}
+
+	stores := []struct {
+		name string
+		open func(t *testing.T, data []byte) BlobStore
+	}{
+		{"local", testLocalStore},
+		{"s3", testS3Store},
+	}
+
+	setLibTrack(&DBTrack{Md5: testTrackHash, Format: "mp3", Mime: "audio/mpeg"})
+	defer removeLibTrack(testTrackHash)
+
+	prevStore := store
+	defer func() { store = prevStore }()
+
+	r := gin.New()
+	r.GET("/music/:file", func(c *gin.Context) {
+		serveTrack(c, c.Param("file"))
+	})
+
+	for _, s := range stores {
+		store = s.open(t, data)
+
+		for _, tc := range cases {
+			t.Run(s.name+"/"+tc.name, func(t *testing.T) {
+				hash := tc.hash
+
+				if len(hash) == 0 {
+					hash = testTrackHash
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "/music/"+hash, nil)
+
+				for k, v := range tc.headers {
+					req.Header.Set(k, v)
+				}
+
+				res := httptest.NewRecorder()
+				r.ServeHTTP(res, req)
+
+				if res.Code != tc.status {
+					t.Fatalf("status = %v, want %v", res.Code, tc.status)
+				}
+
+				if tc.status == http.StatusNotFound {
+					return
+				}
+
+				if got := res.Header().Get("ETag"); got != etag {
+					t.Errorf("ETag = %v, want %v", got, etag)
+				}
+
+				if tc.parts != nil {
+					bodies, ranges := readByteRanges(t, res)
+
+					if len(bodies) != len(tc.parts) {
+						t.Fatalf("got %v parts, want %v", len(bodies), len(tc.parts))
+					}
+
+					for i := range tc.parts {
+						if bodies[i] != tc.parts[i] {
+							t.Errorf("part %v (%v) has the wrong contents", i, ranges[i])
+						}
+					}
+
+					return
+				}
+
+				if got := res.Header().Get("Content-Range"); got != tc.contentRange {
+					t.Errorf("Content-Range = %q, want %q", got, tc.contentRange)
+				}
+
+				if tc.status != http.StatusRequestedRangeNotSatisfiable && res.Body.String() != tc.body {
+					t.Errorf("body of %v bytes, want %v bytes", res.Body.Len(), len(tc.body))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AudyChanListener is a single SSE connection. A user may have several of
+// them, one per open tab
+type AudyChanListener struct {
+	Channel      chan interface{}
+	User         *DBUser
+	ChCtx        *gin.Context
+	Id           string
+	Disconnected bool
+}
+
+// AudyHub keeps SSE listeners grouped by user. Sending and closing happen
+// under the hub lock, so a message is never sent to a closed channel
+type AudyHub struct {
+	mutex     sync.RWMutex
+	listeners map[int]map[string]*AudyChanListener
+}
+
+const listenerBufferSize int = 64
+const maxListenersPerUser int = 10
+
+var hub *AudyHub = newAudyHub()
+
+func newAudyHub() *AudyHub {
+	return &AudyHub{
+		listeners: make(map[int]map[string]*AudyChanListener, 0),
+	}
+}
+
+// Add registers a new listener of the user. It returns nil when the user has
+// too many connections already. welcome, when given, builds the first message
+// of the listener. It runs under the hub lock, so nothing sent meanwhile can
+// come before it
+func (h *AudyHub) Add(u *DBUser, c *gin.Context, welcome func(cl *AudyChanListener) *gin.H) *AudyChanListener {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	userListeners, ok := h.listeners[u.ID]
+
+	if !ok {
+		userListeners = make(map[string]*AudyChanListener, 0)
+		h.listeners[u.ID] = userListeners
+	}
+
+	if len(userListeners) >= maxListenersPerUser {
+		return nil
+	}
+
+	cl := &AudyChanListener{
+		Channel: make(chan interface{}, listenerBufferSize),
+		User:    u,
+		ChCtx:   c,
+		Id:      genId(),
+	}
+
+	for _, exists := userListeners[cl.Id]; exists; _, exists = userListeners[cl.Id] {
+		cl.Id = genId()
+	}
+
+	if welcome != nil {
+		if msg := welcome(cl); msg != nil {
+			cl.Channel <- msg
+		}
+	}
+
+	userListeners[cl.Id] = cl
+	return cl
+}
+
+// Remove unregisters the listener and closes its channel, which ends the
+// SSE stream once the buffered messages are written
+func (h *AudyHub) Remove(cl *AudyChanListener) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.remove(cl)
+}
+
+func (h *AudyHub) remove(cl *AudyChanListener) {
+	if cl.Disconnected {
+		return
+	}
+
+	cl.Disconnected = true
+	close(cl.Channel)
+
+	if userListeners, ok := h.listeners[cl.User.ID]; ok {
+		delete(userListeners, cl.Id)
+
+		if len(userListeners) == 0 {
+			delete(h.listeners, cl.User.ID)
+		}
+	}
+}
+
+func (h *AudyHub) Get(userID int, id string) *AudyChanListener {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if userListeners, ok := h.listeners[userID]; ok {
+		return userListeners[id]
+	}
+
+	return nil
+}
+
+func (h *AudyHub) UserListeners(userID int) []*AudyChanListener {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	result := make([]*AudyChanListener, 0, len(h.listeners[userID]))
+
+	for _, cl := range h.listeners[userID] {
+		result = append(result, cl)
+	}
+
+	return result
+}
+
+// send never blocks. A listener whose buffer is full can't keep up and is
+// reported back to be disconnected
+func (h *AudyHub) send(cl *AudyChanListener, msg *gin.H) bool {
+	if cl.Disconnected {
+		return true
+	}
+
+	select {
+	case cl.Channel <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *AudyHub) dropSlow(slow []*AudyChanListener) {
+	if len(slow) == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, cl := range slow {
+		fmt.Printf("Dropping slow SSE listener %v of user %v\n", cl.Id, cl.User.login)
+		h.remove(cl)
+	}
+}
+
+func (h *AudyHub) SendUser(userID int, msg *gin.H) {
+	slow := make([]*AudyChanListener, 0)
+
+	h.mutex.RLock()
+	for _, cl := range h.listeners[userID] {
+		if !h.send(cl, msg) {
+			slow = append(slow, cl)
+		}
+	}
+	h.mutex.RUnlock()
+
+	h.dropSlow(slow)
+}
+
+func (h *AudyHub) SendAll(msg *gin.H) {
+	slow := make([]*AudyChanListener, 0)
+
+	h.mutex.RLock()
+	for _, userListeners := range h.listeners {
+		for _, cl := range userListeners {
+			if !h.send(cl, msg) {
+				slow = append(slow, cl)
+			}
+		}
+	}
+	h.mutex.RUnlock()
+
+	h.dropSlow(slow)
+}
+
+// DisconnectUser sends the last message to every listener of the user and
+// closes them
+func (h *AudyHub) DisconnectUser(userID int, msg *gin.H) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, cl := range h.listeners[userID] {
+		if msg != nil {
+			h.send(cl, msg)
+		}
+
+		h.remove(cl)
+	}
+}
+
+func (cl *AudyChanListener) SendMessage(msg *gin.H) {
+	hub.mutex.RLock()
+	ok := hub.send(cl, msg)
+	hub.mutex.RUnlock()
+
+	if !ok {
+		hub.dropSlow([]*AudyChanListener{cl})
+	}
+}
+
+func SendMessageAll(msg *gin.H) {
+	hub.SendAll(msg)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// drain reads the listener until the hub closes its channel and returns the
+// number of messages read
+func drain(cl *AudyChanListener) int {
+	count := 0
+
+	for range cl.Channel {
+		count++
+	}
+
+	return count
+}
+
+func TestHubConcurrentUse(t *testing.T) {
+	h := newAudyHub()
+	users := 4
+	perUser := 5
+	messages := 200
+
+	var listeners sync.WaitGroup
+	var senders sync.WaitGroup
+	added := make(chan *AudyChanListener, users*perUser)
+
+	for i := 0; i < users*perUser; i++ {
+		listeners.Add(1)
+
+		go func(userID int) {
+			defer listeners.Done()
+
+			cl := h.Add(&DBUser{ID: userID}, nil, nil)
+
+			if cl == nil {
+				t.Error("listener refused below the per user limit")
+				return
+			}
+
+			added <- cl
+			drain(cl)
+		}(i % users)
+	}
+
+	for i := 0; i < users; i++ {
+		senders.Add(2)
+
+		go func(userID int) {
+			defer senders.Done()
+
+			for j := 0; j < messages; j++ {
+				h.SendUser(userID, &gin.H{"type": "user", "data": j})
+				h.UserListeners(userID)
+			}
+		}(i)
+
+		go func() {
+			defer senders.Done()
+
+			for j := 0; j < messages; j++ {
+				h.SendAll(&gin.H{"type": "all", "data": j})
+			}
+		}()
+	}
+
+	// listeners go away while messages are still being sent, removing twice
+	// must be harmless
+	for i := 0; i < users*perUser; i++ {
+		cl := <-added
+
+		go func() {
+			h.Remove(cl)
+			h.Remove(cl)
+		}()
+	}
+
+	senders.Wait()
+	listeners.Wait()
+
+	for i := 0; i < users; i++ {
+		if left := h.UserListeners(i); len(left) != 0 {
+			t.Errorf("user %v still has %v listeners", i, len(left))
+		}
+	}
+}
+
+func TestHubListenerLimit(t *testing.T) {
+	h := newAudyHub()
+	u := &DBUser{ID: 1}
+
+	for i := 0; i < maxListenersPerUser; i++ {
+		if h.Add(u, nil, nil) == nil {
+			t.Fatalf("listener %v refused", i)
+		}
+	}
+
+	if h.Add(u, nil, nil) != nil {
+		t.Fatal("listener over the limit accepted")
+	}
+
+	if h.Add(&DBUser{ID: 2}, nil, nil) == nil {
+		t.Fatal("limit applied across users")
+	}
+}
+
+func TestHubDropsSlowListener(t *testing.T) {
+	h := newAudyHub()
+	u := &DBUser{ID: 1}
+	slow := h.Add(u, nil, nil)
+	fast := h.Add(u, nil, nil)
+
+	// the fast listener reads every message right away, the slow one never
+	for i := 0; i <= listenerBufferSize; i++ {
+		h.SendUser(u.ID, &gin.H{"type": "test", "data": i})
+		<-fast.Channel
+	}
+
+	if h.Get(u.ID, slow.Id) != nil {
+		t.Fatal("slow listener wasn't dropped")
+	}
+
+	if h.Get(u.ID, fast.Id) == nil {
+		t.Fatal("listener keeping up was dropped")
+	}
+
+	// what was buffered before the drop is still delivered
+	if got := drain(slow); got != listenerBufferSize {
+		t.Errorf("slow listener got %v messages, want %v", got, listenerBufferSize)
+	}
+
+	h.Remove(fast)
+
+	if _, ok := <-fast.Channel; ok {
+		t.Error("removed listener wasn't closed")
+	}
+}
+
+func TestHubDisconnectUser(t *testing.T) {
+	h := newAudyHub()
+	first := h.Add(&DBUser{ID: 1}, nil, nil)
+	second := h.Add(&DBUser{ID: 1}, nil, nil)
+	other := h.Add(&DBUser{ID: 2}, nil, nil)
+
+	h.DisconnectUser(1, &gin.H{"type": "logout", "data": nil})
+
+	for _, cl := range []*AudyChanListener{first, second} {
+		msg, ok := <-cl.Channel
+
+		if !ok || (*msg.(*gin.H))["type"] != "logout" {
+			t.Errorf("listener %v didn't get the last message", cl.Id)
+		}
+
+		if _, ok = <-cl.Channel; ok {
+			t.Errorf("listener %v wasn't closed", cl.Id)
+		}
+	}
+
+	if len(h.UserListeners(1)) != 0 {
+		t.Error("disconnected user still has listeners")
+	}
+
+	if h.Get(2, other.Id) == nil {
+		t.Fatal("listener of another user was disconnected")
+	}
+
+	// sending to a disconnected user and disconnecting again do nothing
+	h.SendUser(1, &gin.H{"type": "test", "data": nil})
+	h.DisconnectUser(1, nil)
+	h.SendAll(&gin.H{"type": "test", "data": nil})
+
+	if msg := <-other.Channel; (*msg.(*gin.H))["type"] != "test" {
+		t.Error("other user missed a message")
+	}
+}
+
+func TestHubWelcomeComesFirst(t *testing.T) {
+	h := newAudyHub()
+	u := &DBUser{ID: 1}
+	stop := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				h.SendUser(u.ID, &gin.H{"type": "track_add"})
+			}
+		}
+	}()
+
+	cl := h.Add(u, nil, func(cl *AudyChanListener) *gin.H {
+		// the snapshot of the library takes a while
+		time.Sleep(10 * time.Millisecond)
+		return &gin.H{"type": "init", "data": cl.Id}
+	})
+
+	close(stop)
+	<-done
+
+	if msg := (*(<-cl.Channel).(*gin.H)); msg["type"] != "init" || msg["data"] != cl.Id {
+		t.Errorf("first message is %v, want init", msg)
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The integrity check compares the library with the blob store, the files
+// of library folders and the playlists. It only reports; repairs are made
+// with audy check -fix or by confirming a report through the admin API
+const jobTypeIntegrityCheck string = "integrity_check"
+
+const integrityReportPath string = "db/integrity.json"
+
+const (
+	integrityMissingFile    string = "missing_file"
+	integrityUnreadable     string = "unreadable"
+	integrityHashMismatch   string = "hash_mismatch"
+	integrityUndecodable    string = "undecodable"
+	integrityDuration       string = "duration_mismatch"
+	integrityOrphanBlob     string = "orphan_blob"
+	integrityDanglingTrack  string = "dangling_playlist_track"
+	integrityOrphanPlaylist string = "orphan_playlist"
+)
+
+// durations may differ by this many seconds, or 1% of the track
+const integrityDurationMinDiff float64 = 1
+
+// track files younger than this may belong to an upload whose row isn't
+// written yet, so they are never taken for orphans
+const integrityOrphanGrace time.Duration = time.Hour
+
+type AudyIntegrityFinding struct {
+	Kind string `json:"kind"`
+	// Hash, Key and Playlist name the track, the blob and the playlist the
+	// finding is about, where they apply
+	Hash     string `json:"hash,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Playlist int    `json:"playlist,omitempty"`
+	Detail   string `json:"detail"`
+	// Duration is the measured duration of duration mismatches
+	Duration float32 `json:"duration,omitempty"`
+	Fixable  bool    `json:"fixable"`
+	Fixed    bool    `json:"fixed"`
+}
+
+func (f *AudyIntegrityFinding) id() string {
+	return fmt.Sprintf("%v|%v|%v|%v", f.Kind, f.Hash, f.Key, f.Playlist)
+}
+
+type AudyIntegrityReport struct {
+	// ID is the id of the job that made the report, 0 on the command line
+	ID       int   `json:"id"`
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+	Fix      bool  `json:"fix"`
+	Tracks   int   `json:"tracks"`
+	// StoreSuspect is set when none of the stored tracks were found. That
+	// looks more like a wrong storage root than a lost library, so missing
+	// files and orphans are then never repaired
+	StoreSuspect bool                    `json:"store_suspect"`
+	Findings     []*AudyIntegrityFinding `json:"findings"`
+}
+
+type integrityJobPayload struct {
+	// Report is the id of the report whose fixable findings were confirmed,
+	// 0 for a dry run
+	Report int `json:"report"`
+}
+
+func (r *AudyIntegrityReport) add(f *AudyIntegrityFinding) {
+	r.Findings = append(r.Findings, f)
+}
+
+// fixableIDs returns the findings a repair of this report may fix
+func (r *AudyIntegrityReport) fixableIDs() map[string]bool {
+	ids := make(map[string]bool, 0)
+
+	for _, f := range r.Findings {
+		if f.Fixable && !f.Fixed {
+			ids[f.id()] = true
+		}
+	}
+
+	return ids
+}
+
+// libChanged reports whether the repairs changed any track
+func (r *AudyIntegrityReport) libChanged() bool {
+	for _, f := range r.Findings {
+		if f.Fixed && (f.Kind == integrityMissingFile || f.Kind == integrityDuration) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *AudyIntegrityReport) unfixed() int {
+	count := 0
+
+	for _, f := range r.Findings {
+		if !f.Fixed {
+			count++
+		}
+	}
+
+	return count
+}
+
+// frameCounter is an audio sink measuring the decoded duration
+type frameCounter struct {
+	rate   int
+	frames int64
+}
+
+func (fc *frameCounter) start(rate, channels int) {
+	fc.rate = rate
+}
+
+func (fc *frameCounter) addFrame(frame []float64) {
+	fc.frames++
+}
+
+func (fc *frameCounter) duration() float32 {
+	if fc.rate == 0 {
+		return 0
+	}
+
+	return float32(float64(fc.frames) / float64(fc.rate))
+}
+
+// checkIntegrity checks the whole library. With fix set, the fixable
+// findings are repaired after being checked once more, only the ones listed
+// in confirmed unless it is nil
+func checkIntegrity(ctx context.Context, fix bool, confirmed map[string]bool) (*AudyIntegrityReport, error) {
+	report := &AudyIntegrityReport{
+		Started:  time.Now().Unix(),
+		Fix:      fix,
+		Findings: []*AudyIntegrityFinding{},
+	}
+
+	tracks, dbErr := db.GetTracks()
+
+	if dbErr != nil {
+		return nil, errors.New(dbErr.Error())
+	}
+
+	musicBlobs, err := store.List("music/")
+
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]bool, len(musicBlobs))
+
+	for _, b := range musicBlobs {
+		stored[b.Key] = true
+	}
+
+	hashes := make([]string, 0, len(tracks))
+
+	for hash := range tracks {
+		hashes = append(hashes, hash)
+	}
+
+	sort.Strings(hashes)
+
+	storedTracks, foundTracks := 0, 0
+
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		t := tracks[hash]
+		report.Tracks++
+
+		if !t.External {
+			storedTracks++
+
+			if !stored[trackKey(hash)] {
+				report.add(&AudyIntegrityFinding{
+					Kind:    integrityMissingFile,
+					Hash:    hash,
+					Key:     trackKey(hash),
+					Detail:  fmt.Sprint(t.Artist, " - ", t.Title),
+					Fixable: true,
+				})
+				continue
+			}
+
+			foundTracks++
+		} else if _, err := os.Stat(t.path); err != nil {
+			// the scan of the folder drops it once the folder is reachable
+			report.add(&AudyIntegrityFinding{
+				Kind:   integrityMissingFile,
+				Hash:   hash,
+				Detail: t.path,
+			})
+			continue
+		}
+
+		for _, f := range verifyTrackFile(t) {
+			report.add(f)
+		}
+	}
+
+	report.StoreSuspect = storedTracks > 0 && foundTracks == 0
+
+	if err = findOrphanBlobs(report, tracks, musicBlobs); err != nil {
+		return nil, err
+	}
+
+	if dbErr = findDanglingPlaylists(report); dbErr != nil {
+		return nil, errors.New(dbErr.Error())
+	}
+
+	if report.StoreSuspect {
+		for _, f := range report.Findings {
+			if f.Kind == integrityMissingFile || f.Kind == integrityOrphanBlob {
+				f.Fixable = false
+			}
+		}
+	}
+
+	if fix {
+		repairIntegrity(report, confirmed)
+	}
+
+	report.Finished = time.Now().Unix()
+
+	return report, nil
+}
+
+// verifyTrackFile hashes the track file again and checks that it decodes
+// to the stored duration. Tracks are only fully decoded when a decoder is
+// available, otherwise their container is checked
+func verifyTrackFile(t *DBTrack) []*AudyIntegrityFinding {
+	findings := []*AudyIntegrityFinding{}
+	trackPath, release, err := localTrackFile(t)
+
+	if err != nil {
+		return append(findings, &AudyIntegrityFinding{Kind: integrityUnreadable, Hash: t.Md5, Detail: err.Error()})
+	}
+
+	defer release()
+
+	f, err := os.Open(trackPath)
+
+	if err != nil {
+		return append(findings, &AudyIntegrityFinding{Kind: integrityUnreadable, Hash: t.Md5, Detail: err.Error()})
+	}
+
+	if hash := md5File(bufio.NewReaderSize(f, 1024*1024)); hash != t.Md5 {
+		findings = append(findings, &AudyIntegrityFinding{
+			Kind:   integrityHashMismatch,
+			Hash:   t.Md5,
+			Detail: fmt.Sprint("file hashes to ", hash),
+		})
+	}
+
+	format := getFormat(t.Format)
+	duration, err := calcFormatDuration(format, f)
+	f.Close()
+
+	if err != nil {
+		return append(findings, &AudyIntegrityFinding{Kind: integrityUndecodable, Hash: t.Md5, Detail: err.Error()})
+	}
+
+	if t.Format == "wav" || decoderAvailable() {
+		counter := &frameCounter{}
+		err = decodeAudio(trackPath, format, counter)
+
+		if err != nil && err != errNoDecoder {
+			return append(findings, &AudyIntegrityFinding{Kind: integrityUndecodable, Hash: t.Md5, Detail: err.Error()})
+		}
+
+		if err == nil {
+			if counter.frames == 0 {
+				return append(findings, &AudyIntegrityFinding{Kind: integrityUndecodable, Hash: t.Md5, Detail: "no audio decoded"})
+			}
+
+			duration = counter.duration()
+		}
+	}
+
+	tolerance := math.Max(integrityDurationMinDiff, float64(duration)/100)
+
+	if math.Abs(float64(t.Duration-duration)) > tolerance {
+		findings = append(findings, &AudyIntegrityFinding{
+			Kind:     integrityDuration,
+			Hash:     t.Md5,
+			Detail:   fmt.Sprintf("stored %.1fs, measured %.1fs", t.Duration, duration),
+			Duration: duration,
+			Fixable:  true,
+		})
+	}
+
+	return findings
+}
+
+// findOrphanBlobs looks for stored files no track, album or user has
+func findOrphanBlobs(report *AudyIntegrityReport, tracks map[string]*DBTrack, musicBlobs []*BlobInfo) error {
+	// files of library folders must never be removed through the store
+	musicFixable := true
+
+	if s, ok := store.(*LocalBlobStore); ok && inLibraryFolder(s.path("music")) {
+		musicFixable = false
+	}
+
+	recent := time.Now().Add(-integrityOrphanGrace)
+	orphans := make(map[string]bool, 0)
+	hashes := make([]string, 0)
+
+	for _, b := range musicBlobs {
+		parts := strings.SplitN(strings.TrimPrefix(b.Key, "music/"), "/", 2)
+
+		if len(parts) < 2 || tracks[parts[0]] != nil {
+			continue
+		}
+
+		if b.ModTime.After(recent) {
+			orphans[parts[0]] = false
+		} else if _, ok := orphans[parts[0]]; !ok {
+			orphans[parts[0]] = true
+			hashes = append(hashes, parts[0])
+		}
+	}
+
+	for _, hash := range hashes {
+		if !orphans[hash] {
+			continue
+		}
+
+		report.add(&AudyIntegrityFinding{
+			Kind:    integrityOrphanBlob,
+			Hash:    hash,
+			Key:     fmt.Sprint("music/", hash, "/"),
+			Detail:  "no track has these files",
+			Fixable: musicFixable,
+		})
+	}
+
+	albumIDs, dbErr := db.GetAlbumIDs()
+
+	if dbErr != nil {
+		return errors.New(dbErr.Error())
+	}
+
+	if err := findOrphanImages(report, "albums/", albumIDs, "album"); err != nil {
+		return err
+	}
+
+	userIDs, dbErr := db.GetUserIDs()
+
+	if dbErr != nil {
+		return errors.New(dbErr.Error())
+	}
+
+	return findOrphanImages(report, "avatars/", userIDs, "user")
+}
+
+// findOrphanImages reports the <prefix><id>.jpg blobs whose id isn't in ids
+func findOrphanImages(report *AudyIntegrityReport, prefix string, ids []int, owner string) error {
+	blobs, err := store.List(prefix)
+
+	if err != nil {
+		return err
+	}
+
+	known := make(map[int]bool, len(ids))
+
+	for _, id := range ids {
+		known[id] = true
+	}
+
+	for _, b := range blobs {
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(b.Key, prefix), ".jpg"))
+
+		if err != nil || known[id] {
+			continue
+		}
+
+		report.add(&AudyIntegrityFinding{
+			Kind:    integrityOrphanBlob,
+			Key:     b.Key,
+			Detail:  fmt.Sprintf("%v %v doesn't exist", owner, id),
+			Fixable: true,
+		})
+	}
+
+	return nil
+}
+
+func findDanglingPlaylists(report *AudyIntegrityReport) *DBWorkerError {
+	rows, dbErr := db.GetDanglingPlaylistTracks()
+
+	if dbErr != nil {
+		return dbErr
+	}
+
+	for _, pt := range rows {
+		report.add(&AudyIntegrityFinding{
+			Kind:     integrityDanglingTrack,
+			Hash:     pt.Md5,
+			Playlist: pt.PlaylistID,
+			Detail:   "playlist or track doesn't exist",
+			Fixable:  true,
+		})
+	}
+
+	ids, dbErr := db.GetOrphanPlaylists()
+
+	if dbErr != nil {
+		return dbErr
+	}
+
+	for _, id := range ids {
+		report.add(&AudyIntegrityFinding{
+			Kind:     integrityOrphanPlaylist,
+			Playlist: id,
+			Detail:   "owner doesn't exist",
+			Fixable:  true,
+		})
+	}
+
+	return nil
+}
+
+// repairIntegrity fixes the fixable findings. Each one is checked again
+// right before, since the library may have changed since it was found
+func repairIntegrity(report *AudyIntegrityReport, confirmed map[string]bool) {
+	dropped := []*DBTrack{}
+	droppedFindings := []*AudyIntegrityFinding{}
+
+	for _, f := range report.Findings {
+		if !f.Fixable || (confirmed != nil && !confirmed[f.id()]) {
+			continue
+		}
+
+		switch f.Kind {
+		case integrityMissingFile:
+			t, dbErr := db.GetTrack(f.Hash)
+
+			if dbErr != nil || t.External || blobExists(trackKey(f.Hash)) {
+				continue
+			}
+
+			dropped = append(dropped, t)
+			droppedFindings = append(droppedFindings, f)
+		case integrityDuration:
+			if _, dbErr := db.SetTrackDuration(f.Hash, f.Duration); dbErr != nil {
+				dbErr.Print()
+				continue
+			}
+
+			updateLibTrack(f.Hash, func(t *DBTrack) { t.Duration = f.Duration })
+
+			f.Fixed = true
+		case integrityOrphanBlob:
+			f.Fixed = repairOrphanBlob(f)
+		case integrityDanglingTrack:
+			if _, dbErr := db.RemovePlaylistTrack(f.Playlist, f.Hash); dbErr != nil {
+				dbErr.Print()
+				continue
+			}
+
+			f.Fixed = true
+		case integrityOrphanPlaylist:
+			if _, dbErr := db.RemovePlaylist(f.Playlist); dbErr != nil {
+				dbErr.Print()
+				continue
+			}
+
+			f.Fixed = true
+		}
+	}
+
+	if len(dropped) > 0 {
+		if dbErr := dropTracks(dropped); dbErr != nil {
+			dbErr.Print()
+		} else {
+			for _, f := range droppedFindings {
+				f.Fixed = true
+			}
+
+			removeOrphanAlbums()
+		}
+	}
+
+	invalidateLibCache()
+}
+
+func repairOrphanBlob(f *AudyIntegrityFinding) bool {
+	var err error
+
+	if len(f.Hash) > 0 {
+		if _, dbErr := db.GetTrack(f.Hash); dbErr == nil || dbErr.underlying != sql.ErrNoRows {
+			return false
+		}
+
+		err = removeTrackBlobs(f.Hash)
+		removeTranscodeCache(f.Hash)
+	} else {
+		err = store.Delete(f.Key)
+	}
+
+	if err != nil {
+		fmt.Printf("Unable to remove %v: %v\n", f.Key, err.Error())
+		return false
+	}
+
+	return true
+}
+
+func printIntegrityReport(report *AudyIntegrityReport) {
+	for _, f := range report.Findings {
+		subject := f.Hash
+
+		if len(f.Key) > 0 {
+			subject = f.Key
+		}
+
+		if f.Playlist != 0 {
+			subject = strings.TrimSpace(fmt.Sprintf("playlist %v %v", f.Playlist, f.Hash))
+		}
+
+		state := ""
+
+		if f.Fixed {
+			state = " [fixed]"
+		} else if f.Fixable {
+			state = " [fixable]"
+		}
+
+		fmt.Printf("%v %v: %v%v\n", f.Kind, subject, f.Detail, state)
+	}
+
+	if report.StoreSuspect {
+		fmt.Println("None of the stored tracks were found. Check the storage settings; missing files and orphans won't be repaired")
+	}
+
+	fmt.Printf("Checked %v tracks: %v findings, %v left\n", report.Tracks, len(report.Findings), report.unfixed())
+}
+
+func saveIntegrityReport(report *AudyIntegrityReport) error {
+	data, err := json.MarshalIndent(report, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := integrityReportPath + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, integrityReportPath)
+}
+
+func loadIntegrityReport() (*AudyIntegrityReport, error) {
+	data, err := ioutil.ReadFile(integrityReportPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AudyIntegrityReport{}
+
+	if err = json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// runIntegrityJob checks the library and keeps the report for the admin. A
+// repair only fixes what the confirmed report listed and is still found
+func runIntegrityJob(ctx context.Context, job *DBJob) *AudyJobError {
+	payload := &integrityJobPayload{}
+
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return &AudyJobError{err, "invalid_job_payload", true}
+	}
+
+	var confirmed map[string]bool
+
+	if payload.Report != 0 {
+		last, err := loadIntegrityReport()
+
+		if err != nil || last.ID != payload.Report {
+			return &AudyJobError{err, "integrity_report_outdated", true}
+		}
+
+		confirmed = last.fixableIDs()
+	}
+
+	report, err := checkIntegrity(ctx, payload.Report != 0, confirmed)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return &AudyJobError{ctx.Err(), "cancelled", true}
+		}
+
+		return &AudyJobError{err, "integrity_check", false}
+	}
+
+	report.ID = job.ID
+
+	if err = saveIntegrityReport(report); err != nil {
+		return &AudyJobError{err, "integrity_report", false}
+	}
+
+	fmt.Printf("Integrity check %v: %v tracks, %v findings, %v left\n", job.ID, report.Tracks, len(report.Findings), report.unfixed())
+
+	if report.libChanged() {
+		SendMessageAll(&gin.H{
+			"type": "lib_changed",
+			"data": &gin.H{
+				"revision": libRevision(),
+			},
+		})
+	}
+
+	return nil
+}
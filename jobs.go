@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	jobStateQueued    string = "queued"
+	jobStateRunning   string = "running"
+	jobStateDone      string = "done"
+	jobStateFailed    string = "failed"
+	jobStateCancelled string = "cancelled"
+)
+
+const jobTypeIngest string = "ingest"
+
+const jobMaxAttempts int = 3
+const jobRetryDelay int64 = 10
+const jobMaxRetryDelay int64 = 600
+const jobPollInterval time.Duration = 5 * time.Second
+
+// finished jobs are kept this long for the admin to look at
+const jobRetention int64 = 7 * 24 * 60 * 60
+
+// AudyJobError is returned by job handlers. Permanent errors fail the job
+// right away, the others are retried with backoff
+type AudyJobError struct {
+	underlying error
+	key        string
+	permanent  bool
+}
+
+func (e *AudyJobError) Error() string {
+	if e.underlying == nil {
+		return e.key
+	}
+
+	return fmt.Sprintf("%v: %v", e.key, e.underlying.Error())
+}
+
+type AudyJobType struct {
+	Run func(ctx context.Context, job *DBJob) *AudyJobError
+	// Finished is called once the job is done, failed or cancelled
+	Finished func(job *DBJob)
+}
+
+var jobTypes map[string]*AudyJobType = map[string]*AudyJobType{
+	jobTypeIngest:         {runIngestJob, ingestJobFinished},
+	jobTypeLibraryScan:    {runLibraryScanJob, nil},
+	jobTypeIntegrityCheck: {runIntegrityJob, nil},
+}
+
+// AudyJobQueue runs jobs stored in the jobs table on a fixed number of
+// workers. Jobs survive restarts, the ones interrupted while running are
+// queued again on start
+type AudyJobQueue struct {
+	mutex   sync.Mutex
+	wake    chan bool
+	running map[int]context.CancelFunc
+
+	// batches whose last job was handled, by the time it happened. Workers
+	// finishing the last jobs of a batch together report it only once
+	drainMutex sync.Mutex
+	drained    map[string]int64
+}
+
+var jobQueue *AudyJobQueue = &AudyJobQueue{
+	running: make(map[int]context.CancelFunc, 0),
+	drained: make(map[string]int64, 0),
+}
+
+func (q *AudyJobQueue) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	q.wake = make(chan bool, workers)
+
+	if _, dbErr := db.RequeueRunningJobs(time.Now().Unix()); dbErr != nil {
+		dbErr.Print()
+	}
+
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+// Wake makes idle workers look for new jobs without waiting for the poll
+func (q *AudyJobQueue) Wake() {
+	for i := 0; i < cap(q.wake); i++ {
+		select {
+		case q.wake <- true:
+		default:
+			return
+		}
+	}
+}
+
+func (q *AudyJobQueue) Enqueue(jobType, batch, target string, userID int, payload interface{}) (*DBJob, *DBWorkerError) {
+	data, err := json.Marshal(payload)
+
+	if err != nil {
+		return nil, &DBWorkerError{err, "", fmt.Sprintf("encoding %v job payload", jobType)}
+	}
+
+	now := time.Now().Unix()
+	job := &DBJob{
+		Type:        jobType,
+		Batch:       batch,
+		Target:      target,
+		Payload:     string(data),
+		userID:      userID,
+		State:       jobStateQueued,
+		MaxAttempts: jobMaxAttempts,
+		Created:     now,
+		Updated:     now,
+	}
+
+	if _, dbErr := db.AddJob(job); dbErr != nil {
+		return nil, dbErr
+	}
+
+	q.Wake()
+	return job, nil
+}
+
+func (q *AudyJobQueue) work() {
+	for {
+		job, ctx := q.claim()
+
+		if job == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(jobPollInterval):
+			}
+
+			continue
+		}
+
+		q.run(ctx, job)
+	}
+}
+
+// claim is serialized, so one job is never picked by two workers
+func (q *AudyJobQueue) claim() (*DBJob, context.Context) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job, dbErr := db.ClaimJob(time.Now().Unix())
+
+	if dbErr != nil {
+		if dbErr.underlying != sql.ErrNoRows {
+			dbErr.Print()
+		}
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.running[job.ID] = cancel
+
+	return job, ctx
+}
+
+func (q *AudyJobQueue) run(ctx context.Context, job *DBJob) {
+	var jobErr *AudyJobError
+	jobType, ok := jobTypes[job.Type]
+
+	if ok {
+		jobErr = jobType.Run(ctx, job)
+	} else {
+		jobErr = &AudyJobError{fmt.Errorf("unknown job type %v", job.Type), "unknown_job_type", true}
+	}
+
+	q.mutex.Lock()
+	cancel := q.running[job.ID]
+	delete(q.running, job.ID)
+	q.mutex.Unlock()
+
+	cancelled := ctx.Err() != nil
+	cancel()
+
+	job.Updated = time.Now().Unix()
+	job.Error = ""
+
+	if jobErr != nil {
+		job.Error = jobErr.key
+	}
+
+	if jobErr == nil {
+		job.State = jobStateDone
+	} else if cancelled {
+		job.State = jobStateCancelled
+	} else if jobErr.permanent || job.Attempts >= job.MaxAttempts {
+		job.State = jobStateFailed
+		fmt.Printf("Job %v failed: %v\n", job, jobErr.Error())
+	} else {
+		delay := jobRetryDelay << uint(job.Attempts-1)
+
+		if delay > jobMaxRetryDelay {
+			delay = jobMaxRetryDelay
+		}
+
+		job.State = jobStateQueued
+		job.RunAfter = job.Updated + delay
+		fmt.Printf("Job %v failed, retrying in %v seconds: %v\n", job, delay, jobErr.Error())
+	}
+
+	if _, dbErr := db.UpdateJobState(job); dbErr != nil {
+		dbErr.Print()
+	}
+
+	if job.State != jobStateQueued && ok && jobType.Finished != nil {
+		jobType.Finished(job)
+	}
+}
+
+// Cancel stops a running job or drops a queued one. It returns false when
+// the job has already finished
+func (q *AudyJobQueue) Cancel(job *DBJob) (bool, *DBWorkerError) {
+	// the lock keeps a worker from claiming the job in between
+	q.mutex.Lock()
+	cancel, running := q.running[job.ID]
+
+	if running {
+		q.mutex.Unlock()
+
+		// the worker records the cancellation once the handler returns
+		cancel()
+		return true, nil
+	}
+
+	res, dbErr := db.SetQueuedJobState(job.ID, jobStateCancelled, time.Now().Unix())
+	q.mutex.Unlock()
+
+	if dbErr != nil {
+		return false, dbErr
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+
+	job.State = jobStateCancelled
+
+	if jobType, ok := jobTypes[job.Type]; ok && jobType.Finished != nil {
+		jobType.Finished(job)
+	}
+
+	return true, nil
+}
+
+// Retry queues a failed or cancelled job again with a fresh attempt count
+func (q *AudyJobQueue) Retry(job *DBJob) *DBWorkerError {
+	job.State = jobStateQueued
+	job.Attempts = 0
+	job.RunAfter = 0
+	job.Error = ""
+	job.Updated = time.Now().Unix()
+
+	if _, dbErr := db.UpdateJobState(job); dbErr != nil {
+		return dbErr
+	}
+
+	q.drainMutex.Lock()
+	delete(q.drained, job.Batch)
+	q.drainMutex.Unlock()
+
+	q.Wake()
+	return nil
+}
+
+// BatchDrained reports whether the batch has no queued or running job left.
+// It returns true to a single caller, until a job of the batch is retried
+func (q *AudyJobQueue) BatchDrained(batch string) (bool, *DBWorkerError) {
+	q.drainMutex.Lock()
+	defer q.drainMutex.Unlock()
+
+	if _, ok := q.drained[batch]; ok {
+		return false, nil
+	}
+
+	active, dbErr := db.CountActiveBatchJobs(batch)
+
+	if dbErr != nil || active > 0 {
+		return false, dbErr
+	}
+
+	q.drained[batch] = time.Now().Unix()
+	return true, nil
+}
+
+// CleanupLoop removes finished jobs older than jobRetention
+func (q *AudyJobQueue) CleanupLoop(interval time.Duration) {
+	for {
+		before := time.Now().Unix() - jobRetention
+
+		if _, dbErr := db.RemoveFinishedJobs(before); dbErr != nil {
+			dbErr.Print()
+		}
+
+		q.drainMutex.Lock()
+		for batch, drained := range q.drained {
+			if drained < before {
+				delete(q.drained, batch)
+			}
+		}
+		q.drainMutex.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+const (
+	ingestSourceFtp     string = "ftp"
+	ingestSourceWatch   string = "watch"
+	ingestSourceUpload  string = "upload"
+	ingestSourceArchive string = "archive"
+)
+
+type ingestJobPayload struct {
+	Path     string `json:"path"`
+	FileName string `json:"file_name"`
+	Source   string `json:"source"`
+	// cover image for tracks of archives that have no picture
+	Cover string `json:"cover,omitempty"`
+	// WatchedArchive is the watched archive a track was extracted from, the
+	// track is rejected next to it when it fails
+	WatchedArchive string `json:"watched_archive,omitempty"`
+}
+
+// these processTrack errors won't go away on retry
+var ingestPermanentErrors map[string]bool = map[string]bool{
+	"unsupported_format": true,
+	"already_exists":     true,
+	"no_hash":            true,
+	"get_duration":       true,
+}
+
+func runIngestJob(ctx context.Context, job *DBJob) *AudyJobError {
+	payload := &ingestJobPayload{}
+
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return &AudyJobError{err, "invalid_job_payload", true}
+	}
+
+	if ctx.Err() != nil {
+		return &AudyJobError{ctx.Err(), "cancelled", true}
+	}
+
+	if isArchiveFileName(payload.FileName) {
+		return expandArchiveJob(job, payload)
+	}
+
+	track, procErr := processTrack(payload.Path, payload.FileName, payload.Cover)
+
+	if procErr != nil {
+		if procErr.underlyingDB != nil {
+			return &AudyJobError{errors.New(procErr.underlyingDB.Error()), "db", false}
+		}
+
+		return &AudyJobError{procErr.underlying, procErr.key, ingestPermanentErrors[procErr.key]}
+	}
+
+	setLibTrack(track)
+	invalidateLibCache()
+
+	SendMessageAll(&gin.H{
+		"type": "track_add",
+		"data": &gin.H{
+			"track":    track,
+			"revision": libRevision(),
+		},
+	})
+
+	return nil
+}
+
+// ingestJobFinished reports the file to the user who started the upload, and
+// the batch once it is through. Watched files that failed, tracks of watched
+// archives included, are moved to the rejected directory
+func ingestJobFinished(job *DBJob) {
+	payload := &ingestJobPayload{}
+	json.Unmarshal([]byte(job.Payload), payload)
+
+	if job.State != jobStateDone {
+		if payload.Source == ingestSourceWatch {
+			rejectWatchedFile(payload.Path, filepath.Dir(payload.Path), filepath.Base(payload.Path), job.Error)
+		} else if len(payload.WatchedArchive) > 0 {
+			rejectWatchedFile(payload.Path, filepath.Dir(payload.WatchedArchive),
+				fmt.Sprint(filepath.Base(payload.WatchedArchive), "-", filepath.Base(payload.FileName)), job.Error)
+		}
+	}
+
+	// tracks of an expanded archive are reported instead of the archive
+	archiveExpanded := isArchiveFileName(payload.FileName) && job.State == jobStateDone
+
+	if job.userID > 0 && !archiveExpanded {
+		hub.SendUser(job.userID, &gin.H{
+			"type": "ftpu_file_processed",
+			"data": &gin.H{
+				"fileName": payload.FileName,
+				"key":      job.Error,
+				"success":  job.State == jobStateDone,
+				"job_id":   job.ID,
+			},
+		})
+	}
+
+	drained, dbErr := jobQueue.BatchDrained(job.Batch)
+
+	if dbErr != nil {
+		dbErr.Print()
+		return
+	}
+
+	if !drained {
+		return
+	}
+
+	removeArchiveUploads(job.Batch)
+
+	if job.userID > 0 {
+		hub.SendUser(job.userID, &gin.H{
+			"type": "ftpu_done",
+			"data": nil,
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func testIngestJob(t *testing.T, path string) *DBJob {
+	payload, err := json.Marshal(&ingestJobPayload{path, filepath.Base(path), ingestSourceFtp, "", ""})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &DBJob{Type: jobTypeIngest, Payload: string(payload)}
+}
+
+// writeTestWav writes a wav file whose md5 depends on seed
+func writeTestWav(t *testing.T, path string, seed byte) string {
+	data := testWav(16)
+	data[len(data)-1] = seed
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return md5String(string(data))
+}
+
+func setupIngest(t *testing.T) {
+	openTestDB(t)
+
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+
+	var err error
+
+	if store, err = NewLocalBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestKeepsSourceOnDBFailure(t *testing.T) {
+	setupIngest(t)
+
+	path := "upload/ftp_upload/track.wav"
+	hash := writeTestWav(t, path, 1)
+	defer removeLibTrack(hash)
+
+	if _, err := db.conn.Exec(`CREATE TRIGGER fail_add_track BEFORE INSERT ON music
+		BEGIN SELECT RAISE(ABORT, 'add track failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	job := testIngestJob(t, path)
+	jobErr := runIngestJob(context.Background(), job)
+
+	if jobErr == nil || jobErr.permanent {
+		t.Fatalf("failed insert answered %v, want a retryable error", jobErr)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("source is gone after a failed insert: %v", err)
+	}
+
+	if blobExists(trackKey(hash)) {
+		t.Error("blob of the failed track kept")
+	}
+
+	if _, err := db.conn.Exec(`DROP TRIGGER fail_add_track`); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retry finds the file where it was
+	if jobErr = runIngestJob(context.Background(), job); jobErr != nil {
+		t.Fatalf("retry failed: %v", jobErr)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("source kept after the track was stored")
+	}
+
+	if _, ok := libTrack(hash); !ok || !blobExists(trackKey(hash)) {
+		t.Error("retried track wasn't stored")
+	}
+}
+
+func TestIngestSameFileConcurrently(t *testing.T) {
+	setupIngest(t)
+
+	copies := 4
+	paths := make([]string, copies)
+	var hash string
+
+	for i := range paths {
+		paths[i] = fmt.Sprintf("upload/ftp_upload/copy-%v.wav", i)
+		hash = writeTestWav(t, paths[i], 2)
+	}
+
+	defer removeLibTrack(hash)
+
+	var wg sync.WaitGroup
+	keys := make([]string, copies)
+
+	for i := range paths {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			if _, procErr := processTrack(paths[i], filepath.Base(paths[i]), ""); procErr != nil {
+				keys[i] = procErr.key
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	stored := 0
+
+	for _, key := range keys {
+		if key == "" {
+			stored++
+		} else if key != "already_exists" {
+			t.Errorf("copy failed with %v", key)
+		}
+	}
+
+	if stored != 1 {
+		t.Errorf("%v copies stored, want 1", stored)
+	}
+
+	if !blobExists(trackKey(hash)) {
+		t.Error("blob of the stored track was removed")
+	}
+
+	if tr, dbErr := db.GetTrack(hash); dbErr != nil || tr == nil {
+		t.Error("track wasn't stored")
+	}
+}
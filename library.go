@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Library folders are read-only directories indexed in place. Their files
+// are never moved, renamed or removed, only the derived data (cover,
+// waveform, transcodes) is kept in the blob store like for uploaded tracks
+const jobTypeLibraryScan string = "library_scan"
+
+// scans of one folder run one at a time, even if two of them got queued
+var libraryScanLocks *AudyKeyedMutex = &AudyKeyedMutex{}
+
+// openTrack opens the audio of the track, from its library folder or the
+// blob store
+func openTrack(t *DBTrack) (BlobReader, error) {
+	if len(t.path) > 0 {
+		return os.Open(t.path)
+	}
+
+	return store.Open(trackKey(t.Md5))
+}
+
+func openTrackByHash(hash string) (BlobReader, error) {
+	if t, ok := libTrack(hash); ok {
+		return openTrack(t)
+	}
+
+	return store.Open(trackKey(hash))
+}
+
+func statTrack(t *DBTrack) (*BlobInfo, error) {
+	if len(t.path) == 0 {
+		return store.Stat(trackKey(t.Md5))
+	}
+
+	fi, err := os.Stat(t.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobInfo{t.path, fi.Size(), fi.ModTime()}, nil
+}
+
+// localTrackFile returns a path decoders and encoders can read the track
+// from, see localBlobFile
+func localTrackFile(t *DBTrack) (string, func(), error) {
+	if len(t.path) > 0 {
+		return t.path, func() {}, nil
+	}
+
+	return localBlobFile(trackKey(t.Md5))
+}
+
+func localTrackFileByHash(hash string) (string, func(), error) {
+	if t, ok := libTrack(hash); ok {
+		return localTrackFile(t)
+	}
+
+	return localBlobFile(trackKey(hash))
+}
+
+func libraryFolderPrefix(root string) string {
+	return filepath.Clean(root) + string(filepath.Separator)
+}
+
+func pathInFolder(path, root string) bool {
+	return path == filepath.Clean(root) || strings.HasPrefix(path, libraryFolderPrefix(root))
+}
+
+// inLibraryFolder reports whether path lies inside one of the library
+// folders. Paths that can't be resolved are treated as inside to be safe
+func inLibraryFolder(path string) bool {
+	abs, err := filepath.Abs(path)
+
+	if err != nil {
+		return true
+	}
+
+	for _, root := range config.LibraryFolders {
+		if pathInFolder(abs, root) || pathInFolder(root, abs) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateLibraryFolders(folders []string) error {
+	dataDir, err := filepath.Abs("db")
+
+	if err != nil {
+		return err
+	}
+
+	dataDirs := []string{dataDir}
+
+	if s, ok := store.(*LocalBlobStore); ok {
+		dataDirs = append(dataDirs, s.Root)
+	}
+
+	for i, folder := range folders {
+		if !filepath.IsAbs(folder) {
+			return fmt.Errorf("Library folder %v is not an absolute path", folder)
+		}
+
+		folder = filepath.Clean(folder)
+
+		if fi, err := os.Stat(folder); err != nil || !fi.IsDir() {
+			return fmt.Errorf("Library folder %v is not a directory", folder)
+		}
+
+		for _, dir := range dataDirs {
+			if pathInFolder(folder, dir) || pathInFolder(dir, folder) {
+				return fmt.Errorf("Library folder %v overlaps with the data directory %v", folder, dir)
+			}
+		}
+
+		for _, other := range folders[:i] {
+			if pathInFolder(folder, other) || pathInFolder(filepath.Clean(other), folder) {
+				return fmt.Errorf("Library folders %v and %v overlap", other, folder)
+			}
+		}
+	}
+
+	return nil
+}
+
+// scanLibraryFolders queues a scan of every library folder that isn't being
+// scanned already
+func scanLibraryFolders() {
+	batch := genId()
+
+	for _, root := range config.LibraryFolders {
+		root = filepath.Clean(root)
+		active, dbErr := db.HasActiveJob(jobTypeLibraryScan, root)
+
+		if dbErr != nil {
+			dbErr.Print()
+			continue
+		}
+
+		if active {
+			continue
+		}
+
+		if _, dbErr = jobQueue.Enqueue(jobTypeLibraryScan, batch, root, 0, nil); dbErr != nil {
+			dbErr.Print()
+		}
+	}
+}
+
+// dropTracks removes tracks from the library along with everything kept
+// for them in the blob store. Files in library folders are left alone
+func dropTracks(tracks []*DBTrack) *DBWorkerError {
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	hashes := make([]interface{}, len(tracks))
+
+	for i, t := range tracks {
+		hashes[i] = t.Md5
+	}
+
+	if _, dbErr := db.RemoveTracks(hashes); dbErr != nil {
+		return dbErr
+	}
+
+	albums := make(map[int]bool, 0)
+
+	for _, t := range tracks {
+		if err := removeTrackBlobs(t.Md5); err != nil {
+			fmt.Printf("Unable to remove files of track %v: %v\n", t.Md5, err.Error())
+		}
+
+		removeTranscodeCache(t.Md5)
+		removeLibTrack(t.Md5)
+
+		if !albums[t.AlbumID] {
+			albums[t.AlbumID] = true
+			refreshAlbumGain(t.AlbumID)
+		}
+	}
+
+	return nil
+}
+
+// AudyLibraryScan compares one library folder with the tracks indexed from
+// it. Files are matched by path and only read again when their size or
+// modification time changed
+type AudyLibraryScan struct {
+	root       string
+	known      map[string]*DBTrack
+	seen       map[string]bool
+	unreadable []string
+
+	added, updated, moved, removed, failed int
+}
+
+func runLibraryScanJob(ctx context.Context, job *DBJob) *AudyJobError {
+	root := job.Target
+
+	libraryScanLocks.Lock(root)
+	defer libraryScanLocks.Unlock(root)
+
+	fi, err := os.Stat(root)
+
+	if err != nil || !fi.IsDir() {
+		// unmounted drives come back, so the scan is retried
+		return &AudyJobError{err, "library_folder_unavailable", false}
+	}
+
+	tracks, dbErr := db.GetFolderTracks(libraryFolderPrefix(root))
+
+	if dbErr != nil {
+		return &AudyJobError{errors.New(dbErr.Error()), "db", false}
+	}
+
+	s := &AudyLibraryScan{
+		root:       root,
+		known:      make(map[string]*DBTrack, len(tracks)),
+		seen:       make(map[string]bool, 0),
+		unreadable: make([]string, 0),
+	}
+
+	for _, t := range tracks {
+		s.known[t.path] = t
+	}
+
+	defer s.finish()
+
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			fmt.Printf("Unable to read %v: %v\n", path, err.Error())
+			s.unreadable = append(s.unreadable, path)
+			return nil
+		}
+
+		name := fi.Name()
+
+		if fi.IsDir() {
+			if path != root && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() || strings.HasPrefix(name, ".") || !isAudioFileName(name) {
+			return nil
+		}
+
+		s.seen[path] = true
+		s.indexFile(path, fi)
+
+		return nil
+	})
+
+	if err != nil {
+		return &AudyJobError{err, "cancelled", true}
+	}
+
+	if dbErr = s.removeMissing(); dbErr != nil {
+		return &AudyJobError{errors.New(dbErr.Error()), "db", false}
+	}
+
+	return nil
+}
+
+func (s *AudyLibraryScan) indexFile(path string, fi os.FileInfo) {
+	old := s.known[path]
+
+	if old != nil && old.fileSize == fi.Size() && old.fileModTime == fi.ModTime().Unix() {
+		return
+	}
+
+	file, procErr := probeTrackFile(path)
+
+	if procErr != nil {
+		fmt.Printf("Unable to index %v: %v\n", path, procErr.Error())
+		s.failed++
+		return
+	}
+
+	// touched, but the contents are the same
+	if old != nil && old.Md5 == file.hash {
+		s.setFileInfo(old, path, fi)
+		return
+	}
+
+	if old != nil {
+		if dbErr := dropTracks([]*DBTrack{old}); dbErr != nil {
+			dbErr.Print()
+			s.failed++
+			return
+		}
+
+		s.updated++
+	}
+
+	stored, procErr := s.storeFile(file, path, fi)
+
+	if procErr != nil {
+		if procErr.underlyingDB != nil {
+			procErr.underlyingDB.Print()
+		} else {
+			fmt.Printf("Unable to index %v: %v\n", path, procErr.Error())
+		}
+
+		s.failed++
+		return
+	}
+
+	if !stored {
+		return
+	}
+
+	if old == nil {
+		s.added++
+	}
+}
+
+func (s *AudyLibraryScan) setFileInfo(t *DBTrack, path string, fi os.FileInfo) {
+	t.path = path
+	t.fileSize = fi.Size()
+	t.fileModTime = fi.ModTime().Unix()
+
+	if _, dbErr := db.SetTrackFileInfo(t); dbErr != nil {
+		dbErr.Print()
+		return
+	}
+
+	updateLibTrack(t.Md5, func(lt *DBTrack) {
+		lt.path = t.path
+		lt.fileSize = t.fileSize
+		lt.fileModTime = t.fileModTime
+	})
+}
+
+// storeFile adds the track of a file, unless its md5 is known already. A
+// file moved within the library keeps its track, playlists included
+func (s *AudyLibraryScan) storeFile(file *AudyTrackFile, path string, fi os.FileInfo) (bool, *AudyTrackProcessingErr) {
+	ingestLocks.Lock(file.hash)
+	defer ingestLocks.Unlock(file.hash)
+
+	if t, _ := db.GetTrack(file.hash); t != nil {
+		if _, err := statTrack(t); t.External && os.IsNotExist(err) {
+			s.seen[t.path] = true
+			s.setFileInfo(t, path, fi)
+			s.moved++
+		}
+
+		return false, nil
+	}
+
+	return true, s.addTrack(file, path, fi)
+}
+
+func (s *AudyLibraryScan) addTrack(file *AudyTrackFile, path string, fi os.FileInfo) *AudyTrackProcessingErr {
+	newTrack := &DBTrack{
+		Md5:         file.hash,
+		Timestamp:   int(time.Now().Unix()),
+		HasImage:    false,
+		Duration:    file.duration,
+		Format:      file.format.Name,
+		Mime:        file.format.Mime,
+		External:    true,
+		path:        path,
+		fileSize:    fi.Size(),
+		fileModTime: fi.ModTime().Unix(),
+	}
+
+	applyTrackTags(newTrack, file.tags, fi.Name())
+
+	// decoding a whole folder up front would hold the scan for a long time,
+	// loudness and waveforms are left to the backfill
+	applyGainTags(newTrack, file.tags)
+
+	if newErr := processAlbumPicture(file.hash, file.tags); newErr != nil {
+		if newErr.underlying != nil {
+			fmt.Print(newErr.Error())
+		}
+	} else {
+		newTrack.HasImage = true
+	}
+
+	if _, dbErr := db.AddTrack(newTrack); dbErr != nil {
+		removeTrackBlobs(file.hash)
+		return &AudyTrackProcessingErr{nil, dbErr, ""}
+	}
+
+	applyAlbumCover(newTrack)
+	setLibTrack(newTrack)
+
+	return nil
+}
+
+// removeMissing drops the tracks whose files are gone. Files in directories
+// that couldn't be read may still be there, so they are kept
+func (s *AudyLibraryScan) removeMissing() *DBWorkerError {
+	removed := make([]*DBTrack, 0)
+
+	for path, t := range s.known {
+		if s.seen[path] {
+			continue
+		}
+
+		missing := true
+
+		for _, dir := range s.unreadable {
+			if pathInFolder(path, dir) {
+				missing = false
+				break
+			}
+		}
+
+		if missing {
+			removed = append(removed, t)
+		}
+	}
+
+	if dbErr := dropTracks(removed); dbErr != nil {
+		return dbErr
+	}
+
+	s.removed += len(removed)
+	return nil
+}
+
+func (s *AudyLibraryScan) finish() {
+	fmt.Printf("Library folder %v scanned: %v added, %v updated, %v moved, %v removed, %v failed\n",
+		s.root, s.added, s.updated, s.moved, s.removed, s.failed)
+
+	if s.added+s.updated+s.moved+s.removed == 0 {
+		return
+	}
+
+	// the library map was kept up to date track by track
+	removeOrphanAlbums()
+	invalidateLibCache()
+
+	// clients fetch the difference with getchanges
+	SendMessageAll(&gin.H{
+		"type": "lib_changed",
+		"data": &gin.H{
+			"revision": libRevision(),
+		},
+	})
+
+	go backfillAnalysis()
+}
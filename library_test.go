@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testLibraryScan(t *testing.T, root string) *AudyLibraryScan {
+	tracks, dbErr := db.GetFolderTracks(libraryFolderPrefix(root))
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	s := &AudyLibraryScan{
+		root:       root,
+		known:      make(map[string]*DBTrack, len(tracks)),
+		seen:       make(map[string]bool, 0),
+		unreadable: make([]string, 0),
+	}
+
+	for _, track := range tracks {
+		s.known[track.path] = track
+	}
+
+	return s
+}
+
+func scanTestFile(t *testing.T, s *AudyLibraryScan, path string) {
+	fi, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.seen[path] = true
+	s.indexFile(path, fi)
+}
+
+func TestLibraryScanUpdatesMovedTrack(t *testing.T) {
+	setupIngest(t)
+
+	root := t.TempDir()
+	path := filepath.Join(root, "a.wav")
+	hash := writeTestWav(t, path, 1)
+	defer removeLibTrack(hash)
+
+	s := testLibraryScan(t, root)
+	scanTestFile(t, s, path)
+
+	added, ok := libTrack(hash)
+
+	if s.added != 1 || !ok || added.path != path {
+		t.Fatalf("track wasn't added to the library: %+v", added)
+	}
+
+	moved := filepath.Join(root, "album", "b.wav")
+
+	if err := os.MkdirAll(filepath.Dir(moved), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	s = testLibraryScan(t, root)
+	scanTestFile(t, s, moved)
+
+	if s.moved != 1 {
+		t.Fatalf("scan counted %v moved tracks", s.moved)
+	}
+
+	if lt, _ := libTrack(hash); lt == nil || lt.path != moved {
+		t.Errorf("library track wasn't moved: %+v", lt)
+	}
+
+	if added.path != path {
+		t.Error("library track was changed in place")
+	}
+
+	if f, err := openTrackByHash(hash); err != nil {
+		t.Errorf("moved track can't be opened: %v", err)
+	} else {
+		f.Close()
+	}
+}
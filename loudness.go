@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// ReplayGain 2.0 reference loudness. Opus R128 gains are relative to the EBU
+// R128 reference of -23 LUFS instead
+const replayGainReference float64 = -18
+const r128Reference float64 = -23
+
+const (
+	gainSourceNone     string = ""
+	gainSourceTags     string = "tags"
+	gainSourceAnalysis string = "analysis"
+	gainSourceFailed   string = "failed"
+)
+
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// loudnessMeter measures integrated loudness per ITU-R BS.1770-4 with the
+// gating of EBU R128. Energy is collected in 100 ms steps, 4 consecutive
+// steps make an overlapping 400 ms gating block
+type loudnessMeter struct {
+	filters    [][2]biquad
+	stepSize   int
+	stepCount  int
+	stepEnergy float64
+	steps      []float64
+	blocks     []float64
+	peak       float64
+}
+
+func (m *loudnessMeter) start(rate, channels int) {
+	m.filters = make([][2]biquad, channels)
+	m.stepSize = rate / 10
+
+	// K-weighting: high shelf followed by the RLB high pass, coefficients
+	// derived for the actual sample rate
+	fs := float64(rate)
+
+	f0 := 1681.974450955533
+	gain := 3.999843853973347
+	q := 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	for i := range m.filters {
+		m.filters[i] = [2]biquad{shelf, highPass}
+	}
+}
+
+func (m *loudnessMeter) addFrame(frame []float64) {
+	for ch, x := range frame {
+		if a := math.Abs(x); a > m.peak {
+			m.peak = a
+		}
+
+		y := m.filters[ch][1].process(m.filters[ch][0].process(x))
+		m.stepEnergy += y * y
+	}
+
+	m.stepCount++
+
+	if m.stepCount < m.stepSize {
+		return
+	}
+
+	m.steps = append(m.steps, m.stepEnergy/float64(m.stepSize))
+	m.stepEnergy = 0
+	m.stepCount = 0
+
+	if n := len(m.steps); n >= 4 {
+		m.blocks = append(m.blocks, (m.steps[n-1]+m.steps[n-2]+m.steps[n-3]+m.steps[n-4])/4)
+		m.steps = m.steps[n-3:]
+	}
+}
+
+func blockLoudness(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// result returns the integrated loudness in LUFS and the sample peak
+func (m *loudnessMeter) result() (float64, float64, error) {
+	var sum float64
+	var count int
+
+	for _, e := range m.blocks {
+		if e > 0 && blockLoudness(e) > -70 {
+			sum += e
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, 0, errors.New("track is silent or shorter than 400 ms")
+	}
+
+	relativeGate := blockLoudness(sum/float64(count)) - 10
+	sum, count = 0, 0
+
+	for _, e := range m.blocks {
+		if e > 0 && blockLoudness(e) > -70 && blockLoudness(e) > relativeGate {
+			sum += e
+			count++
+		}
+	}
+
+	return blockLoudness(sum / float64(count)), m.peak, nil
+}
+
+// parseGainValue reads values like "-6.54 dB" or "0.988553"
+func parseGainValue(v string) (float64, bool) {
+	v = strings.TrimSpace(v)
+	v = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(v, "dB"), "db"))
+
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// applyGainTags reads REPLAYGAIN_* and Opus R128_* tags. The raw tag names
+// differ between containers, so only their last part is compared
+func applyGainTags(t *DBTrack, m tag.Metadata) bool {
+	if m == nil {
+		return false
+	}
+
+	values := make(map[string]string, 0)
+
+	for k, raw := range m.Raw() {
+		name := k
+		value := ""
+
+		switch v := raw.(type) {
+		case *tag.Comm:
+			name = v.Description
+			value = v.Text
+		case string:
+			value = v
+		case []string:
+			if len(v) > 0 {
+				value = v[0]
+			}
+		default:
+			continue
+		}
+
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			name = name[i+1:]
+		}
+
+		values[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+
+	trackGain, hasTrackGain := parseGainValue(values["replaygain_track_gain"])
+	trackPeak, hasTrackPeak := parseGainValue(values["replaygain_track_peak"])
+	albumGain, hasAlbumGain := parseGainValue(values["replaygain_album_gain"])
+	albumPeak, _ := parseGainValue(values["replaygain_album_peak"])
+
+	// R128 gains are Q7.8 fixed point numbers
+	if !hasTrackGain {
+		if v, err := strconv.Atoi(strings.TrimSpace(values["r128_track_gain"])); err == nil {
+			trackGain = float64(v)/256 + replayGainReference - r128Reference
+			hasTrackGain = true
+		}
+	}
+
+	if !hasAlbumGain {
+		if v, err := strconv.Atoi(strings.TrimSpace(values["r128_album_gain"])); err == nil {
+			albumGain = float64(v)/256 + replayGainReference - r128Reference
+			hasAlbumGain = true
+		}
+	}
+
+	if !hasTrackGain {
+		return false
+	}
+
+	t.TrackGain = trackGain
+	t.Loudness = replayGainReference - trackGain
+	t.GainSource = gainSourceTags
+
+	if hasTrackPeak {
+		t.TrackPeak = trackPeak
+	}
+
+	if hasAlbumGain {
+		t.AlbumGain = albumGain
+		t.AlbumPeak = albumPeak
+		t.albumGainTagged = true
+	}
+
+	return true
+}
+
+// applyMeasuredGain stores the meter result. Tracks that couldn't be decoded
+// or measured are marked failed, so the backfill doesn't retry them
+func applyMeasuredGain(t *DBTrack, m *loudnessMeter, decodeErr error) {
+	if decodeErr != nil {
+		t.GainSource = gainSourceFailed
+		return
+	}
+
+	loudness, peak, err := m.result()
+
+	if err != nil {
+		fmt.Printf("Unable to measure loudness of %v: %v\n", t.Md5, err.Error())
+		t.GainSource = gainSourceFailed
+		return
+	}
+
+	t.Loudness = loudness
+	t.TrackGain = replayGainReference - loudness
+	t.TrackPeak = peak
+	t.GainSource = gainSourceAnalysis
+}
+
+// refreshAlbumGain recalculates the album gain of every album track whose
+// album gain didn't come from tags
+func refreshAlbumGain(albumID int) {
+	if albumID <= 0 {
+		return
+	}
+
+	gain, peak, dbErr := db.UpdateAlbumGain(albumID)
+
+	if dbErr != nil {
+		dbErr.Print()
+		return
+	}
+
+	for _, t := range libTracks() {
+		if t.AlbumID == albumID && !t.albumGainTagged {
+			updateLibTrack(t.Md5, func(nt *DBTrack) {
+				nt.AlbumGain = gain
+				nt.AlbumPeak = peak
+			})
+		}
+	}
+}
@@ -2,26 +2,51 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 )
 
 type AudyConfig struct {
-	SessionTime    int    `json:"session_time"`
-	RootUser       string `json:"root_user"`
-	AllPlaylistKey string `json:"all_playlist_key"`
-	DefaultLang    string `json:"default_language"`
-	CustomAppTitle string `json:"custom_app_title"`
+	SessionTime    int                 `json:"session_time"`
+	RootUser       string              `json:"root_user"`
+	AllPlaylistKey string              `json:"all_playlist_key"`
+	DefaultLang    string              `json:"default_language"`
+	CustomAppTitle string              `json:"custom_app_title"`
+	PasswordHash   AudyPasswordHash    `json:"password_hash"`
+	RemIPPrefixV4  int                 `json:"rem_ip_prefix_v4"`
+	RemIPPrefixV6  int                 `json:"rem_ip_prefix_v6"`
+	TrustedProxies []string            `json:"trusted_proxies"`
+	Transcode      AudyTranscodeConfig `json:"transcode"`
+	// DecodeCommand decodes {input} to 48 kHz stereo float32 samples on
+	// stdout for loudness analysis. WAV files are read without it
+	DecodeCommand []string        `json:"decode_command"`
+	JobWorkers    int             `json:"job_workers"`
+	Watch         AudyWatchConfig `json:"watch"`
+	// LibraryFolders are absolute paths of read-only directories indexed
+	// in place, see library.go
+	LibraryFolders []string          `json:"library_folders"`
+	Upload         AudyUploadConfig  `json:"upload"`
+	Storage        AudyStorageConfig `json:"storage"`
+	Backup         AudyBackupConfig  `json:"backup"`
 }
 
 const Version float32 = 0.1
 const Port uint16 = 80
 
-var db *DBWorker = CreateDBWorker()
+// db is opened by main once the config is loaded, migrations read it
+var db *DBWorker
 
-var lib map[string]*DBTrack
+// lib is shared by request handlers and job workers, it is only accessed
+// through libTrack, setLibTrack, removeLibTrack and libTracks
+var lib map[string]*DBTrack = make(map[string]*DBTrack, 0)
+var libMutex sync.RWMutex
 var libJSONCache string
+var libCacheMutex sync.Mutex
 
 var auth *AudyAuth = &AudyAuth{}
 
@@ -30,18 +55,89 @@ var config *AudyConfig = &AudyConfig{
 	RootUser:       "root",
 	AllPlaylistKey: "__PL_ALL_AUDIO__",
 	DefaultLang:    "en",
+	PasswordHash: AudyPasswordHash{
+		Algorithm:     passwordAlgoArgon2id,
+		Argon2Time:    2,
+		Argon2Memory:  19 * 1024,
+		Argon2Threads: 1,
+		BcryptCost:    12,
+	},
+	RemIPPrefixV4:  32,
+	RemIPPrefixV6:  64,
+	TrustedProxies: []string{},
+	Transcode: AudyTranscodeConfig{
+		Command: []string{"ffmpeg", "-v", "error", "-i", "{input}", "-map", "0:a:0", "-map_metadata", "-1",
+			"-c:a", "{codec}", "-b:a", "{bitrate}k", "-f", "{muxer}", "-"},
+		Profiles: []AudyTranscodeProfile{
+			{"mp3-128", "mp3", 128},
+			{"mp3-192", "mp3", 192},
+			{"mp3-320", "mp3", 320},
+			{"opus-64", "opus", 64},
+			{"opus-96", "opus", 96},
+		},
+		CacheMB: 1024,
+	},
+	DecodeCommand: []string{"ffmpeg", "-v", "error", "-i", "{input}", "-map", "0:a:0",
+		"-f", "f32le", "-ac", "2", "-ar", "48000", "-"},
+	JobWorkers: 2,
+	Watch: AudyWatchConfig{
+		Dirs:          []string{},
+		StableSeconds: 5,
+	},
+	LibraryFolders: []string{},
+	Upload: AudyUploadConfig{
+		MaxSizeMB:         2048,
+		ExpireHours:       24,
+		ArchiveMaxMB:      4096,
+		ArchiveMaxEntries: 1000,
+	},
+	Storage: AudyStorageConfig{
+		Type: "local",
+		Root: "db",
+	},
+	Backup: AudyBackupConfig{
+		Dir:           "db/backups",
+		IntervalHours: 24,
+		Keep:          7,
+	},
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	fmt.Printf("Welcome to Audy v%v server\n", Version)
 	r := gin.Default()
 	gin.SetMode(gin.DebugMode)
 
 	loadConfig()
+
+	if err := lockDatabase(); err != nil {
+		log.Fatalf("Unable to lock %v: %v\n", dbLockPath, err.Error())
+	}
+
+	db = CreateDBWorker()
+	initBlobStore()
+	initTranscoders()
+
+	// client addresses are taken from X-Forwarded-For only when the request
+	// comes from one of the configured proxies
+	r.RemoteIPHeaders = []string{"X-Forwarded-For"}
+
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies in config: %v\n", err.Error())
+	}
 	loadLib()
-	removeUnusedMusic()
 
-	fmt.Printf("md5 of 12345: %v\n", md5String("12345"))
+	go auth.CleanupLoop(time.Hour)
+	go jobQueue.CleanupLoop(time.Hour)
+	go tusCleanupLoop(time.Hour)
+	go backupLoop()
+	jobQueue.Start(config.JobWorkers)
+	startWatchers()
+	scanLibraryFolders()
+	go backfillAnalysis()
 
 	route(r)
 	fmt.Printf("error! server crashed: %v\n", r.Run(fmt.Sprint(":", Port)).Error())
@@ -65,34 +161,67 @@ func route(r *gin.Engine) {
 		})
 	}
 
+	routeSubsonic(r)
+
 	r.GET("/music/:file", R_music)
 	r.GET("/download/:file", R_download)
 
 	api := r.Group("/api")
 	{
 		api.GET("/albumimage/:hash", R_albumimage)
+		api.GET("/albumcover/:id", R_albumcover)
+		api.GET("/waveform/:hash", R_waveform)
 		api.GET("/avatar", R_avatar)
+		api.GET("/backup", R_backup)
 
 		api.POST("/upload", R_upload)
+		api.OPTIONS("/upload/tus", R_tus_options)
+		api.OPTIONS("/upload/tus/:id", R_tus_options)
+		api.POST("/upload/tus", R_tus_create)
+		api.HEAD("/upload/tus/:id", R_tus_head)
+		api.PATCH("/upload/tus/:id", R_tus_patch)
+		api.DELETE("/upload/tus/:id", R_tus_delete)
 
 		api.POST("/login", R_login)
 		api.POST("/logout", R_logout)
+		api.POST("/getsessions", R_getsessions)
+		api.POST("/revokesession", R_revokesession)
+		api.POST("/revokesessions", R_revokesessions)
+		api.POST("/revokeusersessions", R_revokeusersessions)
 		api.POST("/closech", R_closech)
 
 		api.POST("/updatetrack", R_updatetrack)
 		api.POST("/removetracks", R_removetracks)
+		api.POST("/getduplicates", R_getduplicates)
+		api.POST("/mergetracks", R_mergetracks)
 		api.POST("/setlyrics", R_setlyrics)
 
+		api.POST("/getalbums", R_getalbums)
+		api.POST("/getalbum", R_getalbum)
+		api.POST("/getartists", R_getartists)
+		api.POST("/getartistalbums", R_getartistalbums)
+		api.POST("/search", R_search)
+		api.POST("/tracks", R_tracks)
+		api.POST("/libchanges", R_libchanges)
+
 		api.POST("/addpl", R_addpl)
 		api.POST("/removepl", R_removepl)
 		api.POST("/renamepl", R_renamepl)
 		api.POST("/updatepl", R_updatepl)
+		api.POST("/insertpltracks", R_insertpltracks)
+		api.POST("/appendpltracks", R_appendpltracks)
+		api.POST("/movepltracks", R_movepltracks)
+		api.POST("/removepltracks", R_removepltracks)
 		api.POST("/getplaylists", R_getplaylists)
 		api.POST("/ftp_upload", R_ftpupload)
+		api.POST("/getjobs", R_getjobs)
+		api.POST("/canceljob", R_canceljob)
+		api.POST("/retryjob", R_retryjob)
 
 		api.POST("/updateuser", R_updateuser)
 		api.POST("/removeuser", R_removeuser)
 		api.POST("/changepassword", R_changepassword)
+		api.POST("/gensubsonicpassword", R_gensubsonicpassword)
 		api.POST("/resetpassword", R_resetpassword)
 		api.POST("/updatetheme", R_updatetheme)
 		api.POST("/updatethemes", R_updatethemes)
@@ -104,6 +233,12 @@ func route(r *gin.Engine) {
 
 		api.POST("/getserverdata", R_getserverdata)
 		api.POST("/setserverdata", R_setserverdata)
+		api.POST("/settranscodeprofiles", R_settranscodeprofiles)
+		api.POST("/setlibraryfolders", R_setlibraryfolders)
+		api.POST("/rescanlibrary", R_rescanlibrary)
+		api.POST("/checkintegrity", R_checkintegrity)
+		api.POST("/getintegrityreport", R_getintegrityreport)
+		api.POST("/repairintegrity", R_repairintegrity)
 
 		api.GET("/init", R_init)
 		/*
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/ as <version>_<name>.sql and are applied in
+// order of their version, each one in a transaction together with its
+// schema_version row. A migration is never changed once released, schema
+// changes always go into a new file. Foreign keys can't be switched off
+// inside a transaction, migrations rebuilding tables use
+// PRAGMA defer_foreign_keys instead
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type AudyMigration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Go steps run after the SQL of the migration with the same version, in
+// its transaction
+var migrationSteps map[int]func(tx *sql.Tx) error = map[int]func(tx *sql.Tx) error{
+	1: upgradeLegacySchema,
+}
+
+func loadMigrations() ([]*AudyMigration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]*AudyMigration, 0, len(entries))
+
+	for _, e := range entries {
+		name := e.Name()
+		sep := strings.IndexByte(name, '_')
+
+		if sep < 0 {
+			return nil, fmt.Errorf("migration %v isn't named <version>_<name>.sql", name)
+		}
+
+		version, err := strconv.Atoi(name[:sep])
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %v isn't named <version>_<name>.sql", name)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, &AudyMigration{version, name, string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %v breaks the numbering, expected version %v", m.name, i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+func (w *DBWorker) schemaVersion() (int, error) {
+	var version int
+	err := w.conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+
+	return version, err
+}
+
+// hasTables tells a database of a version before schema_version apart from
+// a new one
+func (w *DBWorker) hasTables() (bool, error) {
+	var count int
+	err := w.conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&count)
+
+	return count > 0, err
+}
+
+// backupDatabase writes a consistent copy of the database next to it
+func (w *DBWorker) backupDatabase(version int) (string, error) {
+	target := fmt.Sprintf("%v.v%v-%v.bak", dbPath, version, time.Now().Format("20060102150405"))
+	_, err := w.conn.Exec(`VACUUM INTO ?`, target)
+
+	return target, err
+}
+
+// migrate brings the schema up to date. Existing databases are backed up
+// before anything is changed. A failed migration stops the server, leaving
+// the database at the last version that was applied
+func (w *DBWorker) migrate() {
+	migrations, err := loadMigrations()
+
+	if err != nil {
+		log.Fatalf("error while trying to load migrations: %v\n", err.Error())
+		return
+	}
+
+	existing, err := w.hasTables()
+
+	if err != nil {
+		log.Fatalf("error while trying to read the database schema: %v\n", err.Error())
+		return
+	}
+
+	_, err = w.conn.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+							version INTEGER PRIMARY KEY,
+							name TEXT NOT NULL,
+							applied INTEGER NOT NULL)`)
+	if err != nil {
+		log.Fatalf("error while trying to create schema_version table: %v\n", err.Error())
+		return
+	}
+
+	version, err := w.schemaVersion()
+
+	if err != nil {
+		log.Fatalf("error while trying to read the schema version: %v\n", err.Error())
+		return
+	}
+
+	if version > len(migrations) {
+		log.Fatalf("database schema version %v is newer than this build of Audy supports (%v)\n", version, len(migrations))
+		return
+	}
+
+	if version == len(migrations) {
+		return
+	}
+
+	if existing {
+		backup, err := w.backupDatabase(version)
+
+		if err != nil {
+			log.Fatalf("error while trying to back up the database before migrating: %v\n", err.Error())
+			return
+		}
+
+		fmt.Printf("Database backed up to %v before migrating from schema version %v\n", backup, version)
+	}
+
+	for _, m := range migrations[version:] {
+		if err = w.applyMigration(m); err != nil {
+			log.Fatalf("error while trying to apply migration %v: %v\n", m.name, err.Error())
+			return
+		}
+
+		fmt.Printf("Applied migration %v\n", m.name)
+	}
+}
+
+func (w *DBWorker) applyMigration(m *AudyMigration) error {
+	tx, err := w.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(m.sql); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if step, ok := migrationSteps[m.version]; ok {
+		if err = step(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version (version, name, applied) VALUES(?,?,?)`, m.version, m.name, time.Now().Unix())
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%v)", table))
+
+	if err != nil {
+		return false, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defValue sql.NullString
+
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defValue, &pk); err != nil {
+			return false, err
+		}
+
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// legacyColumns were added to existing tables before schema_version existed
+var legacyColumns []struct{ table, column, definition string } = []struct{ table, column, definition string }{
+	{"users", "subsonic_password", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "rem_ip_alert", "TEXT NOT NULL DEFAULT ''"},
+	{"music", "format", "TEXT NOT NULL DEFAULT 'mp3'"},
+	{"music", "mime", "TEXT NOT NULL DEFAULT 'audio/mpeg'"},
+	{"music", "album", "TEXT NOT NULL DEFAULT ''"},
+	{"music", "album_artist", "TEXT NOT NULL DEFAULT ''"},
+	{"music", "track_number", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "disc_number", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "year", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "genre", "TEXT NOT NULL DEFAULT ''"},
+	{"music", "artist_id", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "album_id", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "loudness", "REAL NOT NULL DEFAULT 0"},
+	{"music", "track_gain", "REAL NOT NULL DEFAULT 0"},
+	{"music", "track_peak", "REAL NOT NULL DEFAULT 0"},
+	{"music", "album_gain", "REAL NOT NULL DEFAULT 0"},
+	{"music", "album_peak", "REAL NOT NULL DEFAULT 0"},
+	{"music", "gain_source", "TEXT NOT NULL DEFAULT ''"},
+	{"music", "album_gain_tagged", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "path", "TEXT NOT NULL DEFAULT ''"},
+	{"music", "file_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"music", "file_mtime", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// upgradeLegacySchema brings databases created before schema_version to the
+// initial schema. On new databases there is nothing left to do
+func upgradeLegacySchema(tx *sql.Tx) error {
+	for _, c := range legacyColumns {
+		found, err := hasColumn(tx, c.table, c.column)
+
+		if err != nil {
+			return err
+		}
+
+		if found {
+			continue
+		}
+
+		if _, err = tx.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+
+	if err := migrateSessions(tx); err != nil {
+		return err
+	}
+
+	return migratePlaylistTracks(tx)
+}
+
+// migrateSessions moves the single session hash users had before the sessions
+// table was introduced, so nobody is logged out by the upgrade
+func migrateSessions(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, session_hash, ip FROM users WHERE session_hash != ''`)
+
+	if err != nil {
+		return err
+	}
+
+	sessions := make([]*DBSession, 0)
+	now := time.Now().Unix()
+
+	for rows.Next() {
+		s := &DBSession{Created: now, LastSeen: now, Expires: now + int64(config.SessionTime*60*60)}
+		var hash string
+
+		if err = rows.Scan(&s.userID, &hash, &s.IP); err != nil {
+			rows.Close()
+			return err
+		}
+
+		s.ID = sessionID(hash)
+		sessions = append(sessions, s)
+	}
+
+	rows.Close()
+
+	query := `
+		INSERT OR REPLACE INTO sessions (` + sessionColumns + `)
+		VALUES(?,?,?,?,?,?,?)
+	`
+
+	for _, s := range sessions {
+		if _, err = tx.Exec(query, s.ID, s.userID, s.Created, s.LastSeen, s.Expires, s.IP, s.UserAgent); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE users SET session_hash = ''`)
+	return err
+}
+
+// migratePlaylistTracks moves the tracks of playlists from the JSON column
+// they used to be kept in into playlist_tracks. Hashes of tracks that are
+// gone are dropped, and so are repeated ones
+func migratePlaylistTracks(tx *sql.Tx) error {
+	found, err := hasColumn(tx, "playlists", "tracks")
+
+	if err != nil || !found {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id, tracks FROM playlists`)
+
+	if err != nil {
+		return err
+	}
+
+	playlists := make(map[int][]string, 0)
+
+	for rows.Next() {
+		var id int
+		var data string
+
+		if err = rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+
+		var hashes []string
+
+		// a playlist that can't be read stops the migration rather than
+		// losing its tracks
+		if len(data) > 0 {
+			if err = json.Unmarshal([]byte(data), &hashes); err != nil {
+				rows.Close()
+				return fmt.Errorf("tracks of playlist %v can't be parsed: %v", id, err.Error())
+			}
+		}
+
+		playlists[id] = hashes
+	}
+
+	rows.Close()
+
+	query := `
+		INSERT OR IGNORE INTO playlist_tracks (playlist_id, position, md5)
+		SELECT ?, ?, md5 FROM music
+		WHERE md5 = ?
+	`
+
+	for id, hashes := range playlists {
+		for i, h := range hashes {
+			if _, err = tx.Exec(query, id, i, h); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = tx.Exec(`ALTER TABLE playlists DROP COLUMN tracks`); err != nil {
+		return err
+	}
+
+	fmt.Printf("Tracks of %v playlists moved to playlist_tracks\n", len(playlists))
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestMigratePlaylistTracksFailsOnBadJSON(t *testing.T) {
+	openTestDB(t)
+
+	hash := md5String("track")
+
+	if _, dbErr := db.AddTrack(&DBTrack{Md5: hash, Artist: "Artist", Title: "Track", Album: "Album"}); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	// the layout of playlists before playlist_tracks
+	stmts := []string{
+		`ALTER TABLE playlists ADD COLUMN tracks TEXT NOT NULL DEFAULT ''`,
+		`INSERT INTO playlists (id, name, owner_id, tracks) VALUES (1, 'good', 1, '["` + hash + `","` + hash + `"]')`,
+		`INSERT INTO playlists (id, name, owner_id, tracks) VALUES (2, 'bad', 1, '["` + hash + `"')`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := db.conn.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func() error {
+		tx, err := db.conn.Begin()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = migratePlaylistTracks(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	if err := run(); err == nil {
+		t.Fatal("playlist with broken JSON was migrated")
+	}
+
+	if n := countRows(t, `SELECT COUNT(*) FROM playlist_tracks`); n != 0 {
+		t.Errorf("failed migration left %v playlist tracks", n)
+	}
+
+	if _, err := db.conn.Exec(`UPDATE playlists SET tracks = '[]' WHERE id = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a track listed twice keeps its first place
+	if n := countRows(t, `SELECT COUNT(*) FROM playlist_tracks WHERE playlist_id = 1 AND position = 0`); n != 1 {
+		t.Error("track of the good playlist wasn't migrated")
+	}
+
+	if n := countRows(t, `SELECT COUNT(*) FROM playlist_tracks`); n != 1 {
+		t.Errorf("got %v playlist tracks, want 1", n)
+	}
+}
@@ -0,0 +1,126 @@
+-- Schema of Audy before versioned migrations. Everything is created only if
+-- missing, so databases of older versions pass through this migration too.
+-- Columns those lack are added by its Go step
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT NOT NULL DEFAULT '',
+	nickname TEXT NOT NULL DEFAULT '',
+	password TEXT NOT NULL DEFAULT '',
+	session_hash TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	lang TEXT NOT NULL DEFAULT '',
+	theme TEXT NOT NULL DEFAULT '',
+	themes TEXT NOT NULL DEFAULT '{}',
+	vk_cookies TEXT NOT NULL DEFAULT '[]',
+	vk_user INTEGER NOT NULL DEFAULT 0,
+	rem_ip INTEGER NOT NULL DEFAULT 0,
+	autoplay INTEGER NOT NULL DEFAULT 0,
+	is_admin INTEGER NOT NULL DEFAULT 0,
+	subsonic_password TEXT NOT NULL DEFAULT '',
+	rem_ip_alert TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS music (
+	md5 TEXT NOT NULL UNIQUE PRIMARY KEY,
+	artist TEXT NOT NULL DEFAULT '',
+	title TEXT NOT NULL DEFAULT '',
+	has_image INTEGER NOT NULL DEFAULT 0,
+	lyrics TEXT NOT NULL DEFAULT '',
+	timestamp INT NOT NULL DEFAULT (strftime('%s', 'now')),
+	duration REAL NOT NULL DEFAULT 0.0,
+	format TEXT NOT NULL DEFAULT 'mp3',
+	mime TEXT NOT NULL DEFAULT 'audio/mpeg',
+	album TEXT NOT NULL DEFAULT '',
+	album_artist TEXT NOT NULL DEFAULT '',
+	track_number INTEGER NOT NULL DEFAULT 0,
+	disc_number INTEGER NOT NULL DEFAULT 0,
+	year INTEGER NOT NULL DEFAULT 0,
+	genre TEXT NOT NULL DEFAULT '',
+	artist_id INTEGER NOT NULL DEFAULT 0,
+	album_id INTEGER NOT NULL DEFAULT 0,
+	loudness REAL NOT NULL DEFAULT 0,
+	track_gain REAL NOT NULL DEFAULT 0,
+	track_peak REAL NOT NULL DEFAULT 0,
+	album_gain REAL NOT NULL DEFAULT 0,
+	album_peak REAL NOT NULL DEFAULT 0,
+	gain_source TEXT NOT NULL DEFAULT '',
+	album_gain_tagged INTEGER NOT NULL DEFAULT 0,
+	path TEXT NOT NULL DEFAULT '',
+	file_size INTEGER NOT NULL DEFAULT 0,
+	file_mtime INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS artists (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE COLLATE NOCASE
+);
+
+CREATE TABLE IF NOT EXISTS albums (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	artist_id INTEGER NOT NULL,
+	title TEXT NOT NULL COLLATE NOCASE,
+	year INTEGER NOT NULL DEFAULT 0,
+	has_image INTEGER NOT NULL DEFAULT 0,
+	UNIQUE(artist_id, title)
+);
+
+CREATE TABLE IF NOT EXISTS playlists (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL DEFAULT '',
+	owner_id INTEGER NOT NULL
+);
+
+-- positions only order the tracks of a playlist, gaps left by removed
+-- tracks are never closed
+CREATE TABLE IF NOT EXISTS playlist_tracks (
+	playlist_id INTEGER NOT NULL REFERENCES playlists(id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	md5 TEXT NOT NULL REFERENCES music(md5) ON DELETE CASCADE,
+	PRIMARY KEY(playlist_id, md5)
+);
+
+CREATE INDEX IF NOT EXISTS playlist_tracks_position ON playlist_tracks (playlist_id, position);
+CREATE INDEX IF NOT EXISTS playlist_tracks_md5 ON playlist_tracks (md5);
+
+CREATE TABLE IF NOT EXISTS fingerprints (
+	md5 TEXT NOT NULL PRIMARY KEY,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS library_changes (
+	revision INTEGER PRIMARY KEY AUTOINCREMENT,
+	md5 TEXT NOT NULL,
+	action TEXT NOT NULL,
+	timestamp INT NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	created INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL,
+	expires INTEGER NOT NULL,
+	ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	batch TEXT NOT NULL DEFAULT '',
+	target TEXT NOT NULL DEFAULT '',
+	payload TEXT NOT NULL DEFAULT '',
+	user_id INTEGER NOT NULL DEFAULT 0,
+	state TEXT NOT NULL DEFAULT 'queued',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL DEFAULT 1,
+	run_after INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created INTEGER NOT NULL,
+	updated INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS jobs_state ON jobs (state, run_after);
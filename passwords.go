@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Stored password hashes are prefixed with their algorithm:
+//
+//	argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+//	bcrypt$<bcrypt hash>
+//
+// Rows written before hashing was introduced hold a bare unsalted md5 hex
+// string. They still verify and get rehashed on the next successful login
+type AudyPasswordHash struct {
+	Algorithm     string `json:"algorithm"`
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Memory  uint32 `json:"argon2_memory_kib"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+	BcryptCost    int    `json:"bcrypt_cost"`
+}
+
+const (
+	passwordAlgoArgon2id string = "argon2id"
+	passwordAlgoBcrypt   string = "bcrypt"
+	passwordAlgoMd5      string = "md5"
+)
+
+const argon2SaltLen int = 16
+const argon2KeyLen uint32 = 32
+
+// stored hashes and the config are held to these bounds. argon2.IDKey panics
+// on zero rounds or threads, and huge costs would stall every login
+const (
+	argon2MaxTime   uint32 = 64
+	argon2MaxMemory uint32 = 4 * 1024 * 1024
+	argon2MinSalt   int    = 8
+	argon2MinKey    int    = 16
+	argon2MaxKey    int    = 64
+)
+
+var errUnknownPasswordAlgo error = errors.New("unknown password hash algorithm")
+
+func hashPassword(password string) (string, error) {
+	params := config.PasswordHash
+
+	switch params.Algorithm {
+	case passwordAlgoBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), params.BcryptCost)
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprint(passwordAlgoBcrypt, "$", string(hash)), nil
+	case passwordAlgoArgon2id, "":
+		salt := make([]byte, argon2SaltLen)
+
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf("%v$v=%v$m=%v,t=%v,p=%v$%v$%v", passwordAlgoArgon2id, argon2.Version,
+			params.Argon2Memory, params.Argon2Time, params.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	return "", errUnknownPasswordAlgo
+}
+
+func passwordAlgo(stored string) string {
+	if i := strings.Index(stored, "$"); i > 0 {
+		return stored[:i]
+	}
+
+	return passwordAlgoMd5
+}
+
+type argon2Hash struct {
+	version uint32
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(stored string) (*argon2Hash, error) {
+	parts := strings.Split(stored, "$")
+
+	if len(parts) != 5 || parts[0] != passwordAlgoArgon2id {
+		return nil, errors.New("malformed argon2id hash")
+	}
+
+	h := &argon2Hash{}
+	var err error
+
+	if _, err = fmt.Sscanf(parts[1], "v=%d", &h.version); err != nil {
+		return nil, err
+	}
+
+	if _, err = fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, err
+	}
+
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return nil, err
+	}
+
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+
+	if err = checkArgon2Params(h.time, h.memory, h.threads); err != nil {
+		return nil, err
+	}
+
+	// an empty key would compare equal to the empty key of any password
+	if len(h.salt) < argon2MinSalt || len(h.key) < argon2MinKey || len(h.key) > argon2MaxKey {
+		return nil, errors.New("argon2id salt or key length out of range")
+	}
+
+	return h, nil
+}
+
+func checkArgon2Params(time, memory uint32, threads uint8) error {
+	if time < 1 || time > argon2MaxTime {
+		return fmt.Errorf("argon2id time %v out of range 1-%v", time, argon2MaxTime)
+	}
+
+	if threads < 1 {
+		return errors.New("argon2id needs at least 1 thread")
+	}
+
+	if memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return fmt.Errorf("argon2id memory %v KiB out of range %v-%v", memory, 8*uint32(threads), argon2MaxMemory)
+	}
+
+	return nil
+}
+
+// validatePasswordHash checks the password_hash section of the config
+func validatePasswordHash(params *AudyPasswordHash) error {
+	switch params.Algorithm {
+	case passwordAlgoArgon2id, "":
+		return checkArgon2Params(params.Argon2Time, params.Argon2Memory, params.Argon2Threads)
+	case passwordAlgoBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost %v out of range %v-%v", params.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+		return nil
+	}
+
+	return errUnknownPasswordAlgo
+}
+
+func verifyPassword(stored, password string) bool {
+	switch passwordAlgo(stored) {
+	case passwordAlgoArgon2id:
+		h, err := parseArgon2Hash(stored)
+
+		if err != nil || h.version != argon2.Version {
+			return false
+		}
+
+		key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	case passwordAlgoBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(strings.TrimPrefix(stored, passwordAlgoBcrypt+"$")), []byte(password)) == nil
+	case passwordAlgoMd5:
+		return len(stored) > 0 && subtle.ConstantTimeCompare([]byte(stored), []byte(md5String(password))) == 1
+	}
+
+	return false
+}
+
+// passwordNeedsRehash reports whether the stored hash was made with an
+// algorithm or cost other than the configured one
+func passwordNeedsRehash(stored string) bool {
+	params := config.PasswordHash
+	algo := passwordAlgo(stored)
+
+	if params.Algorithm == "" {
+		params.Algorithm = passwordAlgoArgon2id
+	}
+
+	if algo != params.Algorithm {
+		return true
+	}
+
+	switch algo {
+	case passwordAlgoArgon2id:
+		h, err := parseArgon2Hash(stored)
+
+		return err != nil || h.version != argon2.Version || h.memory != params.Argon2Memory ||
+			h.time != params.Argon2Time || h.threads != params.Argon2Threads
+	case passwordAlgoBcrypt:
+		cost, err := bcrypt.Cost([]byte(strings.TrimPrefix(stored, passwordAlgoBcrypt+"$")))
+
+		return err != nil || cost != params.BcryptCost
+	}
+
+	return true
+}
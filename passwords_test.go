@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openTestDB points db at a fresh, migrated database in a temporary
+// directory, which is the working directory until the test ends
+func openTestDB(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Mkdir(filepath.Join(dir, "db"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := db
+	db = CreateDBWorker()
+
+	t.Cleanup(func() {
+		db.conn.Close()
+		db = prev
+		os.Chdir(wd)
+	})
+}
+
+func postLogin(r *gin.Engine, login, password string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	form := url.Values{"login": {login}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+
+	body := map[string]interface{}{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+
+	return res, body
+}
+
+func storedPassword(t *testing.T, login string) string {
+	u, dbErr := db.GetUserByLogin(login)
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	return u.password
+}
+
+func TestLegacyMd5PasswordRehashedOnLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	openTestDB(t)
+
+	legacy := md5String("secret")
+
+	if _, dbErr := db.AddUser(&DBUser{login: "legacy", password: legacy}); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	r := gin.New()
+	r.POST("/api/login", R_login)
+
+	if _, body := postLogin(r, "legacy", "wrong"); body["key"] != "incorrect_login_password" {
+		t.Fatalf("wrong password answered %v", body)
+	}
+
+	if storedPassword(t, "legacy") != legacy {
+		t.Fatal("failed login changed the stored hash")
+	}
+
+	res, body := postLogin(r, "legacy", "secret")
+
+	if body["success"] != true {
+		t.Fatalf("legacy login answered %v", body)
+	}
+
+	if !strings.Contains(res.Header().Get("Set-Cookie"), SessionCookie+"=") {
+		t.Error("no session cookie set")
+	}
+
+	stored := storedPassword(t, "legacy")
+
+	if passwordAlgo(stored) != passwordAlgoArgon2id {
+		t.Fatalf("password wasn't rehashed to argon2id: %v", stored)
+	}
+
+	if !verifyPassword(stored, "secret") || verifyPassword(stored, "wrong") {
+		t.Fatal("rehashed password doesn't verify")
+	}
+
+	if passwordNeedsRehash(stored) {
+		t.Error("rehashed password still needs a rehash")
+	}
+
+	if _, body = postLogin(r, "legacy", "secret"); body["success"] != true {
+		t.Fatalf("login after rehash answered %v", body)
+	}
+
+	if storedPassword(t, "legacy") != stored {
+		t.Error("up to date hash was rehashed again")
+	}
+}
+
+func TestParseArgon2HashRejectsBadRows(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	row := func(params, salt, key string) string {
+		return fmt.Sprintf("argon2id$v=19$%v$%v$%v", params, salt, key)
+	}
+
+	cases := []struct {
+		name   string
+		stored string
+	}{
+		{"empty key", row("m=19456,t=2,p=1", salt, "")},
+		{"short key", row("m=19456,t=2,p=1", salt, "AAAA")},
+		{"empty salt", row("m=19456,t=2,p=1", "", key)},
+		{"zero time", row("m=19456,t=0,p=1", salt, key)},
+		{"zero memory", row("m=0,t=2,p=1", salt, key)},
+		{"zero threads", row("m=19456,t=2,p=0", salt, key)},
+		{"huge time", row("m=19456,t=100000,p=1", salt, key)},
+		{"huge memory", row("m=4294967295,t=2,p=1", salt, key)},
+		{"missing key segment", fmt.Sprintf("argon2id$v=19$m=19456,t=2,p=1$%v$", salt)},
+		{"missing segments", "argon2id$v=19$m=19456,t=2,p=1"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseArgon2Hash(tc.stored); err == nil {
+				t.Error("row accepted")
+			}
+
+			for _, password := range []string{"", "secret"} {
+				if verifyPassword(tc.stored, password) {
+					t.Errorf("password %q verifies", password)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+	cases := []struct {
+		name   string
+		params AudyPasswordHash
+		valid  bool
+	}{
+		{"argon2id", AudyPasswordHash{Algorithm: passwordAlgoArgon2id, Argon2Time: 2, Argon2Memory: 19456, Argon2Threads: 1}, true},
+		{"default algorithm", AudyPasswordHash{Argon2Time: 2, Argon2Memory: 19456, Argon2Threads: 1}, true},
+		{"argon2id zero time", AudyPasswordHash{Algorithm: passwordAlgoArgon2id, Argon2Memory: 19456, Argon2Threads: 1}, false},
+		{"argon2id zero memory", AudyPasswordHash{Algorithm: passwordAlgoArgon2id, Argon2Time: 2, Argon2Threads: 1}, false},
+		{"argon2id zero threads", AudyPasswordHash{Algorithm: passwordAlgoArgon2id, Argon2Time: 2, Argon2Memory: 19456}, false},
+		{"bcrypt", AudyPasswordHash{Algorithm: passwordAlgoBcrypt, BcryptCost: 12}, true},
+		{"bcrypt cost too high", AudyPasswordHash{Algorithm: passwordAlgoBcrypt, BcryptCost: 40}, false},
+		{"bcrypt cost too low", AudyPasswordHash{Algorithm: passwordAlgoBcrypt, BcryptCost: 1}, false},
+		{"unknown algorithm", AudyPasswordHash{Algorithm: "scrypt"}, false},
+	}
+
+	for _, tc := range cases {
+		if err := validatePasswordHash(&tc.params); (err == nil) != tc.valid {
+			t.Errorf("%v: valid = %v, want %v (%v)", tc.name, err == nil, tc.valid, err)
+		}
+	}
+}
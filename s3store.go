@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AudyS3StoreConfig struct {
+	// Endpoint is the base URL of the service, like https://s3.eu-west-1.amazonaws.com
+	// or http://localhost:9000
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	// Prefix is put in front of every key, so a bucket can be shared
+	Prefix string `json:"prefix"`
+	// PathStyle addresses the bucket as endpoint/bucket instead of
+	// bucket.endpoint, which MinIO and most self-hosted services need
+	PathStyle bool `json:"path_style"`
+}
+
+const s3UnsignedPayload string = "UNSIGNED-PAYLOAD"
+const s3TimeFormat string = "20060102T150405Z"
+
+// S3BlobStore keeps blobs in a bucket of an S3 compatible service (AWS,
+// MinIO, Garage, ...). Requests are signed with AWS Signature Version 4.
+// Payloads aren't hashed, blobs are sent as UNSIGNED-PAYLOAD
+type S3BlobStore struct {
+	cfg      AudyS3StoreConfig
+	endpoint *url.URL
+	client   *http.Client
+	// now is replaced to sign requests at a fixed time
+	now func() time.Time
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type s3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func NewS3BlobStore(cfg *AudyS3StoreConfig) (*S3BlobStore, error) {
+	if len(cfg.Bucket) == 0 || len(cfg.AccessKey) == 0 || len(cfg.SecretKey) == 0 {
+		return nil, errors.New("s3 storage needs bucket, access_key and secret_key")
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("s3 endpoint %q is not an http(s) URL", cfg.Endpoint)
+	}
+
+	s := &S3BlobStore{*cfg, endpoint, &http.Client{}, time.Now}
+
+	if len(s.cfg.Region) == 0 {
+		s.cfg.Region = "us-east-1"
+	}
+
+	if len(s.cfg.Prefix) > 0 && !strings.HasSuffix(s.cfg.Prefix, "/") {
+		s.cfg.Prefix += "/"
+	}
+
+	return s, nil
+}
+
+func (s *S3BlobStore) Name() string {
+	return fmt.Sprintf("s3 %v/%v/%v", s.endpoint.String(), s.cfg.Bucket, s.cfg.Prefix)
+}
+
+func (s *S3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	objectPath := "/"
+
+	// an empty key addresses the bucket itself
+	if len(key) > 0 {
+		objectPath += s.cfg.Prefix + key
+	}
+
+	if s.cfg.PathStyle {
+		objectPath = "/" + s.cfg.Bucket + objectPath
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+
+	u.Path = u.Path + objectPath
+	u.RawPath = s3EscapePath(u.Path)
+
+	if query != nil {
+		u.RawQuery = s3CanonicalQuery(query)
+	}
+
+	return &u
+}
+
+// s3Escape is the URI encoding of Signature Version 4, which differs from
+// url.QueryEscape in spaces and ~
+func s3Escape(v string, keepSlash bool) string {
+	b := strings.Builder{}
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+
+	for k := range query {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// sign adds the Authorization header. Host and every header already set on
+// the request are signed
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format(s3TimeFormat)
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{day, s.cfg.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.cfg.SecretKey), day)
+	key = s3HMAC(key, s.cfg.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.cfg.AccessKey, scope, signedHeaders, hex.EncodeToString(s3HMAC(key, stringToSign))))
+}
+
+// do sends a signed request. Answers other than 2xx are turned into errors,
+// 404 ones matching fs.ErrNotExist
+func (s *S3BlobStore) do(method, key string, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if body != nil {
+		req.ContentLength = length
+	}
+
+	s.sign(req, s3UnsignedPayload)
+	res, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, blobNotFound(key)
+	}
+
+	data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	s3Err := &s3Error{}
+
+	if xml.Unmarshal(data, s3Err) == nil && len(s3Err.Code) > 0 {
+		return nil, fmt.Errorf("s3 %v %v: %v %v: %v", method, key, res.StatusCode, s3Err.Code, s3Err.Message)
+	}
+
+	return nil, fmt.Errorf("s3 %v %v: %v", method, key, res.Status)
+}
+
+func (s *S3BlobStore) Open(key string) (BlobReader, error) {
+	info, err := s.Stat(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{s: s, key: key, size: info.Size}, nil
+}
+
+// Put needs the length up front, readers that can't seek are spooled to a
+// temporary file first. Single requests are limited to 5 GB by S3
+func (s *S3BlobStore) Put(key string, r io.Reader) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+
+	seeker, ok := r.(io.ReadSeeker)
+
+	if !ok {
+		tmp, err := ioutil.TempFile("", "audy-s3-*")
+
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if _, err = io.Copy(tmp, r); err != nil {
+			return err
+		}
+
+		seeker = tmp
+	}
+
+	length, err := seeker.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+
+	// a zero length with a body would be sent chunked, which S3 refuses
+	var body io.Reader = http.NoBody
+
+	if length > 0 {
+		body = ioutil.NopCloser(seeker)
+	}
+
+	res, err := s.do(http.MethodPut, key, nil, header, body, length)
+
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	return nil
+}
+
+// Delete of a missing key succeeds, S3 doesn't tell it apart
+func (s *S3BlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return blobNotFound(key)
+	}
+
+	res, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Stat(key string) (*BlobInfo, error) {
+	if !validBlobKey(key) {
+		return nil, blobNotFound(key)
+	}
+
+	res, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body.Close()
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	return &BlobInfo{key, res.ContentLength, modTime}, nil
+}
+
+func (s *S3BlobStore) List(prefix string) ([]*BlobInfo, error) {
+	blobs := make([]*BlobInfo, 0)
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.cfg.Prefix+prefix)
+
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result := &s3ListResult{}
+		err = xml.NewDecoder(res.Body).Decode(result)
+		res.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			modTime, _ := time.Parse(time.RFC3339, c.LastModified)
+			blobs = append(blobs, &BlobInfo{strings.TrimPrefix(c.Key, s.cfg.Prefix), c.Size, modTime})
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			break
+		}
+
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Key < blobs[j].Key
+	})
+
+	return blobs, nil
+}
+
+// s3Object reads an object with ranged GETs. The body is requested on the
+// first read after a seek, so seeking around like http.ServeContent does
+// costs nothing
+type s3Object struct {
+	s      *S3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+
+		res, err := o.s.do(http.MethodGet, o.key, nil, header, nil, 0)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if res.StatusCode != http.StatusPartialContent && o.offset > 0 {
+			res.Body.Close()
+			return 0, fmt.Errorf("s3 GET %v: range requests are not supported", o.key)
+		}
+
+		o.body = res.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+
+	if offset < 0 {
+		return o.offset, &fs.PathError{Op: "seek", Path: o.key, Err: fs.ErrInvalid}
+	}
+
+	if offset != o.offset {
+		o.closeBody()
+		o.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (o *s3Object) closeBody() {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+}
+
+func (o *s3Object) Close() error {
+	o.closeBody()
+	return nil
+}
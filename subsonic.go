@@ -0,0 +1,1245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+const subsonicVersion string = "1.16.1"
+
+const (
+	ssErrGeneric      int = 0
+	ssErrMissingParam int = 10
+	ssErrWrongCreds   int = 40
+	ssErrNotAllowed   int = 50
+	ssErrNotFound     int = 70
+)
+
+type SubsonicResponse struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error          *SubsonicError        `xml:"error,omitempty" json:"error,omitempty"`
+	License        *SubsonicLicense      `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders   *SubsonicMusicFolders `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes        *SubsonicIndexes      `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Artists        *SubsonicIndexes      `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist         *SubsonicArtist       `xml:"artist,omitempty" json:"artist,omitempty"`
+	Directory      *SubsonicDirectory    `xml:"directory,omitempty" json:"directory,omitempty"`
+	Album          *SubsonicAlbum        `xml:"album,omitempty" json:"album,omitempty"`
+	Song           *SubsonicSong         `xml:"song,omitempty" json:"song,omitempty"`
+	SearchResult3  *SubsonicSearchResult `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Playlists      *SubsonicPlaylists    `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist       *SubsonicPlaylist     `xml:"playlist,omitempty" json:"playlist,omitempty"`
+	Lyrics         *SubsonicLyrics       `xml:"lyrics,omitempty" json:"lyrics,omitempty"`
+	OpenExtensions *[]SubsonicExtension  `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+}
+
+type SubsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type SubsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type SubsonicMusicFolders struct {
+	Folders []SubsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type SubsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type SubsonicIndexes struct {
+	LastModified    int64           `xml:"lastModified,attr,omitempty" json:"lastModified,omitempty"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []SubsonicIndex `xml:"index" json:"index"`
+}
+
+type SubsonicIndex struct {
+	Name    string           `xml:"name,attr" json:"name"`
+	Artists []SubsonicArtist `xml:"artist" json:"artist"`
+}
+
+type SubsonicArtist struct {
+	ID         string          `xml:"id,attr" json:"id"`
+	Name       string          `xml:"name,attr" json:"name"`
+	AlbumCount int             `xml:"albumCount,attr" json:"albumCount"`
+	Albums     []SubsonicAlbum `xml:"album" json:"album,omitempty"`
+}
+
+type SubsonicDirectory struct {
+	ID       string         `xml:"id,attr" json:"id"`
+	Parent   string         `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name     string         `xml:"name,attr" json:"name"`
+	Children []SubsonicSong `xml:"child" json:"child"`
+}
+
+type SubsonicAlbum struct {
+	ID        string         `xml:"id,attr" json:"id"`
+	Name      string         `xml:"name,attr" json:"name"`
+	Artist    string         `xml:"artist,attr" json:"artist"`
+	ArtistID  string         `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string         `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int            `xml:"songCount,attr" json:"songCount"`
+	Duration  int            `xml:"duration,attr" json:"duration"`
+	Year      int            `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Songs     []SubsonicSong `xml:"song" json:"song,omitempty"`
+}
+
+type SubsonicSong struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration    int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	Created     string `xml:"created,attr,omitempty" json:"created,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type        string `xml:"type,attr,omitempty" json:"type,omitempty"`
+
+	ReplayGain *SubsonicReplayGain `xml:"replayGain,omitempty" json:"replayGain,omitempty"`
+}
+
+type SubsonicReplayGain struct {
+	TrackGain float64 `xml:"trackGain,attr" json:"trackGain"`
+	TrackPeak float64 `xml:"trackPeak,attr" json:"trackPeak"`
+	AlbumGain float64 `xml:"albumGain,attr" json:"albumGain"`
+	AlbumPeak float64 `xml:"albumPeak,attr" json:"albumPeak"`
+}
+
+type SubsonicSearchResult struct {
+	Artists []SubsonicArtist `xml:"artist" json:"artist"`
+	Albums  []SubsonicAlbum  `xml:"album" json:"album"`
+	Songs   []SubsonicSong   `xml:"song" json:"song"`
+}
+
+type SubsonicPlaylists struct {
+	Playlists []SubsonicPlaylist `xml:"playlist" json:"playlist"`
+}
+
+type SubsonicPlaylist struct {
+	ID        string         `xml:"id,attr" json:"id"`
+	Name      string         `xml:"name,attr" json:"name"`
+	Owner     string         `xml:"owner,attr" json:"owner"`
+	Public    bool           `xml:"public,attr" json:"public"`
+	SongCount int            `xml:"songCount,attr" json:"songCount"`
+	Duration  int            `xml:"duration,attr" json:"duration"`
+	Entries   []SubsonicSong `xml:"entry" json:"entry,omitempty"`
+}
+
+type SubsonicLyrics struct {
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Title  string `xml:"title,attr,omitempty" json:"title,omitempty"`
+	Value  string `xml:",chardata" json:"value"`
+}
+
+type SubsonicExtension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+var subsonicHandlers map[string]gin.HandlerFunc = map[string]gin.HandlerFunc{
+	"ping":                      SS_ping,
+	"getLicense":                SS_getlicense,
+	"getOpenSubsonicExtensions": SS_getopensubsonicextensions,
+	"getMusicFolders":           SS_getmusicfolders,
+	"getIndexes":                SS_getindexes,
+	"getMusicDirectory":         SS_getmusicdirectory,
+	"getArtists":                SS_getartists,
+	"getArtist":                 SS_getartist,
+	"getAlbum":                  SS_getalbum,
+	"getSong":                   SS_getsong,
+	"search3":                   SS_search3,
+	"getPlaylists":              SS_getplaylists,
+	"getPlaylist":               SS_getplaylist,
+	"createPlaylist":            SS_createplaylist,
+	"updatePlaylist":            SS_updateplaylist,
+	"stream":                    SS_stream,
+	"download":                  SS_download,
+	"getCoverArt":               SS_getcoverart,
+	"getLyrics":                 SS_getlyrics,
+	"scrobble":                  SS_scrobble,
+}
+
+func routeSubsonic(r *gin.Engine) {
+	rest := r.Group("/rest")
+	rest.Use(subsonicAuth())
+
+	for name, handler := range subsonicHandlers {
+		for _, path := range []string{"/" + name, "/" + name + ".view"} {
+			rest.GET(path, handler)
+			rest.POST(path, handler)
+		}
+	}
+}
+
+func ssParam(c *gin.Context, key string) string {
+	if v, ok := c.GetQuery(key); ok {
+		return v
+	}
+
+	return c.PostForm(key)
+}
+
+func ssParamArray(c *gin.Context, key string) []string {
+	return append(c.QueryArray(key), c.PostFormArray(key)...)
+}
+
+func ssIntParam(c *gin.Context, key string, def int) int {
+	v, err := strconv.Atoi(ssParam(c, key))
+
+	if err != nil {
+		return def
+	}
+
+	return v
+}
+
+func newSubsonicResponse() *SubsonicResponse {
+	return &SubsonicResponse{
+		Xmlns:         "http://subsonic.org/restapi",
+		Status:        "ok",
+		Version:       subsonicVersion,
+		Type:          "audy",
+		ServerVersion: fmt.Sprint(Version),
+		OpenSubsonic:  true,
+	}
+}
+
+func sendSubsonic(c *gin.Context, res *SubsonicResponse) {
+	switch ssParam(c, "f") {
+	case "json":
+		c.JSON(http.StatusOK, &gin.H{"subsonic-response": res})
+	case "jsonp":
+		c.JSONP(http.StatusOK, &gin.H{"subsonic-response": res})
+	default:
+		c.XML(http.StatusOK, res)
+	}
+}
+
+func sendSubsonicErr(c *gin.Context, code int, msg string) {
+	res := newSubsonicResponse()
+	res.Status = "failed"
+	res.Error = &SubsonicError{code, msg}
+
+	sendSubsonic(c, res)
+	c.Abort()
+}
+
+func sendSubsonicDBErr(c *gin.Context, dbErr *DBWorkerError) {
+	dbErr.Print()
+	sendSubsonicErr(c, ssErrGeneric, "Database error")
+}
+
+// subsonicAuth checks the u/p or u/t/s credentials of the Subsonic API. Token
+// authentication works with the user's Subsonic password only, since login
+// passwords are stored hashed and can't be salted again on the server
+// Clients sending p= repeat the password with every request, so a matching
+// login password is remembered for a while instead of running argon2id each
+// time. Entries are keyed by the stored hash too, a changed password doesn't
+// match them anymore
+const subsonicPasswordCacheTime int64 = 300
+
+type AudySubsonicPasswordCache struct {
+	expires map[string]int64
+	mutex   sync.Mutex
+}
+
+var subsonicPasswords *AudySubsonicPasswordCache = &AudySubsonicPasswordCache{}
+
+func subsonicPasswordKey(stored, password string) string {
+	h := sha256.Sum256([]byte(stored + "\x00" + password))
+	return hex.EncodeToString(h[:])
+}
+
+// verify checks password against the stored hash, or finds it verified
+// recently
+func (pc *AudySubsonicPasswordCache) verify(stored, password string) bool {
+	key := subsonicPasswordKey(stored, password)
+	now := time.Now().Unix()
+
+	pc.mutex.Lock()
+	expires, ok := pc.expires[key]
+	pc.mutex.Unlock()
+
+	if ok && expires > now {
+		return true
+	}
+
+	if !verifyPassword(stored, password) {
+		return false
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.expires == nil {
+		pc.expires = make(map[string]int64, 0)
+	}
+
+	for k, e := range pc.expires {
+		if e <= now {
+			delete(pc.expires, k)
+		}
+	}
+
+	pc.expires[key] = now + subsonicPasswordCacheTime
+	return true
+}
+
+func subsonicAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		login := ssParam(c, "u")
+
+		if len(login) == 0 {
+			sendSubsonicErr(c, ssErrMissingParam, "Required parameter is missing: u")
+			return
+		}
+
+		u, dbErr := db.GetUserByLogin(login)
+
+		if dbErr != nil {
+			if dbErr.underlying == sql.ErrNoRows {
+				sendSubsonicErr(c, ssErrWrongCreds, "Wrong username or password")
+			} else {
+				sendSubsonicDBErr(c, dbErr)
+			}
+			return
+		}
+
+		password := ssParam(c, "p")
+		token := strings.ToLower(ssParam(c, "t"))
+		salt := ssParam(c, "s")
+		authorized := false
+
+		if len(password) > 0 {
+			if strings.HasPrefix(password, "enc:") {
+				decoded, err := hex.DecodeString(password[4:])
+
+				if err == nil {
+					password = string(decoded)
+				}
+			}
+
+			authorized = (len(u.subsonicPassword) > 0 && subtle.ConstantTimeCompare([]byte(password), []byte(u.subsonicPassword)) == 1) ||
+				subsonicPasswords.verify(u.password, password)
+		} else if len(token) > 0 && len(salt) > 0 {
+			authorized = len(u.subsonicPassword) > 0 &&
+				subtle.ConstantTimeCompare([]byte(token), []byte(md5String(u.subsonicPassword+salt))) == 1
+		} else {
+			sendSubsonicErr(c, ssErrMissingParam, "Required parameter is missing: p or t and s")
+			return
+		}
+
+		if !authorized {
+			sendSubsonicErr(c, ssErrWrongCreds, "Wrong username or password")
+			return
+		}
+
+		u.IsRoot = config.RootUser == u.login
+		c.Set(UserKey, u)
+		c.Next()
+	}
+}
+
+func ssArtistID(id int) string {
+	return fmt.Sprint("ar-", id)
+}
+
+// ssAlbumID builds Subsonic album ids. Tracks without an album are exposed as
+// a virtual album of their artist with the id al-0-<artist id>
+func ssAlbumID(albumID, artistID int) string {
+	if albumID == 0 {
+		return fmt.Sprintf("al-0-%v", artistID)
+	}
+
+	return fmt.Sprint("al-", albumID)
+}
+
+func ssParseID(id, prefix string) (int, bool) {
+	if !strings.HasPrefix(id, prefix) {
+		return 0, false
+	}
+
+	v, err := strconv.Atoi(id[len(prefix):])
+
+	return v, err == nil
+}
+
+func ssParseAlbumID(id string) (int, int, bool) {
+	if strings.HasPrefix(id, "al-0-") {
+		artistID, ok := ssParseID(id, "al-0-")
+		return 0, artistID, ok
+	}
+
+	albumID, ok := ssParseID(id, "al-")
+	return albumID, 0, ok
+}
+
+func ssTrackCoverArt(t *DBTrack) string {
+	if t.AlbumID > 0 && blobExists(albumCoverKey(t.AlbumID)) {
+		return ssAlbumID(t.AlbumID, t.ArtistID)
+	}
+
+	if t.HasImage {
+		return t.Md5
+	}
+
+	return ""
+}
+
+func ssSong(t *DBTrack) SubsonicSong {
+	format := getFormat(t.Format)
+	song := SubsonicSong{
+		ID:          t.Md5,
+		Parent:      ssAlbumID(t.AlbumID, t.ArtistID),
+		Title:       t.Title,
+		Album:       t.Album,
+		Artist:      t.Artist,
+		Track:       t.TrackNumber,
+		DiscNumber:  t.DiscNumber,
+		Year:        t.Year,
+		Genre:       t.Genre,
+		CoverArt:    ssTrackCoverArt(t),
+		ContentType: t.Mime,
+		Suffix:      strings.TrimPrefix(format.Ext, "."),
+		Duration:    int(t.Duration),
+		Created:     time.Unix(int64(t.Timestamp), 0).UTC().Format(time.RFC3339),
+		AlbumID:     ssAlbumID(t.AlbumID, t.ArtistID),
+		ArtistID:    ssArtistID(t.ArtistID),
+		Type:        "music",
+	}
+
+	if info, err := statTrack(t); err == nil {
+		song.Size = info.Size
+	}
+
+	if t.GainSource == gainSourceTags || t.GainSource == gainSourceAnalysis {
+		song.ReplayGain = &SubsonicReplayGain{t.TrackGain, t.TrackPeak, t.AlbumGain, t.AlbumPeak}
+	}
+
+	return song
+}
+
+func ssSongs(tracks []*DBTrack) []SubsonicSong {
+	result := make([]SubsonicSong, 0, len(tracks))
+
+	for _, t := range tracks {
+		result = append(result, ssSong(t))
+	}
+
+	return result
+}
+
+func ssAlbum(a *DBAlbum) SubsonicAlbum {
+	album := SubsonicAlbum{
+		ID:        ssAlbumID(a.ID, a.ArtistID),
+		Name:      a.Title,
+		Artist:    a.Artist,
+		ArtistID:  ssArtistID(a.ArtistID),
+		SongCount: a.TrackCount,
+		Duration:  int(a.Duration),
+		Year:      a.Year,
+	}
+
+	if a.HasImage {
+		album.CoverArt = album.ID
+	}
+
+	return album
+}
+
+// ssLooseAlbum builds the virtual album holding artist tracks without album
+func ssLooseAlbum(artist *DBArtist, tracks []*DBTrack) SubsonicAlbum {
+	album := SubsonicAlbum{
+		ID:        ssAlbumID(0, artist.ID),
+		Name:      "[No album]",
+		Artist:    artist.Name,
+		ArtistID:  ssArtistID(artist.ID),
+		SongCount: len(tracks),
+	}
+
+	for _, t := range tracks {
+		album.Duration += int(t.Duration)
+	}
+
+	return album
+}
+
+func ssArtistAlbums(artist *DBArtist) ([]SubsonicAlbum, *DBWorkerError) {
+	albums, dbErr := db.GetArtistAlbums(artist.ID)
+
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	result := make([]SubsonicAlbum, 0, len(albums)+1)
+
+	for _, a := range albums {
+		result = append(result, ssAlbum(a))
+	}
+
+	loose, dbErr := db.GetArtistLooseTracks(artist.ID)
+
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	if len(loose) > 0 {
+		result = append(result, ssLooseAlbum(artist, loose))
+	}
+
+	return result, nil
+}
+
+func ssIndexName(name string) string {
+	name = strings.TrimPrefix(name, "The ")
+
+	for _, r := range name {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+
+		break
+	}
+
+	return "#"
+}
+
+func ssBuildIndexes() (*SubsonicIndexes, *DBWorkerError) {
+	artists, dbErr := db.GetArtists()
+
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	indexes := &SubsonicIndexes{
+		IgnoredArticles: "The",
+		Index:           []SubsonicIndex{},
+	}
+
+	positions := make(map[string]int, 0)
+
+	for _, a := range artists {
+		name := ssIndexName(a.Name)
+		pos, ok := positions[name]
+
+		if !ok {
+			pos = len(indexes.Index)
+			positions[name] = pos
+			indexes.Index = append(indexes.Index, SubsonicIndex{Name: name, Artists: []SubsonicArtist{}})
+		}
+
+		indexes.Index[pos].Artists = append(indexes.Index[pos].Artists, SubsonicArtist{
+			ID:         ssArtistID(a.ID),
+			Name:       a.Name,
+			AlbumCount: a.AlbumCount,
+		})
+	}
+
+	sort.Slice(indexes.Index, func(i, j int) bool {
+		return indexes.Index[i].Name < indexes.Index[j].Name
+	})
+
+	return indexes, nil
+}
+
+func ssTrack(hash string) (*DBTrack, bool) {
+	t, ok := libTrack(hash)
+	return t, ok
+}
+
+func ssPlaylist(u *DBUser, p *DBPlaylist, withEntries bool) *SubsonicPlaylist {
+	result := &SubsonicPlaylist{
+		ID:    fmt.Sprint(p.ID),
+		Name:  p.Name,
+		Owner: u.login,
+	}
+
+	for _, h := range p.Tracks {
+		t, ok := ssTrack(h)
+
+		if !ok {
+			continue
+		}
+
+		result.SongCount++
+		result.Duration += int(t.Duration)
+
+		if withEntries {
+			result.Entries = append(result.Entries, ssSong(t))
+		}
+	}
+
+	return result
+}
+
+// ssUserPlaylist loads a playlist owned by the user. The library playlist is
+// an Audy implementation detail and never exposed to Subsonic clients
+func ssUserPlaylist(c *gin.Context, u *DBUser, rawID string) *DBPlaylist {
+	id, err := strconv.Atoi(rawID)
+
+	if err != nil {
+		sendSubsonicErr(c, ssErrNotFound, "Playlist not found")
+		return nil
+	}
+
+	p, dbErr := db.GetPlaylist(id)
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendSubsonicErr(c, ssErrNotFound, "Playlist not found")
+		} else {
+			sendSubsonicDBErr(c, dbErr)
+		}
+		return nil
+	}
+
+	if p.ownerID != u.ID || p.Name == config.AllPlaylistKey {
+		sendSubsonicErr(c, ssErrNotFound, "Playlist not found")
+		return nil
+	}
+
+	return p
+}
+
+// ssSetPlaylistHashes keeps the first of repeated songs, a track is listed
+// once per playlist
+func ssSetPlaylistHashes(p *DBPlaylist, hashes []string) {
+	seen := make(map[string]bool, len(hashes))
+	p.Tracks = make([]string, 0, len(hashes))
+
+	for _, h := range hashes {
+		if !seen[h] {
+			seen[h] = true
+			p.Tracks = append(p.Tracks, h)
+		}
+	}
+}
+
+func SS_ping(c *gin.Context) {
+	sendSubsonic(c, newSubsonicResponse())
+}
+
+func SS_getlicense(c *gin.Context) {
+	res := newSubsonicResponse()
+	res.License = &SubsonicLicense{true}
+
+	sendSubsonic(c, res)
+}
+
+func SS_getopensubsonicextensions(c *gin.Context) {
+	res := newSubsonicResponse()
+	res.OpenExtensions = &[]SubsonicExtension{}
+
+	sendSubsonic(c, res)
+}
+
+func SS_getmusicfolders(c *gin.Context) {
+	name := "Audy"
+
+	if len(config.CustomAppTitle) > 0 {
+		name = config.CustomAppTitle
+	}
+
+	res := newSubsonicResponse()
+	res.MusicFolders = &SubsonicMusicFolders{[]SubsonicMusicFolder{{1, name}}}
+
+	sendSubsonic(c, res)
+}
+
+func SS_getindexes(c *gin.Context) {
+	indexes, dbErr := ssBuildIndexes()
+
+	if dbErr != nil {
+		sendSubsonicDBErr(c, dbErr)
+		return
+	}
+
+	indexes.LastModified = time.Now().UnixNano() / int64(time.Millisecond)
+
+	res := newSubsonicResponse()
+	res.Indexes = indexes
+
+	sendSubsonic(c, res)
+}
+
+func SS_getartists(c *gin.Context) {
+	indexes, dbErr := ssBuildIndexes()
+
+	if dbErr != nil {
+		sendSubsonicDBErr(c, dbErr)
+		return
+	}
+
+	res := newSubsonicResponse()
+	res.Artists = indexes
+
+	sendSubsonic(c, res)
+}
+
+func SS_getartist(c *gin.Context) {
+	id, ok := ssParseID(ssParam(c, "id"), "ar-")
+
+	if !ok {
+		sendSubsonicErr(c, ssErrNotFound, "Artist not found")
+		return
+	}
+
+	artist, dbErr := db.GetArtist(id)
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendSubsonicErr(c, ssErrNotFound, "Artist not found")
+		} else {
+			sendSubsonicDBErr(c, dbErr)
+		}
+		return
+	}
+
+	albums, dbErr := ssArtistAlbums(artist)
+
+	if dbErr != nil {
+		sendSubsonicDBErr(c, dbErr)
+		return
+	}
+
+	res := newSubsonicResponse()
+	res.Artist = &SubsonicArtist{
+		ID:         ssArtistID(artist.ID),
+		Name:       artist.Name,
+		AlbumCount: len(albums),
+		Albums:     albums,
+	}
+
+	sendSubsonic(c, res)
+}
+
+// ssGetAlbum resolves both real and virtual albums along with their tracks
+func ssGetAlbum(c *gin.Context, rawID string) (*SubsonicAlbum, []*DBTrack) {
+	albumID, artistID, ok := ssParseAlbumID(rawID)
+
+	if !ok {
+		sendSubsonicErr(c, ssErrNotFound, "Album not found")
+		return nil, nil
+	}
+
+	if albumID == 0 {
+		artist, dbErr := db.GetArtist(artistID)
+
+		if dbErr != nil {
+			if dbErr.underlying == sql.ErrNoRows {
+				sendSubsonicErr(c, ssErrNotFound, "Album not found")
+			} else {
+				sendSubsonicDBErr(c, dbErr)
+			}
+			return nil, nil
+		}
+
+		tracks, dbErr := db.GetArtistLooseTracks(artistID)
+
+		if dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return nil, nil
+		}
+
+		album := ssLooseAlbum(artist, tracks)
+		return &album, tracks
+	}
+
+	a, dbErr := db.GetAlbum(albumID)
+
+	if dbErr != nil {
+		if dbErr.underlying == sql.ErrNoRows {
+			sendSubsonicErr(c, ssErrNotFound, "Album not found")
+		} else {
+			sendSubsonicDBErr(c, dbErr)
+		}
+		return nil, nil
+	}
+
+	tracks, dbErr := db.GetAlbumTracks(albumID)
+
+	if dbErr != nil {
+		sendSubsonicDBErr(c, dbErr)
+		return nil, nil
+	}
+
+	album := ssAlbum(a)
+	return &album, tracks
+}
+
+func SS_getalbum(c *gin.Context) {
+	album, tracks := ssGetAlbum(c, ssParam(c, "id"))
+
+	if album == nil {
+		return
+	}
+
+	album.Songs = ssSongs(tracks)
+
+	res := newSubsonicResponse()
+	res.Album = album
+
+	sendSubsonic(c, res)
+}
+
+func SS_getmusicdirectory(c *gin.Context) {
+	id := ssParam(c, "id")
+	res := newSubsonicResponse()
+
+	if artistID, ok := ssParseID(id, "ar-"); ok {
+		artist, dbErr := db.GetArtist(artistID)
+
+		if dbErr != nil {
+			if dbErr.underlying == sql.ErrNoRows {
+				sendSubsonicErr(c, ssErrNotFound, "Directory not found")
+			} else {
+				sendSubsonicDBErr(c, dbErr)
+			}
+			return
+		}
+
+		albums, dbErr := ssArtistAlbums(artist)
+
+		if dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return
+		}
+
+		res.Directory = &SubsonicDirectory{ID: id, Name: artist.Name, Children: []SubsonicSong{}}
+
+		for _, a := range albums {
+			res.Directory.Children = append(res.Directory.Children, SubsonicSong{
+				ID:       a.ID,
+				Parent:   id,
+				IsDir:    true,
+				Title:    a.Name,
+				Album:    a.Name,
+				Artist:   a.Artist,
+				Year:     a.Year,
+				CoverArt: a.CoverArt,
+			})
+		}
+
+		sendSubsonic(c, res)
+		return
+	}
+
+	album, tracks := ssGetAlbum(c, id)
+
+	if album == nil {
+		return
+	}
+
+	res.Directory = &SubsonicDirectory{
+		ID:       album.ID,
+		Parent:   album.ArtistID,
+		Name:     album.Name,
+		Children: ssSongs(tracks),
+	}
+
+	sendSubsonic(c, res)
+}
+
+func SS_getsong(c *gin.Context) {
+	t, ok := ssTrack(ssParam(c, "id"))
+
+	if !ok {
+		sendSubsonicErr(c, ssErrNotFound, "Song not found")
+		return
+	}
+
+	song := ssSong(t)
+	res := newSubsonicResponse()
+	res.Song = &song
+
+	sendSubsonic(c, res)
+}
+
+func SS_search3(c *gin.Context) {
+	query := strings.Trim(strings.TrimSpace(ssParam(c, "query")), "\"")
+	artistCount := ssIntParam(c, "artistCount", 20)
+	albumCount := ssIntParam(c, "albumCount", 20)
+	songCount := ssIntParam(c, "songCount", 20)
+
+	result := &SubsonicSearchResult{
+		Artists: []SubsonicArtist{},
+		Albums:  []SubsonicAlbum{},
+		Songs:   []SubsonicSong{},
+	}
+
+	if artistCount > 0 {
+		artists, dbErr := db.SearchArtists(query, ssIntParam(c, "artistOffset", 0), artistCount)
+
+		if dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return
+		}
+
+		for _, a := range artists {
+			result.Artists = append(result.Artists, SubsonicArtist{
+				ID:         ssArtistID(a.ID),
+				Name:       a.Name,
+				AlbumCount: a.AlbumCount,
+			})
+		}
+	}
+
+	if albumCount > 0 {
+		albums, dbErr := db.SearchAlbums(query, ssIntParam(c, "albumOffset", 0), albumCount)
+
+		if dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return
+		}
+
+		for _, a := range albums {
+			result.Albums = append(result.Albums, ssAlbum(a))
+		}
+	}
+
+	if songCount > 0 {
+		songOffset := ssIntParam(c, "songOffset", 0)
+		var tracks []*DBTrack
+		var dbErr *DBWorkerError
+
+		if len(query) > 0 && db.fts {
+			var found []*DBSearchResult
+			found, _, dbErr = db.SearchTracks(query, songOffset, songCount)
+
+			for _, f := range found {
+				tracks = append(tracks, f.Track)
+			}
+		} else {
+			tracks, dbErr = db.FindTracks(query, songOffset, songCount)
+		}
+
+		if dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return
+		}
+
+		result.Songs = ssSongs(tracks)
+	}
+
+	res := newSubsonicResponse()
+	res.SearchResult3 = result
+
+	sendSubsonic(c, res)
+}
+
+func SS_getplaylists(c *gin.Context) {
+	u := auth.GetUser(c)
+	pls, dbErr := db.GetPlaylists(u.ID)
+
+	if dbErr != nil && dbErr.underlying != sql.ErrNoRows {
+		sendSubsonicDBErr(c, dbErr)
+		return
+	}
+
+	res := newSubsonicResponse()
+	res.Playlists = &SubsonicPlaylists{[]SubsonicPlaylist{}}
+
+	for _, p := range pls {
+		if p.Name == config.AllPlaylistKey {
+			continue
+		}
+
+		res.Playlists.Playlists = append(res.Playlists.Playlists, *ssPlaylist(u, p, false))
+	}
+
+	sendSubsonic(c, res)
+}
+
+func SS_getplaylist(c *gin.Context) {
+	u := auth.GetUser(c)
+	p := ssUserPlaylist(c, u, ssParam(c, "id"))
+
+	if p == nil {
+		return
+	}
+
+	res := newSubsonicResponse()
+	res.Playlist = ssPlaylist(u, p, true)
+
+	sendSubsonic(c, res)
+}
+
+func SS_createplaylist(c *gin.Context) {
+	u := auth.GetUser(c)
+	songs := ssParamArray(c, "songId")
+	hashes := make([]string, 0, len(songs))
+
+	for _, s := range songs {
+		if _, ok := ssTrack(s); ok {
+			hashes = append(hashes, s)
+		}
+	}
+
+	var p *DBPlaylist
+
+	if id := ssParam(c, "playlistId"); len(id) > 0 {
+		if p = ssUserPlaylist(c, u, id); p == nil {
+			return
+		}
+
+		ssSetPlaylistHashes(p, hashes)
+
+		if _, dbErr := db.UpdatePlaylist(p); dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return
+		}
+	} else {
+		name := ssParam(c, "name")
+
+		if err := validate(nv(name, 1, 30)); err != nil || name == config.AllPlaylistKey {
+			sendSubsonicErr(c, ssErrMissingParam, "Playlist name must be 1 to 30 characters long")
+			return
+		}
+
+		p = &DBPlaylist{
+			Name:    name,
+			ownerID: u.ID,
+		}
+
+		ssSetPlaylistHashes(p, hashes)
+		res, dbErr := db.AddPlaylist(p)
+
+		if dbErr != nil {
+			sendSubsonicDBErr(c, dbErr)
+			return
+		}
+
+		lastID, _ := res.LastInsertId()
+		p.ID = int(lastID)
+	}
+
+	res := newSubsonicResponse()
+	res.Playlist = ssPlaylist(u, p, true)
+
+	sendSubsonic(c, res)
+}
+
+func SS_updateplaylist(c *gin.Context) {
+	u := auth.GetUser(c)
+	p := ssUserPlaylist(c, u, ssParam(c, "playlistId"))
+
+	if p == nil {
+		return
+	}
+
+	if name, ok := c.GetQuery("name"); ok || len(c.PostForm("name")) > 0 {
+		if !ok {
+			name = c.PostForm("name")
+		}
+
+		if err := validate(nv(name, 1, 30)); err != nil || name == config.AllPlaylistKey {
+			sendSubsonicErr(c, ssErrMissingParam, "Playlist name must be 1 to 30 characters long")
+			return
+		}
+
+		p.Name = name
+	}
+
+	hashes := p.Tracks
+	remove := make(map[int]bool, 0)
+
+	for _, v := range ssParamArray(c, "songIndexToRemove") {
+		if i, err := strconv.Atoi(v); err == nil {
+			remove[i] = true
+		}
+	}
+
+	newHashes := make([]string, 0, len(hashes))
+
+	for i, h := range hashes {
+		if !remove[i] {
+			newHashes = append(newHashes, h)
+		}
+	}
+
+	for _, s := range ssParamArray(c, "songIdToAdd") {
+		if _, ok := ssTrack(s); ok {
+			newHashes = append(newHashes, s)
+		}
+	}
+
+	ssSetPlaylistHashes(p, newHashes)
+
+	if _, dbErr := db.UpdatePlaylist(p); dbErr != nil {
+		sendSubsonicDBErr(c, dbErr)
+		return
+	}
+
+	sendSubsonic(c, newSubsonicResponse())
+}
+
+func ssOpenTrack(c *gin.Context) (*DBTrack, BlobReader, *BlobInfo) {
+	t, ok := ssTrack(ssParam(c, "id"))
+
+	if !ok {
+		sendSubsonicErr(c, ssErrNotFound, "Song not found")
+		return nil, nil, nil
+	}
+
+	f, info, err := openTrackInfo(t.Md5)
+
+	if err != nil {
+		sendSubsonicErr(c, ssErrNotFound, "Song file not found")
+		return nil, nil, nil
+	}
+
+	return t, f, info
+}
+
+func SS_stream(c *gin.Context) {
+	t, ok := ssTrack(ssParam(c, "id"))
+
+	if !ok {
+		sendSubsonicErr(c, ssErrNotFound, "Song not found")
+		return
+	}
+
+	serveTranscodedTrack(c, t.Md5, ssParam(c, "format"), ssIntParam(c, "maxBitRate", 0))
+}
+
+func SS_download(c *gin.Context) {
+	t, f, info := ssOpenTrack(c)
+
+	if t == nil {
+		return
+	}
+
+	defer f.Close()
+
+	c.Header("Content-Type", t.Mime)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprint(t.Artist, " - ", t.Title, getFormat(t.Format).Ext)))
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime, f)
+}
+
+func SS_getcoverart(c *gin.Context) {
+	id := ssParam(c, "id")
+	coverKey := ""
+
+	if albumID, _, ok := ssParseAlbumID(id); ok {
+		if albumID > 0 {
+			coverKey = albumCoverKey(albumID)
+		}
+	} else if t, ok := ssTrack(id); ok {
+		coverKey = trackImageKey(t.Md5)
+
+		if t.AlbumID > 0 && blobExists(albumCoverKey(t.AlbumID)) {
+			coverKey = albumCoverKey(t.AlbumID)
+		}
+	}
+
+	if len(coverKey) == 0 || !blobExists(coverKey) {
+		sendSubsonicErr(c, ssErrNotFound, "Cover art not found")
+		return
+	}
+
+	size := ssIntParam(c, "size", 0)
+
+	if size <= 0 {
+		serveBlob(c, coverKey, "")
+		return
+	}
+
+	f, err := store.Open(coverKey)
+
+	if err != nil {
+		sendSubsonicErr(c, ssErrGeneric, err.Error())
+		return
+	}
+
+	img, err := imaging.Decode(f)
+	f.Close()
+
+	if err != nil {
+		sendSubsonicErr(c, ssErrGeneric, err.Error())
+		return
+	}
+
+	if img.Bounds().Dx() > size || img.Bounds().Dy() > size {
+		img = imaging.Fit(img, size, size, imaging.Lanczos)
+	}
+
+	c.Header("Content-Type", "image/jpeg")
+	c.Status(http.StatusOK)
+
+	if err = imaging.Encode(c.Writer, img, imaging.JPEG, imaging.JPEGQuality(80)); err != nil {
+		fmt.Printf("Unable to encode cover art %v: %v\n", coverKey, err.Error())
+	}
+}
+
+func SS_getlyrics(c *gin.Context) {
+	artist := ssParam(c, "artist")
+	title := ssParam(c, "title")
+
+	res := newSubsonicResponse()
+	res.Lyrics = &SubsonicLyrics{}
+
+	for _, t := range libTracks() {
+		if len(t.Lyrics) == 0 || !strings.EqualFold(t.Title, title) {
+			continue
+		}
+
+		if len(artist) > 0 && !strings.EqualFold(t.Artist, artist) {
+			continue
+		}
+
+		res.Lyrics = &SubsonicLyrics{
+			Artist: t.Artist,
+			Title:  t.Title,
+			Value:  t.Lyrics,
+		}
+		break
+	}
+
+	sendSubsonic(c, res)
+}
+
+// SS_scrobble accepts scrobbles so clients don't report errors. Audy doesn't
+// keep play statistics yet
+func SS_scrobble(c *gin.Context) {
+	if _, ok := ssTrack(ssParam(c, "id")); !ok {
+		sendSubsonicErr(c, ssErrNotFound, "Song not found")
+		return
+	}
+
+	sendSubsonic(c, newSubsonicResponse())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSubsonicPasswordCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	openTestDB(t)
+
+	prev := subsonicPasswords
+	subsonicPasswords = &AudySubsonicPasswordCache{}
+	defer func() { subsonicPasswords = prev }()
+
+	stored, err := hashPassword("secret")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, dbErr := db.AddUser(&DBUser{login: "user", password: stored})
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	userID, _ := res.LastInsertId()
+
+	r := gin.New()
+	r.GET("/rest/ping", subsonicAuth(), func(c *gin.Context) { c.String(http.StatusOK, "pong") })
+
+	ping := func(password string) bool {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/rest/ping?u=user&p="+password, nil))
+
+		return res.Body.String() == "pong"
+	}
+
+	for i := 0; i < 2; i++ {
+		if !ping("secret") || !ping("enc:736563726574") {
+			t.Fatal("password refused")
+		}
+	}
+
+	if ping("wrong") {
+		t.Fatal("wrong password accepted")
+	}
+
+	if n := len(subsonicPasswords.expires); n != 1 {
+		t.Errorf("%v cached passwords, want 1", n)
+	}
+
+	changed, _ := hashPassword("changed")
+
+	if _, dbErr = db.SetUserPassword(int(userID), changed); dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if ping("secret") {
+		t.Error("old password accepted from the cache")
+	}
+
+	// expired entries go with the next one added
+	for k := range subsonicPasswords.expires {
+		subsonicPasswords.expires[k] = 0
+	}
+
+	if !ping("changed") {
+		t.Fatal("new password refused")
+	}
+
+	for k := range subsonicPasswords.expires {
+		if k != subsonicPasswordKey(changed, "changed") {
+			t.Error("expired password kept in the cache")
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AudyTranscodeProfile is an output variant tracks may be transcoded to. The
+// profile name is used as the cache file name, so it has to be unique
+type AudyTranscodeProfile struct {
+	Name    string `json:"name"`
+	Format  string `json:"format"`
+	BitRate int    `json:"bit_rate"`
+}
+
+type AudyTranscodeConfig struct {
+	// Command is run with {input}, {codec}, {muxer} and {bitrate} replaced.
+	// The encoded stream is expected on stdout
+	Command  []string               `json:"command"`
+	Profiles []AudyTranscodeProfile `json:"profiles"`
+	CacheMB  int64                  `json:"cache_mb"`
+}
+
+type Transcoder interface {
+	Name() string
+	Available() bool
+	// Passthrough transcoders don't change the file, so their output is
+	// neither cached nor served apart from the original
+	Passthrough() bool
+	Transcode(ctx context.Context, input string, profile *AudyTranscodeProfile, w io.Writer) error
+}
+
+type transcodeCodec struct {
+	codec string
+	muxer string
+}
+
+// encoder arguments of the formats tracks can be transcoded to
+var transcodeCodecs map[string]transcodeCodec = map[string]transcodeCodec{
+	"mp3":  {"libmp3lame", "mp3"},
+	"ogg":  {"libvorbis", "ogg"},
+	"opus": {"libopus", "opus"},
+}
+
+var transcodeProfileName *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+var errNoTranscodeProfile error = errors.New("no transcoding profile matches the request")
+
+const transcodeCachePath string = "db/cache"
+
+type CommandTranscoder struct {
+	Command []string
+}
+
+func (t *CommandTranscoder) Name() string {
+	if len(t.Command) == 0 {
+		return "command"
+	}
+
+	return filepath.Base(t.Command[0])
+}
+
+func (t *CommandTranscoder) Available() bool {
+	if len(t.Command) == 0 {
+		return false
+	}
+
+	_, err := exec.LookPath(t.Command[0])
+	return err == nil
+}
+
+func (t *CommandTranscoder) Passthrough() bool {
+	return false
+}
+
+func (t *CommandTranscoder) Transcode(ctx context.Context, input string, profile *AudyTranscodeProfile, w io.Writer) error {
+	codec, ok := transcodeCodecs[profile.Format]
+
+	if !ok {
+		return fmt.Errorf("transcoding to %v is not supported", profile.Format)
+	}
+
+	replacer := strings.NewReplacer(
+		"{input}", input,
+		"{codec}", codec.codec,
+		"{muxer}", codec.muxer,
+		"{bitrate}", fmt.Sprint(profile.BitRate),
+	)
+
+	args := make([]string, len(t.Command))
+
+	for i, arg := range t.Command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	stderr := &strings.Builder{}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// PassthroughTranscoder is the fallback when no encoder is installed. It
+// keeps the original file
+type PassthroughTranscoder struct{}
+
+func (t *PassthroughTranscoder) Name() string {
+	return "passthrough"
+}
+
+func (t *PassthroughTranscoder) Available() bool {
+	return true
+}
+
+func (t *PassthroughTranscoder) Passthrough() bool {
+	return true
+}
+
+func (t *PassthroughTranscoder) Transcode(ctx context.Context, input string, profile *AudyTranscodeProfile, w io.Writer) error {
+	f, err := os.Open(input)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+var transcoders []Transcoder
+
+// transcodeLocks is held per cache file while it's written, opened or
+// evicted
+var transcodeLocks *AudyKeyedMutex = &AudyKeyedMutex{}
+var transcodeEvictMutex sync.Mutex
+
+func initTranscoders() {
+	transcoders = []Transcoder{
+		&CommandTranscoder{config.Transcode.Command},
+		&PassthroughTranscoder{},
+	}
+
+	fmt.Printf("Transcoding backend: %v\n", getTranscoder().Name())
+}
+
+func getTranscoder() Transcoder {
+	for _, t := range transcoders {
+		if t.Available() {
+			return t
+		}
+	}
+
+	return &PassthroughTranscoder{}
+}
+
+func validateTranscodeProfiles(profiles []AudyTranscodeProfile) error {
+	names := make(map[string]bool, 0)
+
+	for _, p := range profiles {
+		if !transcodeProfileName.MatchString(p.Name) {
+			return fmt.Errorf("profile name %q must be 1 to 32 latin letters, digits, - or _", p.Name)
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("profile name %q is used twice", p.Name)
+		}
+
+		if _, ok := transcodeCodecs[p.Format]; !ok {
+			return fmt.Errorf("transcoding to %q is not supported", p.Format)
+		}
+
+		if p.BitRate < 8 || p.BitRate > 512 {
+			return fmt.Errorf("bitrate of profile %q must be between 8 and 512 kbps", p.Name)
+		}
+
+		names[p.Name] = true
+	}
+
+	return nil
+}
+
+// selectTranscodeProfile picks the profile with the highest bitrate that
+// doesn't exceed maxBitRate. When every profile exceeds it the lowest one is
+// used. nil means the original file fits the request
+func selectTranscodeProfile(t *DBTrack, format string, maxBitRate int) (*AudyTranscodeProfile, error) {
+	if format == "raw" {
+		return nil, nil
+	}
+
+	// the original already fits, there's no point in reencoding it
+	if len(format) == 0 || format == t.Format {
+		if maxBitRate <= 0 || trackBitRate(t) <= maxBitRate {
+			return nil, nil
+		}
+	}
+
+	candidates := make([]*AudyTranscodeProfile, 0)
+
+	for i := range config.Transcode.Profiles {
+		p := &config.Transcode.Profiles[i]
+
+		if len(format) == 0 || p.Format == format {
+			candidates = append(candidates, p)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, errNoTranscodeProfile
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].BitRate > candidates[j].BitRate
+	})
+
+	profile := candidates[len(candidates)-1]
+
+	for _, p := range candidates {
+		if maxBitRate <= 0 || p.BitRate <= maxBitRate {
+			profile = p
+			break
+		}
+	}
+
+	return profile, nil
+}
+
+// trackBitRate estimates the average bitrate in kbps from the file size
+func trackBitRate(t *DBTrack) int {
+	info, err := statTrack(t)
+
+	if err != nil || t.Duration <= 0 {
+		return 0
+	}
+
+	return int(float64(info.Size) * 8 / float64(t.Duration) / 1000)
+}
+
+func transcodeCacheFile(hash string, profile *AudyTranscodeProfile) string {
+	return fmt.Sprint(transcodeCachePath, "/", hash, "/", profile.Name)
+}
+
+// transcodeTrack opens the cached file of the track in the profile,
+// encoding it first if needed. The cache is trimmed after each encoder run
+func transcodeTrack(ctx context.Context, tr Transcoder, hash string, profile *AudyTranscodeProfile) (*os.File, error) {
+	f, encoded, err := openTranscodedTrack(ctx, tr, hash, profile)
+
+	if encoded {
+		evictTranscodeCache()
+	}
+
+	return f, err
+}
+
+// openTranscodedTrack does the work of transcodeTrack under the lock of the
+// variant. Concurrent requests of one variant wait for a single encoder run,
+// and the file is opened before the lock is released so evictTranscodeCache
+// can't remove it in between
+func openTranscodedTrack(ctx context.Context, tr Transcoder, hash string, profile *AudyTranscodeProfile) (*os.File, bool, error) {
+	cachePath := transcodeCacheFile(hash, profile)
+
+	transcodeLocks.Lock(cachePath)
+	defer transcodeLocks.Unlock(cachePath)
+
+	if f, err := os.Open(cachePath); err == nil {
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+
+		return f, false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), os.ModePerm); err != nil {
+		return nil, false, err
+	}
+
+	input, release, err := localTrackFileByHash(hash)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer release()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(cachePath), profile.Name+".tmp-*")
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = tr.Transcode(ctx, input, profile, tmp)
+	tmp.Close()
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, false, err
+	}
+
+	f, err := os.Open(cachePath)
+	return f, true, err
+}
+
+type transcodeCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evictTranscodeCache removes least recently used files until the cache fits
+// into the configured size. Cache hits bump the file modification time.
+// Files being written or opened are skipped, as are those hit since the walk
+func evictTranscodeCache() {
+	limit := config.Transcode.CacheMB * 1024 * 1024
+
+	if limit <= 0 {
+		return
+	}
+
+	transcodeEvictMutex.Lock()
+	defer transcodeEvictMutex.Unlock()
+
+	entries := make([]transcodeCacheEntry, 0)
+	var total int64 = 0
+
+	filepath.Walk(transcodeCachePath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.Contains(fi.Name(), ".tmp-") {
+			return nil
+		}
+
+		entries = append(entries, transcodeCacheEntry{path, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+
+		return nil
+	})
+
+	if total <= limit {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	for _, e := range entries {
+		if total <= limit {
+			break
+		}
+
+		if evictTranscodeFile(e) {
+			total -= e.size
+		}
+	}
+}
+
+func evictTranscodeFile(e transcodeCacheEntry) bool {
+	// keys are the paths built by transcodeCacheFile
+	key := filepath.ToSlash(e.path)
+
+	if !transcodeLocks.TryLock(key) {
+		return false
+	}
+
+	defer transcodeLocks.Unlock(key)
+
+	if fi, err := os.Stat(e.path); err != nil || !fi.ModTime().Equal(e.modTime) {
+		return false
+	}
+
+	if err := os.Remove(e.path); err != nil {
+		fmt.Printf("Unable to evict transcoded file %v: %v\n", e.path, err.Error())
+		return false
+	}
+
+	os.Remove(filepath.Dir(e.path))
+	return true
+}
+
+func removeTranscodeCache(hash string) {
+	removeTranscodeFiles(fmt.Sprint(transcodeCachePath, "/", hash))
+}
+
+// purgeTranscodeCache removes every transcoded file, cached files may belong
+// to profiles that changed
+func purgeTranscodeCache() {
+	removeTranscodeFiles(transcodeCachePath)
+}
+
+// removeTranscodeFiles removes the cached files under dir. Each variant is
+// removed under its lock, so encoder runs finish first instead of putting a
+// file back afterwards, and files already opened are read to the end
+func removeTranscodeFiles(dir string) {
+	transcodeEvictMutex.Lock()
+	defer transcodeEvictMutex.Unlock()
+
+	variants := make(map[string]bool, 0)
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+
+		// temporary files of running encoder runs count as their variant
+		name := fi.Name()
+
+		if i := strings.Index(name, ".tmp-"); i >= 0 {
+			name = name[:i]
+		}
+
+		variants[filepath.ToSlash(filepath.Join(filepath.Dir(path), name))] = true
+		return nil
+	})
+
+	for key := range variants {
+		transcodeLocks.Lock(key)
+
+		if err := os.Remove(filepath.FromSlash(key)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Unable to remove transcoded file %v: %v\n", key, err.Error())
+		}
+
+		transcodeLocks.Unlock(key)
+	}
+
+	dirs := make([]string, 0)
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && path != transcodeCachePath {
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+
+	// deepest first, folders something was added to meanwhile are kept
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
+
+// serveTranscodedTrack serves the track in the requested format and bitrate,
+// falling back to the original file when it fits or nothing can transcode it
+func serveTranscodedTrack(c *gin.Context, hash, format string, maxBitRate int) {
+	t, ok := libTrack(hash)
+
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	profile, err := selectTranscodeProfile(t, format, maxBitRate)
+	tr := getTranscoder()
+
+	if err == errNoTranscodeProfile || profile == nil || tr.Passthrough() {
+		serveTrack(c, hash)
+		return
+	}
+
+	f, err := transcodeTrack(c.Request.Context(), tr, hash, profile)
+
+	if err != nil {
+		fmt.Printf("Unable to transcode track %v to %v: %v\n", hash, profile.Name, err.Error())
+		serveTrack(c, hash)
+		return
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Content-Type", getFormat(profile.Format).Mime)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", fmt.Sprintf("%q", fmt.Sprint(hash, "-", profile.Name)))
+	c.Header("Cache-Control", "private, no-cache")
+
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+}
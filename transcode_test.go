@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// setupTranscodeCache stores a track of size bytes and limits the cache to
+// cacheMB
+func setupTranscodeCache(t *testing.T, size int, cacheMB int64) []byte {
+	openTestDB(t)
+
+	prevStore, prevCacheMB := store, config.Transcode.CacheMB
+	t.Cleanup(func() { store, config.Transcode.CacheMB = prevStore, prevCacheMB })
+
+	data := bytes.Repeat([]byte{0x55}, size)
+	store = testLocalStore(t, data)
+	config.Transcode.CacheMB = cacheMB
+
+	return data
+}
+
+func testTranscode(t *testing.T, profile *AudyTranscodeProfile) []byte {
+	f, err := transcodeTrack(context.Background(), &PassthroughTranscoder{}, testTrackHash, profile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func transcodeLockCount() int {
+	transcodeLocks.mutex.Lock()
+	defer transcodeLocks.mutex.Unlock()
+
+	return len(transcodeLocks.locks)
+}
+
+func TestTranscodeLocksPruned(t *testing.T) {
+	data := setupTranscodeCache(t, 1000, 0)
+	profile := &AudyTranscodeProfile{"mp3-128", "mp3", 128}
+
+	// the first call encodes, the second one is a cache hit
+	for i := 0; i < 2; i++ {
+		if got := testTranscode(t, profile); !bytes.Equal(got, data) {
+			t.Fatalf("call %v: got %v bytes, want %v", i, len(got), len(data))
+		}
+
+		if n := transcodeLockCount(); n != 0 {
+			t.Fatalf("call %v: %v locks left", i, n)
+		}
+	}
+}
+
+func TestEvictTranscodeCache(t *testing.T) {
+	setupTranscodeCache(t, 400*1024, 0)
+	paths := []string{}
+
+	// the three files take 1.2 MB, the first one being the least recently
+	// used
+	fill := func() {
+		config.Transcode.CacheMB = 0
+
+		for i, name := range []string{"mp3-128", "mp3-192", "mp3-320"} {
+			profile := &AudyTranscodeProfile{name, "mp3", 128}
+			testTranscode(t, profile)
+
+			path := transcodeCacheFile(testTrackHash, profile)
+			used := time.Now().Add(time.Duration(i-3) * time.Hour)
+			os.Chtimes(path, used, used)
+
+			if len(paths) < 3 {
+				paths = append(paths, path)
+			}
+		}
+
+		config.Transcode.CacheMB = 1
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	fill()
+
+	// a file in use is skipped and the next one is evicted instead
+	transcodeLocks.Lock(paths[0])
+	evictTranscodeCache()
+	transcodeLocks.Unlock(paths[0])
+
+	if !exists(paths[0]) || exists(paths[1]) || !exists(paths[2]) {
+		t.Errorf("evicting with the oldest file locked left %v %v %v", exists(paths[0]), exists(paths[1]), exists(paths[2]))
+	}
+
+	fill()
+	evictTranscodeCache()
+
+	if exists(paths[0]) || !exists(paths[1]) || !exists(paths[2]) {
+		t.Errorf("evicting left %v %v %v", exists(paths[0]), exists(paths[1]), exists(paths[2]))
+	}
+
+	if n := transcodeLockCount(); n != 0 {
+		t.Errorf("%v locks left", n)
+	}
+}
+
+func TestPurgeTranscodeCacheWaitsForEncoders(t *testing.T) {
+	setupTranscodeCache(t, 1024, 0)
+
+	cached := &AudyTranscodeProfile{"mp3-128", "mp3", 128}
+	testTranscode(t, cached)
+
+	// an encoder run of another variant holds its lock and has only written
+	// its temporary file so far
+	running := &AudyTranscodeProfile{"mp3-320", "mp3", 320}
+	path := transcodeCacheFile(testTrackHash, running)
+	tmp := path + ".tmp-1"
+
+	if err := ioutil.WriteFile(tmp, []byte("encoded"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	transcodeLocks.Lock(path)
+	done := make(chan bool)
+
+	go func() {
+		purgeTranscodeCache()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("purge didn't wait for the encoder run")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	transcodeLocks.Unlock(path)
+	<-done
+
+	if left, _ := ioutil.ReadDir(transcodeCachePath); len(left) != 0 {
+		t.Errorf("purge left %v entries", len(left))
+	}
+
+	if n := transcodeLockCount(); n != 0 {
+		t.Errorf("%v locks left", n)
+	}
+}
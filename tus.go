@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (https://tus.io) with the
+// creation, termination, expiration and checksum extensions. A finished
+// upload is queued for ingest like FTP uploads. Clients may send the
+// md5 of the whole file in the upload metadata, it is checked before ingest
+const tusVersion string = "1.0.0"
+const tusExtensions string = "creation,termination,expiration,checksum"
+const tusUploadPath string = "upload/tus"
+
+// tus status code for a chunk that doesn't match its Upload-Checksum
+const tusStatusChecksumMismatch int = 460
+
+type AudyUploadConfig struct {
+	MaxSizeMB int `json:"max_size_mb"`
+	// unfinished uploads are removed when they weren't written to for
+	// this long
+	ExpireHours int `json:"expire_hours"`
+	// limits of the extracted contents of uploaded archives
+	ArchiveMaxMB      int `json:"archive_max_mb"`
+	ArchiveMaxEntries int `json:"archive_max_entries"`
+}
+
+var tusChecksums map[string]func() hash.Hash = map[string]func() hash.Hash{
+	"md5":  md5.New,
+	"sha1": sha1.New,
+}
+
+// AudyTusUpload is stored as upload/tus/<id>.json next to the received data
+// in upload/tus/<id>. The offset is the size of the data file
+type AudyTusUpload struct {
+	ID       string `json:"id"`
+	Length   int64  `json:"length"`
+	FileName string `json:"file_name"`
+	Md5      string `json:"md5"`
+	UserID   int    `json:"user_id"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires"`
+}
+
+// uploads being written to, so a client that reconnects while its old
+// request is still running gets 423 instead of corrupting the file
+var tusLocks map[string]bool = make(map[string]bool, 0)
+var tusMutex sync.Mutex
+
+func tusLock(id string) bool {
+	tusMutex.Lock()
+	defer tusMutex.Unlock()
+
+	if tusLocks[id] {
+		return false
+	}
+
+	tusLocks[id] = true
+	return true
+}
+
+func tusUnlock(id string) {
+	tusMutex.Lock()
+	delete(tusLocks, id)
+	tusMutex.Unlock()
+}
+
+func tusDataPath(id string) string {
+	return filepath.Join(tusUploadPath, id)
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(tusUploadPath, id+".json")
+}
+
+func tusExpireTime() int64 {
+	return time.Now().Add(time.Duration(config.Upload.ExpireHours) * time.Hour).Unix()
+}
+
+func genUploadID() (string, error) {
+	buf := make([]byte, 16)
+
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// loadTusUpload returns nil for unknown and expired uploads. Ids come from
+// the url, so anything but hex is rejected before touching the disk
+func loadTusUpload(id string) *AudyTusUpload {
+	if len(id) == 0 {
+		return nil
+	}
+
+	if _, err := hex.DecodeString(id); err != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(tusInfoPath(id))
+
+	if err != nil {
+		return nil
+	}
+
+	up := &AudyTusUpload{}
+
+	if err = json.Unmarshal(data, up); err != nil || up.ID != id {
+		return nil
+	}
+
+	if up.Expires < time.Now().Unix() {
+		up.remove()
+		return nil
+	}
+
+	return up
+}
+
+func (up *AudyTusUpload) save() error {
+	data, err := json.Marshal(up)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(tusInfoPath(up.ID), data, os.ModePerm)
+}
+
+func (up *AudyTusUpload) offset() (int64, error) {
+	fi, err := os.Stat(tusDataPath(up.ID))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (up *AudyTusUpload) remove() {
+	os.Remove(tusDataPath(up.ID))
+	os.Remove(tusInfoPath(up.ID))
+}
+
+func (up *AudyTusUpload) sendHeaders(c *gin.Context, offset int64) {
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Expires", time.Unix(up.Expires, 0).UTC().Format(http.TimeFormat))
+}
+
+// verify compares the finished upload with the md5 the client sent
+func (up *AudyTusUpload) verify() bool {
+	if len(up.Md5) == 0 {
+		return true
+	}
+
+	f, err := os.Open(tusDataPath(up.ID))
+
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	return md5File(bufio.NewReaderSize(f, 1024*1024)) == up.Md5
+}
+
+// parseTusMetadata decodes Upload-Metadata, comma separated pairs of a key
+// and a base64 value. Keys without a value are kept as empty strings
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string, 0)
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+
+		if len(parts) == 0 {
+			continue
+		}
+
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("Invalid metadata pair %v", pair)
+		}
+
+		value := ""
+
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			value = string(decoded)
+		}
+
+		meta[parts[0]] = value
+	}
+
+	return meta, nil
+}
+
+// parseTusChecksum reads Upload-Checksum, an algorithm name and the base64
+// digest of the request body
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	parts := strings.Fields(header)
+
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("Invalid checksum %v", header)
+	}
+
+	newHash, ok := tusChecksums[parts[0]]
+
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported checksum algorithm %v", parts[0])
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newHash(), sum, nil
+}
+
+func sendTusErr(c *gin.Context, status int, key, err string) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.AbortWithStatusJSON(status, buildResponse(key, err, nil))
+}
+
+// tusCheck authorizes the request and makes sure the client speaks the
+// supported protocol version
+func tusCheck(c *gin.Context) bool {
+	u := auth.GetUser(c)
+
+	if !u.checkAdmin(c) {
+		return false
+	}
+
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		sendTusErr(c, http.StatusPreconditionFailed, "unsupported_tus_version", c.GetHeader("Tus-Resumable"))
+		return false
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+	return true
+}
+
+// tusUploadOf returns the upload from the url if it belongs to the user
+func tusUploadOf(c *gin.Context) *AudyTusUpload {
+	up := loadTusUpload(c.Param("id"))
+
+	if up == nil || up.UserID != auth.GetUser(c).ID {
+		sendTusErr(c, http.StatusNotFound, "upload_not_found", "")
+		return nil
+	}
+
+	return up
+}
+
+func R_tus_options(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(int64(config.Upload.MaxSizeMB)<<20, 10))
+	c.Header("Tus-Checksum-Algorithm", "md5,sha1")
+	c.Status(http.StatusNoContent)
+}
+
+func R_tus_create(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+
+	if err != nil || length <= 0 {
+		sendTusErr(c, http.StatusBadRequest, "invalid_upload_length", c.GetHeader("Upload-Length"))
+		return
+	}
+
+	if length > int64(config.Upload.MaxSizeMB)<<20 {
+		sendTusErr(c, http.StatusRequestEntityTooLarge, "upload_too_large", fmt.Sprint("Upload length ", length))
+		return
+	}
+
+	meta, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+
+	if err != nil {
+		sendTusErr(c, http.StatusBadRequest, "invalid_upload_metadata", err.Error())
+		return
+	}
+
+	fileName := filepath.Base(meta["filename"])
+
+	if !isAudioFileName(fileName) && !isArchiveFileName(fileName) {
+		sendTusErr(c, http.StatusBadRequest, "unsupported_format", fmt.Sprintf("Uploaded file %v has unsupported extension", fileName))
+		return
+	}
+
+	checksum := strings.ToLower(meta["md5"])
+
+	if len(checksum) > 0 {
+		if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != md5.Size {
+			sendTusErr(c, http.StatusBadRequest, "invalid_checksum", checksum)
+			return
+		}
+
+		// md5 is the track identity, so duplicates are turned down before
+		// a single byte is sent
+		if t, _ := db.GetTrack(checksum); t != nil {
+			sendTusErr(c, http.StatusConflict, "already_exists", "")
+			return
+		}
+	}
+
+	id, err := genUploadID()
+
+	if err != nil {
+		sendTusErr(c, http.StatusInternalServerError, "upload_create", err.Error())
+		return
+	}
+
+	now := time.Now().Unix()
+	up := &AudyTusUpload{
+		ID:       id,
+		Length:   length,
+		FileName: fileName,
+		Md5:      checksum,
+		UserID:   auth.GetUser(c).ID,
+		Created:  now,
+		Expires:  tusExpireTime(),
+	}
+
+	if err = os.MkdirAll(tusUploadPath, os.ModePerm); err == nil {
+		err = ioutil.WriteFile(tusDataPath(id), []byte{}, os.ModePerm)
+	}
+
+	if err == nil {
+		err = up.save()
+	}
+
+	if err != nil {
+		up.remove()
+		sendTusErr(c, http.StatusInternalServerError, "upload_create", err.Error())
+		return
+	}
+
+	c.Header("Location", "/api/upload/tus/"+id)
+	c.Header("Upload-Expires", time.Unix(up.Expires, 0).UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+func R_tus_head(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+
+	up := tusUploadOf(c)
+
+	if up == nil {
+		return
+	}
+
+	offset, err := up.offset()
+
+	if err != nil {
+		sendTusErr(c, http.StatusNotFound, "upload_not_found", err.Error())
+		return
+	}
+
+	up.sendHeaders(c, offset)
+	c.Header("Upload-Length", strconv.FormatInt(up.Length, 10))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+}
+
+func R_tus_patch(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		sendTusErr(c, http.StatusUnsupportedMediaType, "invalid_content_type", c.ContentType())
+		return
+	}
+
+	id := c.Param("id")
+
+	if !tusLock(id) {
+		sendTusErr(c, http.StatusLocked, "upload_locked", "")
+		return
+	}
+
+	defer tusUnlock(id)
+
+	up := tusUploadOf(c)
+
+	if up == nil {
+		return
+	}
+
+	offset, err := up.offset()
+
+	if err != nil {
+		sendTusErr(c, http.StatusNotFound, "upload_not_found", err.Error())
+		return
+	}
+
+	if c.GetHeader("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		sendTusErr(c, http.StatusConflict, "upload_offset_mismatch", fmt.Sprint("Upload offset is ", offset))
+		return
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+
+	if header := c.GetHeader("Upload-Checksum"); len(header) > 0 {
+		if checksum, expected, err = parseTusChecksum(header); err != nil {
+			sendTusErr(c, http.StatusBadRequest, "unsupported_checksum", err.Error())
+			return
+		}
+	}
+
+	f, err := os.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_APPEND, os.ModePerm)
+
+	if err != nil {
+		sendTusErr(c, http.StatusInternalServerError, "write_file", err.Error())
+		return
+	}
+
+	var w io.Writer = f
+
+	if checksum != nil {
+		w = io.MultiWriter(f, checksum)
+	}
+
+	n, err := io.Copy(w, io.LimitReader(c.Request.Body, up.Length-offset))
+
+	// a chunk with a checksum is kept only as a whole, without one the
+	// received part counts and the client resumes after it
+	if checksum != nil && (err != nil || string(checksum.Sum(nil)) != string(expected)) {
+		f.Truncate(offset)
+		f.Close()
+
+		if err != nil {
+			sendTusErr(c, http.StatusBadRequest, "write_file", err.Error())
+		} else {
+			sendTusErr(c, tusStatusChecksumMismatch, "checksum_mismatch", "")
+		}
+
+		return
+	}
+
+	f.Close()
+
+	up.Expires = tusExpireTime()
+
+	if saveErr := up.save(); saveErr != nil {
+		fmt.Printf("Unable to save upload %v: %v\n", id, saveErr.Error())
+	}
+
+	if err != nil {
+		sendTusErr(c, http.StatusInternalServerError, "write_file", err.Error())
+		return
+	}
+
+	offset += n
+	up.sendHeaders(c, offset)
+
+	if offset < up.Length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if !up.verify() {
+		up.remove()
+		sendTusErr(c, tusStatusChecksumMismatch, "checksum_mismatch", "Uploaded file doesn't match its md5")
+		return
+	}
+
+	tusQueueIngest(c, up)
+}
+
+// tusQueueIngest moves a finished upload out of the tus folder and queues its
+// ingest job. The track, or the tracks of an archive, are reported over SSE
+// like FTP uploads
+func tusQueueIngest(c *gin.Context, up *AudyTusUpload) {
+	// on failure the upload stays in place, so the client can retry with an
+	// empty PATCH at the final offset
+	path, err := moveFinishedUpload(tusDataPath(up.ID), up.ID, up.FileName)
+
+	if err != nil {
+		sendTusErr(c, http.StatusInternalServerError, "move_file", err.Error())
+		return
+	}
+
+	batch := genId()
+	_, dbErr := jobQueue.Enqueue(jobTypeIngest, batch, path, up.UserID, &ingestJobPayload{path, up.FileName, ingestSourceUpload, "", ""})
+
+	if dbErr != nil {
+		dbErr.Print()
+
+		if err = os.Rename(path, tusDataPath(up.ID)); err != nil {
+			fmt.Printf("Unable to restore upload %v: %v\n", up.ID, err.Error())
+			os.Remove(path)
+			up.remove()
+		}
+
+		sendTusErr(c, http.StatusInternalServerError, "db", dbErr.Error())
+		return
+	}
+
+	up.remove()
+
+	hub.SendUser(up.UserID, &gin.H{
+		"type": "ftpu_start",
+		"data": &gin.H{
+			"files": 1,
+			"batch": batch,
+		},
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+func R_tus_delete(c *gin.Context) {
+	if !tusCheck(c) {
+		return
+	}
+
+	id := c.Param("id")
+
+	if !tusLock(id) {
+		sendTusErr(c, http.StatusLocked, "upload_locked", "")
+		return
+	}
+
+	defer tusUnlock(id)
+
+	up := tusUploadOf(c)
+
+	if up == nil {
+		return
+	}
+
+	up.remove()
+	c.Status(http.StatusNoContent)
+}
+
+// tusCleanupLoop removes unfinished uploads past their expiry, along with
+// data files that lost their info
+func tusCleanupLoop(interval time.Duration) {
+	for {
+		files, err := ioutil.ReadDir(tusUploadPath)
+
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Unable to read uploads directory: %v\n", err.Error())
+		}
+
+		expired := time.Now().Add(-time.Duration(config.Upload.ExpireHours) * time.Hour)
+
+		for _, fi := range files {
+			name := fi.Name()
+			id := strings.TrimSuffix(name, ".json")
+
+			if !tusLock(id) {
+				continue
+			}
+
+			if name != id {
+				// loading drops expired uploads
+				loadTusUpload(id)
+			} else if _, err := os.Stat(tusInfoPath(id)); os.IsNotExist(err) && fi.ModTime().Before(expired) {
+				os.Remove(tusDataPath(id))
+			}
+
+			tusUnlock(id)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func tusRequest(r *gin.Engine, method, url string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+
+	return res
+}
+
+func TestTusFinishedUploadQueued(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	openTestDB(t)
+
+	u := &DBUser{ID: 1, IsAdmin: true}
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(UserKey, u) })
+	r.POST("/api/upload/tus", R_tus_create)
+	r.PATCH("/api/upload/tus/:id", R_tus_patch)
+
+	cl := hub.Add(u, nil, nil)
+	defer hub.Remove(cl)
+
+	data := testWav(16)
+	half := len(data) / 2
+	tracks := libSize()
+
+	res := tusRequest(r, http.MethodPost, "/api/upload/tus", map[string]string{
+		"Upload-Length":   fmt.Sprint(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("track.wav")),
+	}, nil)
+
+	if res.Code != http.StatusCreated {
+		t.Fatalf("create answered %v: %v", res.Code, res.Body.String())
+	}
+
+	url := res.Header().Get("Location")
+
+	for _, from := range []int{0, half} {
+		to := half
+
+		if from > 0 {
+			to = len(data)
+		}
+
+		res = tusRequest(r, http.MethodPatch, url, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": fmt.Sprint(from),
+		}, data[from:to])
+
+		if res.Code != http.StatusNoContent {
+			t.Fatalf("patch at %v answered %v: %v", from, res.Code, res.Body.String())
+		}
+	}
+
+	if libSize() != tracks {
+		t.Error("track was ingested by the request")
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(tusUploadPath, "*")); len(left) != 0 {
+		t.Errorf("upload files left: %v", left)
+	}
+
+	jobs, dbErr := db.GetJobs(jobStateQueued, 10)
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if len(jobs) != 1 || jobs[0].Type != jobTypeIngest {
+		t.Fatalf("got %v queued jobs, want one ingest job", len(jobs))
+	}
+
+	payload := &ingestJobPayload{}
+
+	if err := json.Unmarshal([]byte(jobs[0].Payload), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.FileName != "track.wav" || payload.Source != ingestSourceUpload {
+		t.Errorf("payload %+v", payload)
+	}
+
+	if queued, err := ioutil.ReadFile(payload.Path); err != nil || !bytes.Equal(queued, data) {
+		t.Errorf("queued file %v doesn't hold the upload (%v)", payload.Path, err)
+	}
+
+	msg := (*(<-cl.Channel).(*gin.H))
+
+	if msg["type"] != "ftpu_start" || (*msg["data"].(*gin.H))["batch"] != jobs[0].Batch {
+		t.Errorf("user got %v, want ftpu_start of the batch", msg)
+	}
+}
+
+func TestTusUploadKeptWhenMoveFails(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	openTestDB(t)
+
+	u := &DBUser{ID: 1, IsAdmin: true}
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(UserKey, u) })
+	r.POST("/api/upload/tus", R_tus_create)
+	r.PATCH("/api/upload/tus/:id", R_tus_patch)
+
+	data := testWav(16)
+
+	res := tusRequest(r, http.MethodPost, "/api/upload/tus", map[string]string{
+		"Upload-Length":   fmt.Sprint(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("track.wav")),
+	}, nil)
+
+	if res.Code != http.StatusCreated {
+		t.Fatalf("create answered %v: %v", res.Code, res.Body.String())
+	}
+
+	url := res.Header().Get("Location")
+
+	// a file in place of the folder makes the move fail
+	if err := ioutil.WriteFile(finishedUploadPath, nil, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(from int, body []byte) *httptest.ResponseRecorder {
+		return tusRequest(r, http.MethodPatch, url, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": fmt.Sprint(from),
+		}, body)
+	}
+
+	if res = patch(0, data); res.Code != http.StatusInternalServerError {
+		t.Fatalf("patch with a failing move answered %v: %v", res.Code, res.Body.String())
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(tusUploadPath, "*")); len(left) != 2 {
+		t.Fatalf("upload files left: %v, want data and info", left)
+	}
+
+	os.Remove(finishedUploadPath)
+
+	if res = patch(len(data), nil); res.Code != http.StatusNoContent {
+		t.Fatalf("retry answered %v: %v", res.Code, res.Body.String())
+	}
+
+	jobs, dbErr := db.GetJobs(jobStateQueued, 10)
+
+	if dbErr != nil {
+		t.Fatal(dbErr.Error())
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("got %v queued jobs after the retry, want one", len(jobs))
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(tusUploadPath, "*")); len(left) != 0 {
+		t.Errorf("upload files left after the retry: %v", left)
+	}
+}
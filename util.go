@@ -16,7 +16,9 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tcolgate/mp3"
@@ -56,7 +58,7 @@ func genHash() string {
 	rand.Seed(time.Now().UnixNano())
 
 	for i := 0; i < 20; i++ {
-		salt = fmt.Sprint(salt, string(rand.Intn(93)+33))
+		salt = fmt.Sprint(salt, string(rune(rand.Intn(93)+33)))
 	}
 
 	h := sha1.New()
@@ -163,36 +165,59 @@ func loadLib() {
 		log.Fatal(err.Error())
 	}
 
+	libMutex.Lock()
 	lib = library
+	libMutex.Unlock()
 
-	if _, err := os.Stat("db/music"); os.IsNotExist(err) {
-		os.Mkdir("db/music", os.ModePerm)
-		db.ClearLib()
-		lib = make(map[string]*DBTrack, 0)
-		libJSONCache = "[]"
-		fmt.Println("Music folder was not found. All music data wiped")
-		return
+	blobs, listErr := store.List("music/")
+
+	if listErr != nil {
+		log.Fatalf("Unable to list stored tracks: %v\n", listErr.Error())
+	}
+
+	stored := make(map[string]bool, len(blobs))
+
+	for _, b := range blobs {
+		stored[b.Key] = true
+	}
+
+	missing := 0
+
+	// nothing is removed here, a wrong storage root would wipe the library.
+	// Files of library folders are checked by their scans
+	for _, t := range libTracks() {
+		if !t.External && !stored[trackKey(t.Md5)] {
+			missing++
+		}
 	}
 
-	for k, t := range lib {
-		trackPath := fmt.Sprint("db/music/", k, "/track")
+	if missing > 0 {
+		fmt.Printf("%v tracks have no file in the blob store. Run audy check for details\n", missing)
+	}
 
-		if _, err := os.Stat(trackPath); os.IsNotExist(err) {
-			fmt.Printf("Track %v not found at path %v. Removing from db...\n", fmt.Sprint(t.Artist, " - ", t.Title), trackPath)
-			db.RemoveTrack(k)
-			delete(lib, k)
+	for _, t := range libTracks() {
+		if t.ArtistID != 0 {
+			continue
+		}
 
+		if _, dbErr := db.AddTrack(t); dbErr != nil {
+			dbErr.Print()
 			continue
 		}
+
+		applyAlbumCover(t)
 	}
 
-	fmt.Printf("Music data loaded successfully. Found %v tracks\n", len(lib))
+	removeOrphanAlbums()
+
+	fmt.Printf("Music data loaded successfully. Found %v tracks\n", libSize())
 
-	updateLibCache()
+	invalidateLibCache()
 }
 
+const configPath string = "db/config.json"
+
 func loadConfig() {
-	configPath := "db/config.json"
 	_, err := os.Stat(configPath)
 
 	if os.IsNotExist(err) {
@@ -227,10 +252,30 @@ func loadConfig() {
 		fmt.Printf("Error while loading config %v: %v\n", configPath, err.Error())
 		return
 	}
+
+	if err = validateConfig(config); err != nil {
+		log.Fatalf("Invalid config %v: %v\n", configPath, err.Error())
+	}
+}
+
+// validateConfig checks the values that would otherwise only fail once used
+func validateConfig(c *AudyConfig) error {
+	if err := validatePasswordHash(&c.PasswordHash); err != nil {
+		return fmt.Errorf("password_hash: %v", err.Error())
+	}
+
+	if c.RemIPPrefixV4 < 0 || c.RemIPPrefixV4 > 32 {
+		return fmt.Errorf("rem_ip_prefix_v4 must be between 0 and 32, got %v", c.RemIPPrefixV4)
+	}
+
+	if c.RemIPPrefixV6 < 0 || c.RemIPPrefixV6 > 128 {
+		return fmt.Errorf("rem_ip_prefix_v6 must be between 0 and 128, got %v", c.RemIPPrefixV6)
+	}
+
+	return nil
 }
 
 func saveConfig() error {
-	configPath := "db/config.json"
 
 	file, err := os.Create(configPath)
 
@@ -252,8 +297,8 @@ func saveConfig() error {
 func parseTrackFileName(name string) (string, string) {
 	var artist, title string = "?", "?"
 
-	if strings.HasSuffix(name, ".mp3") {
-		name = name[:len(name)-4]
+	if isAudioFileName(name) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
 	}
 
 	parts := strings.SplitN(name, "-", 2)
@@ -268,26 +313,68 @@ func parseTrackFileName(name string) (string, string) {
 	return artist, title
 }
 
-func processTrack(path, fileName string) (*DBTrack, *AudyTrackProcessingErr) {
+// applyTrackTags fills track metadata from the embedded ID3/Vorbis/MP4 tags.
+// Artist and title fall back to the file name when the tags have none.
+func applyTrackTags(t *DBTrack, m tag.Metadata, fileName string) {
+	if m != nil {
+		t.Artist = strings.TrimSpace(m.Artist())
+		t.Title = strings.TrimSpace(m.Title())
+		t.Album = strings.TrimSpace(m.Album())
+		t.AlbumArtist = strings.TrimSpace(m.AlbumArtist())
+		t.Genre = strings.TrimSpace(m.Genre())
+		t.Lyrics = strings.TrimSpace(m.Lyrics())
+		t.Year = m.Year()
+		t.TrackNumber, _ = m.Track()
+		t.DiscNumber, _ = m.Disc()
+	}
+
+	if len(t.Artist) == 0 || len(t.Title) == 0 {
+		artist, title := parseTrackFileName(fileName)
+
+		if len(t.Artist) == 0 {
+			t.Artist = artist
+		}
+
+		if len(t.Title) == 0 {
+			t.Title = title
+		}
+	}
+}
+
+// AudyTrackFile is what is learned from an audio file before it is stored
+type AudyTrackFile struct {
+	format   *AudyFormat
+	tags     tag.Metadata
+	hash     string
+	duration float32
+}
+
+func probeTrackFile(path string) (*AudyTrackFile, *AudyTrackProcessingErr) {
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
 
 	if err != nil {
 		return nil, &AudyTrackProcessingErr{err, nil, fmt.Sprint("open_file")}
 	}
 
-	id3, err := tag.ReadFrom(f)
+	defer f.Close()
 
-	if err == nil {
-		if id3.FileType() != tag.MP3 {
-			f.Close()
-			return nil, &AudyTrackProcessingErr{nil, nil, "not_mp3"}
-		}
+	format, err := detectTrackFormat(f)
+
+	if err != nil {
+		return nil, &AudyTrackProcessingErr{err, nil, "unsupported_format"}
 	}
 
 	_, err = f.Seek(0, 0)
 
 	if err != nil {
-		f.Close()
+		return nil, &AudyTrackProcessingErr{err, nil, "seek_file"}
+	}
+
+	id3, _ := tag.ReadFrom(f)
+
+	_, err = f.Seek(0, 0)
+
+	if err != nil {
 		return nil, &AudyTrackProcessingErr{err, nil, "seek_file"}
 	}
 
@@ -295,63 +382,68 @@ func processTrack(path, fileName string) (*DBTrack, *AudyTrackProcessingErr) {
 
 	hash := md5File(fileReader)
 	if len(hash) == 0 {
-		f.Close()
 		return nil, &AudyTrackProcessingErr{nil, nil, "no_hash"}
 	}
 
-	t, _ := db.GetTrack(hash)
+	duration, err := calcFormatDuration(format, f)
 
-	if t != nil {
-		f.Close()
-		os.Remove(path)
-		return nil, &AudyTrackProcessingErr{nil, nil, "already_exists"}
+	if err != nil {
+		return nil, &AudyTrackProcessingErr{err, nil, "get_duration"}
 	}
 
-	_, err = f.Seek(0, 0)
+	return &AudyTrackFile{format, id3, hash, duration}, nil
+}
 
-	if err != nil {
-		f.Close()
-		return nil, &AudyTrackProcessingErr{err, nil, "seek_file"}
-	}
+// ingestLocks is held per md5 while a track is stored, so copies of one file
+// ingested together can't remove the blobs of each other
+var ingestLocks *AudyKeyedMutex = &AudyKeyedMutex{}
 
-	duration, err := calcTrackDuration(fileReader)
-	f.Close()
+// processTrack moves an uploaded file into the library. coverPath is an
+// image used when the file has no picture of its own, it may be empty.
+// The file is only removed once its track is stored, or when the track is
+// already in the library, so a failed ingest can be retried
+func processTrack(path, fileName, coverPath string) (*DBTrack, *AudyTrackProcessingErr) {
+	file, procErr := probeTrackFile(path)
 
-	if err != nil {
-		return nil, &AudyTrackProcessingErr{err, nil, "get_duration"}
+	if procErr != nil {
+		return nil, procErr
 	}
 
-	newDirPath := fmt.Sprint("db/music/", hash)
+	format, id3, hash, duration := file.format, file.tags, file.hash, file.duration
 
-	if _, err := os.Stat(newDirPath); os.IsNotExist(err) {
-		os.Mkdir(newDirPath, os.ModePerm)
-	}
+	ingestLocks.Lock(hash)
+	defer ingestLocks.Unlock(hash)
 
-	newPath := fmt.Sprint(newDirPath, "/track")
+	t, _ := db.GetTrack(hash)
 
-	if _, err := os.Stat(newPath); os.IsExist(err) {
-		os.Remove(newPath)
+	if t != nil {
+		os.Remove(path)
+		return nil, &AudyTrackProcessingErr{nil, nil, "already_exists"}
 	}
 
-	err = os.Rename(path, fmt.Sprint(newPath))
+	err := copyBlobFile(trackKey(hash), path)
 	if err != nil {
-		os.RemoveAll(newPath)
-		os.Remove(path)
+		removeTrackBlobs(hash)
 		return nil, &AudyTrackProcessingErr{err, nil, "move_file"}
 	}
 
-	artist, title := parseTrackFileName(fileName)
-
 	newTrack := &DBTrack{
-		Artist:    artist,
-		Title:     title,
 		Md5:       hash,
 		Timestamp: int(time.Now().Unix()),
 		HasImage:  false,
 		Duration:  duration,
+		Format:    format.Name,
+		Mime:      format.Mime,
 	}
 
-	newErr := processAlbumPicture(newDirPath, id3)
+	applyTrackTags(newTrack, id3, fileName)
+	analyzeTrack(newTrack, id3, true, true, true)
+
+	newErr := processAlbumPicture(hash, id3)
+
+	if newErr != nil && newErr.key == "image_not_found" && len(coverPath) > 0 {
+		newErr = processCoverFile(hash, coverPath)
+	}
 
 	if newErr != nil {
 		if newErr.underlying != nil {
@@ -364,45 +456,116 @@ func processTrack(path, fileName string) (*DBTrack, *AudyTrackProcessingErr) {
 	_, dbErr := db.AddTrack(newTrack)
 
 	if dbErr != nil {
-		os.RemoveAll(newDirPath)
+		removeTrackBlobs(hash)
 		return nil, &AudyTrackProcessingErr{nil, dbErr, ""}
 	}
 
+	os.Remove(path)
+	applyAlbumCover(newTrack)
+	refreshAlbumGain(newTrack.AlbumID)
+
 	return newTrack, nil
 }
 
-func processAlbumPicture(dirPath string, t tag.Metadata) *AudyTrackProcessingErr {
+func processAlbumPicture(hash string, t tag.Metadata) *AudyTrackProcessingErr {
 	if t != nil && t.Picture() != nil {
-		img, err := imaging.Decode(bytes.NewReader(t.Picture().Data))
+		return saveTrackPicture(hash, bytes.NewReader(t.Picture().Data))
+	}
 
-		if err != nil {
-			return &AudyTrackProcessingErr{err, nil, fmt.Sprint("trying to decode album picture")}
-		}
+	return &AudyTrackProcessingErr{nil, nil, "image_not_found"}
+}
 
-		size := img.Bounds().Size()
+// processCoverFile uses an image file, like the cover.jpg of an album
+// folder, as the track picture
+func processCoverFile(hash, coverPath string) *AudyTrackProcessingErr {
+	f, err := os.Open(coverPath)
 
-		if size.X > 350 || size.Y > 350 {
-			img = imaging.Resize(img, 350, 350, imaging.Lanczos)
-		}
+	if err != nil {
+		return &AudyTrackProcessingErr{err, nil, fmt.Sprint("trying to open album picture")}
+	}
 
-		newPicPath := fmt.Sprint(dirPath, "/image.jpg")
+	defer f.Close()
 
-		if _, err = os.Stat(newPicPath); os.IsExist(err) {
-			os.Remove(newPicPath)
-		}
+	return saveTrackPicture(hash, f)
+}
 
-		err = imaging.Save(img, newPicPath, imaging.JPEGQuality(80))
+func saveTrackPicture(hash string, r io.Reader) *AudyTrackProcessingErr {
+	img, err := imaging.Decode(r)
 
-		if err != nil {
-			return &AudyTrackProcessingErr{err, nil, fmt.Sprint("trying to save resized album picture")}
-		}
-	} else {
-		return &AudyTrackProcessingErr{nil, nil, "image_not_found"}
+	if err != nil {
+		return &AudyTrackProcessingErr{err, nil, fmt.Sprint("trying to decode album picture")}
+	}
+
+	size := img.Bounds().Size()
+
+	if size.X > 350 || size.Y > 350 {
+		img = imaging.Resize(img, 350, 350, imaging.Lanczos)
+	}
+
+	buf := &bytes.Buffer{}
+	err = imaging.Encode(buf, img, imaging.JPEG, imaging.JPEGQuality(80))
+
+	if err == nil {
+		err = putBlobBytes(trackImageKey(hash), buf.Bytes())
+	}
+
+	if err != nil {
+		return &AudyTrackProcessingErr{err, nil, fmt.Sprint("trying to save resized album picture")}
 	}
 
 	return nil
 }
 
+// applyAlbumCover makes the track picture the cover of its album if the
+// album has none yet
+func applyAlbumCover(t *DBTrack) {
+	if t.AlbumID == 0 || !t.HasImage {
+		return
+	}
+
+	album, dbErr := db.GetAlbum(t.AlbumID)
+
+	if dbErr != nil {
+		dbErr.Print()
+		return
+	}
+
+	if album.HasImage {
+		return
+	}
+
+	src, err := store.Open(trackImageKey(t.Md5))
+
+	if err != nil {
+		fmt.Printf("Unable to open picture of track %v: %v\n", t.Md5, err.Error())
+		return
+	}
+
+	err = store.Put(albumCoverKey(album.ID), src)
+	src.Close()
+
+	if err != nil {
+		fmt.Printf("Unable to save cover of album %v: %v\n", album.ID, err.Error())
+		return
+	}
+
+	if _, dbErr = db.SetAlbumImage(album.ID, true); dbErr != nil {
+		dbErr.Print()
+	}
+}
+
+func removeOrphanAlbums() {
+	ids, dbErr := db.RemoveOrphanAlbums()
+
+	if dbErr != nil {
+		dbErr.Print()
+	}
+
+	for _, id := range ids {
+		store.Delete(albumCoverKey(id))
+	}
+}
+
 func processVkTrack(f *os.File, path string, track *VkTrack) (*DBTrack, *AudyTrackProcessingErr) {
 	id3, err := tag.ReadFrom(f)
 
@@ -435,22 +598,11 @@ func processVkTrack(f *os.File, path string, track *VkTrack) (*DBTrack, *AudyTra
 		return nil, &AudyTrackProcessingErr{nil, nil, "already_exists"}
 	}
 
-	newDirPath := fmt.Sprint("db/music/", hash)
 	f.Close()
 
-	if _, err := os.Stat(newDirPath); os.IsNotExist(err) {
-		os.Mkdir(newDirPath, os.ModePerm)
-	}
-
-	newPath := fmt.Sprint(newDirPath, "/track")
-
-	if _, err := os.Stat(newPath); os.IsExist(err) {
-		os.Remove(newPath)
-	}
-
-	err = os.Rename(path, fmt.Sprint(newPath))
+	err = putBlobFile(trackKey(hash), path)
 	if err != nil {
-		os.RemoveAll(newDirPath)
+		removeTrackBlobs(hash)
 		os.Remove(path)
 		return nil, &AudyTrackProcessingErr{err, nil, "trying to move file"}
 	}
@@ -462,9 +614,13 @@ func processVkTrack(f *os.File, path string, track *VkTrack) (*DBTrack, *AudyTra
 		Timestamp: int(time.Now().Unix()),
 		HasImage:  false,
 		Duration:  float32(track.Duration),
+		Format:    "mp3",
+		Mime:      getFormat("mp3").Mime,
 	}
 
-	newErr := processAlbumPicture(newDirPath, id3)
+	analyzeTrack(newTrack, id3, true, true, true)
+
+	newErr := processAlbumPicture(hash, id3)
 
 	if newErr != nil {
 		if newErr.underlying != nil {
@@ -477,10 +633,13 @@ func processVkTrack(f *os.File, path string, track *VkTrack) (*DBTrack, *AudyTra
 	_, dbErr := db.AddTrack(newTrack)
 
 	if dbErr != nil {
-		os.RemoveAll(newDirPath)
+		removeTrackBlobs(hash)
 		return nil, &AudyTrackProcessingErr{nil, dbErr, ""}
 	}
 
+	applyAlbumCover(newTrack)
+	refreshAlbumGain(newTrack.AlbumID)
+
 	return newTrack, nil
 }
 
@@ -490,50 +649,12 @@ func genPassword() string {
 	rand.Seed(time.Now().UnixNano())
 
 	for i := 0; i < 9; i++ {
-		salt = fmt.Sprint(salt, string(rand.Intn(26)+97))
+		salt = fmt.Sprint(salt, string(rune(rand.Intn(26)+97)))
 	}
 
 	return salt
 }
 
-func removeUnusedMusic() {
-	musicLibPath := "db/music"
-
-	if fi, err := os.Stat(musicLibPath); os.IsNotExist(err) || !fi.IsDir() {
-		return
-	}
-
-	libMap := make(map[string]int, 0)
-	files, err := ioutil.ReadDir(musicLibPath)
-
-	if err != nil {
-		fmt.Printf("Error while checking unused music: %v\n", err.Error())
-		return
-	}
-
-	for _, f := range files {
-		if !f.IsDir() {
-			continue
-		}
-
-		libMap[f.Name()] = 0
-	}
-
-	for _, s := range lib {
-		if _, ok := libMap[s.Md5]; ok {
-			delete(libMap, s.Md5)
-		}
-	}
-
-	if len(libMap) > 0 {
-		fmt.Printf("Found %v unused music. Removing...\n", len(libMap))
-
-		for k := range libMap {
-			os.RemoveAll(fmt.Sprint(musicLibPath, "/", k))
-		}
-	}
-}
-
 func calcTrackDuration(r io.Reader) (float32, error) {
 	d := mp3.NewDecoder(r)
 
@@ -567,19 +688,98 @@ func genId() string {
 	return id
 }
 
-func (cl *AudyChanListener) SendMessage(msg *gin.H) {
-	cl.Channel <- msg
+func libTrack(hash string) (*DBTrack, bool) {
+	libMutex.RLock()
+	defer libMutex.RUnlock()
+
+	t, ok := lib[hash]
+	return t, ok
+}
+
+func setLibTrack(t *DBTrack) {
+	libMutex.Lock()
+	lib[t.Md5] = t
+	libMutex.Unlock()
+}
+
+// updateLibTrack applies update to a copy of a library track and swaps the
+// copy in. Tracks handed out by the library are shared and never changed in
+// place
+func updateLibTrack(hash string, update func(t *DBTrack)) bool {
+	libMutex.Lock()
+	defer libMutex.Unlock()
+
+	t, ok := lib[hash]
+
+	if !ok {
+		return false
+	}
+
+	nt := *t
+	update(&nt)
+	lib[hash] = &nt
+
+	return true
+}
+
+func removeLibTrack(hash string) {
+	libMutex.Lock()
+	delete(lib, hash)
+	libMutex.Unlock()
+}
+
+// libTracks returns the tracks of the library at the time of the call,
+// ranging over them doesn't hold up changes to the library
+func libTracks() []*DBTrack {
+	libMutex.RLock()
+	defer libMutex.RUnlock()
+
+	tracks := make([]*DBTrack, 0, len(lib))
+
+	for _, t := range lib {
+		tracks = append(tracks, t)
+	}
+
+	return tracks
+}
+
+func libSize() int {
+	libMutex.RLock()
+	defer libMutex.RUnlock()
+
+	return len(lib)
 }
 
-func SendMessageAll(msg *gin.H) {
-	for _, v := range channels {
-		v.Channel <- msg
+// invalidateLibCache drops the marshalled library, it gets rebuilt on the
+// next full library request only
+func invalidateLibCache() {
+	libCacheMutex.Lock()
+	libJSONCache = ""
+	libCacheMutex.Unlock()
+}
+
+func getLibJSON() string {
+	libCacheMutex.Lock()
+	defer libCacheMutex.Unlock()
+
+	if len(libJSONCache) == 0 {
+		libMutex.RLock()
+		json, _ := json.Marshal(&lib)
+		libMutex.RUnlock()
+		libJSONCache = string(json)
 	}
+
+	return libJSONCache
 }
 
-func updateLibCache() {
-	json, _ := json.Marshal(&lib)
-	libJSONCache = string(json)
+func libRevision() int {
+	rev, dbErr := db.GetLibRevision()
+
+	if dbErr != nil {
+		dbErr.Print()
+	}
+
+	return rev
 }
 
 func nv(str string, ranges ...int) *Validator {
@@ -674,3 +874,71 @@ func validateThemeKeys(theme AudyTheme) bool {
 
 	return true
 }
+
+// AudyKeyedMutex hands out one mutex per key. A key is forgotten once
+// nobody holds or waits for its mutex, so the map never outgrows the keys
+// in use
+type AudyKeyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (m *AudyKeyedMutex) acquire(key string) *keyedLock {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock, 0)
+	}
+
+	l, ok := m.locks[key]
+
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+
+	l.refs++
+	return l
+}
+
+func (m *AudyKeyedMutex) release(key string, l *keyedLock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	l.refs--
+
+	if l.refs == 0 {
+		delete(m.locks, key)
+	}
+}
+
+func (m *AudyKeyedMutex) Lock(key string) {
+	m.acquire(key).Lock()
+}
+
+// TryLock locks the key only if nobody holds it
+func (m *AudyKeyedMutex) TryLock(key string) bool {
+	l := m.acquire(key)
+
+	if l.TryLock() {
+		return true
+	}
+
+	m.release(key, l)
+	return false
+}
+
+func (m *AudyKeyedMutex) Unlock(key string) {
+	m.mutex.Lock()
+	l := m.locks[key]
+	m.mutex.Unlock()
+
+	l.Unlock()
+	m.release(key, l)
+}
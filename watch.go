@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AudyWatchConfig lists drop directories whose audio files are ingested
+// automatically. Files that can't be ingested are moved to a rejected
+// subdirectory with a .error.txt file holding the error key
+type AudyWatchConfig struct {
+	Dirs []string `json:"dirs"`
+	// a file is ingested once its size and modification time haven't
+	// changed for this long, so files still being uploaded are left alone
+	StableSeconds int `json:"stable_seconds"`
+}
+
+const watchRejectedDir string = "rejected"
+
+// directories are rescanned this often even without notifications, in case
+// some were lost. Without notification support it's the polling interval
+const watchRescanInterval time.Duration = 30 * time.Second
+const watchPollInterval time.Duration = 5 * time.Second
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+type AudyWatcher struct {
+	dir     string
+	pending map[string]*watchedFile
+}
+
+func startWatchers() {
+	for _, dir := range config.Watch.Dirs {
+		w := &AudyWatcher{
+			dir:     filepath.Clean(dir),
+			pending: make(map[string]*watchedFile, 0),
+		}
+
+		go w.run()
+	}
+}
+
+func (w *AudyWatcher) run() {
+	if err := os.MkdirAll(w.dir, os.ModePerm); err != nil {
+		fmt.Printf("Unable to create watched directory %v: %v\n", w.dir, err.Error())
+		return
+	}
+
+	events := make(chan bool, 1)
+	rescan := watchRescanInterval
+
+	if err := watchDir(w.dir, events); err != nil {
+		fmt.Printf("Watching %v by polling: %v\n", w.dir, err.Error())
+		rescan = watchPollInterval
+	} else {
+		fmt.Printf("Watching %v for new tracks\n", w.dir)
+	}
+
+	for {
+		w.scan()
+
+		interval := rescan
+
+		// files being uploaded are checked every second until they settle
+		if len(w.pending) > 0 {
+			interval = time.Second
+		}
+
+		select {
+		case <-events:
+			// let a burst of events settle into a single scan
+			time.Sleep(time.Second)
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (w *AudyWatcher) scan() {
+	files, err := ioutil.ReadDir(w.dir)
+
+	if err != nil {
+		fmt.Printf("Unable to read watched directory %v: %v\n", w.dir, err.Error())
+		return
+	}
+
+	now := time.Now()
+	stableFor := time.Duration(config.Watch.StableSeconds) * time.Second
+	seen := make(map[string]bool, 0)
+	stable := make([]string, 0)
+
+	for _, fi := range files {
+		name := fi.Name()
+
+		if fi.IsDir() || strings.HasPrefix(name, ".") || !(isAudioFileName(name) || isArchiveFileName(name)) {
+			continue
+		}
+
+		seen[name] = true
+		p, ok := w.pending[name]
+
+		if !ok || p.size != fi.Size() || !p.modTime.Equal(fi.ModTime()) {
+			w.pending[name] = &watchedFile{fi.Size(), fi.ModTime(), now}
+			continue
+		}
+
+		if now.Sub(p.since) >= stableFor {
+			stable = append(stable, name)
+		}
+	}
+
+	for name := range w.pending {
+		if !seen[name] {
+			delete(w.pending, name)
+		}
+	}
+
+	if len(stable) == 0 {
+		return
+	}
+
+	batch := genId()
+
+	for _, name := range stable {
+		delete(w.pending, name)
+		path := filepath.Join(w.dir, name)
+
+		// a file stays in place while its job waits in the queue
+		active, dbErr := db.HasActiveJob(jobTypeIngest, path)
+
+		if dbErr != nil {
+			dbErr.Print()
+			continue
+		}
+
+		if active {
+			continue
+		}
+
+		_, dbErr = jobQueue.Enqueue(jobTypeIngest, batch, path, 0, &ingestJobPayload{path, name, ingestSourceWatch, "", ""})
+
+		if dbErr != nil {
+			dbErr.Print()
+		}
+	}
+}
+
+// rejectWatchedFile moves a file that failed to ingest to the rejected
+// directory of the watched directory dir as name, and writes the error key
+// next to it. processTrack only removes a file once its track is stored,
+// which duplicates are already, so only the error is left for them
+func rejectWatchedFile(path, dir, name, key string) {
+	rejectedDir := filepath.Join(dir, watchRejectedDir)
+
+	if err := os.MkdirAll(rejectedDir, os.ModePerm); err != nil {
+		fmt.Printf("Unable to create directory for rejected files %v: %v\n", rejectedDir, err.Error())
+		return
+	}
+
+	target := filepath.Join(rejectedDir, name)
+
+	if _, err := os.Stat(path); err == nil {
+		// tracks of archives are extracted elsewhere, maybe on another
+		// file system
+		if err = os.Rename(path, target); err != nil {
+			if err = copyFile(path, target); err == nil {
+				os.Remove(path)
+			}
+		}
+
+		if err != nil {
+			fmt.Printf("Unable to move rejected file %v: %v\n", path, err.Error())
+		}
+	}
+
+	if err := ioutil.WriteFile(target+".error.txt", []byte(key+"\n"), os.ModePerm); err != nil {
+		fmt.Printf("Unable to write error of rejected file %v: %v\n", path, err.Error())
+	}
+}
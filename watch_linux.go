@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchDir signals on events whenever a file in dir is created, written or
+// moved in. Bursts of events are collapsed into one signal
+func watchDir(dir string, events chan<- bool) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = unix.InotifyAddWatch(fd, dir, unix.IN_CREATE|unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, 64*1024)
+
+		for {
+			n, err := unix.Read(fd, buf)
+
+			if err == unix.EINTR {
+				continue
+			}
+
+			if err != nil {
+				fmt.Printf("Stopped watching %v: %v\n", dir, err.Error())
+				unix.Close(fd)
+				return
+			}
+
+			if n > 0 {
+				select {
+				case events <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchDir(dir string, events chan<- bool) error {
+	return errors.New("file system notifications are only supported on linux")
+}
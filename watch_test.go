@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failIngest makes every track insert fail until the test ends
+func failIngest(t *testing.T) {
+	if _, err := db.conn.Exec(`CREATE TRIGGER fail_add_track BEFORE INSERT ON music
+		BEGIN SELECT RAISE(ABORT, 'add track failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// finishIngestJob runs an ingest job and finishes it the way the queue does
+// once it's out of attempts
+func finishIngestJob(job *DBJob) *AudyJobError {
+	jobErr := runIngestJob(context.Background(), job)
+	job.State = jobStateDone
+
+	if jobErr != nil {
+		job.State = jobStateFailed
+		job.Error = jobErr.key
+	}
+
+	ingestJobFinished(job)
+	return jobErr
+}
+
+func checkRejected(t *testing.T, dir, name, data string) {
+	rejected := filepath.Join(dir, watchRejectedDir, name)
+
+	if got, err := ioutil.ReadFile(rejected); err != nil || string(got) != data {
+		t.Errorf("%v wasn't rejected with its contents: %v", name, err)
+	}
+
+	if key, err := ioutil.ReadFile(rejected + ".error.txt"); err != nil || len(key) == 0 {
+		t.Errorf("error of %v wasn't written: %v", name, err)
+	}
+}
+
+func TestWatchedFileRejectedOnDBFailure(t *testing.T) {
+	setupIngest(t)
+	failIngest(t)
+
+	dir := "watched"
+	path := filepath.Join(dir, "track.wav")
+	writeTestWav(t, path, 3)
+	data, _ := ioutil.ReadFile(path)
+
+	payload, _ := json.Marshal(&ingestJobPayload{Path: path, FileName: "track.wav", Source: ingestSourceWatch})
+
+	if finishIngestJob(&DBJob{Type: jobTypeIngest, Payload: string(payload)}) == nil {
+		t.Fatal("ingest succeeded")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("failed file left in the watched directory")
+	}
+
+	checkRejected(t, dir, "track.wav", string(data))
+}
+
+func TestWatchedArchiveTrackRejectedOnDBFailure(t *testing.T) {
+	setupIngest(t)
+
+	dir := "watched"
+	archive := filepath.Join(dir, "album.zip")
+	writeTestWav(t, filepath.Join(dir, "track.wav"), 4)
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "track.wav"))
+	os.Remove(filepath.Join(dir, "track.wav"))
+
+	f, err := os.Create(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("album/track.wav")
+	w.Write(data)
+	zw.Close()
+	f.Close()
+
+	payload, _ := json.Marshal(&ingestJobPayload{Path: archive, FileName: "album.zip", Source: ingestSourceWatch})
+	job := &DBJob{Type: jobTypeIngest, Batch: "batch", Payload: string(payload)}
+
+	if jobErr := finishIngestJob(job); jobErr != nil {
+		t.Fatal(jobErr)
+	}
+
+	jobs, dbErr := db.GetJobs(jobStateQueued, 10)
+
+	if dbErr != nil || len(jobs) != 1 {
+		t.Fatalf("archive queued %v tracks (%v)", len(jobs), dbErr)
+	}
+
+	failIngest(t)
+
+	if finishIngestJob(jobs[0]) == nil {
+		t.Fatal("ingest of the extracted track succeeded")
+	}
+
+	checkRejected(t, dir, "album.zip-track.wav", string(data))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Waveforms are stored in the binary format of audiowaveform, version 1 with
+// 8 bit values, which peaks.js and wavesurfer read as is:
+//
+//	int32 version, uint32 flags, int32 sample rate, int32 samples per pixel,
+//	uint32 length, then length pairs of int8 min and max
+const waveformLength int = 1000
+const waveformVersion int32 = 1
+const waveformFlag8Bit uint32 = 1
+
+type waveformHeader struct {
+	Version         int32
+	Flags           uint32
+	SampleRate      int32
+	SamplesPerPixel int32
+	Length          uint32
+}
+
+func waveformKey(hash string) string {
+	return fmt.Sprint("music/", hash, "/waveform.dat")
+}
+
+func hasWaveform(hash string) bool {
+	return blobExists(waveformKey(hash))
+}
+
+// waveformBuilder collects min and max of every 10 ms window, which are
+// merged into waveformLength pairs once the whole track is read
+type waveformBuilder struct {
+	rate     int
+	window   int
+	count    int
+	frames   int64
+	min, max float64
+	mins     []float64
+	maxs     []float64
+}
+
+func (w *waveformBuilder) start(rate, channels int) {
+	w.rate = rate
+	w.window = rate / 100
+}
+
+func (w *waveformBuilder) addFrame(frame []float64) {
+	for _, x := range frame {
+		w.min = math.Min(w.min, x)
+		w.max = math.Max(w.max, x)
+	}
+
+	w.count++
+	w.frames++
+
+	if w.count >= w.window {
+		w.flush()
+	}
+}
+
+func (w *waveformBuilder) flush() {
+	if w.count == 0 {
+		return
+	}
+
+	w.mins = append(w.mins, w.min)
+	w.maxs = append(w.maxs, w.max)
+	w.min, w.max, w.count = 0, 0, 0
+}
+
+func waveformValue(v float64) int8 {
+	return int8(math.Max(-128, math.Min(127, math.Round(v*127))))
+}
+
+func (w *waveformBuilder) save(key string) error {
+	w.flush()
+
+	windows := len(w.mins)
+
+	if windows == 0 {
+		return errors.New("track has no audio")
+	}
+
+	length := waveformLength
+
+	if windows < length {
+		length = windows
+	}
+
+	samplesPerPixel := w.frames / int64(length)
+
+	if samplesPerPixel < 1 {
+		samplesPerPixel = 1
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &waveformHeader{
+		waveformVersion, waveformFlag8Bit, int32(w.rate), int32(samplesPerPixel), uint32(length),
+	})
+
+	for i := 0; i < length; i++ {
+		from, to := i*windows/length, (i+1)*windows/length
+		min, max := w.mins[from], w.maxs[from]
+
+		for j := from + 1; j < to; j++ {
+			min = math.Min(min, w.mins[j])
+			max = math.Max(max, w.maxs[j])
+		}
+
+		buf.WriteByte(byte(waveformValue(min)))
+		buf.WriteByte(byte(waveformValue(max)))
+	}
+
+	return putBlobBytes(key, buf.Bytes())
+}